@@ -1,50 +1,174 @@
 package main
 
 import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/config"
 	"auth-service/internal/handler"
+	"auth-service/internal/kvstore"
+	"auth-service/internal/logging"
+	"auth-service/internal/middleware"
+	"auth-service/internal/ratelimit"
 	"auth-service/internal/routes"
 	"auth-service/internal/services"
+	"auth-service/internal/validation"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"os"
 
 	"github.com/gofiber/fiber/v2"
 	_ "github.com/joho/godotenv/autoload"
 )
 
-var (
-	keycloak_base_url      = "http://localhost:8080"
-	keycloak_realm         = os.Getenv("KEYCLOAK_REALM")
-	keycloak_client_id     = "camp-be-client"
-	keycloak_client_secret = os.Getenv("KEYCLOAK_CLIENT_SECRET")
-	port                   = "5000"
-)
-
 func main() {
+	configPath := flag.String("config", os.Getenv("CONFIG_FILE"), "path to the YAML config file")
+	flag.Parse()
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		log.Fatalf("❌ Loading configuration failed: %v", err)
+	}
+
+	slog.SetDefault(logging.New(os.Stdout, logging.Options{
+		Level:  cfg.Log.Level,
+		Format: cfg.Log.Format,
+	}))
 
 	fmt.Printf("🚀 Starting Auth Service\n")
-	fmt.Printf("   Port: %s\n", port)
-	fmt.Printf("   Keycloak URL: %s\n", keycloak_base_url)
-	fmt.Printf("   Keycloak Realm: %s\n", keycloak_realm)
-	fmt.Printf("   Client ID: %s\n", keycloak_client_id)
-	fmt.Println()
+	for _, line := range cfg.Summary() {
+		fmt.Printf("   %s\n", line)
+	}
+
+	if cfg.Server.ProxyHeader != "" && len(cfg.Server.TrustedProxies) == 0 {
+		slog.Warn("server.proxy_header is ignored without server.trusted_proxies", slog.String("proxy_header", cfg.Server.ProxyHeader))
+	}
 
 	// Create Fiber app
-	app := fiber.New()
+	fiberConfig := cfg.Server.FiberConfig()
+	fiberConfig.ErrorHandler = apperr.ErrorHandler
+	app := fiber.New(fiberConfig)
 
 	// Create Keycloak service
-	keycloakService := services.NewKeycloakService(
-		keycloak_client_id,
-		keycloak_client_secret,
-		keycloak_realm,
-		keycloak_base_url)
+	keycloakService, err := services.NewKeycloakService(
+		cfg.Keycloak.ClientID,
+		cfg.Keycloak.ClientSecret,
+		cfg.Keycloak.Realm,
+		cfg.Keycloak.BaseURL,
+		services.AdminAuthConfig{
+			Strategy: services.AdminAuthStrategy(cfg.Keycloak.Admin.Auth),
+			Username: cfg.Keycloak.Admin.Username,
+			Password: cfg.Keycloak.Admin.Password,
+			Realm:    cfg.Keycloak.Admin.Realm,
+		})
+	if err != nil {
+		log.Fatalf("❌ Keycloak service setup failed: %v", err)
+	}
+	keycloakService.VerifyEmailRedirectURI = cfg.Redirect.VerifyEmail
+	keycloakService.PasswordResetRedirectURI = cfg.Redirect.PasswordReset
+	keycloakService.PasswordResetTTL = cfg.PasswordReset.TokenTTL
+	fmt.Printf("   Admin auth: %s\n", keycloakService.AdminAuth)
+	fmt.Println()
+
+	// Create rate limiter
+	var limitStore ratelimit.Store = kvstore.NewMemoryStore()
+	if cfg.RateLimit.Store == "redis" {
+		limitStore = kvstore.NewRedisStore(cfg.RateLimit.RedisAddr, cfg.RateLimit.RedisPassword)
+	}
+	limiter := ratelimit.NewLimiter(limitStore,
+		ratelimit.Rule{Limit: cfg.RateLimit.IPLimit, Window: cfg.RateLimit.Window},
+		ratelimit.Rule{Limit: cfg.RateLimit.UsernameLimit, Window: cfg.RateLimit.Window},
+		ratelimit.LockoutPolicy{
+			Threshold: cfg.RateLimit.LockoutThreshold,
+			Base:      cfg.RateLimit.LockoutBase,
+			Max:       cfg.RateLimit.LockoutMax,
+		})
+
+	// Create idempotency store (responses replayed to retried requests)
+	var idempotencyStore middleware.IdempotencyStore = kvstore.NewMemoryStore()
+	if cfg.Idempotency.Store == "redis" {
+		idempotencyStore = kvstore.NewRedisStore(cfg.Idempotency.RedisAddr, cfg.Idempotency.RedisPassword)
+	}
+
+	// Create session manager (only used in session mode)
+	var sessions *services.SessionManager
+	if cfg.Session.Mode == "session" {
+		var sessionStore services.SessionStore
+		switch cfg.Session.Store {
+		case "file":
+			sessionStore, err = services.NewFileSessionStore(cfg.Session.FileDir)
+			if err != nil {
+				log.Fatalf("❌ Session store setup failed: %v", err)
+			}
+		case "redis":
+			sessionStore = kvstore.NewRedisStore(cfg.Session.RedisAddr, cfg.Session.RedisPassword)
+		default:
+			sessionStore = kvstore.NewMemoryStore()
+		}
+		sessions = services.NewSessionManager(sessionStore, keycloakService, cfg.Session.IdleTimeout, cfg.Session.AbsoluteTimeout)
+	}
+
+	// Create MFA service (TOTP factors and two-step login)
+	var mfaStore services.MFAStore
+	if cfg.MFA.Store == "memory" {
+		mfaStore = services.NewMemoryMFAStore()
+	} else {
+		mfaStore, err = services.NewFileMFAStore(cfg.MFA.FileDir)
+		if err != nil {
+			log.Fatalf("❌ MFA store setup failed: %v", err)
+		}
+	}
+	mfaService := services.NewMFAService(mfaStore, cfg.MFA.Issuer, cfg.MFA.ChallengeTTL, []byte(cfg.MFA.RecoveryCodeKey))
+	if cfg.Notify.WebhookURL != "" {
+		mfaService.Notifier = services.NewWebhookNotifier(cfg.Notify.WebhookURL)
+	}
+
+	// Create password policy (checked before passwords are sent to Keycloak)
+	passwordPolicy, err := validation.NewPasswordPolicy(cfg.PasswordPolicy)
+	if err != nil {
+		log.Fatalf("❌ Password policy setup failed: %v", err)
+	}
+	if passwordPolicy.Breached != nil {
+		fmt.Printf("   Breached password list: %d entries\n", passwordPolicy.Breached.Len())
+	}
 
 	// Create auth handler
-	authHandler := handler.NewAuthHandler(keycloakService)
+	authHandler := handler.NewAuthHandler(keycloakService, cfg.Cookie, limiter, sessions, mfaService, cfg.EmailVerification, passwordPolicy)
+
+	// Create WebAuthn service (passkey registration and passwordless login)
+	var webauthnCredentials services.WebAuthnCredentialRepository
+	if cfg.WebAuthn.Store == "memory" {
+		webauthnCredentials = services.NewMemoryWebAuthnRepository()
+	} else {
+		webauthnCredentials, err = services.NewFileWebAuthnRepository(cfg.WebAuthn.FileDir)
+		if err != nil {
+			log.Fatalf("❌ WebAuthn store setup failed: %v", err)
+		}
+	}
+	webauthnService, err := services.NewWebAuthnService(cfg.WebAuthn.RPID, cfg.WebAuthn.RPName, cfg.WebAuthn.RPOrigins, webauthnCredentials, keycloakService, cfg.WebAuthn.CeremonyTTL)
+	if err != nil {
+		log.Fatalf("❌ WebAuthn setup failed: %v", err)
+	}
+
+	// Create OIDC (authorization code + PKCE) login handler
+	oidcClient := services.NewOIDCClient(
+		cfg.Keycloak.BaseURL,
+		cfg.Keycloak.Realm,
+		cfg.Keycloak.ClientID,
+		cfg.Keycloak.ClientSecret,
+		cfg.OIDC.CallbackURL)
+	oidcClient.Scopes = cfg.OIDC.Scopes
+	oidcClient.StateTTL = cfg.OIDC.StateTTL
+	oidcClient.Verifier = keycloakService.Verifier
+	oidcHandler, err := handler.NewOIDCHandler(oidcClient, authHandler, cfg.OIDC.PostLoginRedirect)
+	if err != nil {
+		log.Fatalf("❌ OIDC handler setup failed: %v", err)
+	}
 
 	// Setup routes
-	routes.AuthRoutes(app, authHandler, keycloakService)
+	routes.AuthRoutes(app, cfg, authHandler, oidcHandler, handler.NewMFAHandler(mfaService), handler.NewWebAuthnHandler(webauthnService, authHandler), keycloakService, sessions, limiter, idempotencyStore)
 
+	port := cfg.Server.Port
 	fmt.Printf("🌐 Server starting on port %s\n", port)
 	fmt.Printf("📋 Available endpoints:\n")
 	fmt.Printf("   GET  http://localhost:%s/health\n", port)
@@ -52,16 +176,13 @@ func main() {
 	fmt.Printf("   POST http://localhost:%s/api/v1/login\n", port)
 	fmt.Printf("   POST http://localhost:%s/api/v1/register\n", port)
 	fmt.Printf("   POST http://localhost:%s/api/v1/logout\n", port)
+	fmt.Printf("   POST http://localhost:%s/api/v1/password/forgot\n", port)
+	fmt.Printf("   POST http://localhost:%s/api/v1/password/reset\n", port)
+	fmt.Printf("   GET  http://localhost:%s/api/v1/password/policy\n", port)
 	fmt.Printf("   GET  http://localhost:%s/api/v1/me\n", port)
+	fmt.Printf("   GET  http://localhost:%s/api/v1/oidc/login\n", port)
 	fmt.Println()
 
 	// Start server
 	log.Fatal(app.Listen(":" + port))
 }
-
-func getEnvOrDefault(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
@@ -0,0 +1,202 @@
+// Package apperr defines the typed errors the service returns to clients.
+// Every error carries a Kind, which decides the HTTP status, and a stable
+// Code that clients can switch on. The wrapped cause is only logged.
+package apperr
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type Kind int
+
+const (
+	KindInternal Kind = iota
+	KindValidation
+	KindUnauthorized
+	KindForbidden
+	KindNotFound
+	KindMethodNotAllowed
+	KindConflict
+	KindUnprocessable
+	KindRateLimited
+	KindUpstreamUnavailable
+)
+
+// Status returns the HTTP status code for the kind.
+func (k Kind) Status() int {
+	switch k {
+	case KindValidation:
+		return http.StatusBadRequest
+	case KindUnauthorized:
+		return http.StatusUnauthorized
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case KindConflict:
+		return http.StatusConflict
+	case KindUnprocessable:
+		return http.StatusUnprocessableEntity
+	case KindRateLimited:
+		return http.StatusTooManyRequests
+	case KindUpstreamUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Title returns the short, kind-wide summary used as problem title.
+func (k Kind) Title() string {
+	switch k {
+	case KindValidation:
+		return "Validation failed"
+	case KindUnauthorized:
+		return "Unauthorized"
+	case KindForbidden:
+		return "Forbidden"
+	case KindNotFound:
+		return "Not found"
+	case KindMethodNotAllowed:
+		return "Method not allowed"
+	case KindConflict:
+		return "Conflict"
+	case KindUnprocessable:
+		return "Unprocessable content"
+	case KindRateLimited:
+		return "Too many requests"
+	case KindUpstreamUnavailable:
+		return "Upstream unavailable"
+	default:
+		return "Internal server error"
+	}
+}
+
+// Error is an error that is safe to render to clients.
+type Error struct {
+	Kind   Kind
+	Code   string
+	Detail string
+	// RetryAfter is sent as Retry-After header for rate limited errors.
+	RetryAfter time.Duration
+	// Allow is sent as Allow header for method not allowed errors.
+	Allow []string
+	// Extensions are additional members of the problem document.
+	Extensions map[string]interface{}
+
+	cause error
+}
+
+func (e *Error) Error() string {
+	if e.cause != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Detail, e.cause)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Detail)
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// Is matches any *Error with the same code, so sentinel errors keep
+// working after WithCause/With made a copy.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// WithCause returns a copy of the error wrapping cause.
+func (e *Error) WithCause(cause error) *Error {
+	c := e.clone()
+	c.cause = cause
+	return c
+}
+
+// With returns a copy of the error with an extra problem member.
+func (e *Error) With(key string, value interface{}) *Error {
+	c := e.clone()
+	c.Extensions[key] = value
+	return c
+}
+
+func (e *Error) clone() *Error {
+	c := *e
+	c.Extensions = make(map[string]interface{}, len(e.Extensions)+1)
+	for k, v := range e.Extensions {
+		c.Extensions[k] = v
+	}
+	return &c
+}
+
+func New(kind Kind, code, detail string) *Error {
+	return &Error{Kind: kind, Code: code, Detail: detail}
+}
+
+func Validation(code, detail string) *Error {
+	return New(KindValidation, code, detail)
+}
+
+func Unauthorized(code, detail string) *Error {
+	return New(KindUnauthorized, code, detail)
+}
+
+func Forbidden(code, detail string) *Error {
+	return New(KindForbidden, code, detail)
+}
+
+func NotFound(code, detail string) *Error {
+	return New(KindNotFound, code, detail)
+}
+
+// MethodNotAllowed is for requests to a route that only exists with the
+// allowed methods.
+func MethodNotAllowed(allow []string) *Error {
+	e := New(KindMethodNotAllowed, "method_not_allowed", "method not allowed")
+	e.Allow = allow
+	return e
+}
+
+func Conflict(code, detail string) *Error {
+	return New(KindConflict, code, detail)
+}
+
+// Unprocessable is for requests that are well-formed but cannot be processed
+// as sent, e.g. because they contradict an earlier request.
+func Unprocessable(code, detail string) *Error {
+	return New(KindUnprocessable, code, detail)
+}
+
+func RateLimited(code, detail string, retryAfter time.Duration) *Error {
+	e := New(KindRateLimited, code, detail)
+	e.RetryAfter = retryAfter
+	return e
+}
+
+func UpstreamUnavailable(code, detail string) *Error {
+	return New(KindUpstreamUnavailable, code, detail)
+}
+
+// Internal hides cause behind a generic internal error.
+func Internal(cause error) *Error {
+	return New(KindInternal, "internal_error", "an unexpected error occurred").WithCause(cause)
+}
+
+// As returns the *Error in err's chain, if any.
+func As(err error) (*Error, bool) {
+	var appErr *Error
+	if errors.As(err, &appErr) {
+		return appErr, true
+	}
+	return nil, false
+}
+
+// HasCode reports whether err is an *Error with the given code.
+func HasCode(err error, code string) bool {
+	appErr, ok := As(err)
+	return ok && appErr.Code == code
+}
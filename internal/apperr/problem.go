@@ -0,0 +1,112 @@
+package apperr
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ProblemContentType is the media type of RFC 7807 problem documents.
+const ProblemContentType = "application/problem+json"
+
+// typeBase prefixes the code to form the problem type URI.
+const typeBase = "urn:auth-service:problem:"
+
+// Status returns the HTTP status err would be rendered with.
+func Status(err error) int {
+	if appErr, ok := As(err); ok {
+		return appErr.Kind.Status()
+	}
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return fiberErr.Code
+	}
+	return fiber.StatusInternalServerError
+}
+
+// ErrorHandler is the Fiber error handler rendering every error as an RFC
+// 7807 problem document. Errors that are not *Error are reported as
+// internal errors without leaking their message.
+func ErrorHandler(c *fiber.Ctx, err error) error {
+	appErr, ok := As(err)
+	if !ok {
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			appErr = fromFiber(c, fiberErr)
+		} else {
+			appErr = Internal(err)
+		}
+	}
+
+	log := slog.Default()
+	if l, ok := c.Locals("logger").(*slog.Logger); ok {
+		log = l
+	}
+	if appErr.Kind == KindInternal || appErr.Kind == KindUpstreamUnavailable {
+		log.Error("request failed", slog.String("error_code", appErr.Code), slog.Any("error", err))
+	}
+
+	problem := fiber.Map{
+		"type":     typeBase + appErr.Code,
+		"title":    appErr.Kind.Title(),
+		"status":   appErr.Kind.Status(),
+		"detail":   appErr.Detail,
+		"instance": c.OriginalURL(),
+		"code":     appErr.Code,
+	}
+	if appErr.RetryAfter > 0 {
+		seconds := int(math.Ceil(appErr.RetryAfter.Seconds()))
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+		problem["retry_after"] = seconds
+	}
+	if len(appErr.Allow) > 0 {
+		c.Set(fiber.HeaderAllow, strings.Join(appErr.Allow, ", "))
+	}
+	for key, value := range appErr.Extensions {
+		if _, reserved := problem[key]; !reserved {
+			problem[key] = value
+		}
+	}
+
+	c.Status(appErr.Kind.Status())
+	return c.JSON(problem, ProblemContentType)
+}
+
+// AllowedMethods returns the sorted methods of the routes matching the
+// request path. Middleware registered with Use is not counted.
+func AllowedMethods(c *fiber.Ctx) []string {
+	seen := map[string]bool{}
+	var methods []string
+	for _, route := range c.App().GetRoutes(true) {
+		if seen[route.Method] || !fiber.RoutePatternMatch(c.Path(), route.Path, c.App().Config()) {
+			continue
+		}
+		seen[route.Method] = true
+		methods = append(methods, route.Method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+func fromFiber(c *fiber.Ctx, err *fiber.Error) *Error {
+	switch err.Code {
+	case fiber.StatusNotFound:
+		return NotFound("route_not_found", err.Message)
+	case fiber.StatusMethodNotAllowed:
+		return MethodNotAllowed(AllowedMethods(c))
+	case fiber.StatusRequestEntityTooLarge:
+		return Validation("body_too_large", err.Message)
+	case fiber.StatusUnprocessableEntity, fiber.StatusBadRequest:
+		return Validation("invalid_request", err.Message)
+	default:
+		if err.Code < 500 {
+			return Validation("invalid_request", err.Message)
+		}
+		return Internal(err)
+	}
+}
@@ -0,0 +1,133 @@
+package apperr
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func render(t *testing.T, handler fiber.Handler) (int, string, map[string]interface{}) {
+	t.Helper()
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Get("/test", handler)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/test?x=1", nil))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	return resp.StatusCode, resp.Header.Get(fiber.HeaderContentType), body
+}
+
+func TestErrorHandlerRendersProblem(t *testing.T) {
+	status, contentType, body := render(t, func(c *fiber.Ctx) error {
+		return NotFound("user_not_found", "user not found").
+			WithCause(errors.New("keycloak said 404")).
+			With("user_id", "42")
+	})
+
+	if status != fiber.StatusNotFound {
+		t.Fatalf("status = %d, want 404", status)
+	}
+	if contentType != ProblemContentType {
+		t.Fatalf("content type = %q, want %q", contentType, ProblemContentType)
+	}
+	want := map[string]interface{}{
+		"type":     "urn:auth-service:problem:user_not_found",
+		"title":    "Not found",
+		"status":   float64(404),
+		"detail":   "user not found",
+		"instance": "/test?x=1",
+		"code":     "user_not_found",
+		"user_id":  "42",
+	}
+	for key, value := range want {
+		if body[key] != value {
+			t.Errorf("%s = %v, want %v", key, body[key], value)
+		}
+	}
+}
+
+func TestErrorHandlerRateLimited(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Get("/test", func(c *fiber.Ctx) error {
+		return RateLimited("rate_limited", "too many requests", 1500*time.Millisecond)
+	})
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/test", nil))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", resp.StatusCode)
+	}
+	if got := resp.Header.Get(fiber.HeaderRetryAfter); got != "2" {
+		t.Fatalf("Retry-After = %q, want 2", got)
+	}
+}
+
+func TestErrorHandlerMethodNotAllowed(t *testing.T) {
+	app := fiber.New(fiber.Config{ErrorHandler: ErrorHandler})
+	app.Get("/test", func(c *fiber.Ctx) error { return nil })
+
+	resp, err := app.Test(httptest.NewRequest("DELETE", "/test", nil))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if resp.StatusCode != fiber.StatusMethodNotAllowed {
+		t.Fatalf("status = %d, want 405", resp.StatusCode)
+	}
+	if got := resp.Header.Get(fiber.HeaderAllow); got != "GET, HEAD" {
+		t.Fatalf("Allow = %q, want GET, HEAD", got)
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatalf("decode body: %v", err)
+	}
+	if body["code"] != "method_not_allowed" || body["title"] != "Method not allowed" {
+		t.Fatalf("body = %v, want a method_not_allowed problem", body)
+	}
+}
+
+func TestErrorHandlerHidesUnknownErrors(t *testing.T) {
+	status, _, body := render(t, func(c *fiber.Ctx) error {
+		return errors.New("dial tcp 10.0.0.1:8080: connection refused")
+	})
+
+	if status != fiber.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", status)
+	}
+	if body["code"] != "internal_error" {
+		t.Fatalf("code = %v, want internal_error", body["code"])
+	}
+	if body["detail"] != "an unexpected error occurred" {
+		t.Fatalf("detail leaks the cause: %v", body["detail"])
+	}
+}
+
+func TestIsMatchesCode(t *testing.T) {
+	sentinel := Unauthorized("invalid_credentials", "invalid username or password")
+	err := sentinel.WithCause(errors.New("401 Unauthorized"))
+
+	if !errors.Is(err, sentinel) {
+		t.Fatal("copy made by WithCause should match its sentinel")
+	}
+	if errors.Is(err, Unauthorized("invalid_token", "invalid token")) {
+		t.Fatal("errors with different codes must not match")
+	}
+	if !HasCode(err, "invalid_credentials") {
+		t.Fatal("HasCode should find the code")
+	}
+	if Status(err) != fiber.StatusUnauthorized {
+		t.Fatalf("Status = %d, want 401", Status(err))
+	}
+}
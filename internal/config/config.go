@@ -0,0 +1,647 @@
+package config
+
+import (
+	"auth-service/internal/models"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the typed service configuration. Values are read from an
+// optional YAML file and then overridden by the environment variable named in
+// each field's env tag. For every such variable, NAME_FILE may point to a file
+// holding the value instead (Docker/Kubernetes secrets).
+type Config struct {
+	Server   ServerConfig   `yaml:"server"`
+	Log      LogConfig      `yaml:"log"`
+	Keycloak KeycloakConfig `yaml:"keycloak"`
+	CORS     CORSConfig     `yaml:"cors"`
+	Redirect RedirectConfig `yaml:"redirect"`
+	Cookie   CookieConfig   `yaml:"cookie"`
+	OIDC     OIDCConfig     `yaml:"oidc"`
+	Session  SessionConfig  `yaml:"session"`
+	MFA      MFAConfig      `yaml:"mfa"`
+	WebAuthn WebAuthnConfig `yaml:"webauthn"`
+	Notify   NotifyConfig   `yaml:"notify"`
+
+	EmailVerification EmailVerificationConfig `yaml:"email_verification"`
+	PasswordReset     PasswordResetConfig     `yaml:"password_reset"`
+	PasswordPolicy    PasswordPolicyConfig    `yaml:"password_policy"`
+	RateLimit         RateLimitConfig         `yaml:"rate_limit"`
+	Idempotency       IdempotencyConfig       `yaml:"idempotency"`
+}
+
+type ServerConfig struct {
+	Port string `yaml:"port" env:"PORT"`
+	// ProxyHeader names the header carrying the client IP (e.g.
+	// X-Forwarded-For) when the service runs behind a reverse proxy. It is
+	// only read on requests from TrustedProxies and ignored without them.
+	ProxyHeader string `yaml:"proxy_header" env:"PROXY_HEADER"`
+	// TrustedProxies lists the IPs and CIDR ranges of the reverse proxies
+	// allowed to set ProxyHeader. The proxies must overwrite the header, as
+	// its first valid IP is taken as the client IP.
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+}
+
+// FiberConfig returns the Fiber settings deciding the client IP. Without
+// trusted proxies the proxy header is left unset, so c.IP() is always the
+// peer address and cannot be forged with a header.
+func (s ServerConfig) FiberConfig() fiber.Config {
+	if s.ProxyHeader == "" || len(s.TrustedProxies) == 0 {
+		return fiber.Config{}
+	}
+	return fiber.Config{
+		ProxyHeader:             s.ProxyHeader,
+		EnableTrustedProxyCheck: true,
+		TrustedProxies:          s.TrustedProxies,
+		EnableIPValidation:      true,
+	}
+}
+
+type LogConfig struct {
+	// Level is debug, info, warn or error. At debug level request bodies are
+	// logged with secret fields redacted.
+	Level string `yaml:"level" env:"LOG_LEVEL"`
+	// Format is json or text.
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+type KeycloakConfig struct {
+	BaseURL      string              `yaml:"base_url" env:"KEYCLOAK_BASE_URL"`
+	Realm        string              `yaml:"realm" env:"KEYCLOAK_REALM"`
+	ClientID     string              `yaml:"client_id" env:"KEYCLOAK_CLIENT_ID"`
+	ClientSecret string              `yaml:"client_secret" env:"KEYCLOAK_CLIENT_SECRET" secret:"true"`
+	Admin        KeycloakAdminConfig `yaml:"admin"`
+}
+
+type KeycloakAdminConfig struct {
+	// Auth is "password" or "client_credentials", see services.AdminAuthStrategy.
+	Auth     string `yaml:"auth" env:"KEYCLOAK_ADMIN_AUTH"`
+	Username string `yaml:"username" env:"KEYCLOAK_ADMIN_USERNAME"`
+	Password string `yaml:"password" env:"KEYCLOAK_ADMIN_PASSWORD" secret:"true"`
+	Realm    string `yaml:"realm" env:"KEYCLOAK_ADMIN_REALM"`
+}
+
+type CORSConfig struct {
+	AllowOrigins []string `yaml:"allow_origins" env:"CORS_ALLOW_ORIGINS"`
+}
+
+type RedirectConfig struct {
+	// VerifyEmail is where Keycloak sends the user after the verification link.
+	VerifyEmail string `yaml:"verify_email" env:"REDIRECT_VERIFY_EMAIL"`
+	// PasswordReset is the frontend page that receives the reset token.
+	PasswordReset string `yaml:"password_reset" env:"REDIRECT_PASSWORD_RESET"`
+}
+
+type OIDCConfig struct {
+	// CallbackURL is the public URL of GET /api/v1/oidc/callback. It must be
+	// a valid redirect URI of the Keycloak client.
+	CallbackURL string `yaml:"callback_url" env:"OIDC_CALLBACK_URL"`
+	// PostLoginRedirect is the frontend page browsers land on after login.
+	// A relative return_to passed to /oidc/login is resolved against it.
+	PostLoginRedirect string        `yaml:"post_login_redirect" env:"OIDC_POST_LOGIN_REDIRECT"`
+	Scopes            []string      `yaml:"scopes" env:"OIDC_SCOPES"`
+	StateTTL          time.Duration `yaml:"state_ttl" env:"OIDC_STATE_TTL"`
+}
+
+type SessionConfig struct {
+	// Mode is "token" (tokens are returned to the client, the access token
+	// also as a cookie) or "session" (tokens stay in the session store and
+	// the browser only gets an opaque session_id cookie).
+	Mode string `yaml:"mode" env:"SESSION_MODE"`
+	// Store is "memory", "file" or "redis".
+	Store         string `yaml:"store" env:"SESSION_STORE"`
+	FileDir       string `yaml:"file_dir" env:"SESSION_FILE_DIR"`
+	RedisAddr     string `yaml:"redis_addr" env:"SESSION_REDIS_ADDR"`
+	RedisPassword string `yaml:"redis_password" env:"SESSION_REDIS_PASSWORD" secret:"true"`
+
+	IdleTimeout     time.Duration `yaml:"idle_timeout" env:"SESSION_IDLE_TIMEOUT"`
+	AbsoluteTimeout time.Duration `yaml:"absolute_timeout" env:"SESSION_ABSOLUTE_TIMEOUT"`
+}
+
+type MFAConfig struct {
+	// Issuer is the name authenticator apps show for the account.
+	Issuer string `yaml:"issuer" env:"MFA_ISSUER"`
+	// Store is "file" or "memory". Factors in memory are lost on restart,
+	// which silently turns MFA off.
+	Store        string        `yaml:"store" env:"MFA_STORE"`
+	FileDir      string        `yaml:"file_dir" env:"MFA_FILE_DIR"`
+	ChallengeTTL time.Duration `yaml:"challenge_ttl" env:"MFA_CHALLENGE_TTL"`
+	// RecoveryCodeKey keys the recovery code hashes, so a leaked store
+	// cannot be brute-forced without it. Changing it invalidates all
+	// recovery codes.
+	RecoveryCodeKey string `yaml:"recovery_code_key" env:"MFA_RECOVERY_CODE_KEY" secret:"true"`
+}
+
+type WebAuthnConfig struct {
+	// RPID is the domain passkeys are bound to: the frontend's host or a
+	// parent domain of it. Passkeys stop working when it changes.
+	RPID   string `yaml:"rp_id" env:"WEBAUTHN_RP_ID"`
+	RPName string `yaml:"rp_name" env:"WEBAUTHN_RP_NAME"`
+	// RPOrigins are the frontend origins ceremonies may run on.
+	RPOrigins []string `yaml:"rp_origins" env:"WEBAUTHN_RP_ORIGINS"`
+	// Store is "file" or "memory".
+	Store       string        `yaml:"store" env:"WEBAUTHN_STORE"`
+	FileDir     string        `yaml:"file_dir" env:"WEBAUTHN_FILE_DIR"`
+	CeremonyTTL time.Duration `yaml:"ceremony_ttl" env:"WEBAUTHN_CEREMONY_TTL"`
+}
+
+type NotifyConfig struct {
+	// WebhookURL receives security notifications for users as JSON POSTs,
+	// e.g. a mail service. Without it notifications are only logged. Such
+	// URLs often carry a token, so the value is treated as a secret.
+	WebhookURL string `yaml:"webhook_url" env:"NOTIFY_WEBHOOK_URL" secret:"true"`
+}
+
+type EmailVerificationConfig struct {
+	// Required rejects logins of users who have not verified their email
+	// address yet, with the email_not_verified error.
+	Required bool `yaml:"required" env:"EMAIL_VERIFICATION_REQUIRED"`
+	// ResendLimit verification emails may be requested per ResendWindow
+	// and email address.
+	ResendLimit  int           `yaml:"resend_limit" env:"EMAIL_VERIFICATION_RESEND_LIMIT"`
+	ResendWindow time.Duration `yaml:"resend_window" env:"EMAIL_VERIFICATION_RESEND_WINDOW"`
+}
+
+type IdempotencyConfig struct {
+	// Store is "memory" or "redis". Retries only replay responses stored
+	// by the same instance with the memory store.
+	Store         string `yaml:"store" env:"IDEMPOTENCY_STORE"`
+	RedisAddr     string `yaml:"redis_addr" env:"IDEMPOTENCY_REDIS_ADDR"`
+	RedisPassword string `yaml:"redis_password" env:"IDEMPOTENCY_REDIS_PASSWORD" secret:"true"`
+	// TTL is how long responses are kept for replay.
+	TTL time.Duration `yaml:"ttl" env:"IDEMPOTENCY_TTL"`
+}
+
+type PasswordResetConfig struct {
+	TokenTTL time.Duration `yaml:"token_ttl" env:"PASSWORD_RESET_TOKEN_TTL"`
+}
+
+type PasswordPolicyConfig struct {
+	MinLength int `yaml:"min_length" env:"PASSWORD_MIN_LENGTH"`
+	MaxLength int `yaml:"max_length" env:"PASSWORD_MAX_LENGTH"`
+	// Require* demand at least one character of the class.
+	RequireLowercase bool `yaml:"require_lowercase" env:"PASSWORD_REQUIRE_LOWERCASE"`
+	RequireUppercase bool `yaml:"require_uppercase" env:"PASSWORD_REQUIRE_UPPERCASE"`
+	RequireDigit     bool `yaml:"require_digit" env:"PASSWORD_REQUIRE_DIGIT"`
+	RequireSymbol    bool `yaml:"require_symbol" env:"PASSWORD_REQUIRE_SYMBOL"`
+	// MinStrength is the lowest accepted zxcvbn score, from 0 (off) to 4.
+	MinStrength int `yaml:"min_strength" env:"PASSWORD_MIN_STRENGTH"`
+	// BreachedListFile lists breached passwords as hex SHA-1 hashes or hash
+	// prefixes, one per line.
+	BreachedListFile string `yaml:"breached_list_file" env:"PASSWORD_BREACHED_LIST_FILE"`
+}
+
+type RateLimitConfig struct {
+	// Store is "memory" or "redis".
+	Store         string `yaml:"store" env:"RATE_LIMIT_STORE"`
+	RedisAddr     string `yaml:"redis_addr" env:"RATE_LIMIT_REDIS_ADDR"`
+	RedisPassword string `yaml:"redis_password" env:"RATE_LIMIT_REDIS_PASSWORD" secret:"true"`
+
+	Window        time.Duration `yaml:"window" env:"RATE_LIMIT_WINDOW"`
+	IPLimit       int           `yaml:"ip_limit" env:"RATE_LIMIT_IP_LIMIT"`
+	UsernameLimit int           `yaml:"username_limit" env:"RATE_LIMIT_USERNAME_LIMIT"`
+
+	LockoutThreshold int           `yaml:"lockout_threshold" env:"LOCKOUT_THRESHOLD"`
+	LockoutBase      time.Duration `yaml:"lockout_base" env:"LOCKOUT_BASE"`
+	LockoutMax       time.Duration `yaml:"lockout_max" env:"LOCKOUT_MAX"`
+}
+
+type CookieConfig struct {
+	Secure   bool   `yaml:"secure" env:"COOKIE_SECURE"`
+	SameSite string `yaml:"same_site" env:"COOKIE_SAME_SITE"`
+	Domain   string `yaml:"domain" env:"COOKIE_DOMAIN"`
+	// RefreshPath scopes the refresh_token cookie, so browsers only send it
+	// to the refresh endpoint. Other routes never see it: clients renew an
+	// expired access token there and retry.
+	RefreshPath string `yaml:"refresh_path" env:"COOKIE_REFRESH_PATH"`
+}
+
+// Cookie builds an HTTP-only cookie with the configured attributes.
+// A negative maxAge deletes the cookie.
+func (cc CookieConfig) Cookie(name, value string, maxAge int) *fiber.Cookie {
+	cookie := &fiber.Cookie{
+		Name:     name,
+		Value:    value,
+		MaxAge:   maxAge,
+		Domain:   cc.Domain,
+		HTTPOnly: true,
+		Secure:   cc.Secure,
+		SameSite: cc.SameSite,
+	}
+	if maxAge < 0 {
+		// fasthttp omits a non-positive Max-Age, so expire it explicitly.
+		cookie.Expires = time.Unix(0, 0)
+	}
+	return cookie
+}
+
+// TokenCookies returns the access_token and refresh_token cookies for a
+// token response. They expire with the tokens; a token without a lifetime
+// (e.g. an offline token) gets a session cookie.
+func (cc CookieConfig) TokenCookies(token *models.LoginResponse) []*fiber.Cookie {
+	refresh := cc.Cookie("refresh_token", token.RefreshToken, token.RefreshExpiresIn)
+	refresh.Path = cc.RefreshPath
+	return []*fiber.Cookie{
+		cc.Cookie("access_token", token.AccessToken, token.ExpiresIn),
+		refresh,
+	}
+}
+
+// ClearTokenCookies returns the cookies deleting both token cookies.
+func (cc CookieConfig) ClearTokenCookies() []*fiber.Cookie {
+	refresh := cc.Cookie("refresh_token", "", -1)
+	refresh.Path = cc.RefreshPath
+	return []*fiber.Cookie{
+		cc.Cookie("access_token", "", -1),
+		refresh,
+	}
+}
+
+// Default returns the configuration used for local development.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{Port: "5000"},
+		Log:    LogConfig{Level: "info", Format: "json"},
+		Keycloak: KeycloakConfig{
+			BaseURL:  "http://localhost:8080",
+			ClientID: "camp-be-client",
+		},
+		CORS: CORSConfig{AllowOrigins: []string{"http://localhost:3000"}},
+		Redirect: RedirectConfig{
+			VerifyEmail:   "http://localhost:3000/",
+			PasswordReset: "http://localhost:3000/reset-password",
+		},
+		Cookie: CookieConfig{SameSite: fiber.CookieSameSiteLaxMode, RefreshPath: "/api/v1/refresh"},
+		OIDC: OIDCConfig{
+			CallbackURL:       "http://localhost:5000/api/v1/oidc/callback",
+			PostLoginRedirect: "http://localhost:3000/",
+			Scopes:            []string{"openid", "profile", "email"},
+			StateTTL:          10 * time.Minute,
+		},
+		Session: SessionConfig{
+			Mode:            "token",
+			Store:           "memory",
+			FileDir:         "sessions",
+			IdleTimeout:     30 * time.Minute,
+			AbsoluteTimeout: 12 * time.Hour,
+		},
+		MFA: MFAConfig{
+			Issuer:       "auth-service",
+			Store:        "file",
+			FileDir:      "mfa",
+			ChallengeTTL: 5 * time.Minute,
+		},
+		WebAuthn: WebAuthnConfig{
+			RPID:        "localhost",
+			RPName:      "auth-service",
+			RPOrigins:   []string{"http://localhost:3000"},
+			Store:       "file",
+			FileDir:     "webauthn",
+			CeremonyTTL: 5 * time.Minute,
+		},
+
+		EmailVerification: EmailVerificationConfig{ResendLimit: 3, ResendWindow: time.Hour},
+		PasswordReset:     PasswordResetConfig{TokenTTL: 15 * time.Minute},
+		PasswordPolicy:    PasswordPolicyConfig{MinLength: 8, MaxLength: 128},
+		RateLimit: RateLimitConfig{
+			Store:            "memory",
+			Window:           time.Minute,
+			IPLimit:          30,
+			UsernameLimit:    10,
+			LockoutThreshold: 5,
+			LockoutBase:      time.Minute,
+			LockoutMax:       time.Hour,
+		},
+		Idempotency: IdempotencyConfig{Store: "memory", TTL: 24 * time.Hour},
+	}
+}
+
+// Load builds the configuration from defaults, the YAML file at path (if
+// any) and the environment, then validates it.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read config file failed: %w", err)
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parse config file failed: %w", err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(cfg).Elem()); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// minRecoveryCodeKeyLength is the shortest mfa.recovery_code_key accepted,
+// 32 random characters or more.
+const minRecoveryCodeKeyLength = 32
+
+// Validate checks that required fields are present and well formed.
+func (cfg *Config) Validate() error {
+	var errs []error
+
+	if cfg.Keycloak.BaseURL == "" {
+		errs = append(errs, errors.New("keycloak.base_url (KEYCLOAK_BASE_URL) is required"))
+	} else if u, err := url.Parse(cfg.Keycloak.BaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("keycloak.base_url %q is not a valid URL", cfg.Keycloak.BaseURL))
+	}
+	if cfg.Keycloak.Realm == "" {
+		errs = append(errs, errors.New("keycloak.realm (KEYCLOAK_REALM) is required"))
+	}
+	if cfg.Keycloak.ClientID == "" {
+		errs = append(errs, errors.New("keycloak.client_id (KEYCLOAK_CLIENT_ID) is required"))
+	}
+	if port, err := strconv.Atoi(cfg.Server.Port); err != nil || port <= 0 || port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port %q is not a valid port", cfg.Server.Port))
+	}
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			errs = append(errs, fmt.Errorf("server.trusted_proxies entry %q is not an IP or CIDR range", proxy))
+		}
+	}
+	switch strings.ToLower(cfg.Log.Level) {
+	case "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("log.level %q must be debug, info, warn or error", cfg.Log.Level))
+	}
+	if cfg.Log.Format != "json" && cfg.Log.Format != "text" {
+		errs = append(errs, fmt.Errorf("log.format %q must be json or text", cfg.Log.Format))
+	}
+	switch strings.ToLower(cfg.Cookie.SameSite) {
+	case "lax", "strict", "none":
+	default:
+		errs = append(errs, fmt.Errorf("cookie.same_site %q must be Lax, Strict or None", cfg.Cookie.SameSite))
+	}
+	if !strings.HasPrefix(cfg.Cookie.RefreshPath, "/") {
+		errs = append(errs, fmt.Errorf("cookie.refresh_path %q must be an absolute path", cfg.Cookie.RefreshPath))
+	}
+	if u, err := url.Parse(cfg.Redirect.PasswordReset); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("redirect.password_reset %q is not a valid URL", cfg.Redirect.PasswordReset))
+	}
+	if u, err := url.Parse(cfg.OIDC.CallbackURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("oidc.callback_url %q is not a valid URL", cfg.OIDC.CallbackURL))
+	}
+	if u, err := url.Parse(cfg.OIDC.PostLoginRedirect); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("oidc.post_login_redirect %q is not a valid URL", cfg.OIDC.PostLoginRedirect))
+	}
+	if cfg.Notify.WebhookURL != "" {
+		if u, err := url.Parse(cfg.Notify.WebhookURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, errors.New("notify.webhook_url (NOTIFY_WEBHOOK_URL) is not a valid URL"))
+		}
+	}
+	if !slices.Contains(cfg.OIDC.Scopes, "openid") {
+		errs = append(errs, errors.New("oidc.scopes must include openid"))
+	}
+	if cfg.OIDC.StateTTL <= 0 {
+		errs = append(errs, errors.New("oidc.state_ttl must be positive"))
+	}
+	switch cfg.Session.Mode {
+	case "token", "session":
+	default:
+		errs = append(errs, fmt.Errorf("session.mode %q must be token or session", cfg.Session.Mode))
+	}
+	switch cfg.Session.Store {
+	case "memory":
+	case "file":
+		if cfg.Session.FileDir == "" {
+			errs = append(errs, errors.New("session.file_dir (SESSION_FILE_DIR) is required for the file store"))
+		}
+	case "redis":
+		if cfg.Session.RedisAddr == "" {
+			errs = append(errs, errors.New("session.redis_addr (SESSION_REDIS_ADDR) is required for the redis store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("session.store %q must be memory, file or redis", cfg.Session.Store))
+	}
+	if cfg.Session.IdleTimeout <= 0 || cfg.Session.AbsoluteTimeout <= 0 {
+		errs = append(errs, errors.New("session.idle_timeout and session.absolute_timeout must be positive"))
+	}
+	if cfg.MFA.Issuer == "" || strings.Contains(cfg.MFA.Issuer, ":") {
+		errs = append(errs, fmt.Errorf("mfa.issuer %q must be set and must not contain a colon", cfg.MFA.Issuer))
+	}
+	switch cfg.MFA.Store {
+	case "memory":
+	case "file":
+		if cfg.MFA.FileDir == "" {
+			errs = append(errs, errors.New("mfa.file_dir (MFA_FILE_DIR) is required for the file store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("mfa.store %q must be file or memory", cfg.MFA.Store))
+	}
+	if cfg.MFA.ChallengeTTL <= 0 {
+		errs = append(errs, errors.New("mfa.challenge_ttl must be positive"))
+	}
+	if len(cfg.MFA.RecoveryCodeKey) < minRecoveryCodeKeyLength {
+		errs = append(errs, fmt.Errorf("mfa.recovery_code_key (MFA_RECOVERY_CODE_KEY) must be at least %d characters", minRecoveryCodeKeyLength))
+	}
+	if cfg.WebAuthn.RPID == "" || strings.ContainsAny(cfg.WebAuthn.RPID, ":/") {
+		errs = append(errs, fmt.Errorf("webauthn.rp_id %q must be a bare domain", cfg.WebAuthn.RPID))
+	}
+	if cfg.WebAuthn.RPName == "" {
+		errs = append(errs, errors.New("webauthn.rp_name (WEBAUTHN_RP_NAME) is required"))
+	}
+	if len(cfg.WebAuthn.RPOrigins) == 0 {
+		errs = append(errs, errors.New("webauthn.rp_origins (WEBAUTHN_RP_ORIGINS) is required"))
+	}
+	for _, origin := range cfg.WebAuthn.RPOrigins {
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("webauthn.rp_origins entry %q is not a valid origin", origin))
+		}
+	}
+	switch cfg.WebAuthn.Store {
+	case "memory":
+	case "file":
+		if cfg.WebAuthn.FileDir == "" {
+			errs = append(errs, errors.New("webauthn.file_dir (WEBAUTHN_FILE_DIR) is required for the file store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("webauthn.store %q must be file or memory", cfg.WebAuthn.Store))
+	}
+	if cfg.WebAuthn.CeremonyTTL <= 0 {
+		errs = append(errs, errors.New("webauthn.ceremony_ttl must be positive"))
+	}
+	if cfg.EmailVerification.ResendLimit <= 0 || cfg.EmailVerification.ResendWindow <= 0 {
+		errs = append(errs, errors.New("email_verification.resend_limit and email_verification.resend_window must be positive"))
+	}
+	if cfg.PasswordReset.TokenTTL <= 0 {
+		errs = append(errs, errors.New("password_reset.token_ttl must be positive"))
+	}
+	if cfg.PasswordPolicy.MinLength < 1 || cfg.PasswordPolicy.MaxLength < cfg.PasswordPolicy.MinLength {
+		errs = append(errs, errors.New("password_policy.min_length must be positive and at most password_policy.max_length"))
+	}
+	if cfg.PasswordPolicy.MinStrength < 0 || cfg.PasswordPolicy.MinStrength > 4 {
+		errs = append(errs, fmt.Errorf("password_policy.min_strength %d must be between 0 and 4", cfg.PasswordPolicy.MinStrength))
+	}
+	switch cfg.RateLimit.Store {
+	case "memory":
+	case "redis":
+		if cfg.RateLimit.RedisAddr == "" {
+			errs = append(errs, errors.New("rate_limit.redis_addr (RATE_LIMIT_REDIS_ADDR) is required for the redis store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("rate_limit.store %q must be memory or redis", cfg.RateLimit.Store))
+	}
+	if cfg.RateLimit.Window <= 0 {
+		errs = append(errs, errors.New("rate_limit.window must be positive"))
+	}
+	switch cfg.Idempotency.Store {
+	case "memory":
+	case "redis":
+		if cfg.Idempotency.RedisAddr == "" {
+			errs = append(errs, errors.New("idempotency.redis_addr (IDEMPOTENCY_REDIS_ADDR) is required for the redis store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("idempotency.store %q must be memory or redis", cfg.Idempotency.Store))
+	}
+	if cfg.Idempotency.TTL <= 0 {
+		errs = append(errs, errors.New("idempotency.ttl must be positive"))
+	}
+	if strings.EqualFold(cfg.Cookie.SameSite, "none") && !cfg.Cookie.Secure {
+		errs = append(errs, errors.New("cookie.same_site None requires cookie.secure"))
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Summary renders the configuration with secrets redacted, one setting per line.
+func (cfg *Config) Summary() []string {
+	var lines []string
+	summarize(reflect.ValueOf(cfg).Elem(), "", &lines)
+	return lines
+}
+
+func summarize(v reflect.Value, prefix string, lines *[]string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := prefix + strings.Split(field.Tag.Get("yaml"), ",")[0]
+		value := v.Field(i)
+
+		if value.Kind() == reflect.Struct {
+			summarize(value, name+".", lines)
+			continue
+		}
+
+		shown := fmt.Sprint(value.Interface())
+		if value.Kind() == reflect.Slice {
+			shown = strings.Join(value.Interface().([]string), ", ")
+		}
+		if field.Tag.Get("secret") == "true" {
+			shown = redact(shown)
+		}
+		*lines = append(*lines, fmt.Sprintf("%s: %s", name, shown))
+	}
+}
+
+func redact(value string) string {
+	if value == "" {
+		return "(not set)"
+	}
+	return "******"
+}
+
+// applyEnv overrides fields that have an env tag from NAME or NAME_FILE.
+func applyEnv(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		value := v.Field(i)
+
+		if value.Kind() == reflect.Struct {
+			if err := applyEnv(value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		key := field.Tag.Get("env")
+		if key == "" {
+			continue
+		}
+		raw, ok, err := lookupEnv(key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := setValue(value, raw); err != nil {
+			return fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+func lookupEnv(key string) (string, bool, error) {
+	if raw := os.Getenv(key); raw != "" {
+		return raw, true, nil
+	}
+	if path := os.Getenv(key + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("read %s_FILE failed: %w", key, err)
+		}
+		return strings.TrimSpace(string(data)), true, nil
+	}
+	return "", false, nil
+}
+
+func setValue(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		if v.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(d))
+			return nil
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported field type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRecoveryCodeKey = "0123456789abcdef0123456789abcdef"
+
+// clearEnv unsets every variable Load reads, so the environment of the test
+// run does not leak into the configuration.
+func clearEnv(t *testing.T) {
+	t.Helper()
+	var walk func(reflect.Type)
+	walk = func(typ reflect.Type) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			if field.Type.Kind() == reflect.Struct {
+				walk(field.Type)
+				continue
+			}
+			if key := field.Tag.Get("env"); key != "" {
+				t.Setenv(key, "")
+				t.Setenv(key+"_FILE", "")
+			}
+		}
+	}
+	walk(reflect.TypeOf(Config{}))
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// validConfig is the smallest YAML file Load accepts.
+const validConfig = `
+keycloak:
+  realm: camp
+mfa:
+  recovery_code_key: ` + testRecoveryCodeKey + `
+`
+
+func TestLoadYAML(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, "config.yaml", validConfig+`
+server:
+  port: "8081"
+cors:
+  allow_origins: [https://app.example.com, https://admin.example.com]
+session:
+  idle_timeout: 45m
+`)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != "8081" || cfg.Keycloak.Realm != "camp" {
+		t.Fatalf("file values not loaded: port %q, realm %q", cfg.Server.Port, cfg.Keycloak.Realm)
+	}
+	if want := []string{"https://app.example.com", "https://admin.example.com"}; !slices.Equal(cfg.CORS.AllowOrigins, want) {
+		t.Fatalf("allow_origins = %v, want %v", cfg.CORS.AllowOrigins, want)
+	}
+	if cfg.Session.IdleTimeout != 45*time.Minute {
+		t.Fatalf("idle_timeout = %v, want 45m", cfg.Session.IdleTimeout)
+	}
+	// Settings the file leaves out keep their defaults.
+	if cfg.Keycloak.BaseURL != Default().Keycloak.BaseURL || cfg.Session.AbsoluteTimeout != 12*time.Hour {
+		t.Fatalf("defaults lost: base_url %q, absolute_timeout %v", cfg.Keycloak.BaseURL, cfg.Session.AbsoluteTimeout)
+	}
+}
+
+func TestLoadEnvOverrides(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, "config.yaml", validConfig+`
+server:
+  port: "8081"
+`)
+	t.Setenv("PORT", "9090")
+	t.Setenv("CORS_ALLOW_ORIGINS", "https://a.example.com, ,https://b.example.com")
+	t.Setenv("COOKIE_SECURE", "true")
+	t.Setenv("SESSION_IDLE_TIMEOUT", "20m")
+	t.Setenv("RATE_LIMIT_IP_LIMIT", "7")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != "9090" {
+		t.Fatalf("port = %q, want the environment to win", cfg.Server.Port)
+	}
+	if want := []string{"https://a.example.com", "https://b.example.com"}; !slices.Equal(cfg.CORS.AllowOrigins, want) {
+		t.Fatalf("allow_origins = %v, want %v", cfg.CORS.AllowOrigins, want)
+	}
+	if !cfg.Cookie.Secure || cfg.Session.IdleTimeout != 20*time.Minute || cfg.RateLimit.IPLimit != 7 {
+		t.Fatalf("typed overrides not applied: secure %v, idle_timeout %v, ip_limit %d", cfg.Cookie.Secure, cfg.Session.IdleTimeout, cfg.RateLimit.IPLimit)
+	}
+
+	t.Setenv("SESSION_IDLE_TIMEOUT", "soon")
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "SESSION_IDLE_TIMEOUT") {
+		t.Fatalf("err = %v, want the bad duration named", err)
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	clearEnv(t)
+	path := writeFile(t, "config.yaml", validConfig)
+	t.Setenv("KEYCLOAK_CLIENT_SECRET_FILE", writeFile(t, "client_secret", "from-file\n"))
+	t.Setenv("NOTIFY_WEBHOOK_URL_FILE", writeFile(t, "webhook_url", "https://hooks.example.com/T0K3N\n"))
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Keycloak.ClientSecret != "from-file" || cfg.Notify.WebhookURL != "https://hooks.example.com/T0K3N" {
+		t.Fatalf("secrets not read from files: %q, %q", cfg.Keycloak.ClientSecret, cfg.Notify.WebhookURL)
+	}
+
+	// The variable itself wins over the file.
+	t.Setenv("KEYCLOAK_CLIENT_SECRET", "from-env")
+	if cfg, err = Load(path); err != nil || cfg.Keycloak.ClientSecret != "from-env" {
+		t.Fatalf("client secret = %q (%v), want from-env", cfg.Keycloak.ClientSecret, err)
+	}
+
+	t.Setenv("KEYCLOAK_ADMIN_PASSWORD_FILE", filepath.Join(t.TempDir(), "missing"))
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), "KEYCLOAK_ADMIN_PASSWORD_FILE") {
+		t.Fatalf("err = %v, want the missing secret file named", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string
+	}{
+		{name: "valid", change: func(*Config) {}},
+		{name: "missing realm", change: func(c *Config) { c.Keycloak.Realm = "" }, want: "keycloak.realm"},
+		{name: "bad base url", change: func(c *Config) { c.Keycloak.BaseURL = "localhost" }, want: "keycloak.base_url"},
+		{name: "bad port", change: func(c *Config) { c.Server.Port = "http" }, want: "server.port"},
+		{name: "bad trusted proxy", change: func(c *Config) { c.Server.TrustedProxies = []string{"proxy.local"} }, want: "server.trusted_proxies"},
+		{name: "short recovery code key", change: func(c *Config) { c.MFA.RecoveryCodeKey = "short" }, want: "mfa.recovery_code_key"},
+		{name: "unknown session store", change: func(c *Config) { c.Session.Store = "disk" }, want: "session.store"},
+		{name: "redis without address", change: func(c *Config) { c.RateLimit.Store = "redis" }, want: "rate_limit.redis_addr"},
+		{name: "same site none without secure", change: func(c *Config) { c.Cookie.SameSite = "None" }, want: "cookie.same_site"},
+		{name: "bad webhook url", change: func(c *Config) { c.Notify.WebhookURL = "hooks.example.com/T0K3N" }, want: "notify.webhook_url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			cfg.Keycloak.Realm = "camp"
+			cfg.MFA.RecoveryCodeKey = testRecoveryCodeKey
+			tt.change(cfg)
+
+			err := cfg.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Fatalf("valid configuration rejected: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("err = %v, want it to mention %s", err, tt.want)
+			}
+			if strings.Contains(err.Error(), "T0K3N") {
+				t.Fatalf("err = %v, leaks the secret", err)
+			}
+		})
+	}
+}
+
+func TestSummaryRedactsSecrets(t *testing.T) {
+	cfg := Default()
+	cfg.Keycloak.ClientSecret = "client-s3cret"
+	cfg.MFA.RecoveryCodeKey = testRecoveryCodeKey
+	cfg.Notify.WebhookURL = "https://hooks.example.com/T0K3N"
+
+	summary := strings.Join(cfg.Summary(), "\n")
+	for _, secret := range []string{"client-s3cret", testRecoveryCodeKey, "T0K3N"} {
+		if strings.Contains(summary, secret) {
+			t.Fatalf("summary shows %q:\n%s", secret, summary)
+		}
+	}
+	for _, line := range []string{"notify.webhook_url: ******", "keycloak.admin.password: (not set)", "server.port: 5000"} {
+		if !strings.Contains(summary, line) {
+			t.Fatalf("summary lacks %q:\n%s", line, summary)
+		}
+	}
+}
@@ -1,25 +1,83 @@
 package handler
 
 import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/config"
+	"auth-service/internal/logging"
 	"auth-service/internal/models"
+	"auth-service/internal/ratelimit"
 	"auth-service/internal/services"
+	"auth-service/internal/validation"
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Nerzal/gocloak/v13"
 	"github.com/gofiber/fiber/v2"
 )
 
+var (
+	errAuthenticationRequired = apperr.Unauthorized("authentication_required", "authentication required")
+	errNoUserFields           = apperr.Validation("missing_fields", "at least one of firstname, lastname, username and email is required")
+)
+
+// detachedTimeout bounds the identity provider work that runs after the
+// response was sent.
+const detachedTimeout = 30 * time.Second
+
 type AuthHandler struct {
-	keycloakService *services.KeycloakService
+	identity services.IdentityProvider
+	cookies  config.CookieConfig
+	limiter  *ratelimit.Limiter
+	// sessions is set in session mode: tokens then stay server side and
+	// clients only get a session_id cookie.
+	sessions *services.SessionManager
+	// mfa turns logins of users with a second factor into a two-step
+	// challenge.
+	mfa          *services.MFAService
+	verification config.EmailVerificationConfig
+	// passwords is checked before new passwords reach the identity
+	// provider.
+	passwords *validation.PasswordPolicy
+	// background tracks the work started by detach.
+	background sync.WaitGroup
 }
 
-func NewAuthHandler(ks *services.KeycloakService) *AuthHandler {
+func NewAuthHandler(identity services.IdentityProvider, cookies config.CookieConfig, limiter *ratelimit.Limiter, sessions *services.SessionManager, mfa *services.MFAService, verification config.EmailVerificationConfig, passwords *validation.PasswordPolicy) *AuthHandler {
 	return &AuthHandler{
-		keycloakService: ks,
+		identity:     identity,
+		cookies:      cookies,
+		limiter:      limiter,
+		sessions:     sessions,
+		mfa:          mfa,
+		verification: verification,
+		passwords:    passwords,
 	}
 }
 
+// detach runs fn after the request on a context that outlives it. Endpoints
+// that must not reveal whether an account exists use it, so their response
+// time does not depend on the lookups and emails done for real accounts.
+func (h *AuthHandler) detach(c *fiber.Ctx, fn func(ctx context.Context)) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(c.UserContext()), detachedTimeout)
+	h.background.Add(1)
+	go func() {
+		defer h.background.Done()
+		defer cancel()
+		fn(ctx)
+	}()
+}
+
+// Wait blocks until the work detached from finished requests is done.
+func (h *AuthHandler) Wait() {
+	h.background.Wait()
+}
+
 type AuthInterface interface {
 	LoginHandler(c *fiber.Ctx) error
 	RegisterHandler(c *fiber.Ctx) error
@@ -28,51 +86,231 @@ type AuthInterface interface {
 	GetUserHandler(c *fiber.Ctx) error
 	GetProfileHandler(c *fiber.Ctx) error
 	LogoutHandler(c *fiber.Ctx) error
-	GetCurrentUserHandler(c *fiber.Ctx) error  // Yeni: Giriş yapmış kullanıcının kendi bilgilerini getirme
-	UpdateCurrentUserHandler(c *fiber.Ctx) error // Yeni: Giriş yapmış kullanıcının kendi bilgilerini güncelleme
-	DeleteCurrentUserHandler(c *fiber.Ctx) error // Yeni: Giriş yapmış kullanıcının kendi hesabını silme
+	LoginMFAHandler(c *fiber.Ctx) error            // İki adımlı girişte ikinci faktör kodunu doğrulama
+	GetCurrentUserHandler(c *fiber.Ctx) error      // Yeni: Giriş yapmış kullanıcının kendi bilgilerini getirme
+	UpdateCurrentUserHandler(c *fiber.Ctx) error   // Yeni: Giriş yapmış kullanıcının kendi bilgilerini güncelleme
+	DeleteCurrentUserHandler(c *fiber.Ctx) error   // Yeni: Giriş yapmış kullanıcının kendi hesabını silme
+	ChangePasswordHandler(c *fiber.Ctx) error      // Giriş yapmış kullanıcının şifresini değiştirme
+	ListSessionsHandler(c *fiber.Ctx) error        // Giriş yapmış kullanıcının oturumlarını listeleme
+	RevokeSessionHandler(c *fiber.Ctx) error       // Tek bir oturumu sonlandırma
+	RevokeOtherSessionsHandler(c *fiber.Ctx) error // Mevcut oturum hariç tüm oturumları sonlandırma
 	RefreshTokenHandler(c *fiber.Ctx) error
+	ForgotPasswordHandler(c *fiber.Ctx) error
+	ResendVerificationEmailHandler(c *fiber.Ctx) error // Doğrulama e-postasını yeniden gönderme
+	ResetPasswordHandler(c *fiber.Ctx) error
+	PasswordPolicyHandler(c *fiber.Ctx) error // Şifre kurallarını (frontend için) getirme
+	ClearLockoutHandler(c *fiber.Ctx) error
+}
+
+// validatedBody returns the request body middleware.Validate stored under
+// key.
+func validatedBody[T any](c *fiber.Ctx, key string) (T, error) {
+	body, ok := c.Locals(key).(T)
+	if !ok {
+		logging.FromCtx(c).Error("validated body not found in locals", slog.String("key", key))
+		return body, apperr.Internal(fmt.Errorf("%s body not found in locals", key))
+	}
+	return body, nil
+}
+
+// userUpdate builds the partial update of a user from the fields given in
+// payload.
+func userUpdate(userID string, payload models.UserPayload) (gocloak.User, error) {
+	if payload.Firstname == nil && payload.Lastname == nil && payload.Username == nil && payload.Email == nil {
+		return gocloak.User{}, errNoUserFields
+	}
+	return gocloak.User{
+		ID:        gocloak.StringP(userID),
+		FirstName: payload.Firstname,
+		LastName:  payload.Lastname,
+		Username:  payload.Username,
+		Email:     payload.Email,
+	}, nil
 }
 
 func (h *AuthHandler) LoginHandler(c *fiber.Ctx) error {
-	fmt.Printf("🔐 LoginHandler called\n")
-	
-	loginData := c.Locals("login")
-	if loginData == nil {
-		fmt.Printf("❌ No login data in locals\n")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "login data not found in request",
-		})
+	log := logging.FromCtx(c)
+
+	login, err := validatedBody[models.LoginParams](c, "login")
+	if err != nil {
+		return err
 	}
-	
-	login, ok := loginData.(models.LoginParams)
-	if !ok {
-		fmt.Printf("❌ Login data type assertion failed\n")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid login data format",
-		})
+
+	token, err := h.identity.Login(c.Context(), login)
+	if err != nil {
+		log.Info("login failed", slog.String("username", login.Username), slog.Any("error", err))
+		return err
+	}
+	if err := h.requireVerifiedEmail(c, token); err != nil {
+		log.Info("login rejected", slog.String("username", login.Username), slog.Any("error", err))
+		return err
+	}
+
+	if h.mfa != nil {
+		challenge, err := h.startMFAChallenge(c, login.Username, token)
+		if err != nil {
+			return err
+		}
+		if challenge != nil {
+			// 202, not 200: the login is not complete, so the lockout does
+			// not count it as a success yet.
+			log.Info("password accepted, mfa required", slog.String("username", login.Username))
+			return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+				"message":      "mfa required",
+				"mfa_required": true,
+				"challenge_id": challenge.ID,
+				"methods":      challenge.Methods,
+				"expires_at":   challenge.ExpiresAt,
+			})
+		}
 	}
 
-	fmt.Printf("👤 Login attempt for username: %s\n", login.Username)
+	log.Info("login successful", slog.String("username", login.Username))
+	return h.completeLogin(c, token)
+}
+
+// POST /login/mfa - İki adımlı girişin ikinci adımı: challenge ve TOTP veya kurtarma kodu
+func (h *AuthHandler) LoginMFAHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	if h.mfa == nil {
+		return apperr.NotFound("mfa_not_enabled", "multi-factor authentication is not enabled")
+	}
 
-	token, err := h.keycloakService.Login(login)
+	body, err := validatedBody[models.LoginMFAParams](c, "login_mfa")
 	if err != nil {
-		fmt.Printf("❌ Keycloak login failed: %v\n", err)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "login failed",
-			"details": err.Error(),
-		})
+		return err
 	}
 
-	fmt.Printf("✅ Login successful!\n")
+	// Codes are checked against the lockout like passwords on /login, so a
+	// locked account cannot keep guessing its second factor.
+	pending, err := h.mfa.ChallengeUser(body.ChallengeID)
+	if err != nil {
+		return err
+	}
+	lockedFor, err := h.limiter.LockedFor(c.Context(), pending.Username)
+	if err != nil {
+		log.Error("lockout check failed", slog.Any("error", err))
+	}
+	if lockedFor > 0 {
+		log.Info("mfa login rejected, account locked", slog.String("username", pending.Username))
+		return ratelimit.AccountLockedError(lockedFor)
+	}
+
+	login, err := h.mfa.CompleteChallenge(c.Context(), body.ChallengeID, body.Code)
+	if err != nil {
+		if login != nil {
+			// Wrong codes count towards the lockout of the password step.
+			if _, err := h.limiter.RecordFailure(c.Context(), login.Username); err != nil {
+				log.Error("recording login failure failed", slog.Any("error", err))
+			}
+		}
+		log.Info("mfa login failed", slog.Any("error", err))
+		return err
+	}
 
-	c.Cookie(&fiber.Cookie{
-		Name:     "access_token",
-		Value:    token.AccessToken,
-		HTTPOnly: true,
-		Secure:   false,
-		SameSite: "Lax",
+	if err := h.limiter.RecordSuccess(c.Context(), login.Username); err != nil {
+		log.Error("recording login success failed", slog.Any("error", err))
+	}
+	if login.Verification.Method == services.FactorRecoveryCode {
+		h.recoveryCodeUsed(c, login)
+	}
+	log.Info("login successful", slog.String("username", login.Username), slog.Bool("mfa", true))
+	return h.completeLogin(c, login.Token)
+}
+
+// recoveryCodeUsed audits the use of a recovery code and tells the user, who
+// should know if someone else used it.
+func (h *AuthHandler) recoveryCodeUsed(c *fiber.Ctx, login *services.MFALogin) {
+	log := logging.FromCtx(c)
+	left := login.Verification.RecoveryCodesLeft
+	logging.Audit(log, services.EventRecoveryCodeUsed,
+		slog.String("user_id", login.UserID),
+		slog.String("username", login.Username),
+		slog.Int("recovery_codes_left", left),
+	)
+
+	err := h.mfa.Notifier.Notify(c.Context(), services.Notification{
+		Event:    services.EventRecoveryCodeUsed,
+		UserID:   login.UserID,
+		Username: login.Username,
+		Email:    login.Email,
+		Time:     time.Now(),
+		Details: map[string]string{
+			"ip":                  c.IP(),
+			"user_agent":          c.Get(fiber.HeaderUserAgent),
+			"recovery_codes_left": strconv.Itoa(left),
+		},
 	})
+	if err != nil {
+		log.Error("notifying user failed", slog.String("user_id", login.UserID), slog.Any("error", err))
+	}
+}
+
+// requireVerifiedEmail rejects a login when verified email addresses are
+// required and the user has not verified theirs. The session the identity
+// provider already started for the login is ended again.
+func (h *AuthHandler) requireVerifiedEmail(c *fiber.Ctx, token *models.LoginResponse) error {
+	if !h.verification.Required {
+		return nil
+	}
+	claims, err := services.UnverifiedClaims(token.AccessToken)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+	if claims.EmailVerified {
+		return nil
+	}
+	h.endProviderSession(c, token)
+	return services.ErrEmailNotVerified
+}
+
+// endProviderSession ends the identity provider session of a login that is
+// rejected after the provider accepted it.
+func (h *AuthHandler) endProviderSession(c *fiber.Ctx, token *models.LoginResponse) {
+	if err := h.identity.Logout(c.Context(), token.RefreshToken); err != nil {
+		logging.FromCtx(c).Warn("ending session of rejected login failed", slog.Any("error", err))
+	}
+}
+
+// startMFAChallenge holds the tokens back when the user has a second factor
+// and returns the challenge to complete instead. It returns nil for users
+// without one.
+func (h *AuthHandler) startMFAChallenge(c *fiber.Ctx, username string, token *models.LoginResponse) (*services.MFAChallenge, error) {
+	// The token comes straight from the identity provider and may already
+	// be expired, so it is not verified again.
+	claims, err := services.UnverifiedClaims(token.AccessToken)
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	enabled, err := h.mfa.Enabled(c.Context(), claims.Subject)
+	if err != nil || !enabled {
+		return nil, err
+	}
+	return h.mfa.StartChallenge(c.Context(), services.MFALogin{
+		UserID:   claims.Subject,
+		Username: strings.ToLower(username),
+		Email:    claims.Email,
+		Token:    token,
+	})
+}
+
+// completeLogin hands the tokens of a finished login to the client, or keeps
+// them in a new session in session mode.
+func (h *AuthHandler) completeLogin(c *fiber.Ctx, token *models.LoginResponse) error {
+	if h.sessions != nil {
+		session, err := startSession(c, h.sessions, h.cookies, token)
+		if err != nil {
+			logging.FromCtx(c).Error("create session failed", slog.Any("error", err))
+			return err
+		}
+		return c.JSON(fiber.Map{
+			"message": "login successful",
+			"session": sessionInfo(h.sessions, session),
+		})
+	}
+
+	setCookies(c, h.cookies.TokenCookies(token))
 
 	return c.JSON(fiber.Map{
 		"message": "login successful",
@@ -81,42 +319,43 @@ func (h *AuthHandler) LoginHandler(c *fiber.Ctx) error {
 }
 
 func (h *AuthHandler) LogoutHandler(c *fiber.Ctx) error {
-	fmt.Printf("👋 LogoutHandler called\n")
-
-	var body struct {
-		RefreshToken string `json:"refresh_token"`
-	}
+	log := logging.FromCtx(c)
 
-	if err := c.BodyParser(&body); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid request body",
+	if sessionID := c.Cookies("session_id"); h.sessions != nil && sessionID != "" {
+		if err := h.sessions.End(c.Context(), sessionID); err != nil {
+			log.Warn("session logout failed", slog.Any("error", err))
+		}
+		c.Cookie(h.cookies.Cookie("session_id", "", -1))
+		return c.JSON(fiber.Map{
+			"message": "logout successful",
 		})
 	}
 
-	if body.RefreshToken == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "refresh token not provided",
-		})
-	}
+	// The cookies are cleared whatever happens below, so the client is
+	// logged out even when there is no session left to end.
+	setCookies(c, h.cookies.ClearTokenCookies())
 
-	err := h.keycloakService.Logout(body.RefreshToken)
+	refreshToken, _, err := refreshTokenFrom(c)
 	if err != nil {
-		// Log the error but still try to clear cookies and log the user out on the client side
-		fmt.Printf("⚠️ Keycloak logout failed: %v\n", err)
+		return err
 	}
 
-	c.Cookie(&fiber.Cookie{
-		Name:     "access_token",
-		Value:    "",
-		HTTPOnly: true,
-		MaxAge:   -1,
-	})
-	c.Cookie(&fiber.Cookie{
-		Name:     "refresh_token",
-		Value:    "",
-		HTTPOnly: true,
-		MaxAge:   -1,
-	})
+	switch accessToken := c.Cookies("access_token"); {
+	case refreshToken != "":
+		err = h.identity.Logout(c.Context(), refreshToken)
+	case accessToken != "":
+		// Browsers do not send the refresh_token cookie here (its path is
+		// the refresh endpoint), so end the session the access token names.
+		err = h.revokeTokenSession(c, accessToken)
+	default:
+		// The access_token cookie expired with the token and the browser
+		// sent nothing; the Keycloak session ends with its refresh token.
+		log.Debug("logout without tokens, nothing to revoke")
+	}
+	if err != nil {
+		// Log the error but still log the user out on the client side
+		log.Warn("keycloak logout failed", slog.Any("error", err))
+	}
 
 	return c.JSON(fiber.Map{
 		"message": "logout successful",
@@ -124,164 +363,133 @@ func (h *AuthHandler) LogoutHandler(c *fiber.Ctx) error {
 }
 
 func (h *AuthHandler) GetProfileHandler(c *fiber.Ctx) error {
-	fmt.Printf("👤 GetProfileHandler called\n")
-	
+	log := logging.FromCtx(c)
+
 	token := c.Cookies("access_token")
+	if sessionID := c.Cookies("session_id"); h.sessions != nil && sessionID != "" {
+		session, err := h.sessions.Get(c.Context(), sessionID)
+		if err != nil {
+			return err
+		}
+		token = session.AccessToken
+	}
 	if token == "" {
 		authHeader := c.Get("Authorization")
 		if authHeader == "" {
-			fmt.Printf("❌ No access token provided\n")
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "no access token provided",
-			})
+			log.Debug("no access token provided")
+			return apperr.Unauthorized("authentication_required", "no access token provided")
 		}
 		
 		parts := strings.Split(authHeader, " ")
 		if len(parts) != 2 || parts[0] != "Bearer" {
-			fmt.Printf("❌ Invalid authorization header format\n")
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "invalid authorization header format",
-			})
+			log.Debug("invalid authorization header format")
+			return apperr.Unauthorized("invalid_authorization_header", "invalid authorization header format")
 		}
 		token = parts[1]
 	}
 
-	fmt.Printf("🔍 Getting user profile with token\n")
-
-	user, err := h.keycloakService.GetUserProfile(token)
+	user, err := h.identity.GetUserProfile(c.Context(), token)
 	if err != nil {
-		fmt.Printf("❌ Get user profile failed: %v\n", err)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "invalid or expired token",
-			"details": err.Error(),
-		})
+		log.Info("get user profile failed", slog.Any("error", err))
+		return err
 	}
 
-	fmt.Printf("✅ User profile retrieved successfully\n")
 	return c.JSON(user)
 }
 
 func (h *AuthHandler) RegisterHandler(c *fiber.Ctx) error {
-	fmt.Printf("📝 RegisterHandler called\n")
-	
-	registerData := c.Locals("register")
-	if registerData == nil {
-		fmt.Printf("❌ No register data in locals\n")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "register data not found in request",
-		})
-	}
-	
-	register, ok := registerData.(models.RegisterParams)
-	if !ok {
-		fmt.Printf("❌ Register data type assertion failed\n")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid register data format",
-		})
+	log := logging.FromCtx(c)
+
+	register, err := validatedBody[models.RegisterParams](c, "register")
+	if err != nil {
+		return err
 	}
 
-	fmt.Printf("📧 Registration attempt for email: %s, username: %s\n", register.Email, register.Username)
+	if err := h.passwords.Validate("password", register.Password, register.Username, register.Email); err != nil {
+		log.Info("registration rejected by password policy", slog.String("username", register.Username))
+		return err
+	}
 
-	err := h.keycloakService.Register(register)
-	if err != nil {
-		fmt.Printf("❌ Registration failed: %v\n", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "user creation failed",
-			"details": err.Error(),
-		})
+	if err := h.identity.Register(c.Context(), register); err != nil {
+		log.Error("registration failed", slog.String("username", register.Username), slog.String("email", register.Email), slog.Any("error", err))
+		return err
 	}
+	log.Info("user registered", slog.String("username", register.Username))
 
-	fmt.Printf("✅ Registration successful!\n")
-	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+	response := fiber.Map{
 		"message": "user registered successfully",
-	})
+	}
+	// The account exists either way, so a failed email only gets a
+	// warning: the user can request a new one.
+	if err := h.identity.SendVerificationEmail(c.Context(), register.Email); err != nil {
+		log.Warn("sending verification email failed", slog.String("username", register.Username), slog.Any("error", err))
+		response["warnings"] = []fiber.Map{{
+			"code":    "verification_email_not_sent",
+			"message": "the verification email could not be sent, request a new one from /api/v1/email/verify/resend",
+		}}
+	}
+	return c.Status(fiber.StatusCreated).JSON(response)
 }
 
 // USER MANAGEMENT ENDPOINTS
 
 // GET /user/:id - Belirli bir kullanıcıyı ID ile getir (Admin işlemi)
 func (h *AuthHandler) GetUserHandler(c *fiber.Ctx) error {
-	fmt.Printf("👥 GetUserHandler called\n")
-	
+	log := logging.FromCtx(c)
+
 	// Token kontrolü
 	token := c.Locals("access_token")
 	if token == nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "authentication required",
-		})
+		return errAuthenticationRequired
 	}
 
 	userIDVal := c.Locals("userID")
 	userID, ok := userIDVal.(string)
 	if !ok || userID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "user ID is required",
-		})
+		return apperr.Validation("missing_user_id", "user ID is required")
 	}
 
-	fmt.Printf("🔍 Getting user by ID: %s\n", userID)
-
-	user, err := h.keycloakService.GetUserByID(userID)
+	user, err := h.identity.GetUserByID(c.Context(), userID)
 	if err != nil {
-		fmt.Printf("❌ Get user by ID failed: %v\n", err)
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": "user not found",
-			"details": err.Error(),
-		})
+		log.Info("get user by ID failed", slog.String("user_id", userID), slog.Any("error", err))
+		return err
 	}
 
-	fmt.Printf("✅ User retrieved successfully\n")
 	return c.JSON(user)
 }
 
 // PUT /user/:id - Belirli bir kullanıcıyı güncelle
 func (h *AuthHandler) UpdateHandler(c *fiber.Ctx) error {
-	fmt.Printf("✏️ UpdateHandler called\n")
-	
+	log := logging.FromCtx(c)
+
 	// Token kontrolü
 	token := c.Locals("access_token")
 	if token == nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "authentication required",
-		})
+		return errAuthenticationRequired
 	}
 
 	userIDVal := c.Locals("userID")
 	userID, ok := userIDVal.(string)
 	if !ok || userID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "user ID is required",
-		})
+		return apperr.Validation("missing_user_id", "user ID is required")
 	}
 
-	var userPayload models.UserPayload
-	if err := c.BodyParser(&userPayload); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid request body",
-			"details": err.Error(),
-		})
+	userPayload, err := validatedBody[models.UserPayload](c, "user")
+	if err != nil {
+		return err
 	}
-
-	fmt.Printf("🔄 Updating user ID: %s\n", userID)
-
-	user := gocloak.User{
-		ID:        gocloak.StringP(userID),
-		FirstName: gocloak.StringP(userPayload.Firstname),
-		LastName:  gocloak.StringP(userPayload.Lastname),
-		Username:  gocloak.StringP(userPayload.Username),
-		Email:     gocloak.StringP(userPayload.Email),
+	user, err := userUpdate(userID, userPayload)
+	if err != nil {
+		return err
 	}
 
-	err := h.keycloakService.UpdateUser(userID, user)
+	err = h.identity.UpdateUser(c.Context(), userID, user)
 	if err != nil {
-		fmt.Printf("❌ Update user failed: %v\n", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "update failed",
-			"details": err.Error(),
-		})
+		log.Error("update user failed", slog.String("user_id", userID), slog.Any("error", err))
+		return err
 	}
 
-	fmt.Printf("✅ User updated successfully\n")
+	log.Info("user updated", slog.String("user_id", userID))
 	return c.JSON(fiber.Map{
 		"message": "user updated successfully",
 	})
@@ -289,36 +497,27 @@ func (h *AuthHandler) UpdateHandler(c *fiber.Ctx) error {
 
 // DELETE /user/:id - Belirli bir kullanıcıyı sil
 func (h *AuthHandler) DeleteHandler(c *fiber.Ctx) error {
-	fmt.Printf("🗑️ DeleteHandler called\n")
-	
+	log := logging.FromCtx(c)
+
 	// Token kontrolü
 	token := c.Locals("access_token")
 	if token == nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "authentication required",
-		})
+		return errAuthenticationRequired
 	}
 
 	userIDVal := c.Locals("userID")
 	userID, ok := userIDVal.(string)
 	if !ok || userID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "user ID is required",
-		})
+		return apperr.Validation("missing_user_id", "user ID is required")
 	}
 
-	fmt.Printf("🗑️ Deleting user ID: %s\n", userID)
-
-	err := h.keycloakService.DeleteUser(userID)
+	err := h.identity.DeleteUser(c.Context(), userID)
 	if err != nil {
-		fmt.Printf("❌ Delete user failed: %v\n", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "delete failed",
-			"details": err.Error(),
-		})
+		log.Error("delete user failed", slog.String("user_id", userID), slog.Any("error", err))
+		return err
 	}
 
-	fmt.Printf("✅ User deleted successfully\n")
+	log.Info("user deleted", slog.String("user_id", userID))
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "user deleted successfully",
 	})
@@ -328,91 +527,70 @@ func (h *AuthHandler) DeleteHandler(c *fiber.Ctx) error {
 
 // GET /user/me - Giriş yapmış kullanıcının kendi bilgilerini getir
 func (h *AuthHandler) GetCurrentUserHandler(c *fiber.Ctx) error {
-	fmt.Printf("👤 GetCurrentUserHandler called\n")
-	
+	log := logging.FromCtx(c)
+
 	token := c.Locals("access_token")
 	if token == nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "authentication required",
-		})
+		return errAuthenticationRequired
 	}
 
 	tokenStr, ok := token.(string)
 	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "invalid token format",
-		})
+		return apperr.Unauthorized("invalid_token", "invalid token format")
 	}
 
-	fmt.Printf("🔍 Getting current user profile\n")
-
-	user, err := h.keycloakService.GetUserProfile(tokenStr)
+	user, err := h.identity.GetUserProfile(c.Context(), tokenStr)
 	if err != nil {
-		fmt.Printf("❌ Get current user failed: %v\n", err)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "invalid or expired token",
-			"details": err.Error(),
-		})
+		log.Info("get current user failed", slog.Any("error", err))
+		return err
 	}
 
-	fmt.Printf("✅ Current user profile retrieved successfully\n")
-	return c.JSON(user)
+	return c.JSON(currentUser{User: user, EmailVerified: gocloak.PBool(user.EmailVerified)})
+}
+
+// currentUser is the user representation of the identity provider plus
+// email_verified, which the frontend uses to offer a new verification email.
+type currentUser struct {
+	*gocloak.User
+	EmailVerified bool `json:"email_verified"`
 }
 
 // PUT /user/me - Giriş yapmış kullanıcının kendi bilgilerini güncelle
 func (h *AuthHandler) UpdateCurrentUserHandler(c *fiber.Ctx) error {
-	fmt.Printf("✏️ UpdateCurrentUserHandler called\n")
-	
+	log := logging.FromCtx(c)
+
 	token := c.Locals("access_token")
 	if token == nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "authentication required",
-		})
+		return errAuthenticationRequired
 	}
 
 	tokenStr, ok := token.(string)
 	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "invalid token format",
-		})
+		return apperr.Unauthorized("invalid_token", "invalid token format")
 	}
 
 	// Önce kullanıcının kendi ID'sini al
-	userProfile, err := h.keycloakService.GetUserProfile(tokenStr)
+	userProfile, err := h.identity.GetUserProfile(c.Context(), tokenStr)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "invalid or expired token",
-		})
+		return err
 	}
 
-	var userPayload models.UserPayload
-	if err := c.BodyParser(&userPayload); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid request body",
-			"details": err.Error(),
-		})
+	userPayload, err := validatedBody[models.UserPayload](c, "user")
+	if err != nil {
+		return err
 	}
-
-	fmt.Printf("🔄 Updating current user\n")
-
-	user := gocloak.User{
-		ID:        userProfile.ID,
-		FirstName: gocloak.StringP(userPayload.Firstname),
-		LastName:  gocloak.StringP(userPayload.Lastname),
-		Username:  gocloak.StringP(userPayload.Username),
-		Email:     gocloak.StringP(userPayload.Email),
+	user, err := userUpdate(*userProfile.ID, userPayload)
+	if err != nil {
+		return err
 	}
 
-	err = h.keycloakService.UpdateUser(*userProfile.ID, user)
+	err = h.identity.UpdateUser(c.Context(), *userProfile.ID, user)
 	if err != nil {
-		fmt.Printf("❌ Update current user failed: %v\n", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "update failed",
-			"details": err.Error(),
-		})
+		log.Error("update current user failed", slog.String("user_id", *userProfile.ID), slog.Any("error", err))
+		return err
 	}
 
-	fmt.Printf("✅ Current user updated successfully\n")
+	log.Info("current user updated", slog.String("user_id", *userProfile.ID))
 	return c.JSON(fiber.Map{
 		"message": "profile updated successfully",
 	})
@@ -420,93 +598,346 @@ func (h *AuthHandler) UpdateCurrentUserHandler(c *fiber.Ctx) error {
 
 // DELETE /user/me - Giriş yapmış kullanıcının kendi hesabını sil
 func (h *AuthHandler) DeleteCurrentUserHandler(c *fiber.Ctx) error {
-	fmt.Printf("🗑️ DeleteCurrentUserHandler called\n")
-	
+	log := logging.FromCtx(c)
+
 	token := c.Locals("access_token")
 	if token == nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "authentication required",
-		})
+		return errAuthenticationRequired
 	}
 
 	tokenStr, ok := token.(string)
 	if !ok {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "invalid token format",
-		})
+		return apperr.Unauthorized("invalid_token", "invalid token format")
 	}
 
 	// Önce kullanıcının kendi ID'sini al
-	userProfile, err := h.keycloakService.GetUserProfile(tokenStr)
+	userProfile, err := h.identity.GetUserProfile(c.Context(), tokenStr)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "invalid or expired token",
-		})
+		return err
 	}
 
-	fmt.Printf("🗑️ Deleting current user account\n")
-
-	err = h.keycloakService.DeleteUser(*userProfile.ID)
+	err = h.identity.DeleteUser(c.Context(), *userProfile.ID)
 	if err != nil {
-		fmt.Printf("❌ Delete current user failed: %v\n", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "delete failed",
-			"details": err.Error(),
-		})
+		log.Error("delete current user failed", slog.String("user_id", *userProfile.ID), slog.Any("error", err))
+		return err
 	}
 
-	// Hesap silindikten sonra cookie'yi de temizle
-	c.Cookie(&fiber.Cookie{
-		Name:     "access_token",
-		Value:    "",
-		HTTPOnly: true,
-		MaxAge:   -1,
-	})
+	// Hesap silindikten sonra cookie'leri ve sunucu tarafı oturumu da temizle
+	setCookies(c, h.cookies.ClearTokenCookies())
+	if session, ok := c.Locals("session").(*services.Session); ok && h.sessions != nil {
+		if err := h.sessions.Delete(c.Context(), session.ID); err != nil {
+			log.Warn("delete session failed", slog.Any("error", err))
+		}
+		c.Cookie(h.cookies.Cookie("session_id", "", -1))
+	}
 
-	fmt.Printf("✅ Current user account deleted successfully\n")
+	log.Info("current user deleted account", slog.String("user_id", *userProfile.ID))
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"message": "account deleted successfully",
 	})
 }
 
-func (h *AuthHandler) RefreshTokenHandler(c *fiber.Ctx) error {
-	fmt.Printf("🔄 RefreshTokenHandler called\n")
+// PUT /user/me/password - Giriş yapmış kullanıcının şifresini değiştir
+func (h *AuthHandler) ChangePasswordHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
 
-	var body struct {
-		RefreshToken string `json:"refresh_token"`
+	claims, ok := c.Locals("claims").(*services.TokenClaims)
+	if !ok || claims == nil {
+		return errAuthenticationRequired
 	}
 
-	if err := c.BodyParser(&body); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid request body",
-		})
+	body, err := validatedBody[models.ChangePasswordParams](c, "change_password")
+	if err != nil {
+		return err
 	}
 
-	if body.RefreshToken == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "refresh token not provided",
-		})
+	if err := h.passwords.Validate("new_password", body.NewPassword, claims.PreferredUsername, claims.Email); err != nil {
+		log.Info("new password rejected by password policy", slog.String("user_id", claims.Subject))
+		return err
 	}
 
+	keepSessionID := ""
+	if body.RevokeOtherSessions {
+		keepSessionID = claims.SessionID
+	}
 
-token, err := h.keycloakService.RefreshToken(body.RefreshToken)
+	err = h.identity.ChangePassword(c.Context(), claims.Subject, claims.PreferredUsername, body.CurrentPassword, body.NewPassword, keepSessionID)
 	if err != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error":   "failed to refresh token",
-			"details": err.Error(),
-		})
+		log.Info("change password failed", slog.String("user_id", claims.Subject), slog.Any("error", err))
+		return err
+	}
+
+	log.Info("password changed", slog.String("user_id", claims.Subject))
+	return c.JSON(fiber.Map{
+		"message": "password changed successfully",
+	})
+}
+
+// GET /user/me/sessions - Giriş yapmış kullanıcının aktif oturumlarını listele
+func (h *AuthHandler) ListSessionsHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	claims, ok := c.Locals("claims").(*services.TokenClaims)
+	if !ok || claims == nil {
+		return errAuthenticationRequired
+	}
+
+	sessions, err := h.identity.GetUserSessions(c.Context(), claims.Subject)
+	if err != nil {
+		log.Error("list sessions failed", slog.String("user_id", claims.Subject), slog.Any("error", err))
+		return err
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == claims.SessionID
+	}
+
+	return c.JSON(fiber.Map{
+		"sessions": sessions,
+	})
+}
+
+// DELETE /user/me/sessions/:sid - Belirli bir oturumu sonlandır
+func (h *AuthHandler) RevokeSessionHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	claims, ok := c.Locals("claims").(*services.TokenClaims)
+	if !ok || claims == nil {
+		return errAuthenticationRequired
+	}
+
+	sessionID := c.Params("sid")
+	if sessionID == "" {
+		return apperr.Validation("missing_session_id", "session ID is required")
 	}
 
-	c.Cookie(&fiber.Cookie{
-		Name:     "access_token",
-		Value:    token.AccessToken,
-		HTTPOnly: true,
-		Secure:   false, 
-		SameSite: "Lax",
+	err := h.identity.RevokeUserSession(c.Context(), claims.Subject, sessionID)
+	if err != nil {
+		log.Info("revoke session failed", slog.String("user_id", claims.Subject), slog.String("session_id", sessionID), slog.Any("error", err))
+		return err
+	}
+
+	log.Info("session revoked", slog.String("user_id", claims.Subject), slog.String("session_id", sessionID))
+	return c.JSON(fiber.Map{
+		"message": "session revoked successfully",
 	})
+}
+
+// DELETE /user/me/sessions - Mevcut oturum hariç her yerden çıkış yap
+func (h *AuthHandler) RevokeOtherSessionsHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	claims, ok := c.Locals("claims").(*services.TokenClaims)
+	if !ok || claims == nil {
+		return errAuthenticationRequired
+	}
+
+	if claims.SessionID == "" {
+		return apperr.Validation("session_unknown", "current session could not be determined from token")
+	}
+
+	err := h.identity.RevokeOtherSessions(c.Context(), claims.Subject, claims.SessionID)
+	if err != nil {
+		log.Error("revoke other sessions failed", slog.String("user_id", claims.Subject), slog.Any("error", err))
+		return err
+	}
+
+	log.Info("other sessions revoked", slog.String("user_id", claims.Subject))
+	return c.JSON(fiber.Map{
+		"message": "all other sessions revoked successfully",
+	})
+}
+
+func (h *AuthHandler) RefreshTokenHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	if sessionID := c.Cookies("session_id"); h.sessions != nil && sessionID != "" {
+		session, err := h.sessions.Get(c.Context(), sessionID)
+		if err == nil {
+			err = h.sessions.Refresh(c.Context(), session)
+		}
+		if err != nil {
+			if errors.Is(err, services.ErrSessionExpired) {
+				c.Cookie(h.cookies.Cookie("session_id", "", -1))
+			}
+			log.Info("session refresh failed", slog.Any("error", err))
+			return err
+		}
+		return c.JSON(fiber.Map{
+			"message": "session refreshed successfully",
+			"session": sessionInfo(h.sessions, session),
+		})
+	}
+
+	refreshToken, fromCookie, err := refreshTokenFrom(c)
+	if err != nil {
+		return err
+	}
+	if refreshToken == "" {
+		return apperr.Validation("missing_fields", "refresh token not provided")
+	}
+
+	token, err := h.identity.RefreshToken(c.Context(), refreshToken)
+	if err != nil {
+		if fromCookie && !errors.Is(err, services.ErrKeycloakUnavailable) {
+			setCookies(c, h.cookies.ClearTokenCookies())
+		}
+		log.Info("token refresh failed", slog.Any("error", err))
+		return err
+	}
+
+	setCookies(c, h.cookies.TokenCookies(token))
 
 	return c.JSON(fiber.Map{
 		"message": "token refreshed successfully",
 		"user":    token,
 	})
 }
+
+// PASSWORD RESET ENDPOINTS
+
+// POST /password/forgot - Şifre sıfırlama emaili gönder
+func (h *AuthHandler) ForgotPasswordHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	body, err := validatedBody[models.ForgotPasswordParams](c, "forgot_password")
+	if err != nil {
+		return err
+	}
+
+	// The response must not reveal whether the account exists, so the
+	// reset runs detached and failures are only logged.
+	// Form bodies point into the request buffer, which is reused.
+	email := strings.Clone(body.Email)
+	h.detach(c, func(ctx context.Context) {
+		if err := h.identity.ForgotPassword(ctx, email); err != nil {
+			log.Error("forgot password failed", slog.Any("error", err))
+		}
+	})
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "if an account exists for this email, a password reset link has been sent",
+	})
+}
+
+// POST /email/verify/resend - E-posta doğrulama bağlantısını yeniden gönder
+func (h *AuthHandler) ResendVerificationEmailHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	body, err := validatedBody[models.ResendVerificationParams](c, "resend_verification")
+	if err != nil {
+		return err
+	}
+	// Cloned, since form bodies point into the reused request buffer.
+	email := strings.ToLower(strings.Clone(body.Email))
+
+	// Throttled per address, so nobody can flood a mailbox from many IPs.
+	allowed, retryAfter, err := h.limiter.Allow(c.Context(), "verify-email-resend:email:"+email, ratelimit.Rule{
+		Limit:  h.verification.ResendLimit,
+		Window: h.verification.ResendWindow,
+	})
+	if err != nil {
+		log.Error("rate limit check failed", slog.Any("error", err))
+	} else if !allowed {
+		return apperr.RateLimited("rate_limited", "too many verification emails requested for this address", retryAfter)
+	}
+
+	// Like /password/forgot, the response must not reveal whether the
+	// account exists or is verified, so the email is sent detached and
+	// failures are only logged.
+	h.detach(c, func(ctx context.Context) {
+		switch err := h.identity.SendVerificationEmail(ctx, email); {
+		case errors.Is(err, services.ErrUserNotFound), errors.Is(err, services.ErrEmailAlreadyVerified):
+			log.Info("verification email not sent", slog.Any("error", err))
+		case err != nil:
+			log.Error("resend verification email failed", slog.Any("error", err))
+		}
+	})
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "if an unverified account exists for this email, a verification link has been sent",
+	})
+}
+
+// POST /password/reset - Sıfırlama token'ı ile yeni şifreyi belirle
+func (h *AuthHandler) ResetPasswordHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	body, err := validatedBody[models.ResetPasswordParams](c, "reset_password")
+	if err != nil {
+		return err
+	}
+
+	// The token does not tell whose password it is, so the username and
+	// email address are left to the realm policy here.
+	if err := h.passwords.Validate("new_password", body.NewPassword); err != nil {
+		log.Info("new password rejected by password policy")
+		return err
+	}
+
+	err = h.identity.ResetPassword(c.Context(), body.Token, body.NewPassword)
+	if err != nil {
+		log.Info("reset password failed", slog.Any("error", err))
+		return err
+	}
+
+	log.Info("password reset completed")
+	return c.JSON(fiber.Map{
+		"message": "password reset successfully",
+	})
+}
+
+// GET /password/policy - Şifre kurallarını döndür (frontend formları için)
+func (h *AuthHandler) PasswordPolicyHandler(c *fiber.Ctx) error {
+	return c.JSON(h.passwords.Rules())
+}
+
+// ADMIN ENDPOINTS
+
+// DELETE /admin/lockouts/:username - Kilitlenmiş bir hesabın kilidini kaldır
+func (h *AuthHandler) ClearLockoutHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	username := strings.ToLower(c.Params("username"))
+	if username == "" {
+		return apperr.Validation("missing_username", "username is required")
+	}
+
+	if err := h.limiter.Reset(c.Context(), username); err != nil {
+		return apperr.Internal(fmt.Errorf("clear lockout for %q: %w", username, err))
+	}
+
+	log.Info("lockout cleared", slog.String("username", username))
+	return c.JSON(fiber.Map{
+		"message": "lockout cleared",
+	})
+}
+
+// refreshTokenFrom reads the refresh token from the JSON body or, when the
+// body is empty, from the refresh_token cookie.
+func refreshTokenFrom(c *fiber.Ctx) (refreshToken string, fromCookie bool, err error) {
+	if len(c.Body()) > 0 {
+		var body struct {
+			RefreshToken string `json:"refresh_token"`
+		}
+		if err := c.BodyParser(&body); err != nil {
+			return "", false, apperr.Validation("invalid_body", "invalid request body")
+		}
+		if body.RefreshToken != "" {
+			return body.RefreshToken, false, nil
+		}
+	}
+	refreshToken = c.Cookies("refresh_token")
+	return refreshToken, refreshToken != "", nil
+}
+
+// revokeTokenSession ends the identity provider session an access token
+// belongs to. Expired or foreign tokens are ignored, their cookies are
+// cleared all the same.
+func (h *AuthHandler) revokeTokenSession(c *fiber.Ctx, accessToken string) error {
+	claims, err := h.identity.VerifyToken(c.Context(), accessToken)
+	if err != nil || claims.SessionID == "" {
+		return nil
+	}
+	return h.identity.RevokeUserSession(c.Context(), claims.Subject, claims.SessionID)
+}
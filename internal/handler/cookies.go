@@ -0,0 +1,9 @@
+package handler
+
+import "github.com/gofiber/fiber/v2"
+
+func setCookies(c *fiber.Ctx, cookies []*fiber.Cookie) {
+	for _, cookie := range cookies {
+		c.Cookie(cookie)
+	}
+}
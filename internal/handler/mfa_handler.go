@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"auth-service/internal/logging"
+	"auth-service/internal/models"
+	"auth-service/internal/services"
+	"encoding/base64"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// MFAHandler lets logged in users manage their second factors.
+type MFAHandler struct {
+	mfa *services.MFAService
+}
+
+func NewMFAHandler(mfa *services.MFAService) *MFAHandler {
+	return &MFAHandler{mfa: mfa}
+}
+
+// GET /user/me/mfa - Kullanıcının ikinci faktörlerini listele
+func (h *MFAHandler) ListFactorsHandler(c *fiber.Ctx) error {
+	claims, ok := c.Locals("claims").(*services.TokenClaims)
+	if !ok || claims == nil {
+		return errAuthenticationRequired
+	}
+
+	factors, err := h.mfa.Factors(c.Context(), claims.Subject)
+	if err != nil {
+		return err
+	}
+
+	enabled := false
+	recoveryCodesLeft := 0
+	infos := make([]models.MFAFactorInfo, 0, len(factors))
+	for _, f := range factors {
+		if f.Type == services.FactorRecoveryCode {
+			recoveryCodesLeft = len(f.CodeHashes)
+			continue
+		}
+		enabled = enabled || f.Confirmed
+		infos = append(infos, models.MFAFactorInfo{
+			ID:        f.ID,
+			Type:      f.Type,
+			Label:     f.Label,
+			Confirmed: f.Confirmed,
+			CreatedAt: f.CreatedAt,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"enabled":             enabled,
+		"factors":             infos,
+		"recovery_codes_left": recoveryCodesLeft,
+	})
+}
+
+// POST /user/me/mfa/totp - TOTP kaydını başlat (secret, otpauth URI ve QR kod)
+func (h *MFAHandler) EnrollTOTPHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	claims, ok := c.Locals("claims").(*services.TokenClaims)
+	if !ok || claims == nil {
+		return errAuthenticationRequired
+	}
+
+	body, err := validatedBody[models.EnrollTOTPParams](c, "enroll_totp")
+	if err != nil {
+		return err
+	}
+
+	account := claims.PreferredUsername
+	if claims.Email != "" {
+		account = claims.Email
+	}
+	enrollment, err := h.mfa.BeginTOTP(c.Context(), claims.Subject, account, body.Label)
+	if err != nil {
+		log.Error("totp enrollment failed", slog.String("user_id", claims.Subject), slog.Any("error", err))
+		return err
+	}
+
+	log.Info("totp enrollment started", slog.String("user_id", claims.Subject), slog.String("factor_id", enrollment.FactorID))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"factor_id":   enrollment.FactorID,
+		"secret":      enrollment.Secret,
+		"otpauth_uri": enrollment.URI,
+		"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(enrollment.QRCode),
+	})
+}
+
+// POST /user/me/mfa/totp/:id/confirm - TOTP kaydını uygulamadaki kod ile onayla
+func (h *MFAHandler) ConfirmTOTPHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	claims, ok := c.Locals("claims").(*services.TokenClaims)
+	if !ok || claims == nil {
+		return errAuthenticationRequired
+	}
+
+	body, err := validatedBody[models.MFACodeParams](c, "mfa_code")
+	if err != nil {
+		return err
+	}
+
+	factorID := c.Params("id")
+	recoveryCodes, err := h.mfa.ConfirmTOTP(c.Context(), claims.Subject, factorID, body.Code)
+	if err != nil {
+		log.Info("totp confirmation failed", slog.String("user_id", claims.Subject), slog.Any("error", err))
+		return err
+	}
+
+	log.Info("totp factor confirmed", slog.String("user_id", claims.Subject), slog.String("factor_id", factorID))
+	response := fiber.Map{
+		"message": "mfa enabled",
+	}
+	// The first confirmed factor comes with recovery codes, shown only now.
+	if recoveryCodes != nil {
+		logging.Audit(log, "mfa.recovery_codes_generated", slog.String("user_id", claims.Subject))
+		c.Set(fiber.HeaderCacheControl, "no-store")
+		response["recovery_codes"] = recoveryCodes
+	}
+	return c.JSON(response)
+}
+
+// POST /user/me/mfa/recovery-codes - Kurtarma kodlarını yeniden üret (eskiler geçersiz olur, güncel bir kod gerekir)
+func (h *MFAHandler) RegenerateRecoveryCodesHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	claims, ok := c.Locals("claims").(*services.TokenClaims)
+	if !ok || claims == nil {
+		return errAuthenticationRequired
+	}
+
+	body, err := validatedBody[models.MFAStepUpParams](c, "mfa_step_up")
+	if err != nil {
+		return err
+	}
+	recoveryCodes, err := h.mfa.RegenerateRecoveryCodes(c.Context(), claims.Subject, body.Code)
+	if err != nil {
+		log.Info("regenerate recovery codes failed", slog.String("user_id", claims.Subject), slog.Any("error", err))
+		return err
+	}
+
+	logging.Audit(log, services.EventRecoveryCodesRegenerated, slog.String("user_id", claims.Subject))
+	err = h.mfa.Notifier.Notify(c.Context(), services.Notification{
+		Event:    services.EventRecoveryCodesRegenerated,
+		UserID:   claims.Subject,
+		Username: claims.PreferredUsername,
+		Email:    claims.Email,
+		Time:     time.Now(),
+		Details: map[string]string{
+			"ip":         c.IP(),
+			"user_agent": c.Get(fiber.HeaderUserAgent),
+		},
+	})
+	if err != nil {
+		log.Error("notifying user failed", slog.String("user_id", claims.Subject), slog.Any("error", err))
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(fiber.Map{
+		"recovery_codes": recoveryCodes,
+	})
+}
+
+// DELETE /user/me/mfa/:id - İkinci faktörü kaldır (son faktörle kurtarma kodları da silinir, güncel bir kod gerekir)
+func (h *MFAHandler) RemoveFactorHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	claims, ok := c.Locals("claims").(*services.TokenClaims)
+	if !ok || claims == nil {
+		return errAuthenticationRequired
+	}
+
+	body, err := validatedBody[models.MFAStepUpParams](c, "mfa_step_up")
+	if err != nil {
+		return err
+	}
+	factorID := c.Params("id")
+	if err := h.mfa.RemoveFactor(c.Context(), claims.Subject, factorID, body.Code); err != nil {
+		log.Info("remove mfa factor failed", slog.String("user_id", claims.Subject), slog.Any("error", err))
+		return err
+	}
+
+	log.Info("mfa factor removed", slog.String("user_id", claims.Subject), slog.String("factor_id", factorID))
+	return c.JSON(fiber.Map{
+		"message": "mfa factor removed",
+	})
+}
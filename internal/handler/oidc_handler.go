@@ -0,0 +1,180 @@
+package handler
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/logging"
+	"auth-service/internal/services"
+	"crypto/subtle"
+	"log/slog"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// oidcStateCookie binds a started login to the browser that started it, so
+// a callback URL with someone else's code cannot log the victim in.
+const oidcStateCookie = "oidc_state"
+
+var (
+	errInvalidReturnTo  = apperr.Validation("invalid_return_to", "return_to must be a path on the frontend")
+	errMFALoginRequired = apperr.Forbidden("mfa_login_required", "this account has a second factor, log in with username and password")
+)
+
+// OIDCHandler serves the browser login through Keycloak's login pages. The
+// tokens never reach the frontend's JavaScript, they are only set as
+// HTTP-only cookies (backend-for-frontend). Logins end like password logins:
+// the cookies or the session come from the auth handler.
+type OIDCHandler struct {
+	client            *services.OIDCClient
+	auth              *AuthHandler
+	postLoginRedirect *url.URL
+}
+
+// NewOIDCHandler returns the OIDC login handler.
+func NewOIDCHandler(client *services.OIDCClient, auth *AuthHandler, postLoginRedirect string) (*OIDCHandler, error) {
+	target, err := url.Parse(postLoginRedirect)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCHandler{
+		client:            client,
+		auth:              auth,
+		postLoginRedirect: target,
+	}, nil
+}
+
+// LoginHandler redirects to Keycloak's authorization endpoint. The optional
+// return_to query parameter is a frontend path to land on after login.
+func (h *OIDCHandler) LoginHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	// The value outlives the request in the pending login, so it must not
+	// alias Fiber's request buffer.
+	returnTo := utils.CopyString(c.Query("return_to"))
+	if _, err := h.resolveReturnTo(returnTo); err != nil {
+		return err
+	}
+
+	request, err := h.client.Begin(returnTo)
+	if err != nil {
+		return apperr.Internal(err)
+	}
+
+	c.Cookie(h.stateCookie(c, request.State, int(h.client.StateTTL.Seconds())))
+	log.Debug("oidc login started")
+	return c.Redirect(request.URL, fiber.StatusFound)
+}
+
+// CallbackHandler completes the login Keycloak redirects back with, sets the
+// session cookies and sends the browser on to the frontend. Failures also
+// redirect there, with the problem code in the error query parameter.
+func (h *OIDCHandler) CallbackHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	state := c.Cookies(oidcStateCookie)
+	c.Cookie(h.stateCookie(c, "", -1))
+
+	if errCode := c.Query("error"); errCode != "" {
+		log.Info("oidc login denied", slog.String("error", errCode), slog.String("description", c.Query("error_description")))
+		return h.fail(c, services.ErrAuthorizationDenied)
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(c.Query("state"))) != 1 {
+		return h.fail(c, services.ErrInvalidOIDCState)
+	}
+	code := c.Query("code")
+	if code == "" {
+		return h.fail(c, services.ErrInvalidAuthorizationCode)
+	}
+
+	login, err := h.client.Complete(c.Context(), state, code)
+	if err != nil {
+		return h.fail(c, err)
+	}
+
+	if err := h.auth.requireVerifiedEmail(c, login.Token); err != nil {
+		return h.fail(c, err)
+	}
+
+	// Keycloak's login pages know nothing of the local second factor, so
+	// users who have one must log in through /login and /login/mfa.
+	if h.auth.mfa != nil {
+		enabled, err := h.auth.mfa.Enabled(c.Context(), login.Claims.Subject)
+		if err != nil {
+			h.auth.endProviderSession(c, login.Token)
+			return h.fail(c, err)
+		}
+		if enabled {
+			h.auth.endProviderSession(c, login.Token)
+			return h.fail(c, errMFALoginRequired)
+		}
+	}
+
+	if h.auth.sessions != nil {
+		if _, err := startSession(c, h.auth.sessions, h.auth.cookies, login.Token); err != nil {
+			return h.fail(c, err)
+		}
+	} else {
+		setCookies(c, h.auth.cookies.TokenCookies(login.Token))
+	}
+
+	log.Info("oidc login successful",
+		slog.String("user_id", login.Claims.Subject),
+		slog.String("username", login.Claims.PreferredUsername))
+
+	target, err := h.resolveReturnTo(login.ReturnTo)
+	if err != nil {
+		return h.fail(c, err)
+	}
+	return c.Redirect(target.String(), fiber.StatusFound)
+}
+
+// stateCookie is scoped to the OIDC routes. It is always SameSite=Lax: the
+// callback is a cross-site navigation from Keycloak, which drops Strict
+// cookies.
+func (h *OIDCHandler) stateCookie(c *fiber.Ctx, state string, maxAge int) *fiber.Cookie {
+	cookie := h.auth.cookies.Cookie(oidcStateCookie, state, maxAge)
+	cookie.Path = path.Dir(c.Path())
+	cookie.SameSite = fiber.CookieSameSiteLaxMode
+	return cookie
+}
+
+// resolveReturnTo accepts only paths, so the login cannot be turned into an
+// open redirect to another origin.
+func (h *OIDCHandler) resolveReturnTo(returnTo string) (*url.URL, error) {
+	if returnTo == "" {
+		return h.postLoginRedirect, nil
+	}
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.Contains(returnTo, "\\") {
+		return nil, errInvalidReturnTo
+	}
+	ref, err := url.Parse(returnTo)
+	if err != nil || ref.Scheme != "" || ref.Host != "" {
+		return nil, errInvalidReturnTo
+	}
+	return h.postLoginRedirect.ResolveReference(ref), nil
+}
+
+// fail sends the browser back to the frontend with the error code; a problem
+// document would leave the user on a bare JSON page.
+func (h *OIDCHandler) fail(c *fiber.Ctx, err error) error {
+	log := logging.FromCtx(c)
+
+	appErr, ok := apperr.As(err)
+	if !ok {
+		appErr = apperr.Internal(err)
+	}
+	if appErr.Kind == apperr.KindInternal || appErr.Kind == apperr.KindUpstreamUnavailable {
+		log.Error("oidc login failed", slog.String("error_code", appErr.Code), slog.Any("error", err))
+	} else {
+		log.Info("oidc login failed", slog.String("error_code", appErr.Code), slog.Any("error", err))
+	}
+
+	target := *h.postLoginRedirect
+	query := target.Query()
+	query.Set("error", appErr.Code)
+	target.RawQuery = query.Encode()
+	return c.Redirect(target.String(), fiber.StatusFound)
+}
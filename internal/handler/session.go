@@ -0,0 +1,30 @@
+package handler
+
+import (
+	"auth-service/internal/config"
+	"auth-service/internal/models"
+	"auth-service/internal/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// startSession keeps the tokens of a login in a new server-side session and
+// gives the browser only its ID, in an HTTP-only cookie.
+func startSession(c *fiber.Ctx, sessions *services.SessionManager, cookies config.CookieConfig, token *models.LoginResponse) (*services.Session, error) {
+	session, err := sessions.Create(c.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	c.Cookie(cookies.Cookie("session_id", session.ID, int(sessions.AbsoluteTimeout.Seconds())))
+	return session, nil
+}
+
+// sessionInfo is what clients learn about their session instead of tokens.
+func sessionInfo(sessions *services.SessionManager, session *services.Session) fiber.Map {
+	return fiber.Map{
+		"user_id":      session.UserID,
+		"username":     session.Username,
+		"expires_at":   sessions.ExpiresAt(session),
+		"idle_timeout": int(sessions.IdleTimeout.Seconds()),
+	}
+}
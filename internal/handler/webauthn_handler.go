@@ -0,0 +1,125 @@
+package handler
+
+import (
+	"auth-service/internal/logging"
+	"auth-service/internal/models"
+	"auth-service/internal/services"
+	"encoding/base64"
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// WebAuthnHandler registers passkeys and logs users in with them. Passkey
+// logins end like password logins: completeLogin of the auth handler sets
+// the same cookies or starts the same session.
+type WebAuthnHandler struct {
+	webauthn *services.WebAuthnService
+	auth     *AuthHandler
+}
+
+func NewWebAuthnHandler(webauthn *services.WebAuthnService, auth *AuthHandler) *WebAuthnHandler {
+	return &WebAuthnHandler{webauthn: webauthn, auth: auth}
+}
+
+// POST /webauthn/register/begin - Giriş yapmış kullanıcı için passkey kaydını başlat
+func (h *WebAuthnHandler) RegisterBeginHandler(c *fiber.Ctx) error {
+	claims, ok := c.Locals("claims").(*services.TokenClaims)
+	if !ok || claims == nil {
+		return errAuthenticationRequired
+	}
+
+	ceremony, err := h.webauthn.BeginRegistration(c.Context(), webauthnUser(claims))
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(fiber.Map{
+		"ceremony_id": ceremony.ID,
+		"options":     ceremony.Options,
+	})
+}
+
+// POST /webauthn/register/finish - Tarayıcının cevabını doğrula ve passkey'i kaydet
+func (h *WebAuthnHandler) RegisterFinishHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	claims, ok := c.Locals("claims").(*services.TokenClaims)
+	if !ok || claims == nil {
+		return errAuthenticationRequired
+	}
+
+	body, err := validatedBody[models.WebAuthnFinishParams](c, "webauthn_finish")
+	if err != nil {
+		return err
+	}
+
+	credential, err := h.webauthn.FinishRegistration(c.Context(), webauthnUser(claims), body.CeremonyID, body.Label, body.Credential)
+	if err != nil {
+		log.Info("passkey registration failed", slog.String("user_id", claims.Subject), slog.Any("error", err))
+		return err
+	}
+
+	credentialID := base64.RawURLEncoding.EncodeToString(credential.Credential.ID)
+	log.Info("passkey registered", slog.String("user_id", claims.Subject), slog.String("credential_id", credentialID))
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"message": "passkey registered",
+		"credential": fiber.Map{
+			"id":         credentialID,
+			"label":      credential.Label,
+			"created_at": credential.CreatedAt,
+		},
+	})
+}
+
+// POST /webauthn/login/begin - Şifresiz (passkey) girişi başlat
+func (h *WebAuthnHandler) LoginBeginHandler(c *fiber.Ctx) error {
+	ceremony, err := h.webauthn.BeginLogin(c.Context())
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.JSON(fiber.Map{
+		"ceremony_id": ceremony.ID,
+		"options":     ceremony.Options,
+	})
+}
+
+// POST /webauthn/login/finish - Passkey imzasını doğrula ve girişi tamamla
+func (h *WebAuthnHandler) LoginFinishHandler(c *fiber.Ctx) error {
+	log := logging.FromCtx(c)
+
+	body, err := validatedBody[models.WebAuthnFinishParams](c, "webauthn_finish")
+	if err != nil {
+		return err
+	}
+
+	login, err := h.webauthn.FinishLogin(c.Context(), body.CeremonyID, body.Credential)
+	if err != nil {
+		log.Info("passkey login failed", slog.Any("error", err))
+		return err
+	}
+	if err := h.auth.requireVerifiedEmail(c, login.Token); err != nil {
+		log.Info("login rejected", slog.String("user_id", login.UserID), slog.Any("error", err))
+		return err
+	}
+
+	log.Info("login successful", slog.String("user_id", login.UserID), slog.String("method", "webauthn"))
+	return h.auth.completeLogin(c, login.Token)
+}
+
+// webauthnUser names the account in the authenticator like the TOTP
+// enrollment does: by email, else by username.
+func webauthnUser(claims *services.TokenClaims) services.WebAuthnUser {
+	name := claims.PreferredUsername
+	if claims.Email != "" {
+		name = claims.Email
+	}
+	return services.WebAuthnUser{
+		ID:          claims.Subject,
+		Name:        name,
+		DisplayName: claims.PreferredUsername,
+	}
+}
@@ -0,0 +1,131 @@
+// Package kvstore provides the key-value stores shared by the rate limiter,
+// server-side sessions and idempotency records: MemoryStore for a single
+// instance and RedisStore for any server speaking the Redis protocol. The
+// operations mirror Redis commands (ZADD/ZREMRANGEBYSCORE/ZCARD/ZREM, INCR,
+// SET PX, DEL); each consumer declares the subset it needs.
+package kvstore
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memoryValue struct {
+	value     string
+	events    []time.Time
+	expiresAt time.Time
+}
+
+// MemoryStore keeps values in process memory.
+type MemoryStore struct {
+	mu        sync.Mutex
+	data      map[string]*memoryValue
+	now       func() time.Time
+	lastPurge time.Time
+}
+
+// memoryPurgeInterval bounds how often expired keys are swept.
+const memoryPurgeInterval = time.Minute
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data: make(map[string]*memoryValue),
+		now:  time.Now,
+	}
+}
+
+// Hit drops the events under key older than window and records an event at
+// now unless limit events remain. It reports whether the event was recorded
+// and returns the oldest event time.
+func (s *MemoryStore) Hit(ctx context.Context, key string, now time.Time, window time.Duration, limit int) (bool, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeExpired(now)
+
+	entry := s.entry(key, now)
+	cutoff := now.Add(-window)
+	idx := sort.Search(len(entry.events), func(i int) bool {
+		return entry.events[i].After(cutoff)
+	})
+	entry.events = entry.events[idx:]
+	if len(entry.events) >= limit {
+		return false, entry.events[0], nil
+	}
+	entry.events = append(entry.events, now)
+	entry.expiresAt = now.Add(window)
+	return true, entry.events[0], nil
+}
+
+// Incr increments the counter at key and (re)sets its expiry to ttl.
+func (s *MemoryStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.purgeExpired(now)
+
+	entry := s.entry(key, now)
+	n, _ := strconv.ParseInt(entry.value, 10, 64)
+	n++
+	entry.value = strconv.FormatInt(n, 10)
+	entry.expiresAt = now.Add(ttl)
+	return n, nil
+}
+
+// Get returns the value at key, or "" if it does not exist.
+func (s *MemoryStore) Get(ctx context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.data[key]; ok && !entry.expired(s.now()) {
+		return entry.value, nil
+	}
+	return "", nil
+}
+
+// Set stores value at key for ttl.
+func (s *MemoryStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[key] = &memoryValue{value: value, expiresAt: s.now().Add(ttl)}
+	return nil
+}
+
+// Del removes the keys.
+func (s *MemoryStore) Del(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.data, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) entry(key string, now time.Time) *memoryValue {
+	entry, ok := s.data[key]
+	if !ok || entry.expired(now) {
+		entry = &memoryValue{}
+		s.data[key] = entry
+	}
+	return entry
+}
+
+func (s *MemoryStore) purgeExpired(now time.Time) {
+	if now.Sub(s.lastPurge) < memoryPurgeInterval {
+		return
+	}
+	s.lastPurge = now
+	for key, entry := range s.data {
+		if entry.expired(now) {
+			delete(s.data, key)
+		}
+	}
+}
+
+func (v *memoryValue) expired(now time.Time) bool {
+	return !v.expiresAt.IsZero() && now.After(v.expiresAt)
+}
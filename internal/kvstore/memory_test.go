@@ -0,0 +1,33 @@
+package kvstore
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreHit(t *testing.T) {
+	store := NewMemoryStore()
+	ctx := context.Background()
+	start := time.Unix(1700000000, 0)
+
+	for i := 0; i < 10; i++ {
+		now := start.Add(time.Duration(i) * time.Second)
+		allowed, oldest, err := store.Hit(ctx, "k", now, time.Minute, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed != (i < 3) || !oldest.Equal(start) {
+			t.Fatalf("hit %d: allowed=%v oldest=%s", i, allowed, oldest)
+		}
+	}
+	if n := len(store.data["k"].events); n != 3 {
+		t.Fatalf("%d events kept, want the 3 allowed ones", n)
+	}
+
+	// The first event left the window, making room for one more.
+	allowed, oldest, _ := store.Hit(ctx, "k", start.Add(time.Minute+time.Millisecond), time.Minute, 3)
+	if !allowed || !oldest.Equal(start.Add(time.Second)) {
+		t.Fatalf("allowed=%v oldest=%s after the window moved", allowed, oldest)
+	}
+}
@@ -0,0 +1,283 @@
+package kvstore
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisStore keeps values on any server speaking the Redis protocol (Redis,
+// Valkey, KeyDB or a local stand-in). It keeps a single connection and
+// reconnects lazily after errors.
+type RedisStore struct {
+	Addr        string
+	Password    string
+	DialTimeout time.Duration
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+func NewRedisStore(addr string, password string) *RedisStore {
+	return &RedisStore{
+		Addr:        addr,
+		Password:    password,
+		DialTimeout: 5 * time.Second,
+	}
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// Hit adds the event first and takes it back when it exceeds the limit: the
+// transaction makes the count each caller sees exact, so of concurrent hits
+// only those beyond the limit are removed again.
+func (s *RedisStore) Hit(ctx context.Context, key string, now time.Time, window time.Duration, limit int) (bool, time.Time, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return false, time.Time{}, err
+	}
+	nowMicro := now.UnixMicro()
+	cutoff := now.Add(-window).UnixMicro()
+	member := strconv.FormatInt(nowMicro, 10) + "-" + hex.EncodeToString(random)
+
+	replies, err := s.transaction(ctx,
+		[]string{"ZREMRANGEBYSCORE", key, "-inf", strconv.FormatInt(cutoff, 10)},
+		[]string{"ZADD", key, strconv.FormatInt(nowMicro, 10), member},
+		[]string{"ZCARD", key},
+		[]string{"ZRANGE", key, "0", "0", "WITHSCORES"},
+		[]string{"PEXPIRE", key, strconv.FormatInt(window.Milliseconds(), 10)},
+	)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+
+	count, ok := replies[2].(int64)
+	if !ok {
+		return false, time.Time{}, fmt.Errorf("redis: unexpected ZCARD reply %v", replies[2])
+	}
+	oldest := now
+	if first, ok := replies[3].([]interface{}); ok && len(first) == 2 {
+		if score, ok := first[1].(string); ok {
+			if micro, err := strconv.ParseFloat(score, 64); err == nil {
+				oldest = time.UnixMicro(int64(micro))
+			}
+		}
+	}
+	if count <= int64(limit) {
+		return true, oldest, nil
+	}
+	if _, err := s.do(ctx, "ZREM", key, member); err != nil {
+		return false, time.Time{}, err
+	}
+	return false, oldest, nil
+}
+
+func (s *RedisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	replies, err := s.transaction(ctx,
+		[]string{"INCR", key},
+		[]string{"PEXPIRE", key, strconv.FormatInt(ttl.Milliseconds(), 10)},
+	)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := replies[0].(int64)
+	if !ok {
+		return 0, fmt.Errorf("redis: unexpected INCR reply %v", replies[0])
+	}
+	return n, nil
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) (string, error) {
+	reply, err := s.do(ctx, "GET", key)
+	if err != nil || reply == nil {
+		return "", err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return "", fmt.Errorf("redis: unexpected GET reply %v", reply)
+	}
+	return value, nil
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	_, err := s.do(ctx, "SET", key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (s *RedisStore) Del(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	_, err := s.do(ctx, append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+// transaction runs the commands atomically in MULTI/EXEC and returns the
+// replies of the individual commands.
+func (s *RedisStore) transaction(ctx context.Context, commands ...[]string) ([]interface{}, error) {
+	all := make([][]string, 0, len(commands)+2)
+	all = append(all, []string{"MULTI"})
+	all = append(all, commands...)
+	all = append(all, []string{"EXEC"})
+
+	replies, err := s.pipeline(ctx, all...)
+	if err != nil {
+		return nil, err
+	}
+	exec, ok := replies[len(replies)-1].([]interface{})
+	if !ok || len(exec) != len(commands) {
+		return nil, errors.New("redis: transaction aborted")
+	}
+	for _, reply := range exec {
+		if err, ok := reply.(redisError); ok {
+			return nil, err
+		}
+	}
+	return exec, nil
+}
+
+func (s *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	replies, err := s.pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+func (s *RedisStore) pipeline(ctx context.Context, commands ...[]string) ([]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.connect(ctx); err != nil {
+		return nil, err
+	}
+
+	replies, err := s.roundTrip(ctx, commands)
+	if err != nil {
+		// The connection state is unknown after an I/O error, start over.
+		s.conn.Close()
+		s.conn = nil
+		return nil, err
+	}
+	for _, reply := range replies {
+		if err, ok := reply.(redisError); ok {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+func (s *RedisStore) connect(ctx context.Context) error {
+	if s.conn != nil {
+		return nil
+	}
+
+	dialer := net.Dialer{Timeout: s.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return fmt.Errorf("redis: connect failed: %w", err)
+	}
+	s.conn = conn
+	s.rd = bufio.NewReader(conn)
+
+	if s.Password != "" {
+		replies, err := s.roundTrip(ctx, [][]string{{"AUTH", s.Password}})
+		if err == nil {
+			if authErr, ok := replies[0].(redisError); ok {
+				err = authErr
+			}
+		}
+		if err != nil {
+			conn.Close()
+			s.conn = nil
+			return fmt.Errorf("redis: auth failed: %w", err)
+		}
+	}
+	return nil
+}
+
+func (s *RedisStore) roundTrip(ctx context.Context, commands [][]string) ([]interface{}, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+	} else {
+		s.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+
+	w := bufio.NewWriter(s.conn)
+	for _, args := range commands {
+		fmt.Fprintf(w, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := readReply(s.rd)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// readReply decodes one RESP value. Errors are returned as redisError
+// values, not as Go errors, so the connection stays usable.
+func readReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, errors.New("redis: short reply")
+	}
+	payload := line[1 : len(line)-2]
+
+	switch line[0] {
+	case '+':
+		return payload, nil
+	case '-':
+		return redisError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(payload)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readReply(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+	}
+}
@@ -0,0 +1,185 @@
+package logging
+
+import (
+	"auth-service/internal/apperr"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const redacted = "[REDACTED]"
+
+// secretKeys are attribute/field names whose values must never be logged.
+// Matching is case-insensitive; keys ending in one of secretSuffixes are
+// treated the same way.
+var (
+	secretKeys = map[string]bool{
+		"password":      true,
+		"secret":        true,
+		"client_secret": true,
+		"token":         true,
+		"authorization": true,
+		"cookie":        true,
+		"set-cookie":    true,
+		"code":          true,
+		"totp":          true,
+		"otp":           true,
+		"recovery_code": true,
+	}
+	secretSuffixes = []string{"password", "_token", "_secret", "token"}
+)
+
+// IsSecret reports whether values stored under key must be redacted.
+func IsSecret(key string) bool {
+	key = strings.ToLower(key)
+	if secretKeys[key] {
+		return true
+	}
+	for _, suffix := range secretSuffixes {
+		if strings.HasSuffix(key, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Options configures the logger built by New.
+type Options struct {
+	// Level is debug, info, warn or error.
+	Level string
+	// Format is json or text.
+	Format string
+}
+
+// New builds a slog logger that redacts secret attributes.
+func New(w io.Writer, opts Options) *slog.Logger {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+
+	handlerOpts := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if IsSecret(a.Key) {
+				return slog.String(a.Key, redacted)
+			}
+			return a
+		},
+	}
+
+	if opts.Format == "text" {
+		return slog.New(slog.NewTextHandler(w, handlerOpts))
+	}
+	return slog.New(slog.NewJSONHandler(w, handlerOpts))
+}
+
+// RedactBody returns a loggable version of a request body: JSON bodies
+// with every secret field replaced, anything else omitted.
+func RedactBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return "[non-JSON body omitted]"
+	}
+	out, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return "[body omitted]"
+	}
+	return string(out)
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if IsSecret(key) {
+				v[key] = redacted
+				continue
+			}
+			v[key] = redactValue(item)
+		}
+		return v
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// Middleware attaches a request-scoped logger (request_id, method, path, ip)
+// to every request and writes one access log line when it completes. At
+// debug level the redacted request body is logged as well.
+func Middleware(logger *slog.Logger) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		start := time.Now()
+
+		requestID := c.Get(fiber.HeaderXRequestID)
+		if requestID == "" || len(requestID) > 128 {
+			requestID = newRequestID()
+		}
+		c.Set(fiber.HeaderXRequestID, requestID)
+
+		reqLogger := logger.With(
+			slog.String("request_id", requestID),
+			slog.String("method", c.Method()),
+			slog.String("path", c.Path()),
+			slog.String("ip", c.IP()),
+		)
+		c.Locals("logger", reqLogger)
+
+		if reqLogger.Enabled(c.Context(), slog.LevelDebug) && len(c.Body()) > 0 {
+			reqLogger.Debug("request body",
+				slog.String("content_type", c.Get(fiber.HeaderContentType)),
+				slog.String("body", RedactBody(c.Body())),
+			)
+		}
+
+		err := c.Next()
+
+		status := c.Response().StatusCode()
+		if err != nil {
+			status = apperr.Status(err)
+		}
+		reqLogger.Info("request completed",
+			slog.Int("status", status),
+			slog.Duration("duration", time.Since(start)),
+		)
+		return err
+	}
+}
+
+// Audit logs a security relevant event. Audit lines carry audit=true and
+// the event name, so they can be filtered into an audit trail.
+func Audit(logger *slog.Logger, event string, attrs ...any) {
+	logger.Info("audit "+event, append([]any{slog.Bool("audit", true), slog.String("event", event)}, attrs...)...)
+}
+
+// FromCtx returns the request-scoped logger, or the default logger when the
+// logging middleware did not run.
+func FromCtx(c *fiber.Ctx) *slog.Logger {
+	if logger, ok := c.Locals("logger").(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,144 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// logLines decodes the JSON lines written to buf.
+func logLines(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var lines []map[string]interface{}
+	for _, raw := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if raw == "" {
+			continue
+		}
+		var line map[string]interface{}
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", raw, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestIsSecret(t *testing.T) {
+	for _, key := range []string{"password", "new_password", "Authorization", "token", "access_token", "refreshToken", "client_secret", "secret", "cookie", "code", "recovery_code"} {
+		if !IsSecret(key) {
+			t.Errorf("IsSecret(%q) = false, want true", key)
+		}
+	}
+	for _, key := range []string{"username", "email", "user_id", "status", "path", "challenge_id"} {
+		if IsSecret(key) {
+			t.Errorf("IsSecret(%q) = true, want false", key)
+		}
+	}
+}
+
+func TestLoggerRedactsSecretAttributes(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, Options{Level: "info", Format: "json"})
+
+	logger.Info("login",
+		slog.String("username", "ada"),
+		slog.String("password", "analytical-engine"),
+		slog.String("access_token", "eyJhbGciOi"),
+		slog.String("Authorization", "Bearer eyJhbGciOi"),
+		slog.Group("client", slog.String("id", "camp"), slog.String("secret", "s3cret")),
+	)
+
+	out := buf.String()
+	for _, secret := range []string{"analytical-engine", "eyJhbGciOi", "s3cret"} {
+		if strings.Contains(out, secret) {
+			t.Fatalf("log shows %q: %s", secret, out)
+		}
+	}
+	line := logLines(t, &buf)[0]
+	if line["username"] != "ada" || line["password"] != redacted || line["Authorization"] != redacted {
+		t.Fatalf("unexpected log line %v", line)
+	}
+	if client, _ := line["client"].(map[string]interface{}); client["id"] != "camp" || client["secret"] != redacted {
+		t.Fatalf("grouped attributes %v, want only the secret redacted", line["client"])
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	body := `{"username":"ada","password":"analytical-engine","profile":{"email":"ada@example.com","refresh_token":"r1"},"factors":[{"label":"phone","code":"123456"}]}`
+
+	got := RedactBody([]byte(body))
+	var value map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &value); err != nil {
+		t.Fatalf("redacted body %q is not JSON: %v", got, err)
+	}
+	profile := value["profile"].(map[string]interface{})
+	factor := value["factors"].([]interface{})[0].(map[string]interface{})
+	if value["username"] != "ada" || profile["email"] != "ada@example.com" || factor["label"] != "phone" {
+		t.Fatalf("ordinary fields changed: %s", got)
+	}
+	if value["password"] != redacted || profile["refresh_token"] != redacted || factor["code"] != redacted {
+		t.Fatalf("secrets not redacted: %s", got)
+	}
+
+	if got := RedactBody([]byte("password=analytical-engine")); got != "[non-JSON body omitted]" {
+		t.Fatalf("form body logged as %q", got)
+	}
+	if got := RedactBody(nil); got != "" {
+		t.Fatalf("empty body logged as %q", got)
+	}
+}
+
+func TestMiddlewareLogsRedactedBody(t *testing.T) {
+	var buf bytes.Buffer
+	app := fiber.New()
+	app.Use(Middleware(New(&buf, Options{Level: "debug", Format: "json"})))
+	app.Post("/login", func(c *fiber.Ctx) error {
+		FromCtx(c).Info("handler ran", slog.String("token", "eyJhbGciOi"))
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(`{"username":"ada","password":"analytical-engine"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(fiber.HeaderXRequestID, "req-1")
+	if _, err := app.Test(req, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if strings.Contains(out, "analytical-engine") || strings.Contains(out, "eyJhbGciOi") {
+		t.Fatalf("log shows a secret: %s", out)
+	}
+	lines := logLines(t, &buf)
+	if len(lines) != 3 {
+		t.Fatalf("got %d log lines, want body, handler and access lines: %s", len(lines), out)
+	}
+	for _, line := range lines {
+		if line["request_id"] != "req-1" || line["path"] != "/login" {
+			t.Fatalf("line %v lacks the request attributes", line)
+		}
+	}
+	if body, _ := lines[0]["body"].(string); !strings.Contains(body, `"username":"ada"`) || !strings.Contains(body, `"password":"[REDACTED]"`) {
+		t.Fatalf("body logged as %q", body)
+	}
+	if lines[2]["msg"] != "request completed" || lines[2]["status"] != float64(fiber.StatusNoContent) {
+		t.Fatalf("unexpected access line %v", lines[2])
+	}
+}
+
+func TestAudit(t *testing.T) {
+	var buf bytes.Buffer
+	Audit(New(&buf, Options{Format: "json"}), "mfa.factor_removed", slog.String("user_id", "u1"), slog.String("code", "123456"))
+
+	line := logLines(t, &buf)[0]
+	if line["msg"] != "audit mfa.factor_removed" || line["audit"] != true || line["event"] != "mfa.factor_removed" {
+		t.Fatalf("unexpected audit line %v", line)
+	}
+	if line["user_id"] != "u1" || line["code"] != redacted {
+		t.Fatalf("audit attributes %v, want user_id kept and code redacted", line)
+	}
+}
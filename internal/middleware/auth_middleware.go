@@ -1,174 +1,154 @@
 package middleware
 
 import (
-	"auth-service/internal/models"
+	"auth-service/internal/apperr"
+	"auth-service/internal/config"
+	"auth-service/internal/logging"
 	"auth-service/internal/services"
-	"fmt"
+	"errors"
+	"log/slog"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/golang-jwt/jwt/v5"
 )
 
-func LoginMiddleware(c *fiber.Ctx) error {
-	fmt.Printf("🔍 LoginMiddleware called\n")
-	fmt.Printf("   Method: %s\n", c.Method())
-	fmt.Printf("   Path: %s\n", c.Path())
-	fmt.Printf("   Content-Type: %s\n", c.Get("Content-Type"))
-	
-	rawBody := c.Body()
-	fmt.Printf("   Raw Body: %s\n", string(rawBody))
-
-	var login models.LoginParams
-
-	if err := c.BodyParser(&login); err != nil {
-		fmt.Printf("❌ Body parsing failed: %v\n", err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid request body",
-			"details": err.Error(),
-		})
-	}
-
-	fmt.Printf("✅ Parsed login data:\n")
-	fmt.Printf("   Username: %s\n", login.Username)
-	fmt.Printf("   Password: %s\n", "***")
-
-	if login.Username == "" || login.Password == "" {
-		fmt.Printf("❌ Missing required fields\n")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "username and password are required",
-		})
-	}
+var (
+	// errTokenExpired tells the client to renew its tokens. The refresh_token
+	// cookie is scoped to the refresh endpoint and never reaches this
+	// middleware, so browsers call POST /refresh and retry the request.
+	errTokenExpired  = apperr.Unauthorized("token_expired", "access token expired, renew it with POST /api/v1/refresh")
+	errTokenInactive = apperr.Unauthorized("session_expired", "session expired or was revoked, log in again")
+)
 
-	c.Locals("login", login)
-	fmt.Printf("✅ LoginMiddleware completed successfully\n")
-	return c.Next()
+// AuthTokenConfig tunes how NewAuthTokenMiddleware validates access tokens.
+type AuthTokenConfig struct {
+	// Introspect additionally asks the identity provider whether the token is
+	// still active after local verification. Use it on routes that must honour
+	// revocation.
+	Introspect bool
+	// Cookie holds the attributes for clearing the session_id cookie of an
+	// expired session.
+	Cookie config.CookieConfig
+	// Sessions resolves the session_id cookie of session mode logins. When
+	// set, requests carrying that cookie are authenticated with the tokens
+	// held in the session store.
+	Sessions *services.SessionManager
 }
 
-func RegisterMiddleware(c *fiber.Ctx) error {
-	fmt.Printf("🔍 RegisterMiddleware called\n")
-	fmt.Printf("   Method: %s\n", c.Method())
-	fmt.Printf("   Path: %s\n", c.Path())
-	fmt.Printf("   Content-Type: %s\n", c.Get("Content-Type"))
-	
-	rawBody := c.Body()
-	fmt.Printf("   Raw Body: %s\n", string(rawBody))
-
-	var register models.RegisterParams
-
-	if err := c.BodyParser(&register); err != nil {
-		fmt.Printf("❌ Body parsing failed: %v\n", err)
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "invalid request body",
-			"details": err.Error(),
-		})
-	}
-
-	fmt.Printf("✅ Parsed register data:\n")
-	fmt.Printf("   Email: %s\n", register.Email)
-	fmt.Printf("   Username: %s\n", register.Username)
-	fmt.Printf("   Firstname: %s\n", register.Firstname)
-	fmt.Printf("   Lastname: %s\n", register.Lastname)
-	fmt.Printf("   Password: %s\n", "***")
-
-	if register.Email == "" || register.Password == "" || register.Username == "" || register.Firstname == "" || register.Lastname == "" {
-		fmt.Printf("❌ Missing required fields\n")
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "all fields are required",
-			"received": fiber.Map{
-				"email": register.Email,
-				"username": register.Username,
-				"firstname": register.Firstname,
-				"lastname": register.Lastname,
-				"password": "***",
-			},
-		})
+func NewAuthTokenMiddleware(identity services.IdentityProvider, config ...AuthTokenConfig) fiber.Handler {
+	cfg := AuthTokenConfig{}
+	if len(config) > 0 {
+		cfg = config[0]
 	}
 
-	c.Locals("register", register)
-	fmt.Printf("✅ RegisterMiddleware completed successfully\n")
-	return c.Next()
-}
-
-func NewAuthTokenMiddleware(keycloakService *services.KeycloakService) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		fmt.Printf("🔐 AuthTokenMiddleware called for path: %s\n", c.Path())
+		log := logging.FromCtx(c)
+
+		if cfg.Sessions != nil {
+			if sessionID := c.Cookies("session_id"); sessionID != "" {
+				return authenticateSession(c, identity, cfg, sessionID)
+			}
+		}
 
 		// 1. Get access token from header or cookie
 		accessToken := c.Cookies("access_token")
 		if accessToken == "" {
 			authHeader := c.Get("Authorization")
 			if authHeader == "" {
-				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "access token required"})
+				return apperr.Unauthorized("authentication_required", "access token required")
 			}
 			parts := strings.Split(authHeader, " ")
 			if len(parts) != 2 || parts[0] != "Bearer" {
-				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "invalid authorization header format"})
+				return apperr.Unauthorized("invalid_authorization_header", "invalid authorization header format")
 			}
 			accessToken = parts[1]
 		}
 
-		// 2. Introspect the token
+		// 2. Verify the token locally against the realm keys
 		ctx := c.Context()
-		result, err := keycloakService.Gocloak.RetrospectToken(ctx, accessToken, keycloakService.ClientId, keycloakService.ClientSecret, keycloakService.Realm)
+		claims, err := identity.VerifyToken(ctx, accessToken)
 		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "failed to introspect token", "details": err.Error()})
-		}
-
-		// 3. Check if token is active
-		if !*result.Active {
-			fmt.Println("Token is inactive, attempting refresh")
-
-			// 3a. Get refresh token from cookie
-			refreshToken := c.Cookies("refresh_token")
-			if refreshToken == "" {
-				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "session expired, no refresh token found"})
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				return errTokenExpired.WithCause(err)
 			}
+			log.Warn("access token rejected", slog.Any("error", err))
+			return services.ErrInvalidAccessToken.WithCause(err)
+		}
 
-			// 3b. Attempt to refresh the token
-			newTokens, err := keycloakService.RefreshToken(refreshToken)
+		// 3. Optionally check revocation with the identity provider
+		if cfg.Introspect {
+			active, err := identity.IntrospectToken(ctx, accessToken)
 			if err != nil {
-				// Clear cookies if refresh fails
-				c.Cookie(&fiber.Cookie{Name: "access_token", MaxAge: -1})
-				c.Cookie(&fiber.Cookie{Name: "refresh_token", MaxAge: -1})
-				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "session expired, token refresh failed", "details": err.Error()})
+				return err
+			}
+			if !active {
+				log.Debug("access token inactive")
+				return errTokenInactive
 			}
-
-			// 3c. Refresh successful, set new tokens in cookies
-			c.Cookie(&fiber.Cookie{
-				Name:     "access_token",
-				Value:    newTokens.AccessToken,
-				HTTPOnly: true,
-				Secure:   false,
-				SameSite: "Lax",
-			})
-			c.Cookie(&fiber.Cookie{
-				Name:     "refresh_token",
-				Value:    newTokens.RefreshToken,
-				HTTPOnly: true,
-				Secure:   false,
-				SameSite: "Lax",
-			})
-
-			// Use the new access token for the current request
-			c.Locals("access_token", newTokens.AccessToken)
-			fmt.Println("✅ Token refreshed successfully")
-			return c.Next()
 		}
 
-		// 4. Token is active, proceed
+		// 4. Token is valid, proceed
+		c.Locals("claims", claims)
 		c.Locals("access_token", accessToken)
-		fmt.Printf("✅ Token validated and stored in locals\n")
 		return c.Next()
 	}
 }
 
+// authenticateSession continues the request with the tokens of a server-side
+// session. The session manager refreshes them transparently; a session it
+// reports as expired also loses its cookie.
+func authenticateSession(c *fiber.Ctx, identity services.IdentityProvider, cfg AuthTokenConfig, sessionID string) error {
+	log := logging.FromCtx(c)
+	ctx := c.Context()
+
+	session, err := cfg.Sessions.Get(ctx, sessionID)
+	if err != nil {
+		return endSession(c, cfg.Cookie, err)
+	}
+
+	claims, err := identity.VerifyToken(ctx, session.AccessToken)
+	if err != nil {
+		log.Warn("session access token rejected", slog.Any("error", err))
+		return services.ErrInvalidAccessToken.WithCause(err)
+	}
+
+	if cfg.Introspect {
+		active, err := identity.IntrospectToken(ctx, session.AccessToken)
+		if err != nil {
+			return err
+		}
+		if !active {
+			// The refresh token tells whether the whole session was revoked.
+			log.Debug("session access token inactive, attempting refresh")
+			if err := cfg.Sessions.Refresh(ctx, session); err != nil {
+				return endSession(c, cfg.Cookie, err)
+			}
+			if claims, err = identity.VerifyToken(ctx, session.AccessToken); err != nil {
+				return services.ErrInvalidAccessToken.WithCause(err)
+			}
+		}
+	}
+
+	c.Locals("claims", claims)
+	c.Locals("access_token", session.AccessToken)
+	c.Locals("session", session)
+	return c.Next()
+}
+
+func endSession(c *fiber.Ctx, cookies config.CookieConfig, err error) error {
+	if errors.Is(err, services.ErrSessionExpired) {
+		c.Cookie(cookies.Cookie("session_id", "", -1))
+		logging.FromCtx(c).Info("session ended", slog.Any("error", err))
+	}
+	return err
+}
+
 func GetUserMiddleware(c *fiber.Ctx) error {
 	userID := c.Params("id")
 
 	if userID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "user ID is required",
-		})
+		return apperr.Validation("missing_user_id", "user ID is required")
 	}
 
 	c.Locals("userID", userID)
@@ -179,9 +159,7 @@ func UpdateMiddleware(c *fiber.Ctx) error {
 	userID := c.Params("id")
 
 	if userID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "user ID is required",
-		})
+		return apperr.Validation("missing_user_id", "user ID is required")
 	}
 
 	c.Locals("userID", userID)
@@ -192,9 +170,7 @@ func DeleteMiddleware(c *fiber.Ctx) error {
 	userID := c.Params("id")
 
 	if userID == "" {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "user ID is required",
-		})
+		return apperr.Validation("missing_user_id", "user ID is required")
 	}
 
 	c.Locals("userID", userID)
@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/logging"
+	"auth-service/internal/services"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	// IdempotencyHeader carries the client-chosen key of a retryable request.
+	IdempotencyHeader = "Idempotency-Key"
+	// IdempotencyReplayedHeader marks responses replayed from the store.
+	IdempotencyReplayedHeader = "Idempotent-Replayed"
+
+	maxIdempotencyKeyLength = 255
+	// idempotencyLockTTL bounds how long a crashed request blocks its key.
+	idempotencyLockTTL = time.Minute
+)
+
+var (
+	ErrIdempotencyKeyInvalid    = apperr.Validation("invalid_idempotency_key", "Idempotency-Key must be 1 to 255 printable ASCII characters")
+	ErrIdempotencyKeyReused     = apperr.Unprocessable("idempotency_key_reused", "Idempotency-Key was already used with a different request")
+	ErrIdempotencyKeyInProgress = apperr.Conflict("idempotency_request_in_progress", "a request with this Idempotency-Key is still being processed")
+)
+
+// IdempotencyStore keeps idempotency records. kvstore.MemoryStore and
+// kvstore.RedisStore implement it; Incr serves as the lock of a key while
+// its first request runs.
+type IdempotencyStore interface {
+	Get(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	Del(ctx context.Context, keys ...string) error
+}
+
+// idempotencyRecord is the stored outcome of a request.
+type idempotencyRecord struct {
+	Fingerprint string `json:"fingerprint"`
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type"`
+	Body        []byte `json:"body"`
+}
+
+// NewIdempotencyMiddleware makes retries of a request carrying an
+// Idempotency-Key header safe: the first response is stored for ttl and
+// replayed to retries with the same key, and the same key with a different
+// request is rejected. Server errors and rate limits are not stored, so
+// those requests can be retried for real. Requests without the header pass
+// through.
+//
+// Keys are scoped to the route and to the caller: the subject of
+// authenticated requests, the client IP of anonymous ones (register, forgot
+// password). The client IP is the peer address, or the proxy header when
+// the peer is one of server.trusted_proxies, so clients cannot pick another
+// client's scope with a forged header. Anyone behind the same IP who sends
+// the same key and body still gets the stored response, and a client whose
+// IP changes between retries runs the request again.
+func NewIdempotencyMiddleware(store IdempotencyStore, ttl time.Duration) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key := c.Get(IdempotencyHeader)
+		if key == "" {
+			return c.Next()
+		}
+		if !validIdempotencyKey(key) {
+			return ErrIdempotencyKeyInvalid
+		}
+
+		ctx := c.Context()
+		log := logging.FromCtx(c)
+		storeKey := idempotencyStoreKey(c, key)
+		fingerprint := requestFingerprint(c)
+
+		record, err := loadIdempotencyRecord(ctx, store, storeKey)
+		if err != nil {
+			// Without the store the request runs unprotected rather than
+			// not at all, like with the rate limiter.
+			log.Error("idempotency lookup failed", slog.Any("error", err))
+			return c.Next()
+		}
+		if record != nil {
+			return replayIdempotent(c, record, fingerprint)
+		}
+
+		lockKey := storeKey + ":lock"
+		n, err := store.Incr(ctx, lockKey, idempotencyLockTTL)
+		if err != nil {
+			log.Error("idempotency lock failed", slog.Any("error", err))
+			return c.Next()
+		}
+		if n > 1 {
+			return ErrIdempotencyKeyInProgress
+		}
+		defer func() {
+			if err := store.Del(context.WithoutCancel(ctx), lockKey); err != nil {
+				log.Error("idempotency unlock failed", slog.Any("error", err))
+			}
+		}()
+
+		// Render errors here, so the response that is stored is the one
+		// the client gets.
+		if err := c.Next(); err != nil {
+			if err := c.App().ErrorHandler(c, err); err != nil {
+				return err
+			}
+		}
+
+		status := c.Response().StatusCode()
+		if status >= fiber.StatusInternalServerError || status == fiber.StatusTooManyRequests {
+			return nil
+		}
+		data, err := json.Marshal(idempotencyRecord{
+			Fingerprint: fingerprint,
+			Status:      status,
+			ContentType: string(c.Response().Header.ContentType()),
+			Body:        c.Response().Body(),
+		})
+		if err == nil {
+			err = store.Set(ctx, storeKey, string(data), ttl)
+		}
+		if err != nil {
+			log.Error("storing idempotent response failed", slog.Any("error", err))
+		}
+		return nil
+	}
+}
+
+func replayIdempotent(c *fiber.Ctx, record *idempotencyRecord, fingerprint string) error {
+	if record.Fingerprint != fingerprint {
+		return ErrIdempotencyKeyReused
+	}
+	logging.FromCtx(c).Info("replaying idempotent response", slog.Int("status", record.Status))
+	c.Set(IdempotencyReplayedHeader, "true")
+	c.Set(fiber.HeaderContentType, record.ContentType)
+	return c.Status(record.Status).Send(record.Body)
+}
+
+func loadIdempotencyRecord(ctx context.Context, store IdempotencyStore, key string) (*idempotencyRecord, error) {
+	value, err := store.Get(ctx, key)
+	if err != nil || value == "" {
+		return nil, err
+	}
+	var record idempotencyRecord
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyStoreKey scopes key to the route and the caller, so clients
+// cannot see each other's responses by guessing keys. c.IP() only honours
+// the proxy header of trusted proxies, see config.ServerConfig.
+func idempotencyStoreKey(c *fiber.Ctx, key string) string {
+	caller := "ip:" + c.IP()
+	if claims, ok := c.Locals("claims").(*services.TokenClaims); ok && claims != nil {
+		caller = "sub:" + claims.Subject
+	}
+	sum := sha256.Sum256([]byte(c.Method() + " " + c.Route().Path + "\n" + caller + "\n" + key))
+	return "idem:" + hex.EncodeToString(sum[:])
+}
+
+// requestFingerprint identifies the request a key was first used with.
+func requestFingerprint(c *fiber.Ctx) string {
+	sum := sha256.Sum256(bytes.Join([][]byte{[]byte(c.Method()), []byte(c.Path()), c.Body()}, []byte{0}))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,108 @@
+package middleware
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/logging"
+	"auth-service/internal/ratelimit"
+	"auth-service/internal/services"
+	"log/slog"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// NewRateLimitMiddleware throttles a route per client IP and, when the
+// request names an account, per username. scope keeps the counters of
+// different endpoints apart. If the store is unreachable the request is let
+// through rather than locking everybody out.
+func NewRateLimitMiddleware(limiter *ratelimit.Limiter, scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ctx := c.Context()
+		log := logging.FromCtx(c)
+
+		allowed, retryAfter, err := limiter.Allow(ctx, scope+":ip:"+c.IP(), limiter.IP)
+		if err != nil {
+			log.Error("rate limit check failed", slog.Any("error", err))
+			return c.Next()
+		}
+		if !allowed {
+			log.Warn("rate limit exceeded", slog.String("scope", scope), slog.String("limit", "ip"))
+			return apperr.RateLimited("rate_limited", "too many requests", retryAfter)
+		}
+
+		if username := requestUsername(c); username != "" {
+			allowed, retryAfter, err = limiter.Allow(ctx, scope+":user:"+username, limiter.Username)
+			if err != nil {
+				log.Error("rate limit check failed", slog.Any("error", err))
+				return c.Next()
+			}
+			if !allowed {
+				log.Warn("rate limit exceeded", slog.String("scope", scope), slog.String("limit", "username"), slog.String("username", username))
+				return apperr.RateLimited("rate_limited", "too many requests for this account", retryAfter)
+			}
+		}
+
+		return c.Next()
+	}
+}
+
+// NewLoginLockoutMiddleware rejects logins for locked usernames and feeds
+// the outcome of each login attempt into the progressive lockout.
+func NewLoginLockoutMiddleware(limiter *ratelimit.Limiter) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		username := requestUsername(c)
+		if username == "" {
+			return c.Next()
+		}
+
+		ctx := c.Context()
+		log := logging.FromCtx(c).With(slog.String("username", username))
+
+		lockedFor, err := limiter.LockedFor(ctx, username)
+		if err != nil {
+			log.Error("lockout check failed", slog.Any("error", err))
+		}
+		if lockedFor > 0 {
+			return ratelimit.AccountLockedError(lockedFor)
+		}
+
+		// Only rejected credentials count as a failure: an unavailable
+		// Keycloak or a malformed body must not lock anybody out.
+		err = c.Next()
+		switch {
+		case apperr.HasCode(err, services.ErrInvalidCredentials.Code):
+			lockout, err := limiter.RecordFailure(ctx, username)
+			if err != nil {
+				log.Error("recording login failure failed", slog.Any("error", err))
+			} else if lockout > 0 {
+				log.Warn("username locked after failed logins", slog.Duration("lockout", lockout))
+			}
+		case err == nil && c.Response().StatusCode() == fiber.StatusOK:
+			if err := limiter.RecordSuccess(ctx, username); err != nil {
+				log.Error("recording login success failed", slog.Any("error", err))
+			}
+		}
+		return err
+	}
+}
+
+// requestUsername finds the account a request is about: the authenticated
+// user, or the username/email in the body. Usernames are case-insensitive
+// in Keycloak, so the result is lower-cased.
+func requestUsername(c *fiber.Ctx) string {
+	if claims, ok := c.Locals("claims").(*services.TokenClaims); ok && claims != nil {
+		return strings.ToLower(claims.PreferredUsername)
+	}
+
+	var body struct {
+		Username string `json:"username" form:"username"`
+		Email    string `json:"email" form:"email"`
+	}
+	if err := c.BodyParser(&body); err != nil {
+		return ""
+	}
+	if body.Username != "" {
+		return strings.ToLower(strings.TrimSpace(body.Username))
+	}
+	return strings.ToLower(strings.TrimSpace(body.Email))
+}
@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/logging"
+	"auth-service/internal/services"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// RequireRoles allows the request through when the validated token carries at
+// least one of the given roles. A plain name ("admin") is matched against the
+// realm roles, "client:role" ("camp-be-client:admin") against that client's
+// roles. It must run after NewAuthTokenMiddleware.
+func RequireRoles(roles ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, ok := c.Locals("claims").(*services.TokenClaims)
+		if !ok || claims == nil {
+			return apperr.Unauthorized("authentication_required", "authentication required")
+		}
+
+		for _, role := range roles {
+			if hasRole(claims, role) {
+				return c.Next()
+			}
+		}
+
+		logging.FromCtx(c).Warn("access denied, missing role",
+			slog.String("user_id", claims.Subject),
+			slog.Any("required_roles", roles),
+		)
+		return apperr.Forbidden("insufficient_role", fmt.Sprintf("one of the following roles is required: %s", strings.Join(roles, ", "))).
+			With("required_roles", roles)
+	}
+}
+
+func hasRole(claims *services.TokenClaims, role string) bool {
+	if client, name, found := strings.Cut(role, ":"); found {
+		return claims.HasClientRole(client, name)
+	}
+	return claims.HasRealmRole(role)
+}
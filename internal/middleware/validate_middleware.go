@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/logging"
+	"auth-service/internal/validation"
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Validate parses the request body into a T, normalizes and checks it
+// against the validate tags of T (see validation.Struct) and stores the
+// value in Locals under key for the handler. An empty body is checked as
+// a T without fields, so it fails the required ones only.
+func Validate[T any](key string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		log := logging.FromCtx(c)
+
+		var body T
+		if len(c.Body()) > 0 {
+			if err := c.BodyParser(&body); err != nil {
+				log.Warn("request body parsing failed", slog.Any("error", err))
+				return apperr.Validation("invalid_body", "invalid request body")
+			}
+		}
+		if err := validation.Struct(&body); err != nil {
+			log.Info("request body rejected", slog.Any("error", err))
+			return err
+		}
+
+		c.Locals(key, body)
+		return c.Next()
+	}
+}
@@ -1,29 +1,101 @@
 // internal/models/keycloak.go - UPDATED
 package models
 
+import (
+	"encoding/json"
+	"time"
+)
+
+// Request bodies carry `validate` tags, checked by middleware.Validate;
+// see validation.Struct for the rules.
+
 type LoginParams struct {
-	Username string `json:"username"` // Email yerine username
-	Password string `json:"password"`
+	Username string `json:"username" validate:"required,max=255"` // Email yerine username
+	Password string `json:"password" validate:"required,max=1024,verbatim"`
 }
 
 type RegisterParams struct {
-	Firstname string      `json:"firstname"`
-	Lastname  string      `json:"lastname"`
-	Username  string      `json:"username"`
-	Email     string      `json:"email"`    // Email ayrı field olarak
-	Password  string      `json:"password"` // Password direkt olarak
+	Firstname string `json:"firstname" validate:"required,max=255,printable"`
+	Lastname  string `json:"lastname" validate:"required,max=255,printable"`
+	Username  string `json:"username" validate:"required,min=3,max=64,username"`
+	Email     string `json:"email" validate:"required,max=254,email"` // Email ayrı field olarak
+	Password  string `json:"password" validate:"required,verbatim"`   // Password direkt olarak, kuralları PasswordPolicy belirler
 }
 
+// UserPayload updates a user. Fields left out stay unchanged; given ones
+// must not be empty.
 type UserPayload struct {
-	Firstname string `json:"firstname"`
-	Lastname  string `json:"lastname"`
-	Username  string `json:"username"`
-	Email     string `json:"email"`
+	Firstname *string `json:"firstname" validate:"required,max=255,printable"`
+	Lastname  *string `json:"lastname" validate:"required,max=255,printable"`
+	Username  *string `json:"username" validate:"required,min=3,max=64,username"`
+	Email     *string `json:"email" validate:"required,max=254,email"`
 }
 
 type LoginResponse struct {
-	AccessToken  string `json:"access_token"`
-	RefreshToken string `json:"refresh_token"`
-	ExpiresIn    int    `json:"expires_in"`
-	TokenType    string `json:"token_type"`
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
+	TokenType        string `json:"token_type"`
+}
+
+type ForgotPasswordParams struct {
+	Email string `json:"email" validate:"required,max=254,email"`
+}
+
+type ResendVerificationParams struct {
+	Email string `json:"email" validate:"required,max=254,email"`
+}
+
+type ResetPasswordParams struct {
+	Token       string `json:"token" validate:"required,max=512,verbatim"`
+	NewPassword string `json:"new_password" validate:"required,verbatim"`
+}
+
+type ChangePasswordParams struct {
+	CurrentPassword     string `json:"current_password" validate:"required,max=1024,verbatim"`
+	NewPassword         string `json:"new_password" validate:"required,verbatim"`
+	RevokeOtherSessions bool   `json:"revoke_other_sessions"`
+}
+
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	IPAddress  string    `json:"ip_address"`
+	Start      time.Time `json:"start"`
+	LastAccess time.Time `json:"last_access"`
+	Clients    []string  `json:"clients"`
+	Current    bool      `json:"current"`
+}
+
+type EnrollTOTPParams struct {
+	Label string `json:"label" validate:"max=64,printable"`
+}
+
+type MFACodeParams struct {
+	Code string `json:"code" validate:"required,max=64"`
+}
+
+// MFAStepUpParams confirms a change to the second factors. The code is
+// optional here, so the service can answer mfa_code_required.
+type MFAStepUpParams struct {
+	Code string `json:"code" validate:"max=64"`
+}
+
+type LoginMFAParams struct {
+	ChallengeID string `json:"challenge_id" validate:"required,max=128"`
+	Code        string `json:"code" validate:"required,max=64"`
+}
+
+type MFAFactorInfo struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Label     string    `json:"label"`
+	Confirmed bool      `json:"confirmed"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type WebAuthnFinishParams struct {
+	CeremonyID string          `json:"ceremony_id" validate:"required,max=128"`
+	Label      string          `json:"label" validate:"max=64,printable"`
+	Credential json.RawMessage `json:"credential" validate:"required"`
 }
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"auth-service/internal/apperr"
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Rule allows Limit events per sliding Window.
+type Rule struct {
+	Limit  int
+	Window time.Duration
+}
+
+// LockoutPolicy locks a username after Threshold consecutive failures. Each
+// further lockout doubles the duration, starting at Base and capped at Max.
+// The escalation is forgotten after a successful login or Reset.
+type LockoutPolicy struct {
+	Threshold int
+	Base      time.Duration
+	Max       time.Duration
+}
+
+// lockoutMemory is how long failure counters and lockout levels are kept.
+const lockoutMemory = 24 * time.Hour
+
+// Limiter applies sliding-window limits per client IP and per username and
+// keeps the progressive lockout state for failed logins.
+type Limiter struct {
+	Store    Store
+	IP       Rule
+	Username Rule
+	Lockout  LockoutPolicy
+
+	now func() time.Time
+}
+
+func NewLimiter(store Store, ip Rule, username Rule, lockout LockoutPolicy) *Limiter {
+	return &Limiter{
+		Store:    store,
+		IP:       ip,
+		Username: username,
+		Lockout:  lockout,
+		now:      time.Now,
+	}
+}
+
+// Allow records an attempt under key and reports whether it is within the
+// rule. Rejected attempts are not recorded; retryAfter tells when the oldest
+// recorded attempt leaves the window.
+func (l *Limiter) Allow(ctx context.Context, key string, rule Rule) (bool, time.Duration, error) {
+	if rule.Limit <= 0 {
+		return true, 0, nil
+	}
+
+	now := l.now()
+	allowed, oldest, err := l.Store.Hit(ctx, "rl:"+key, now, rule.Window, rule.Limit)
+	if err != nil {
+		return false, 0, fmt.Errorf("rate limit check failed: %w", err)
+	}
+	if allowed {
+		return true, 0, nil
+	}
+	return false, oldest.Add(rule.Window).Sub(now), nil
+}
+
+// AccountLockedError is the error for a login of a username that stays
+// locked for lockedFor.
+func AccountLockedError(lockedFor time.Duration) *apperr.Error {
+	return apperr.RateLimited("account_locked", "account temporarily locked due to failed login attempts", lockedFor)
+}
+
+// LockedFor returns how long the username stays locked, or 0.
+func (l *Limiter) LockedFor(ctx context.Context, username string) (time.Duration, error) {
+	value, err := l.Store.Get(ctx, lockKey(username))
+	if err != nil || value == "" {
+		return 0, err
+	}
+	until, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, nil
+	}
+	remaining := time.Unix(until, 0).Sub(l.now())
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
+
+// RecordFailure counts a failed login and locks the username once the
+// threshold is reached. It returns the lockout duration, or 0.
+func (l *Limiter) RecordFailure(ctx context.Context, username string) (time.Duration, error) {
+	if l.Lockout.Threshold <= 0 {
+		return 0, nil
+	}
+
+	failures, err := l.Store.Incr(ctx, failuresKey(username), lockoutMemory)
+	if err != nil {
+		return 0, err
+	}
+	if failures < int64(l.Lockout.Threshold) {
+		return 0, nil
+	}
+
+	level, err := l.Store.Incr(ctx, levelKey(username), lockoutMemory)
+	if err != nil {
+		return 0, err
+	}
+	duration := l.Lockout.Base
+	for i := int64(1); i < level && duration < l.Lockout.Max; i++ {
+		duration *= 2
+	}
+	if l.Lockout.Max > 0 && duration > l.Lockout.Max {
+		duration = l.Lockout.Max
+	}
+
+	until := l.now().Add(duration).Unix()
+	if err := l.Store.Set(ctx, lockKey(username), strconv.FormatInt(until, 10), duration); err != nil {
+		return 0, err
+	}
+	if err := l.Store.Del(ctx, failuresKey(username)); err != nil {
+		return 0, err
+	}
+	return duration, nil
+}
+
+// RecordSuccess clears the failure history after a successful login.
+func (l *Limiter) RecordSuccess(ctx context.Context, username string) error {
+	return l.Store.Del(ctx, failuresKey(username), levelKey(username))
+}
+
+// Reset lifts a lockout and forgets the failure history (admin action).
+func (l *Limiter) Reset(ctx context.Context, username string) error {
+	return l.Store.Del(ctx, failuresKey(username), levelKey(username), lockKey(username))
+}
+
+func failuresKey(username string) string { return "lockout:failures:" + username }
+func levelKey(username string) string    { return "lockout:level:" + username }
+func lockKey(username string) string     { return "lockout:until:" + username }
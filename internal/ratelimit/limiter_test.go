@@ -0,0 +1,123 @@
+package ratelimit
+
+import (
+	"auth-service/internal/kvstore"
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestLimiter(ip Rule, lockout LockoutPolicy) (*Limiter, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+
+	limiter := NewLimiter(kvstore.NewMemoryStore(), ip, Rule{}, lockout)
+	limiter.now = clock
+	return limiter, &now
+}
+
+func TestLimiterSlidingWindow(t *testing.T) {
+	limiter, now := newTestLimiter(Rule{Limit: 3, Window: time.Minute}, LockoutPolicy{})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		allowed, _, err := limiter.Allow(ctx, "ip:1.2.3.4", limiter.IP)
+		if err != nil || !allowed {
+			t.Fatalf("attempt %d: allowed=%v err=%v", i+1, allowed, err)
+		}
+		*now = now.Add(10 * time.Second)
+	}
+
+	allowed, retryAfter, err := limiter.Allow(ctx, "ip:1.2.3.4", limiter.IP)
+	if err != nil || allowed {
+		t.Fatalf("4th attempt: allowed=%v err=%v", allowed, err)
+	}
+	// The first attempt was 30s ago and leaves the window in another 30s.
+	if retryAfter != 30*time.Second {
+		t.Fatalf("expected retry after 30s, got %s", retryAfter)
+	}
+
+	// Other keys are not affected.
+	if allowed, _, _ := limiter.Allow(ctx, "ip:5.6.7.8", limiter.IP); !allowed {
+		t.Fatal("expected a different key to be allowed")
+	}
+
+	*now = now.Add(2 * time.Minute)
+	if allowed, _, _ := limiter.Allow(ctx, "ip:1.2.3.4", limiter.IP); !allowed {
+		t.Fatal("expected attempts to be allowed once the window passed")
+	}
+}
+
+func TestLimiterIgnoresRejectedAttempts(t *testing.T) {
+	limiter, now := newTestLimiter(Rule{Limit: 2, Window: time.Minute}, LockoutPolicy{})
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if allowed, _, _ := limiter.Allow(ctx, "ip:1.2.3.4", limiter.IP); !allowed {
+			t.Fatalf("attempt %d rejected", i+1)
+		}
+	}
+
+	// A client flooding the limit is let in again once its first allowed
+	// attempt leaves the window, and Retry-After counts down to that.
+	for i := 0; i < 59; i++ {
+		allowed, retryAfter, err := limiter.Allow(ctx, "ip:1.2.3.4", limiter.IP)
+		if err != nil || allowed {
+			t.Fatalf("flood attempt %d: allowed=%v err=%v", i, allowed, err)
+		}
+		if want := time.Minute - time.Duration(i)*time.Second; retryAfter != want {
+			t.Fatalf("flood attempt %d: retry after %s, want %s", i, retryAfter, want)
+		}
+		*now = now.Add(time.Second)
+	}
+	*now = now.Add(time.Second + time.Millisecond)
+	if allowed, _, _ := limiter.Allow(ctx, "ip:1.2.3.4", limiter.IP); !allowed {
+		t.Fatal("expected an attempt to be allowed once the window passed")
+	}
+}
+
+func TestLimiterProgressiveLockout(t *testing.T) {
+	policy := LockoutPolicy{Threshold: 3, Base: time.Minute, Max: 3 * time.Minute}
+	limiter, now := newTestLimiter(Rule{}, policy)
+	ctx := context.Background()
+
+	fail := func() time.Duration {
+		t.Helper()
+		var lockout time.Duration
+		for i := 0; i < policy.Threshold; i++ {
+			d, err := limiter.RecordFailure(ctx, "alice")
+			if err != nil {
+				t.Fatalf("RecordFailure: %v", err)
+			}
+			lockout = d
+		}
+		return lockout
+	}
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		if got := fail(); got != want {
+			t.Fatalf("expected lockout of %s, got %s", want, got)
+		}
+		if locked, _ := limiter.LockedFor(ctx, "alice"); locked != want {
+			t.Fatalf("expected to be locked for %s, got %s", want, locked)
+		}
+		*now = now.Add(want + time.Second)
+		if locked, _ := limiter.LockedFor(ctx, "alice"); locked != 0 {
+			t.Fatalf("expected lockout to expire, still locked for %s", locked)
+		}
+	}
+
+	if err := limiter.RecordSuccess(ctx, "alice"); err != nil {
+		t.Fatalf("RecordSuccess: %v", err)
+	}
+	if got := fail(); got != time.Minute {
+		t.Fatalf("expected escalation to restart after success, got %s", got)
+	}
+
+	if err := limiter.Reset(ctx, "alice"); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if locked, _ := limiter.LockedFor(ctx, "alice"); locked != 0 {
+		t.Fatalf("expected Reset to lift the lockout, still locked for %s", locked)
+	}
+}
@@ -0,0 +1,26 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the storage the limiter needs. kvstore.MemoryStore is the
+// single-instance default, kvstore.RedisStore shares the limits between
+// instances.
+type Store interface {
+	// Hit drops the events under key older than window and records an
+	// event at now unless limit events remain. It reports whether the event
+	// was recorded and returns the oldest event time. Rejected events are
+	// not kept, so a client that keeps retrying is let in again once its
+	// oldest event leaves the window.
+	Hit(ctx context.Context, key string, now time.Time, window time.Duration, limit int) (bool, time.Time, error)
+	// Incr increments the counter at key and (re)sets its expiry to ttl.
+	Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	// Get returns the value at key, or "" if it does not exist.
+	Get(ctx context.Context, key string) (string, error)
+	// Set stores value at key for ttl.
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+	// Del removes the keys.
+	Del(ctx context.Context, keys ...string) error
+}
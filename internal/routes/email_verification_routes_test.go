@@ -0,0 +1,133 @@
+package routes
+
+import (
+	"auth-service/internal/config"
+	"auth-service/internal/services"
+	"auth-service/internal/testing/fakekeycloak"
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestKeycloakEmailVerification(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+
+	// The user is created even though the email cannot be sent.
+	kc.FailNext(fakekeycloak.OpSendVerifyEmail, http.StatusInternalServerError)
+	resp, body := env.do("POST", "/api/v1/register", "", fiber.Map{
+		"firstname": "Ada",
+		"lastname":  "Lovelace",
+		"username":  "ada",
+		"email":     "ada@example.com",
+		"password":  "analytical-engine",
+	})
+	expectStatus(t, resp, body, fiber.StatusCreated)
+	warnings, _ := body["warnings"].([]interface{})
+	if len(warnings) != 1 || warnings[0].(map[string]interface{})["code"] != "verification_email_not_sent" {
+		t.Fatalf("missing warning about the verification email: %v", body)
+	}
+	if _, ok := kc.UserByUsername("ada"); !ok || len(kc.Emails()) != 0 {
+		t.Fatalf("user not created or email sent: %+v", kc.Emails())
+	}
+
+	accessToken, _ := env.login("ada", "analytical-engine")
+	resp, body = env.do("GET", "/api/v1/user/me", accessToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["email_verified"] != false {
+		t.Fatalf("email_verified = %v, want false", body["email_verified"])
+	}
+
+	resp, body = env.do("POST", "/api/v1/email/verify/resend", "", fiber.Map{})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+
+	resp, body = env.do("POST", "/api/v1/email/verify/resend", "", fiber.Map{"email": "ADA@example.com"})
+	expectStatus(t, resp, body, fiber.StatusAccepted)
+	emails := kc.Emails()
+	if len(emails) != 1 || emails[0].Kind != "verify-email" || emails[0].RedirectURI != "http://app.test/verified" {
+		t.Fatalf("unexpected emails %+v", emails)
+	}
+
+	// Unknown and verified addresses get the same answer, without an email.
+	kc.AddUser(fakekeycloak.User{Username: "grace", Email: "grace@example.com", Password: "cobol-rules", EmailVerified: true})
+	for _, email := range []string{"nobody@example.com", "grace@example.com"} {
+		resp, body = env.do("POST", "/api/v1/email/verify/resend", "", fiber.Map{"email": email})
+		expectStatus(t, resp, body, fiber.StatusAccepted)
+	}
+	if n := len(kc.Emails()); n != 1 {
+		t.Fatalf("%d emails sent, want 1", n)
+	}
+	graceToken, _ := env.login("grace", "cobol-rules")
+	resp, body = env.do("GET", "/api/v1/user/me", graceToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["email_verified"] != true {
+		t.Fatalf("email_verified = %v, want true", body["email_verified"])
+	}
+
+	limit := config.Default().EmailVerification.ResendLimit
+	for i := 1; i < limit; i++ {
+		resp, body = env.do("POST", "/api/v1/email/verify/resend", "", fiber.Map{"email": "ada@example.com"})
+		expectStatus(t, resp, body, fiber.StatusAccepted)
+	}
+	resp, body = env.do("POST", "/api/v1/email/verify/resend", "", fiber.Map{"email": "ada@example.com"})
+	expectProblem(t, resp, body, fiber.StatusTooManyRequests, "rate_limited")
+	if resp.Header.Get(fiber.HeaderRetryAfter) == "" {
+		t.Fatal("Retry-After not set")
+	}
+	if n := len(kc.Emails()); n != limit {
+		t.Fatalf("%d emails sent, want %d", n, limit)
+	}
+}
+
+func TestLoginRequiresVerifiedEmail(t *testing.T) {
+	provider, err := services.NewMemoryProvider("http://auth.test/realms/test", config.Default().Keycloak.ClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.EmailVerification.Required = true
+	app, mfa := newAppWithConfig(t, cfg, provider, nil, nil)
+	env := &testEnv{t: t, app: app, mfa: mfa, provider: provider}
+	userID := env.addUser("ada", "analytical-engine")
+
+	resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": "ada", "password": "analytical-engine"})
+	expectProblem(t, resp, body, fiber.StatusForbidden, "email_not_verified")
+	if responseCookie(resp, "access_token") != nil {
+		t.Fatal("tokens handed out for an unverified email")
+	}
+	sessions, _ := provider.GetUserSessions(context.Background(), userID)
+	if len(sessions) != 0 {
+		t.Fatalf("%d sessions left by the rejected login", len(sessions))
+	}
+
+	if err := provider.UpdateUser(context.Background(), userID, gocloak.User{EmailVerified: gocloak.BoolP(true)}); err != nil {
+		t.Fatal(err)
+	}
+	env.login("ada", "analytical-engine")
+}
+
+func TestKeycloakOIDCLoginRequiresVerifiedEmail(t *testing.T) {
+	cfg := config.Default()
+	cfg.EmailVerification.Required = true
+	env, kc, _ := keycloakEnv(t, cfg, false)
+	userID := addKeycloakUser(kc, "ada", "analytical-engine")
+
+	loginURL, state := env.startOIDCLogin("/dashboard")
+	callback := signIn(t, loginURL, "ada", "analytical-engine")
+	resp, _ := env.do("GET", callback, "", nil, withCookies(map[string]string{"oidc_state": state.Value}))
+	expectRedirect(t, resp, "http://app.test/?error=email_not_verified")
+	if responseCookie(resp, "access_token") != nil || responseCookie(resp, "refresh_token") != nil {
+		t.Fatal("tokens handed out for an unverified email")
+	}
+	if n := len(kc.Sessions(userID)); n != 0 {
+		t.Fatalf("%d sessions left by the rejected login", n)
+	}
+
+	kc.AddUser(fakekeycloak.User{Username: "grace", Email: "grace@example.com", Password: "cobol-rules", EmailVerified: true})
+	loginURL, state = env.startOIDCLogin("/dashboard")
+	callback = signIn(t, loginURL, "grace", "cobol-rules")
+	resp, _ = env.do("GET", callback, "", nil, withCookies(map[string]string{"oidc_state": state.Value}))
+	expectRedirect(t, resp, "http://app.test/dashboard")
+}
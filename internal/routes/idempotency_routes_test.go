@@ -0,0 +1,164 @@
+package routes
+
+import (
+	"auth-service/internal/config"
+	"auth-service/internal/middleware"
+	"auth-service/internal/services"
+	"auth-service/internal/testing/fakekeycloak"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func withIdempotencyKey(key string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.Header.Set(middleware.IdempotencyHeader, key)
+	}
+}
+
+func expectReplayed(t *testing.T, resp *http.Response, replayed bool) {
+	t.Helper()
+	if got := resp.Header.Get(middleware.IdempotencyReplayedHeader) == "true"; got != replayed {
+		t.Fatalf("%s %s: replayed = %v, want %v", resp.Request.Method, resp.Request.URL.Path, got, replayed)
+	}
+}
+
+func TestKeycloakIdempotentRegister(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	register := fiber.Map{
+		"firstname": "Ada",
+		"lastname":  "Lovelace",
+		"username":  "ada",
+		"email":     "ada@example.com",
+		"password":  "analytical-engine",
+	}
+
+	// A server error is not stored, so the retry runs again.
+	kc.FailNext(fakekeycloak.OpCreateUser, http.StatusServiceUnavailable)
+	resp, body := env.do("POST", "/api/v1/register", "", register, withIdempotencyKey("register-1"))
+	expectProblem(t, resp, body, fiber.StatusServiceUnavailable, "keycloak_unavailable")
+
+	resp, first := env.do("POST", "/api/v1/register", "", register, withIdempotencyKey("register-1"))
+	expectStatus(t, resp, first, fiber.StatusCreated)
+	expectReplayed(t, resp, false)
+
+	resp, body = env.do("POST", "/api/v1/register", "", register, withIdempotencyKey("register-1"))
+	expectStatus(t, resp, body, fiber.StatusCreated)
+	expectReplayed(t, resp, true)
+	if !reflect.DeepEqual(body, first) {
+		t.Fatalf("replayed %v, want %v", body, first)
+	}
+	if n := kc.Calls(fakekeycloak.OpCreateUser); n != 2 {
+		t.Fatalf("user created %d times, want 2 (one failed)", n)
+	}
+
+	// Without a key, or with a new one, the request runs again.
+	resp, body = env.do("POST", "/api/v1/register", "", register)
+	expectProblem(t, resp, body, fiber.StatusConflict, "user_exists")
+	resp, body = env.do("POST", "/api/v1/register", "", register, withIdempotencyKey("register-2"))
+	expectProblem(t, resp, body, fiber.StatusConflict, "user_exists")
+	resp, body = env.do("POST", "/api/v1/register", "", register, withIdempotencyKey("register-2"))
+	expectProblem(t, resp, body, fiber.StatusConflict, "user_exists")
+	expectReplayed(t, resp, true)
+
+	register["firstname"] = "Augusta"
+	resp, body = env.do("POST", "/api/v1/register", "", register, withIdempotencyKey("register-1"))
+	expectProblem(t, resp, body, fiber.StatusUnprocessableEntity, "idempotency_key_reused")
+
+	for _, key := range []string{strings.Repeat("k", 256), "key\twith-tab"} {
+		resp, body = env.do("POST", "/api/v1/register", "", register, withIdempotencyKey(key))
+		expectProblem(t, resp, body, fiber.StatusBadRequest, "invalid_idempotency_key")
+	}
+}
+
+func TestIdempotentForgotPassword(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("ada", "analytical-engine")
+
+	for i := 0; i < 2; i++ {
+		resp, body := env.do("POST", "/api/v1/password/forgot", "", fiber.Map{"email": "ada@example.com"}, withIdempotencyKey("forgot-1"))
+		expectStatus(t, resp, body, fiber.StatusAccepted)
+		expectReplayed(t, resp, i > 0)
+	}
+	if len(env.resetTokens) != 1 {
+		t.Fatalf("%d reset emails sent, want 1", len(env.resetTokens))
+	}
+
+	// Keys are scoped to the route.
+	resp, body := env.do("POST", "/api/v1/register", "", fiber.Map{"username": "bob"}, withIdempotencyKey("forgot-1"))
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+	expectReplayed(t, resp, false)
+}
+
+func TestIdempotencyKeysScopedToClientIP(t *testing.T) {
+	provider, err := services.NewMemoryProvider("http://auth.test/realms/test", config.Default().Keycloak.ClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Server.ProxyHeader = fiber.HeaderXForwardedFor
+	cfg.Server.TrustedProxies = []string{"0.0.0.0"}
+	app, mfa := newAppWithConfig(t, cfg, provider, nil, nil)
+	env := &testEnv{t: t, app: app, mfa: mfa, provider: provider}
+	env.addUser("ada", "analytical-engine")
+	emails := 0
+	provider.OnPasswordReset = func(string, string) { emails++ }
+
+	forgot := fiber.Map{"email": "ada@example.com"}
+	for _, tt := range []struct {
+		ip       string
+		replayed bool
+	}{
+		{"203.0.113.7", false},
+		{"203.0.113.7", true},
+		{"198.51.100.23", false},
+	} {
+		resp, body := env.do("POST", "/api/v1/password/forgot", "", forgot, withIdempotencyKey("forgot-1"), forwardedFor(tt.ip))
+		expectStatus(t, resp, body, fiber.StatusAccepted)
+		expectReplayed(t, resp, tt.replayed)
+	}
+	if emails != 2 {
+		t.Fatalf("%d reset emails sent, want 2", emails)
+	}
+}
+
+func TestIdempotencyScopeIgnoresForgedForwardingHeader(t *testing.T) {
+	provider, err := services.NewMemoryProvider("http://auth.test/realms/test", config.Default().Keycloak.ClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Server.ProxyHeader = fiber.HeaderXForwardedFor
+	cfg.Server.TrustedProxies = []string{"10.0.0.1"}
+	app, mfa := newAppWithConfig(t, cfg, provider, nil, nil)
+	env := &testEnv{t: t, app: app, mfa: mfa, provider: provider}
+	env.addUser("ada", "analytical-engine")
+	emails := 0
+	provider.OnPasswordReset = func(string, string) { emails++ }
+
+	// The peer is not a trusted proxy, so every request is scoped to the
+	// peer address whatever X-Forwarded-For claims.
+	forgot := fiber.Map{"email": "ada@example.com"}
+	for _, tt := range []struct {
+		ip       string
+		replayed bool
+	}{
+		{"203.0.113.7", false},
+		{"198.51.100.23", true},
+		{"", true},
+	} {
+		opts := []func(*http.Request){withIdempotencyKey("forgot-1")}
+		if tt.ip != "" {
+			opts = append(opts, forwardedFor(tt.ip))
+		}
+		resp, body := env.do("POST", "/api/v1/password/forgot", "", forgot, opts...)
+		expectStatus(t, resp, body, fiber.StatusAccepted)
+		expectReplayed(t, resp, tt.replayed)
+	}
+	if emails != 1 {
+		t.Fatalf("%d reset emails sent, want 1", emails)
+	}
+}
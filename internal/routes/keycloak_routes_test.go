@@ -0,0 +1,671 @@
+package routes
+
+import (
+	"auth-service/internal/config"
+	"auth-service/internal/kvstore"
+	"auth-service/internal/services"
+	"auth-service/internal/testing/fakekeycloak"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The tests in this file run every route against the real KeycloakService,
+// talking to a fake Keycloak over HTTP.
+
+func newKeycloakEnv(t *testing.T) (*testEnv, *fakekeycloak.Server) {
+	t.Helper()
+	env, kc, _ := keycloakEnv(t, config.Default(), false)
+	return env, kc
+}
+
+// newKeycloakSessionEnv runs the routes in session mode, with sessions kept
+// in memory.
+func newKeycloakSessionEnv(t *testing.T) (*testEnv, *fakekeycloak.Server, *services.SessionManager) {
+	t.Helper()
+	return keycloakEnv(t, config.Default(), true)
+}
+
+func keycloakEnv(t *testing.T, cfg *config.Config, sessionMode bool) (*testEnv, *fakekeycloak.Server, *services.SessionManager) {
+	t.Helper()
+
+	kc := fakekeycloak.New()
+	t.Cleanup(kc.Close)
+
+	ks, err := services.NewKeycloakService(kc.ClientID, kc.ClientSecret, kc.Realm, kc.URL, services.AdminAuthConfig{})
+	if err != nil {
+		t.Fatalf("create keycloak service: %v", err)
+	}
+	ks.VerifyEmailRedirectURI = "http://app.test/verified"
+	ks.PasswordResetRedirectURI = "http://app.test/reset-password"
+
+	oidcClient := services.NewOIDCClient(kc.URL, kc.Realm, kc.ClientID, kc.ClientSecret, "http://auth.test/api/v1/oidc/callback")
+	oidcClient.Verifier = ks.Verifier
+
+	var sessions *services.SessionManager
+	if sessionMode {
+		sessions = services.NewSessionManager(kvstore.NewMemoryStore(), ks, 30*time.Minute, 12*time.Hour)
+	}
+
+	app, mfa := newAppWithConfig(t, cfg, ks, oidcClient, sessions)
+	return &testEnv{t: t, app: app, mfa: mfa}, kc, sessions
+}
+
+func addKeycloakUser(kc *fakekeycloak.Server, username, password string, roles ...string) string {
+	return kc.AddUser(fakekeycloak.User{
+		Username:   username,
+		Email:      username + "@example.com",
+		FirstName:  username,
+		Password:   password,
+		RealmRoles: roles,
+	})
+}
+
+func withCookies(cookies map[string]string) func(*http.Request) {
+	return func(req *http.Request) {
+		for name, value := range cookies {
+			req.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+	}
+}
+
+// cookieJar keeps the cookies a browser would keep and, like a browser,
+// only sends those whose path matches the request.
+type cookieJar map[string]*http.Cookie
+
+func (jar cookieJar) update(resp *http.Response) {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Value == "" || cookie.MaxAge < 0 || (!cookie.Expires.IsZero() && cookie.Expires.Before(time.Now())) {
+			delete(jar, cookie.Name)
+			continue
+		}
+		jar[cookie.Name] = cookie
+	}
+}
+
+func (jar cookieJar) send(req *http.Request) {
+	for _, cookie := range jar {
+		scope := strings.TrimSuffix(cookie.Path, "/")
+		if path := req.URL.Path; scope == "" || path == scope || strings.HasPrefix(path, scope+"/") {
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+	}
+}
+
+func responseCookie(resp *http.Response, name string) *http.Cookie {
+	for _, cookie := range resp.Cookies() {
+		if cookie.Name == name {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestKeycloakPublicRoutes(t *testing.T) {
+	env, _ := newKeycloakEnv(t)
+
+	for _, path := range []string{"/health", "/api/v1/health", "/api/v1/test-cors"} {
+		resp, body := env.do("GET", path, "", nil)
+		expectStatus(t, resp, body, fiber.StatusOK)
+	}
+
+	resp, body := env.do("GET", "/api/v1/nope", "", nil)
+	expectProblem(t, resp, body, fiber.StatusNotFound, "route_not_found")
+
+	resp, body = env.do("DELETE", "/api/v1/health", "", nil)
+	expectProblem(t, resp, body, fiber.StatusMethodNotAllowed, "method_not_allowed")
+	if got := resp.Header.Get(fiber.HeaderAllow); got != "GET, HEAD" {
+		t.Fatalf("Allow = %q, want GET, HEAD", got)
+	}
+}
+
+func TestKeycloakRegister(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+
+	register := fiber.Map{
+		"firstname": "Ada",
+		"lastname":  "Lovelace",
+		"username":  "ada",
+		"email":     "ada@example.com",
+		"password":  "analytical-engine",
+	}
+	resp, body := env.do("POST", "/api/v1/register", "", register)
+	expectStatus(t, resp, body, fiber.StatusCreated)
+
+	user, ok := kc.UserByUsername("ada")
+	if !ok || user.Password != "analytical-engine" || user.FirstName != "Ada" {
+		t.Fatalf("user not created as expected: %+v", user)
+	}
+	emails := kc.Emails()
+	if len(emails) != 1 || emails[0].Kind != "verify-email" || emails[0].RedirectURI != "http://app.test/verified" {
+		t.Fatalf("unexpected emails %+v", emails)
+	}
+
+	resp, body = env.do("POST", "/api/v1/register", "", register)
+	expectProblem(t, resp, body, fiber.StatusConflict, "user_exists")
+
+	resp, body = env.do("POST", "/api/v1/register", "", fiber.Map{"username": "bob"})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+
+	kc.FailNext(fakekeycloak.OpCreateUser, http.StatusServiceUnavailable)
+	register["username"], register["email"] = "grace", "grace@example.com"
+	resp, body = env.do("POST", "/api/v1/register", "", register)
+	expectProblem(t, resp, body, fiber.StatusServiceUnavailable, "keycloak_unavailable")
+}
+
+func TestKeycloakLogin(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	userID := addKeycloakUser(kc, "ada", "analytical-engine")
+
+	resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": "ada", "password": "analytical-engine"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if cookie := responseCookie(resp, "access_token"); cookie == nil || cookie.Value == "" || !cookie.HttpOnly {
+		t.Fatalf("access_token cookie not set: %+v", cookie)
+	}
+
+	resp, body = env.do("POST", "/api/v1/login", "", fiber.Map{"username": "ada"})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+
+	// An unavailable Keycloak must not count towards the lockout (threshold 3).
+	kc.Fail(fakekeycloak.OpToken, http.StatusServiceUnavailable)
+	for i := 0; i < 4; i++ {
+		resp, body = env.do("POST", "/api/v1/login", "", fiber.Map{"username": "ada", "password": "analytical-engine"})
+		expectProblem(t, resp, body, fiber.StatusServiceUnavailable, "keycloak_unavailable")
+	}
+	kc.Recover()
+	env.login("ada", "analytical-engine")
+
+	kc.SetEnabled(userID, false)
+	resp, body = env.do("POST", "/api/v1/login", "", fiber.Map{"username": "ada", "password": "analytical-engine"})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "account_unavailable")
+}
+
+func TestKeycloakLockoutAndClear(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	addKeycloakUser(kc, "mallory", "correct-horse")
+	addKeycloakUser(kc, "root", "super-secret", "admin")
+	adminToken, _ := env.login("root", "super-secret")
+
+	for i := 0; i < 3; i++ {
+		resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": "mallory", "password": "guess"})
+		expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_credentials")
+	}
+	resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": "mallory", "password": "correct-horse"})
+	expectProblem(t, resp, body, fiber.StatusTooManyRequests, "account_locked")
+
+	resp, body = env.do("DELETE", "/api/v1/admin/lockouts/Mallory", adminToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	env.login("mallory", "correct-horse")
+}
+
+func TestKeycloakRefreshAndLogout(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	userID := addKeycloakUser(kc, "grace", "cobol-rules")
+	_, refreshToken := env.login("grace", "cobol-rules")
+
+	resp, body := env.do("POST", "/api/v1/refresh", "", fiber.Map{"refresh_token": refreshToken})
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	resp, body = env.do("POST", "/api/v1/refresh", "", fiber.Map{"refresh_token": "bogus"})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_refresh_token")
+
+	resp, body = env.do("POST", "/api/v1/refresh", "", fiber.Map{})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+
+	resp, body = env.do("POST", "/api/v1/logout", "", fiber.Map{"refresh_token": refreshToken})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if cookie := responseCookie(resp, "access_token"); cookie == nil || cookie.Expires.IsZero() || cookie.Expires.After(time.Now()) {
+		t.Fatalf("access_token cookie not cleared: %+v", cookie)
+	}
+	if n := len(kc.Sessions(userID)); n != 0 {
+		t.Fatalf("%d sessions left after logout", n)
+	}
+
+	resp, body = env.do("POST", "/api/v1/refresh", "", fiber.Map{"refresh_token": refreshToken})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_refresh_token")
+}
+
+func TestKeycloakExpiredToken(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	addKeycloakUser(kc, "grace", "cobol-rules")
+
+	kc.AccessTokenTTL = -time.Minute
+	expired, refreshToken := env.login("grace", "cobol-rules")
+	kc.AccessTokenTTL = 5 * time.Minute
+
+	resp, body := env.do("GET", "/api/v1/user/me", "", nil, withCookies(map[string]string{"access_token": expired}))
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "token_expired")
+	resp, body = env.do("GET", "/api/v1/user/me", expired, nil)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "token_expired")
+
+	resp, body = env.do("POST", "/api/v1/refresh", "", fiber.Map{"refresh_token": refreshToken})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	accessToken, _ := body["user"].(map[string]interface{})["access_token"].(string)
+	resp, body = env.do("GET", "/api/v1/user/me", accessToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["username"] != "grace" {
+		t.Fatalf("unexpected profile %v", body)
+	}
+}
+
+func TestKeycloakTokenCookies(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	userID := addKeycloakUser(kc, "grace", "cobol-rules")
+	csrf := withCSRF(env.csrfToken())
+
+	resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": "grace", "password": "cobol-rules"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	access, refresh := responseCookie(resp, "access_token"), responseCookie(resp, "refresh_token")
+	if access == nil || !access.HttpOnly || access.MaxAge != 300 || access.SameSite != http.SameSiteLaxMode {
+		t.Fatalf("unexpected access_token cookie %+v", access)
+	}
+	if refresh == nil || !refresh.HttpOnly || refresh.MaxAge != 1800 || refresh.Path != "/api/v1/refresh" {
+		t.Fatalf("unexpected refresh_token cookie %+v", refresh)
+	}
+
+	jar := cookieJar{}
+	jar.update(resp)
+
+	// The refresh endpoint takes the token from the cookie when the body is
+	// empty. It is the only route the refresh_token cookie is sent to.
+	resp, body = env.do("POST", "/api/v1/refresh", "", nil, csrf, jar.send)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	renewed := responseCookie(resp, "refresh_token")
+	if renewed == nil || renewed.Value == "" || renewed.Value == refresh.Value || renewed.Path != "/api/v1/refresh" {
+		t.Fatalf("refresh_token cookie not renewed: %+v", renewed)
+	}
+	if cookie := responseCookie(resp, "access_token"); cookie == nil || cookie.MaxAge != 300 {
+		t.Fatalf("access_token cookie not renewed: %+v", cookie)
+	}
+	jar.update(resp)
+
+	// Once the access_token cookie expired the browser sends no token to
+	// other routes; the client renews it at /refresh and retries.
+	delete(jar, "access_token")
+	resp, body = env.do("GET", "/api/v1/user/me", "", nil, jar.send)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "authentication_required")
+	resp, body = env.do("POST", "/api/v1/refresh", "", nil, csrf, jar.send)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	jar.update(resp)
+	resp, body = env.do("GET", "/api/v1/user/me", "", nil, jar.send)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	access = jar["access_token"]
+
+	resp, body = env.do("POST", "/api/v1/refresh", "", nil, csrf, withCookies(map[string]string{"refresh_token": "bogus"}))
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_refresh_token")
+	if cookie := responseCookie(resp, "refresh_token"); cookie == nil || cookie.Path != "/api/v1/refresh" || cookie.Expires.After(time.Now()) {
+		t.Fatalf("rejected refresh_token cookie not cleared: %+v", cookie)
+	}
+
+	// Logout only gets the access_token cookie from browsers and ends the
+	// Keycloak session it belongs to.
+	resp, body = env.do("POST", "/api/v1/logout", "", nil, csrf, jar.send)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if n := len(kc.Sessions(userID)); n != 0 {
+		t.Fatalf("%d sessions left after logout", n)
+	}
+	expectTokenCookiesCleared(t, resp)
+
+	// With the access_token cookie expired there is nothing to revoke, the
+	// cookies are cleared all the same.
+	resp, body = env.do("POST", "/api/v1/login", "", fiber.Map{"username": "grace", "password": "cobol-rules"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	jar.update(resp)
+	delete(jar, "access_token")
+	resp, body = env.do("POST", "/api/v1/logout", "", nil, csrf, jar.send)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	expectTokenCookiesCleared(t, resp)
+	jar.update(resp)
+	if len(jar) != 0 {
+		t.Fatalf("cookies left after logout: %v", jar)
+	}
+}
+
+func expectTokenCookiesCleared(t *testing.T, resp *http.Response) {
+	t.Helper()
+	for _, name := range []string{"access_token", "refresh_token"} {
+		if cookie := responseCookie(resp, name); cookie == nil || cookie.Expires.After(time.Now()) {
+			t.Fatalf("%s cookie not cleared: %+v", name, cookie)
+		}
+	}
+}
+
+func TestKeycloakCurrentUser(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	userID := addKeycloakUser(kc, "ada", "analytical-engine")
+	accessToken, _ := env.login("ada", "analytical-engine")
+
+	resp, body := env.do("GET", "/api/v1/me", accessToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	resp, body = env.do("GET", "/api/v1/me", "", nil)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "authentication_required")
+
+	resp, body = env.do("GET", "/api/v1/user/me", accessToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["id"] != userID || body["email"] != "ada@example.com" {
+		t.Fatalf("unexpected profile %v", body)
+	}
+
+	resp, body = env.do("PUT", "/api/v1/user/me", accessToken, fiber.Map{"firstname": "Augusta", "lastname": "King", "username": "ada", "email": "ada@example.com"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if user, _ := kc.User(userID); user.FirstName != "Augusta" || user.LastName != "King" {
+		t.Fatalf("update not applied: %+v", user)
+	}
+
+	kc.FailNext(fakekeycloak.OpUserInfo, http.StatusBadGateway)
+	resp, body = env.do("GET", "/api/v1/user/me", accessToken, nil)
+	expectProblem(t, resp, body, fiber.StatusServiceUnavailable, "keycloak_unavailable")
+
+	resp, body = env.do("DELETE", "/api/v1/user/me", accessToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if _, ok := kc.User(userID); ok {
+		t.Fatal("user still exists after deleting the account")
+	}
+
+	resp, body = env.do("GET", "/api/v1/user/me", "", nil)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "authentication_required")
+}
+
+func TestKeycloakChangePassword(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	kc.MinPasswordLength = 8
+	userID := addKeycloakUser(kc, "alan", "enigma-one")
+	accessToken, _ := env.login("alan", "enigma-one")
+	env.login("alan", "enigma-one")
+
+	resp, body := env.do("PUT", "/api/v1/user/me/password", accessToken, fiber.Map{"current_password": "wrong", "new_password": "enigma-two"})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_current_password")
+
+	// A disabled account fails the verification login with 400, not 401.
+	kc.SetEnabled(userID, false)
+	resp, body = env.do("PUT", "/api/v1/user/me/password", accessToken, fiber.Map{"current_password": "enigma-one", "new_password": "enigma-two"})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "account_unavailable")
+	kc.SetEnabled(userID, true)
+
+	resp, body = env.do("PUT", "/api/v1/user/me/password", accessToken, fiber.Map{"current_password": "enigma-one", "new_password": "short"})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "password_policy_violation")
+
+	resp, body = env.do("PUT", "/api/v1/user/me/password", accessToken, fiber.Map{"current_password": "enigma-one", "new_password": "enigma-two", "revoke_other_sessions": true})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if user, _ := kc.User(userID); user.Password != "enigma-two" {
+		t.Fatal("password not changed")
+	}
+	if n := len(kc.Sessions(userID)); n != 1 {
+		t.Fatalf("got %d sessions after revoking the others, want 1", n)
+	}
+}
+
+func TestKeycloakPasswordReset(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	userID := addKeycloakUser(kc, "alan", "enigma-one")
+	env.login("alan", "enigma-one")
+
+	resp, body := env.do("POST", "/api/v1/password/forgot", "", fiber.Map{"email": "nobody@example.com"})
+	expectStatus(t, resp, body, fiber.StatusAccepted)
+	if n := len(kc.Emails()); n != 0 {
+		t.Fatalf("sent %d emails for an unknown address", n)
+	}
+
+	resp, body = env.do("POST", "/api/v1/password/forgot", "", fiber.Map{"email": "alan@example.com"})
+	expectStatus(t, resp, body, fiber.StatusAccepted)
+	emails := kc.Emails()
+	if len(emails) != 1 || emails[0].Kind != "execute-actions" || len(emails[0].Actions) != 1 || emails[0].Actions[0] != "UPDATE_PASSWORD" {
+		t.Fatalf("unexpected emails %+v", emails)
+	}
+	redirect, err := url.Parse(emails[0].RedirectURI)
+	if err != nil {
+		t.Fatalf("parse redirect: %v", err)
+	}
+	resetToken := redirect.Query().Get("token")
+
+	// A password the realm rejects does not use up the token.
+	kc.MinPasswordLength = 8
+	resp, body = env.do("POST", "/api/v1/password/reset", "", fiber.Map{"token": resetToken, "new_password": "short"})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "password_policy_violation")
+
+	resp, body = env.do("POST", "/api/v1/password/reset", "", fiber.Map{"token": resetToken, "new_password": "enigma-two"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if user, _ := kc.User(userID); user.Password != "enigma-two" {
+		t.Fatal("password not reset")
+	}
+	if n := len(kc.Sessions(userID)); n != 0 {
+		t.Fatalf("%d sessions left after password reset", n)
+	}
+
+	resp, body = env.do("POST", "/api/v1/password/reset", "", fiber.Map{"token": resetToken, "new_password": "enigma-three"})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "invalid_reset_token")
+
+	// Failures are not reported, so the response does not reveal accounts.
+	kc.FailNext(fakekeycloak.OpExecuteActionsEmail, http.StatusInternalServerError)
+	resp, body = env.do("POST", "/api/v1/password/forgot", "", fiber.Map{"email": "alan@example.com"})
+	expectStatus(t, resp, body, fiber.StatusAccepted)
+}
+
+func TestKeycloakSessions(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	userID := addKeycloakUser(kc, "linus", "penguins")
+	first, _ := env.login("linus", "penguins")
+	env.login("linus", "penguins")
+	env.login("linus", "penguins")
+
+	resp, body := env.do("GET", "/api/v1/user/me/sessions", first, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	sessions := body["sessions"].([]interface{})
+	if len(sessions) != 3 {
+		t.Fatalf("got %d sessions, want 3", len(sessions))
+	}
+
+	var other string
+	for _, s := range sessions {
+		session := s.(map[string]interface{})
+		if session["current"] != true {
+			other = session["id"].(string)
+		}
+	}
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions/"+other, first, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions/"+other, first, nil)
+	expectProblem(t, resp, body, fiber.StatusNotFound, "session_not_found")
+
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions", first, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if n := len(kc.Sessions(userID)); n != 1 {
+		t.Fatalf("got %d sessions, want only the current one", n)
+	}
+
+	kc.FailNext(fakekeycloak.OpUserSessions, http.StatusServiceUnavailable)
+	resp, body = env.do("GET", "/api/v1/user/me/sessions", first, nil)
+	expectProblem(t, resp, body, fiber.StatusServiceUnavailable, "keycloak_unavailable")
+}
+
+func TestKeycloakAdminUserRoutes(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	userID := addKeycloakUser(kc, "barbara", "liskov-sub")
+	addKeycloakUser(kc, "root", "super-secret", "admin")
+	userToken, _ := env.login("barbara", "liskov-sub")
+	adminToken, adminRefresh := env.login("root", "super-secret")
+
+	resp, body := env.do("GET", "/api/v1/user/"+userID, userToken, nil)
+	expectProblem(t, resp, body, fiber.StatusForbidden, "insufficient_role")
+	resp, body = env.do("DELETE", "/api/v1/admin/lockouts/barbara", userToken, nil)
+	expectProblem(t, resp, body, fiber.StatusForbidden, "insufficient_role")
+
+	resp, body = env.do("GET", "/api/v1/user/"+userID, adminToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["username"] != "barbara" {
+		t.Fatalf("unexpected user %v", body)
+	}
+
+	resp, body = env.do("PUT", "/api/v1/user/"+userID, adminToken, fiber.Map{"firstname": "Barbara", "lastname": "Liskov", "username": "barbara", "email": "barbara@example.com"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if user, _ := kc.User(userID); user.LastName != "Liskov" {
+		t.Fatalf("update not applied: %+v", user)
+	}
+
+	resp, body = env.do("PUT", "/api/v1/user/"+userID, adminToken, fiber.Map{"username": "root"})
+	expectProblem(t, resp, body, fiber.StatusConflict, "user_exists")
+
+	kc.FailNext(fakekeycloak.OpIntrospect, http.StatusServiceUnavailable)
+	resp, body = env.do("GET", "/api/v1/user/"+userID, adminToken, nil)
+	expectProblem(t, resp, body, fiber.StatusServiceUnavailable, "keycloak_unavailable")
+
+	resp, body = env.do("DELETE", "/api/v1/user/"+userID, adminToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	resp, body = env.do("GET", "/api/v1/user/"+userID, adminToken, nil)
+	expectProblem(t, resp, body, fiber.StatusNotFound, "user_not_found")
+
+	// Admin routes introspect, so a logged out token stops working at once.
+	resp, body = env.do("POST", "/api/v1/logout", "", fiber.Map{"refresh_token": adminRefresh})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	resp, body = env.do("GET", "/api/v1/user/"+userID, adminToken, nil)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "session_expired")
+}
+
+// startOIDCLogin calls /oidc/login and returns Keycloak's login page URL and
+// the state cookie the browser would keep.
+func (env *testEnv) startOIDCLogin(returnTo string) (string, *http.Cookie) {
+	env.t.Helper()
+	resp, body := env.do("GET", "/api/v1/oidc/login?return_to="+url.QueryEscape(returnTo), "", nil)
+	expectStatus(env.t, resp, body, fiber.StatusFound)
+	state := responseCookie(resp, "oidc_state")
+	if state == nil || state.Value == "" || !state.HttpOnly {
+		env.t.Fatalf("oidc_state cookie not set: %+v", state)
+	}
+	return resp.Header.Get("Location"), state
+}
+
+// signIn submits the fake Keycloak login form and returns the path and query
+// of the callback Keycloak redirects to.
+func signIn(t *testing.T, loginURL, username, password string) string {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.PostForm(loginURL, url.Values{"username": {username}, "password": {password}})
+	if err != nil {
+		t.Fatalf("submit login form: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login form: status = %d, want 302", resp.StatusCode)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parse callback: %v", err)
+	}
+	return callback.RequestURI()
+}
+
+func expectRedirect(t *testing.T, resp *http.Response, location string) {
+	t.Helper()
+	if resp.StatusCode != fiber.StatusFound || resp.Header.Get("Location") != location {
+		t.Fatalf("%s %s: got %d to %q, want redirect to %q", resp.Request.Method, resp.Request.URL.Path,
+			resp.StatusCode, resp.Header.Get("Location"), location)
+	}
+}
+
+func TestKeycloakOIDCLogin(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	userID := addKeycloakUser(kc, "ada", "analytical-engine")
+
+	loginURL, state := env.startOIDCLogin("/dashboard?tab=1")
+	authorize, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatalf("parse login url: %v", err)
+	}
+	query := authorize.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" || query.Get("nonce") == "" {
+		t.Fatalf("authorization request without PKCE or nonce: %s", loginURL)
+	}
+	if query.Get("state") != state.Value {
+		t.Fatal("state parameter does not match the state cookie")
+	}
+
+	// Other requests in between must not change where this login returns to.
+	env.startOIDCLogin("/settings")
+	env.do("GET", "/api/v1/oidc/callback?error=access_denied", "", nil)
+
+	callback := signIn(t, loginURL, "ada", "analytical-engine")
+	resp, body := env.do("GET", callback, "", nil, withCookies(map[string]string{"oidc_state": state.Value}))
+	expectRedirect(t, resp, "http://app.test/dashboard?tab=1")
+
+	access, refresh := responseCookie(resp, "access_token"), responseCookie(resp, "refresh_token")
+	if access == nil || access.Value == "" || refresh == nil || refresh.Value == "" {
+		t.Fatalf("session cookies not set (body %v)", body)
+	}
+	if cleared := responseCookie(resp, "oidc_state"); cleared == nil || cleared.Value != "" {
+		t.Fatal("oidc_state cookie not cleared")
+	}
+	if n := len(kc.Sessions(userID)); n != 1 {
+		t.Fatalf("got %d sessions, want 1", n)
+	}
+
+	resp, body = env.do("GET", "/api/v1/user/me", "", nil, withCookies(map[string]string{"access_token": access.Value}))
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["id"] != userID {
+		t.Fatalf("unexpected profile %v", body)
+	}
+
+	// The code and the state are single-use.
+	resp, _ = env.do("GET", callback, "", nil, withCookies(map[string]string{"oidc_state": state.Value}))
+	expectRedirect(t, resp, "http://app.test/?error=invalid_oidc_state")
+}
+
+func TestKeycloakOIDCLoginRefusesMFAUsers(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	userID := addKeycloakUser(kc, "ada", "analytical-engine")
+	token, _ := env.login("ada", "analytical-engine")
+	env.enrollTOTP(token)
+	sessions := len(kc.Sessions(userID))
+
+	loginURL, state := env.startOIDCLogin("/dashboard")
+	callback := signIn(t, loginURL, "ada", "analytical-engine")
+	resp, _ := env.do("GET", callback, "", nil, withCookies(map[string]string{"oidc_state": state.Value}))
+	expectRedirect(t, resp, "http://app.test/?error=mfa_login_required")
+	if responseCookie(resp, "access_token") != nil || responseCookie(resp, "refresh_token") != nil {
+		t.Fatal("tokens handed out without the second factor")
+	}
+	if n := len(kc.Sessions(userID)); n != sessions {
+		t.Fatalf("got %d sessions, want the refused login's session ended (%d)", n, sessions)
+	}
+}
+
+func TestKeycloakOIDCCallbackFailures(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	addKeycloakUser(kc, "ada", "analytical-engine")
+
+	resp, body := env.do("GET", "/api/v1/oidc/login?return_to="+url.QueryEscape("//evil.example"), "", nil)
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "invalid_return_to")
+	resp, body = env.do("GET", "/api/v1/oidc/login?return_to="+url.QueryEscape("https://evil.example/"), "", nil)
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "invalid_return_to")
+
+	// A callback without the state cookie was not started by this browser.
+	loginURL, _ := env.startOIDCLogin("")
+	callback := signIn(t, loginURL, "ada", "analytical-engine")
+	resp, _ = env.do("GET", callback, "", nil)
+	expectRedirect(t, resp, "http://app.test/?error=invalid_oidc_state")
+
+	_, state := env.startOIDCLogin("")
+	resp, _ = env.do("GET", "/api/v1/oidc/callback?error=access_denied&state="+state.Value, "", nil,
+		withCookies(map[string]string{"oidc_state": state.Value}))
+	expectRedirect(t, resp, "http://app.test/?error=authorization_denied")
+
+	// A code issued for another login fails the PKCE check.
+	firstURL, _ := env.startOIDCLogin("")
+	firstCallback, _ := url.Parse(signIn(t, firstURL, "ada", "analytical-engine"))
+	_, second := env.startOIDCLogin("")
+	resp, _ = env.do("GET", "/api/v1/oidc/callback?code="+firstCallback.Query().Get("code")+"&state="+second.Value, "", nil,
+		withCookies(map[string]string{"oidc_state": second.Value}))
+	expectRedirect(t, resp, "http://app.test/?error=invalid_authorization_code")
+
+	loginURL, state = env.startOIDCLogin("")
+	callback = signIn(t, loginURL, "ada", "analytical-engine")
+	kc.FailNext(fakekeycloak.OpToken, http.StatusServiceUnavailable)
+	resp, _ = env.do("GET", callback, "", nil, withCookies(map[string]string{"oidc_state": state.Value}))
+	expectRedirect(t, resp, "http://app.test/?error=keycloak_unavailable")
+}
@@ -0,0 +1,247 @@
+package routes
+
+import (
+	"auth-service/internal/services"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// recordingNotifier collects the notifications sent to users.
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []services.Notification
+}
+
+func (rn *recordingNotifier) Notify(ctx context.Context, n services.Notification) error {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	rn.sent = append(rn.sent, n)
+	return nil
+}
+
+func (rn *recordingNotifier) events() []string {
+	rn.mu.Lock()
+	defer rn.mu.Unlock()
+	events := make([]string, len(rn.sent))
+	for i, n := range rn.sent {
+		events[i] = n.Event
+	}
+	return events
+}
+
+// enrollTOTP enrolls and confirms a TOTP factor for the owner of token and
+// returns its secret and recovery codes.
+func (env *testEnv) enrollTOTP(token string) (string, []string) {
+	env.t.Helper()
+	resp, body := env.do("POST", "/api/v1/user/me/mfa/totp", token, fiber.Map{"label": "phone"})
+	expectStatus(env.t, resp, body, fiber.StatusCreated)
+	secret, _ := body["secret"].(string)
+	factorID, _ := body["factor_id"].(string)
+
+	code, err := services.TOTPCode(secret, time.Now())
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	resp, body = env.do("POST", "/api/v1/user/me/mfa/totp/"+factorID+"/confirm", token, fiber.Map{"code": code})
+	expectStatus(env.t, resp, body, fiber.StatusOK)
+	return secret, stringList(body["recovery_codes"])
+}
+
+func stringList(value interface{}) []string {
+	items, _ := value.([]interface{})
+	list := make([]string, len(items))
+	for i, item := range items {
+		list[i], _ = item.(string)
+	}
+	return list
+}
+
+// startMFALogin logs in with a password and returns the MFA challenge.
+func (env *testEnv) startMFALogin(username, password string) string {
+	env.t.Helper()
+	resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": username, "password": password})
+	expectStatus(env.t, resp, body, fiber.StatusAccepted)
+	challengeID, _ := body["challenge_id"].(string)
+	return challengeID
+}
+
+func TestMFAEnrollment(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("ada", "analytical-engine")
+	token, _ := env.login("ada", "analytical-engine")
+
+	resp, body := env.do("GET", "/api/v1/user/me/mfa", token, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["enabled"] != false {
+		t.Fatalf("mfa enabled before enrollment: %v", body)
+	}
+
+	resp, body = env.do("POST", "/api/v1/user/me/mfa/totp", token, nil)
+	expectStatus(t, resp, body, fiber.StatusCreated)
+	if resp.Header.Get(fiber.HeaderCacheControl) != "no-store" {
+		t.Fatal("enrollment response may be cached")
+	}
+	factorID, _ := body["factor_id"].(string)
+	if uri, _ := body["otpauth_uri"].(string); uri == "" || uri[:15] != "otpauth://totp/" {
+		t.Fatalf("otpauth_uri = %q", uri)
+	}
+	if qr, _ := body["qr_code"].(string); len(qr) < 30 || qr[:22] != "data:image/png;base64," {
+		t.Fatalf("qr_code = %.40q", qr)
+	}
+
+	resp, body = env.do("POST", "/api/v1/user/me/mfa/totp/"+factorID+"/confirm", token, fiber.Map{"code": "000000"})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_mfa_code")
+
+	resp, body = env.do("GET", "/api/v1/user/me/mfa", token, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["enabled"] != false || len(body["factors"].([]interface{})) != 1 {
+		t.Fatalf("unconfirmed factor: %v", body)
+	}
+
+	// Starting over replaces the pending enrollment.
+	_, codes := env.enrollTOTP(token)
+	resp, body = env.do("GET", "/api/v1/user/me/mfa", token, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	factors := body["factors"].([]interface{})
+	if body["enabled"] != true || len(factors) != 1 {
+		t.Fatalf("after confirmation: %v", body)
+	}
+	factor := factors[0].(map[string]interface{})
+	if factor["label"] != "phone" || factor["confirmed"] != true || factor["secret"] != nil {
+		t.Fatalf("factor = %v", factor)
+	}
+
+	resp, body = env.do("DELETE", "/api/v1/user/me/mfa/"+factorID, token, nil)
+	expectProblem(t, resp, body, fiber.StatusNotFound, "mfa_factor_not_found")
+	// The access token alone cannot turn MFA off.
+	remove := "/api/v1/user/me/mfa/" + factor["id"].(string)
+	resp, body = env.do("DELETE", remove, token, nil)
+	expectProblem(t, resp, body, fiber.StatusForbidden, "mfa_code_required")
+	resp, body = env.do("DELETE", remove, token, fiber.Map{"code": "000000"})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_mfa_code")
+	resp, body = env.do("DELETE", remove, token, fiber.Map{"code": codes[0]})
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	// Without a factor the password is enough again.
+	env.login("ada", "analytical-engine")
+}
+
+func TestMFALogin(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("ada", "analytical-engine")
+	token, _ := env.login("ada", "analytical-engine")
+	secret, _ := env.enrollTOTP(token)
+
+	resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": "ada", "password": "analytical-engine"})
+	expectStatus(t, resp, body, fiber.StatusAccepted)
+	if body["mfa_required"] != true || body["user"] != nil || responseCookie(resp, "access_token") != nil {
+		t.Fatalf("tokens handed out before the second factor: %v", body)
+	}
+	if methods := stringList(body["methods"]); len(methods) != 2 || methods[0] != "totp" || methods[1] != "recovery_code" {
+		t.Fatalf("methods = %v, want totp and recovery_code", body["methods"])
+	}
+	challengeID, _ := body["challenge_id"].(string)
+
+	resp, body = env.do("POST", "/api/v1/login/mfa", "", fiber.Map{"challenge_id": challengeID})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+
+	// The code that confirmed the factor cannot be used again.
+	used, _ := services.TOTPCode(secret, time.Now())
+	resp, body = env.do("POST", "/api/v1/login/mfa", "", fiber.Map{"challenge_id": challengeID, "code": used})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_mfa_code")
+
+	next, _ := services.TOTPCode(secret, time.Now().Add(30*time.Second))
+	resp, body = env.do("POST", "/api/v1/login/mfa", "", fiber.Map{"challenge_id": challengeID, "code": next})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	tokens := body["user"].(map[string]interface{})
+	if tokens["access_token"] == "" || responseCookie(resp, "access_token") == nil {
+		t.Fatalf("no tokens after the second factor: %v", body)
+	}
+
+	resp, body = env.do("POST", "/api/v1/login/mfa", "", fiber.Map{"challenge_id": challengeID, "code": next})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "mfa_challenge_expired")
+}
+
+func TestMFALoginLockout(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("mallory", "correct-horse")
+	token, _ := env.login("mallory", "correct-horse")
+	secret, _ := env.enrollTOTP(token)
+	challengeID := env.startMFALogin("mallory", "correct-horse")
+
+	// Wrong codes count towards the lockout of the account like wrong passwords.
+	for i := 0; i < 3; i++ {
+		resp, body := env.do("POST", "/api/v1/login/mfa", "", fiber.Map{"challenge_id": challengeID, "code": "000000"})
+		expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_mfa_code")
+	}
+
+	resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": "mallory", "password": "correct-horse"})
+	expectProblem(t, resp, body, fiber.StatusTooManyRequests, "account_locked")
+
+	// The challenge has attempts left, but the locked account cannot use
+	// them, not even with the right code.
+	code, _ := services.TOTPCode(secret, time.Now().Add(30*time.Second))
+	resp, body = env.do("POST", "/api/v1/login/mfa", "", fiber.Map{"challenge_id": challengeID, "code": code})
+	expectProblem(t, resp, body, fiber.StatusTooManyRequests, "account_locked")
+}
+
+func TestMFARecoveryCodes(t *testing.T) {
+	env := newTestEnv(t)
+	notifier := &recordingNotifier{}
+	env.mfa.Notifier = notifier
+	env.addUser("ada", "analytical-engine")
+	token, _ := env.login("ada", "analytical-engine")
+
+	resp, body := env.do("POST", "/api/v1/user/me/mfa/recovery-codes", token, nil)
+	expectProblem(t, resp, body, fiber.StatusConflict, "mfa_not_enabled")
+
+	_, codes := env.enrollTOTP(token)
+	if len(codes) != 10 {
+		t.Fatalf("got %d recovery codes with the first factor, want 10", len(codes))
+	}
+
+	challengeID := env.startMFALogin("ada", "analytical-engine")
+	resp, body = env.do("POST", "/api/v1/login/mfa", "", fiber.Map{"challenge_id": challengeID, "code": codes[0]})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if events := notifier.events(); len(events) != 1 || events[0] != services.EventRecoveryCodeUsed {
+		t.Fatalf("notifications = %v", events)
+	}
+	if n := notifier.sent[0]; n.Email != "ada@example.com" || n.Details["recovery_codes_left"] != "9" {
+		t.Fatalf("notification = %+v", n)
+	}
+
+	challengeID = env.startMFALogin("ada", "analytical-engine")
+	resp, body = env.do("POST", "/api/v1/login/mfa", "", fiber.Map{"challenge_id": challengeID, "code": codes[0]})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_mfa_code")
+
+	resp, body = env.do("GET", "/api/v1/user/me/mfa", token, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["recovery_codes_left"] != float64(9) || len(body["factors"].([]interface{})) != 1 {
+		t.Fatalf("factors = %v", body)
+	}
+
+	// Regenerating takes a current code, not just the access token.
+	resp, body = env.do("POST", "/api/v1/user/me/mfa/recovery-codes", token, nil)
+	expectProblem(t, resp, body, fiber.StatusForbidden, "mfa_code_required")
+	resp, body = env.do("POST", "/api/v1/user/me/mfa/recovery-codes", token, fiber.Map{"code": codes[0]})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_mfa_code")
+	resp, body = env.do("POST", "/api/v1/user/me/mfa/recovery-codes", token, fiber.Map{"code": codes[2]})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	regenerated := stringList(body["recovery_codes"])
+	if len(regenerated) != 10 || resp.Header.Get(fiber.HeaderCacheControl) != "no-store" {
+		t.Fatalf("regenerated = %v", body)
+	}
+	if events := notifier.events(); len(events) != 2 || events[1] != services.EventRecoveryCodesRegenerated {
+		t.Fatalf("notifications = %v", events)
+	}
+
+	// The old codes stopped working.
+	resp, body = env.do("POST", "/api/v1/login/mfa", "", fiber.Map{"challenge_id": challengeID, "code": codes[1]})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_mfa_code")
+	resp, body = env.do("POST", "/api/v1/login/mfa", "", fiber.Map{"challenge_id": challengeID, "code": regenerated[1]})
+	expectStatus(t, resp, body, fiber.StatusOK)
+}
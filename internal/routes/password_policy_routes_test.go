@@ -0,0 +1,86 @@
+package routes
+
+import (
+	"auth-service/internal/config"
+	"auth-service/internal/services"
+	"auth-service/internal/testing/fakekeycloak"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func expectFieldErrors(t *testing.T, body fiber.Map, field string, codes ...string) {
+	t.Helper()
+	errs, _ := body["errors"].([]interface{})
+	if len(errs) != len(codes) {
+		t.Fatalf("field errors %v, want %v", body["errors"], codes)
+	}
+	for i, code := range codes {
+		err, _ := errs[i].(map[string]interface{})
+		if err["field"] != field || err["code"] != code || err["message"] == "" {
+			t.Fatalf("field error %d = %v, want %s on %s", i, errs[i], code, field)
+		}
+	}
+}
+
+func TestKeycloakRegisterPasswordPolicy(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	register := fiber.Map{
+		"firstname": "Ada",
+		"lastname":  "Lovelace",
+		"username":  "ada",
+		"email":     "ada@example.com",
+		"password":  "Ada-1815",
+	}
+
+	resp, body := env.do("POST", "/api/v1/register", "", register)
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "password_policy_violation")
+	expectFieldErrors(t, body, "password", "contains_user_info")
+
+	register["password"] = "engine"
+	resp, body = env.do("POST", "/api/v1/register", "", register)
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "password_policy_violation")
+	expectFieldErrors(t, body, "password", "too_short")
+
+	if n := kc.Calls(fakekeycloak.OpCreateUser); n != 0 {
+		t.Fatalf("Keycloak asked to create %d users for rejected passwords", n)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	provider, err := services.NewMemoryProvider("http://auth.test/realms/test", config.Default().Keycloak.ClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.PasswordPolicy.MinLength = 10
+	cfg.PasswordPolicy.RequireDigit = true
+	app, mfa := newAppWithConfig(t, cfg, provider, nil, nil)
+	env := &testEnv{t: t, app: app, mfa: mfa, provider: provider, resetTokens: map[string]string{}}
+	provider.OnPasswordReset = func(email, resetToken string) {
+		env.resetTokens[email] = resetToken
+	}
+
+	resp, body := env.do("GET", "/api/v1/password/policy", "", nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["min_length"] != float64(10) || body["require_digit"] != true || body["require_symbol"] != false || body["check_breached"] != false {
+		t.Fatalf("unexpected policy %v", body)
+	}
+
+	env.addUser("grace", "cobol-rules-1959")
+	accessToken, _ := env.login("grace", "cobol-rules-1959")
+	resp, body = env.do("PUT", "/api/v1/user/me/password", accessToken, fiber.Map{"current_password": "cobol-rules-1959", "new_password": "grace-hopper"})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "password_policy_violation")
+	expectFieldErrors(t, body, "new_password", "missing_digit", "contains_user_info")
+
+	resp, body = env.do("POST", "/api/v1/password/forgot", "", fiber.Map{"email": "grace@example.com"})
+	expectStatus(t, resp, body, fiber.StatusAccepted)
+	resp, body = env.do("POST", "/api/v1/password/reset", "", fiber.Map{"token": env.resetTokens["grace@example.com"], "new_password": "nanosecond"})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "password_policy_violation")
+	expectFieldErrors(t, body, "new_password", "missing_digit")
+
+	// The rejected attempt did not use up the token.
+	resp, body = env.do("POST", "/api/v1/password/reset", "", fiber.Map{"token": env.resetTokens["grace@example.com"], "new_password": "nanosecond-30cm"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	env.login("grace", "nanosecond-30cm")
+}
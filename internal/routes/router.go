@@ -1,24 +1,30 @@
 package routes
 
 import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/config"
 	"auth-service/internal/handler"
+	"auth-service/internal/logging"
 	"auth-service/internal/middleware"
+	"auth-service/internal/models"
+	"auth-service/internal/ratelimit"
 	"auth-service/internal/services"
+	"log/slog"
+	"strings"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 )
 
-func AuthRoutes(app *fiber.App, handler handler.AuthInterface, keycloakService *services.KeycloakService) {
-	app.Use(logger.New())
+func AuthRoutes(app *fiber.App, cfg *config.Config, handler handler.AuthInterface, oidc *handler.OIDCHandler, mfa *handler.MFAHandler, webauthn *handler.WebAuthnHandler, identity services.IdentityProvider, sessions *services.SessionManager, limiter *ratelimit.Limiter, idempotencyStore middleware.IdempotencyStore) {
+	app.Use(logging.Middleware(slog.Default()))
 
 	app.Use(cors.New(cors.Config{
-		AllowOrigins:     "http://localhost:3000",
+		AllowOrigins:     strings.Join(cfg.CORS.AllowOrigins, ","),
 		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
-		AllowHeaders:     "Origin,Content-Type,Accept,Authorization,X-Requested-With",
+		AllowHeaders:     "Origin,Content-Type,Accept,Authorization,X-Requested-With," + middleware.CSRFHeader + "," + middleware.IdempotencyHeader,
 		AllowCredentials: true,
-		ExposeHeaders:    "Set-Cookie",
+		ExposeHeaders:    "Set-Cookie," + middleware.IdempotencyReplayedHeader,
 	}))
 
 	// Health check endpoint
@@ -42,27 +48,80 @@ func AuthRoutes(app *fiber.App, handler handler.AuthInterface, keycloakService *
 		})
 	})
 
-	authTokenMiddleware := middleware.NewAuthTokenMiddleware(keycloakService)
+	authTokenMiddleware := middleware.NewAuthTokenMiddleware(identity, middleware.AuthTokenConfig{Cookie: cfg.Cookie, Sessions: sessions})
+	// Admin işlemlerinde iptal edilmiş token'ları da yakalamak için introspection
+	adminTokenMiddleware := middleware.NewAuthTokenMiddleware(identity, middleware.AuthTokenConfig{Introspect: true, Cookie: cfg.Cookie, Sessions: sessions})
+	// Cookie ile kimliği doğrulanan isteklerde CSRF token'ı ve Origin kontrolü
+	csrf := middleware.NewCSRFMiddleware(cfg.CORS.AllowOrigins)
+	// Idempotency-Key ile gönderilen isteklerin tekrarında ilk cevabı döndür
+	idempotent := middleware.NewIdempotencyMiddleware(idempotencyStore, cfg.Idempotency.TTL)
+
+	// CSRF token'ı (cookie ile giriş yapan tarayıcılar için)
+	api.Get("/csrf", middleware.CSRFTokenHandler(cfg.Cookie))
 
 	// AUTH ENDPOINTS (Token gerektirmeyen)
-	api.Post("/login", middleware.LoginMiddleware, handler.LoginHandler)
-	api.Post("/register", middleware.RegisterMiddleware, handler.RegisterHandler)
-	api.Post("/logout", handler.LogoutHandler)
-	api.Post("/refresh", handler.RefreshTokenHandler)
+	api.Post("/login", middleware.NewRateLimitMiddleware(limiter, "login"), middleware.NewLoginLockoutMiddleware(limiter), middleware.Validate[models.LoginParams]("login"), handler.LoginHandler)
+	api.Post("/login/mfa", middleware.NewRateLimitMiddleware(limiter, "login-mfa"), middleware.Validate[models.LoginMFAParams]("login_mfa"), handler.LoginMFAHandler)
+	api.Post("/register", middleware.NewRateLimitMiddleware(limiter, "register"), idempotent, middleware.Validate[models.RegisterParams]("register"), handler.RegisterHandler)
+	api.Post("/logout", csrf, handler.LogoutHandler)
+	api.Post("/refresh", middleware.NewRateLimitMiddleware(limiter, "refresh"), csrf, handler.RefreshTokenHandler)
 	api.Get("/me", handler.GetProfileHandler) // Eski endpoint, uyumluluk için
 
+	// OIDC ENDPOINTS: Keycloak giriş sayfası üzerinden tarayıcı girişi (authorization code + PKCE)
+	if oidc != nil {
+		oidcGroup := api.Group("/oidc")
+		oidcGroup.Get("/login", middleware.NewRateLimitMiddleware(limiter, "oidc-login"), oidc.LoginHandler)
+		oidcGroup.Get("/callback", oidc.CallbackHandler)
+	}
+
+	// WEBAUTHN ENDPOINTS: passkey kaydı (giriş yapmış kullanıcı) ve şifresiz giriş
+	if webauthn != nil {
+		webauthnGroup := api.Group("/webauthn")
+		webauthnGroup.Post("/register/begin", csrf, authTokenMiddleware, webauthn.RegisterBeginHandler)
+		webauthnGroup.Post("/register/finish", csrf, authTokenMiddleware, middleware.Validate[models.WebAuthnFinishParams]("webauthn_finish"), webauthn.RegisterFinishHandler)
+		webauthnGroup.Post("/login/begin", middleware.NewRateLimitMiddleware(limiter, "webauthn-login"), webauthn.LoginBeginHandler)
+		webauthnGroup.Post("/login/finish", middleware.NewRateLimitMiddleware(limiter, "webauthn-login"), middleware.Validate[models.WebAuthnFinishParams]("webauthn_finish"), webauthn.LoginFinishHandler)
+	}
+
+	// E-POSTA DOĞRULAMA: doğrulama bağlantısını yeniden gönder (adres başına sınırlı)
+	api.Post("/email/verify/resend", middleware.NewRateLimitMiddleware(limiter, "verify-email-resend"), middleware.Validate[models.ResendVerificationParams]("resend_verification"), handler.ResendVerificationEmailHandler)
+
+	// PASSWORD RESET ENDPOINTS (Token gerektirmeyen)
+	password := api.Group("/password")
+	password.Post("/forgot", middleware.NewRateLimitMiddleware(limiter, "password-forgot"), idempotent, middleware.Validate[models.ForgotPasswordParams]("forgot_password"), handler.ForgotPasswordHandler)
+	password.Post("/reset", middleware.NewRateLimitMiddleware(limiter, "password-reset"), middleware.Validate[models.ResetPasswordParams]("reset_password"), handler.ResetPasswordHandler)
+	password.Get("/policy", handler.PasswordPolicyHandler)
+
 	// USER MANAGEMENT ENDPOINTS (Token gerektiren)
-	user := api.Group("/user")
+	user := api.Group("/user", csrf)
 	
 	// Giriş yapmış kullanıcının kendi işlemleri (Token ile)
 	user.Get("/me", authTokenMiddleware, handler.GetCurrentUserHandler)
-	user.Put("/me", authTokenMiddleware, handler.UpdateCurrentUserHandler)
+	user.Put("/me", authTokenMiddleware, middleware.Validate[models.UserPayload]("user"), handler.UpdateCurrentUserHandler)
 	user.Delete("/me", authTokenMiddleware, handler.DeleteCurrentUserHandler)
+	user.Put("/me/password", authTokenMiddleware, middleware.NewRateLimitMiddleware(limiter, "password-change"), middleware.Validate[models.ChangePasswordParams]("change_password"), handler.ChangePasswordHandler)
+	user.Get("/me/sessions", authTokenMiddleware, handler.ListSessionsHandler)
+	user.Delete("/me/sessions", authTokenMiddleware, handler.RevokeOtherSessionsHandler)
+	user.Delete("/me/sessions/:sid", authTokenMiddleware, handler.RevokeSessionHandler)
+
+	// İki faktörlü doğrulama (TOTP) yönetimi
+	if mfa != nil {
+		user.Get("/me/mfa", authTokenMiddleware, mfa.ListFactorsHandler)
+		user.Post("/me/mfa/totp", authTokenMiddleware, middleware.Validate[models.EnrollTOTPParams]("enroll_totp"), mfa.EnrollTOTPHandler)
+		user.Post("/me/mfa/totp/:id/confirm", authTokenMiddleware, middleware.NewRateLimitMiddleware(limiter, "mfa-confirm"), middleware.Validate[models.MFACodeParams]("mfa_code"), mfa.ConfirmTOTPHandler)
+		user.Post("/me/mfa/recovery-codes", authTokenMiddleware, middleware.NewRateLimitMiddleware(limiter, "mfa-step-up"), middleware.Validate[models.MFAStepUpParams]("mfa_step_up"), mfa.RegenerateRecoveryCodesHandler)
+		user.Delete("/me/mfa/:id", authTokenMiddleware, middleware.NewRateLimitMiddleware(limiter, "mfa-step-up"), middleware.Validate[models.MFAStepUpParams]("mfa_step_up"), mfa.RemoveFactorHandler)
+	}
 	
-	// Admin seviyesi işlemler (ID ile) - Token gerekli
-	user.Get("/:id", authTokenMiddleware, middleware.GetUserMiddleware, handler.GetUserHandler)
-	user.Put("/:id", authTokenMiddleware, middleware.UpdateMiddleware, handler.UpdateHandler)
-	user.Delete("/:id", authTokenMiddleware, middleware.DeleteMiddleware, handler.DeleteHandler)
+	// Admin seviyesi işlemler (ID ile) - Token ve admin rolü gerekli
+	requireAdmin := middleware.RequireRoles("admin")
+	user.Get("/:id", adminTokenMiddleware, requireAdmin, middleware.GetUserMiddleware, handler.GetUserHandler)
+	user.Put("/:id", adminTokenMiddleware, requireAdmin, middleware.UpdateMiddleware, middleware.Validate[models.UserPayload]("user"), handler.UpdateHandler)
+	user.Delete("/:id", adminTokenMiddleware, requireAdmin, middleware.DeleteMiddleware, handler.DeleteHandler)
+
+	// Admin: başarısız girişler nedeniyle kilitlenen hesapların kilidini kaldır
+	admin := api.Group("/admin", csrf, adminTokenMiddleware, requireAdmin)
+	admin.Delete("/lockouts/:username", handler.ClearLockoutHandler)
 
 	// Debug endpoint
 	api.Get("/test-cors", func(c *fiber.Ctx) error {
@@ -75,10 +134,11 @@ func AuthRoutes(app *fiber.App, handler handler.AuthInterface, keycloakService *
 
 	// Catch-all route
 	app.Use("*", func(c *fiber.Ctx) error {
-		return c.Status(404).JSON(fiber.Map{
-			"error":  "Route not found",
-			"method": c.Method(),
-			"path":   c.Path(),
-		})
+		// Yol başka bir metotla tanımlıysa 404 yerine 405 dön
+		if allowed := apperr.AllowedMethods(c); len(allowed) > 0 {
+			return apperr.MethodNotAllowed(allowed)
+		}
+		return apperr.NotFound("route_not_found", "route not found").
+			With("method", c.Method())
 	})
 }
@@ -0,0 +1,543 @@
+package routes
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/config"
+	"auth-service/internal/handler"
+	"auth-service/internal/kvstore"
+	"auth-service/internal/ratelimit"
+	"auth-service/internal/services"
+	"auth-service/internal/validation"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/gofiber/fiber/v2"
+)
+
+type testEnv struct {
+	t   *testing.T
+	app *fiber.App
+	mfa *services.MFAService
+
+	// provider and resetTokens are set for MemoryProvider environments;
+	// resetTokens collects the tokens ForgotPassword would have emailed.
+	provider    *services.MemoryProvider
+	resetTokens map[string]string
+}
+
+// newApp wires the routes exactly like main does, on top of identity, and
+// returns them with the MFA service. The OIDC routes are only registered
+// when oidc is not nil, and logins start server-side sessions when sessions
+// is not nil.
+func newApp(t *testing.T, identity services.IdentityProvider, oidc *services.OIDCClient, sessions *services.SessionManager) (*fiber.App, *services.MFAService) {
+	t.Helper()
+	return newAppWithConfig(t, config.Default(), identity, oidc, sessions)
+}
+
+// newAppWithConfig is newApp with a changed configuration.
+func newAppWithConfig(t *testing.T, cfg *config.Config, identity services.IdentityProvider, oidc *services.OIDCClient, sessions *services.SessionManager) (*fiber.App, *services.MFAService) {
+	t.Helper()
+	limiter := ratelimit.NewLimiter(kvstore.NewMemoryStore(),
+		ratelimit.Rule{Limit: 1000, Window: time.Minute},
+		ratelimit.Rule{Limit: 1000, Window: time.Minute},
+		ratelimit.LockoutPolicy{Threshold: 3, Base: time.Minute, Max: time.Hour})
+	return newAppWithLimiter(t, cfg, limiter, identity, oidc, sessions)
+}
+
+// newAppWithLimiter is newAppWithConfig with the given rate limiter.
+func newAppWithLimiter(t *testing.T, cfg *config.Config, limiter *ratelimit.Limiter, identity services.IdentityProvider, oidc *services.OIDCClient, sessions *services.SessionManager) (*fiber.App, *services.MFAService) {
+	t.Helper()
+	return buildApp(t, cfg, limiter, identity, oidc, sessions, true)
+}
+
+// buildApp wires the routes like main does. With waitDetached, requests
+// only finish once the work the handlers detached is done, so tests can
+// check its effects right after the response.
+func buildApp(t *testing.T, cfg *config.Config, limiter *ratelimit.Limiter, identity services.IdentityProvider, oidc *services.OIDCClient, sessions *services.SessionManager, waitDetached bool) (*fiber.App, *services.MFAService) {
+	t.Helper()
+
+	fiberConfig := cfg.Server.FiberConfig()
+	fiberConfig.ErrorHandler = apperr.ErrorHandler
+	app := fiber.New(fiberConfig)
+	mfa := services.NewMFAService(services.NewMemoryMFAStore(), cfg.MFA.Issuer, cfg.MFA.ChallengeTTL, []byte(cfg.MFA.RecoveryCodeKey))
+	webauthn, err := services.NewWebAuthnService(cfg.WebAuthn.RPID, cfg.WebAuthn.RPName, cfg.WebAuthn.RPOrigins, services.NewMemoryWebAuthnRepository(), identity, cfg.WebAuthn.CeremonyTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwords, err := validation.NewPasswordPolicy(cfg.PasswordPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := handler.NewAuthHandler(identity, cfg.Cookie, limiter, sessions, mfa, cfg.EmailVerification, passwords)
+	if waitDetached {
+		app.Use(func(c *fiber.Ctx) error {
+			err := c.Next()
+			auth.Wait()
+			return err
+		})
+	}
+	var oidcHandler *handler.OIDCHandler
+	if oidc != nil {
+		if oidcHandler, err = handler.NewOIDCHandler(oidc, auth, "http://app.test/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	AuthRoutes(app, cfg, auth, oidcHandler, handler.NewMFAHandler(mfa), handler.NewWebAuthnHandler(webauthn, auth), identity, sessions, limiter, kvstore.NewMemoryStore())
+	return app, mfa
+}
+
+func newTestEnv(t *testing.T) *testEnv {
+	t.Helper()
+
+	provider, err := services.NewMemoryProvider("http://auth.test/realms/test", config.Default().Keycloak.ClientID)
+	if err != nil {
+		t.Fatalf("create provider: %v", err)
+	}
+	app, mfa := newApp(t, provider, nil, nil)
+	env := &testEnv{t: t, app: app, mfa: mfa, provider: provider, resetTokens: map[string]string{}}
+	provider.OnPasswordReset = func(email, resetToken string) {
+		env.resetTokens[email] = resetToken
+	}
+	return env
+}
+
+func (env *testEnv) addUser(username, password string, roles ...string) string {
+	env.t.Helper()
+	id, err := env.provider.AddUser(gocloak.User{
+		Username: gocloak.StringP(username),
+		Email:    gocloak.StringP(username + "@example.com"),
+	}, password, roles...)
+	if err != nil {
+		env.t.Fatalf("add user: %v", err)
+	}
+	return id
+}
+
+// do sends a JSON request, authenticated with token when it is not empty,
+// and decodes the JSON response. opts can adjust the request before it is
+// sent, e.g. to add cookies.
+func (env *testEnv) do(method, path, token string, body interface{}, opts ...func(*http.Request)) (*http.Response, map[string]interface{}) {
+	env.t.Helper()
+
+	var reader io.Reader
+	if body != nil {
+		raw, err := json.Marshal(body)
+		if err != nil {
+			env.t.Fatalf("encode body: %v", err)
+		}
+		reader = bytes.NewReader(raw)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+
+	resp, err := env.app.Test(req, -1)
+	if err != nil {
+		env.t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	result := map[string]interface{}{}
+	raw, _ := io.ReadAll(resp.Body)
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &result); err != nil {
+			env.t.Fatalf("%s %s: decode %q: %v", method, path, raw, err)
+		}
+	}
+	return resp, result
+}
+
+func (env *testEnv) login(username, password string) (accessToken, refreshToken string) {
+	env.t.Helper()
+	resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": username, "password": password})
+	expectStatus(env.t, resp, body, fiber.StatusOK)
+	tokens := body["user"].(map[string]interface{})
+	return tokens["access_token"].(string), tokens["refresh_token"].(string)
+}
+
+// csrfToken fetches a CSRF token like a browser app would before sending
+// cookie-authenticated requests.
+func (env *testEnv) csrfToken() string {
+	env.t.Helper()
+	resp, body := env.do("GET", "/api/v1/csrf", "", nil)
+	expectStatus(env.t, resp, body, fiber.StatusOK)
+	token, _ := body["csrf_token"].(string)
+	if cookie := responseCookie(resp, "csrf_token"); cookie == nil || cookie.Value != token || token == "" {
+		env.t.Fatalf("csrf_token cookie does not match the returned token: %+v", cookie)
+	}
+	return token
+}
+
+// withCSRF sends token in both the csrf_token cookie and the X-CSRF-Token header.
+func withCSRF(token string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: "csrf_token", Value: token})
+		req.Header.Set("X-CSRF-Token", token)
+	}
+}
+
+func expectStatus(t *testing.T, resp *http.Response, body map[string]interface{}, status int) {
+	t.Helper()
+	if resp.StatusCode != status {
+		t.Fatalf("%s %s: status = %d, want %d (body %v)", resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, status, body)
+	}
+}
+
+func expectProblem(t *testing.T, resp *http.Response, body map[string]interface{}, status int, code string) {
+	t.Helper()
+	expectStatus(t, resp, body, status)
+	if body["code"] != code {
+		t.Fatalf("%s %s: code = %v, want %s", resp.Request.Method, resp.Request.URL.Path, body["code"], code)
+	}
+}
+
+func TestRegisterLoginAndProfile(t *testing.T) {
+	env := newTestEnv(t)
+
+	register := fiber.Map{
+		"firstname": "Ada",
+		"lastname":  "Lovelace",
+		"username":  "ada",
+		"email":     "ada@example.com",
+		"password":  "analytical-engine",
+	}
+	resp, body := env.do("POST", "/api/v1/register", "", register)
+	expectStatus(t, resp, body, fiber.StatusCreated)
+
+	resp, body = env.do("POST", "/api/v1/register", "", register)
+	expectProblem(t, resp, body, fiber.StatusConflict, "user_exists")
+
+	resp, body = env.do("POST", "/api/v1/login", "", fiber.Map{"username": "ada", "password": "wrong"})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_credentials")
+
+	accessToken, _ := env.login("ada", "analytical-engine")
+
+	resp, body = env.do("GET", "/api/v1/user/me", accessToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["username"] != "ada" || body["firstName"] != "Ada" {
+		t.Fatalf("unexpected profile %v", body)
+	}
+
+	resp, body = env.do("PUT", "/api/v1/user/me", accessToken, fiber.Map{"firstname": "Augusta", "lastname": "Lovelace", "username": "ada", "email": "ada@example.com"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	resp, body = env.do("GET", "/api/v1/me", accessToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["firstName"] != "Augusta" {
+		t.Fatalf("update not applied: %v", body)
+	}
+
+	resp, body = env.do("GET", "/api/v1/user/me", "not-a-jwt", nil)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_token")
+}
+
+func TestRefreshAndLogout(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("grace", "cobol-rules")
+	_, refreshToken := env.login("grace", "cobol-rules")
+
+	resp, body := env.do("POST", "/api/v1/refresh", "", fiber.Map{"refresh_token": refreshToken})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	rotated := body["user"].(map[string]interface{})["refresh_token"].(string)
+
+	// Refresh tokens are single use.
+	resp, body = env.do("POST", "/api/v1/refresh", "", fiber.Map{"refresh_token": refreshToken})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_refresh_token")
+
+	resp, body = env.do("POST", "/api/v1/logout", "", fiber.Map{"refresh_token": rotated})
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	resp, body = env.do("POST", "/api/v1/refresh", "", fiber.Map{"refresh_token": rotated})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_refresh_token")
+}
+
+func TestSessions(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("linus", "penguins")
+	first, _ := env.login("linus", "penguins")
+	second, _ := env.login("linus", "penguins")
+
+	resp, body := env.do("GET", "/api/v1/user/me/sessions", first, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	sessions := body["sessions"].([]interface{})
+	if len(sessions) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(sessions))
+	}
+	current := 0
+	for _, s := range sessions {
+		if s.(map[string]interface{})["current"] == true {
+			current++
+		}
+	}
+	if current != 1 {
+		t.Fatalf("got %d current sessions, want 1", current)
+	}
+
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions/unknown", first, nil)
+	expectProblem(t, resp, body, fiber.StatusNotFound, "session_not_found")
+
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions", first, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	resp, body = env.do("GET", "/api/v1/user/me", second, nil)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_token")
+
+	resp, body = env.do("GET", "/api/v1/user/me/sessions", first, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if n := len(body["sessions"].([]interface{})); n != 1 {
+		t.Fatalf("got %d sessions after revoking others, want 1", n)
+	}
+}
+
+func TestPasswordChangeAndReset(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("alan", "enigma-1")
+	accessToken, _ := env.login("alan", "enigma-1")
+
+	resp, body := env.do("PUT", "/api/v1/user/me/password", accessToken, fiber.Map{"current_password": "wrong", "new_password": "enigma-2"})
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_current_password")
+
+	resp, body = env.do("PUT", "/api/v1/user/me/password", accessToken, fiber.Map{"current_password": "enigma-1", "new_password": "enigma-2"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	env.login("alan", "enigma-2")
+
+	resp, body = env.do("POST", "/api/v1/password/forgot", "", fiber.Map{"email": "nobody@example.com"})
+	expectStatus(t, resp, body, fiber.StatusAccepted)
+
+	resp, body = env.do("POST", "/api/v1/password/forgot", "", fiber.Map{"email": "alan@example.com"})
+	expectStatus(t, resp, body, fiber.StatusAccepted)
+	resetToken := env.resetTokens["alan@example.com"]
+	if resetToken == "" {
+		t.Fatal("no reset token issued")
+	}
+
+	resp, body = env.do("POST", "/api/v1/password/reset", "", fiber.Map{"token": resetToken, "new_password": "enigma-3"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	resp, body = env.do("POST", "/api/v1/password/reset", "", fiber.Map{"token": resetToken, "new_password": "enigma-4"})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "invalid_reset_token")
+
+	env.login("alan", "enigma-3")
+}
+
+// stalledEmails holds back reset and verification emails until released.
+type stalledEmails struct {
+	services.IdentityProvider
+	release chan struct{}
+	sent    chan string
+}
+
+func (s *stalledEmails) ForgotPassword(ctx context.Context, email string) error {
+	<-s.release
+	s.sent <- "reset:" + email
+	return nil
+}
+
+func (s *stalledEmails) SendVerificationEmail(ctx context.Context, email string) error {
+	<-s.release
+	s.sent <- "verify:" + email
+	return nil
+}
+
+func TestAccountEmailsDoNotDelayResponse(t *testing.T) {
+	provider, err := services.NewMemoryProvider("http://auth.test/realms/test", config.Default().Keycloak.ClientID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := &stalledEmails{IdentityProvider: provider, release: make(chan struct{}), sent: make(chan string, 2)}
+	cfg := config.Default()
+	limiter := ratelimit.NewLimiter(kvstore.NewMemoryStore(),
+		ratelimit.Rule{Limit: 1000, Window: time.Minute},
+		ratelimit.Rule{Limit: 1000, Window: time.Minute},
+		ratelimit.LockoutPolicy{Threshold: 3, Base: time.Minute, Max: time.Hour})
+	app, _ := buildApp(t, cfg, limiter, identity, nil, nil, false)
+
+	for _, path := range []string{"/api/v1/password/forgot", "/api/v1/email/verify/resend"} {
+		payload, _ := json.Marshal(fiber.Map{"email": "ada@example.com"})
+		req := httptest.NewRequest("POST", path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req, 2000)
+		if err != nil {
+			t.Fatalf("%s waited for the email: %v", path, err)
+		}
+		if resp.StatusCode != fiber.StatusAccepted {
+			t.Fatalf("%s: got status %d, want 202", path, resp.StatusCode)
+		}
+	}
+
+	close(identity.release)
+	want := map[string]bool{"reset:ada@example.com": true, "verify:ada@example.com": true}
+	for range want {
+		select {
+		case got := <-identity.sent:
+			if !want[got] {
+				t.Fatalf("unexpected email %q", got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("detached emails were not sent")
+		}
+	}
+}
+
+func TestAdminRoutes(t *testing.T) {
+	env := newTestEnv(t)
+	userID := env.addUser("barbara", "liskov-sub")
+	env.addUser("root", "super-secret", "admin")
+	userToken, _ := env.login("barbara", "liskov-sub")
+	adminToken, adminRefresh := env.login("root", "super-secret")
+
+	resp, body := env.do("GET", "/api/v1/user/"+userID, userToken, nil)
+	expectProblem(t, resp, body, fiber.StatusForbidden, "insufficient_role")
+
+	resp, body = env.do("GET", "/api/v1/user/"+userID, adminToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["username"] != "barbara" {
+		t.Fatalf("unexpected user %v", body)
+	}
+
+	resp, body = env.do("DELETE", "/api/v1/user/"+userID, adminToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	resp, body = env.do("GET", "/api/v1/user/"+userID, adminToken, nil)
+	expectProblem(t, resp, body, fiber.StatusNotFound, "user_not_found")
+
+	// Admin routes introspect, so a logged out token stops working at once.
+	resp, body = env.do("POST", "/api/v1/logout", "", fiber.Map{"refresh_token": adminRefresh})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	resp, body = env.do("GET", "/api/v1/user/"+userID, adminToken, nil)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "session_expired")
+}
+
+func TestLoginLockout(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("mallory", "correct-horse")
+
+	for i := 0; i < 3; i++ {
+		resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": "mallory", "password": "guess"})
+		expectProblem(t, resp, body, fiber.StatusUnauthorized, "invalid_credentials")
+	}
+
+	resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": "mallory", "password": "correct-horse"})
+	expectProblem(t, resp, body, fiber.StatusTooManyRequests, "account_locked")
+	if resp.Header.Get(fiber.HeaderRetryAfter) == "" {
+		t.Fatal("missing Retry-After header")
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("ada", "analytical-engine")
+	accessToken, _ := env.login("ada", "analytical-engine")
+	cookie := func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: "access_token", Value: accessToken})
+	}
+	header := func(name, value string) func(*http.Request) {
+		return func(req *http.Request) { req.Header.Set(name, value) }
+	}
+
+	resp, body := env.do("GET", "/api/v1/csrf", "", nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	token := body["csrf_token"].(string)
+	csrfCookie := responseCookie(resp, "csrf_token")
+	if csrfCookie == nil || csrfCookie.Value != token || !csrfCookie.HttpOnly {
+		t.Fatalf("unexpected csrf_token cookie %+v", csrfCookie)
+	}
+
+	// An existing token is handed out again, so parallel tabs keep working.
+	resp, body = env.do("GET", "/api/v1/csrf", "", nil, withCSRF(token))
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["csrf_token"] != token {
+		t.Fatal("csrf token rotated on every fetch")
+	}
+
+	// Safe methods and bearer tokens are not subject to the check.
+	resp, body = env.do("GET", "/api/v1/user/me/sessions", "", nil, cookie)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions", accessToken, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions", "", nil, cookie)
+	expectProblem(t, resp, body, fiber.StatusForbidden, "csrf_token_invalid")
+
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions", "", nil, cookie, withCSRF(token), header("X-CSRF-Token", "forged"))
+	expectProblem(t, resp, body, fiber.StatusForbidden, "csrf_token_invalid")
+
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions", "", nil, cookie, withCSRF(token), header("Origin", "https://evil.example"))
+	expectProblem(t, resp, body, fiber.StatusForbidden, "csrf_origin_not_allowed")
+
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions", "", nil, cookie, withCSRF(token), header("Referer", "https://evil.example/page"))
+	expectProblem(t, resp, body, fiber.StatusForbidden, "csrf_origin_not_allowed")
+
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions", "", nil, cookie, withCSRF(token), header("Origin", "http://localhost:3000"))
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	resp, body = env.do("DELETE", "/api/v1/user/me/sessions", "", nil, cookie, withCSRF(token), header("Referer", "http://localhost:3000/settings"))
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	// Logout reads the cookies, so it is protected as well.
+	resp, body = env.do("POST", "/api/v1/logout", "", nil, cookie)
+	expectProblem(t, resp, body, fiber.StatusForbidden, "csrf_token_invalid")
+}
+
+// forwardedFor sets the X-Forwarded-For header. Requests of app.Test come
+// from 0.0.0.0, which is the proxy the tests trust when they trust one.
+func forwardedFor(ip string) func(*http.Request) {
+	return func(req *http.Request) { req.Header.Set(fiber.HeaderXForwardedFor, ip) }
+}
+
+func TestRateLimitIgnoresForgedForwardingHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		proxies []string
+		limited bool
+	}{
+		{"untrusted peer", []string{"10.0.0.1"}, true},
+		{"no trusted proxies", nil, true},
+		{"trusted proxy", []string{"0.0.0.0/32"}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := services.NewMemoryProvider("http://auth.test/realms/test", config.Default().Keycloak.ClientID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := config.Default()
+			cfg.Server.ProxyHeader = fiber.HeaderXForwardedFor
+			cfg.Server.TrustedProxies = tt.proxies
+			limiter := ratelimit.NewLimiter(kvstore.NewMemoryStore(),
+				ratelimit.Rule{Limit: 2, Window: time.Minute},
+				ratelimit.Rule{Limit: 1000, Window: time.Minute},
+				ratelimit.LockoutPolicy{Threshold: 1000, Base: time.Minute, Max: time.Hour})
+			app, mfa := newAppWithLimiter(t, cfg, limiter, provider, nil, nil)
+			env := &testEnv{t: t, app: app, mfa: mfa, provider: provider}
+			env.addUser("ada", "analytical-engine")
+
+			login := fiber.Map{"username": "ada", "password": "analytical-engine"}
+			for _, ip := range []string{"203.0.113.1", "203.0.113.2"} {
+				resp, body := env.do("POST", "/api/v1/login", "", login, forwardedFor(ip))
+				expectStatus(t, resp, body, fiber.StatusOK)
+			}
+			// A fresh forwarded IP only opens a new bucket when a trusted
+			// proxy set it.
+			resp, body := env.do("POST", "/api/v1/login", "", login, forwardedFor("203.0.113.3"))
+			if tt.limited {
+				expectProblem(t, resp, body, fiber.StatusTooManyRequests, "rate_limited")
+			} else {
+				expectStatus(t, resp, body, fiber.StatusOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package routes
+
+import (
+	"auth-service/internal/testing/fakekeycloak"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// loginSession logs in through /login in session mode and returns the
+// session_id cookie value.
+func (env *testEnv) loginSession(username, password string) string {
+	env.t.Helper()
+	resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": username, "password": password})
+	expectStatus(env.t, resp, body, fiber.StatusOK)
+	cookie := responseCookie(resp, "session_id")
+	if cookie == nil || cookie.Value == "" {
+		env.t.Fatalf("session_id cookie not set (body %v)", body)
+	}
+	return cookie.Value
+}
+
+func expectCookieCleared(t *testing.T, resp *http.Response, name string) {
+	t.Helper()
+	if cookie := responseCookie(resp, name); cookie == nil || cookie.Expires.IsZero() || cookie.Expires.After(time.Now()) {
+		t.Fatalf("%s cookie not cleared: %+v", name, cookie)
+	}
+}
+
+func TestKeycloakSessionLogin(t *testing.T) {
+	env, kc, _ := newKeycloakSessionEnv(t)
+	userID := addKeycloakUser(kc, "grace", "cobol-rules")
+
+	resp, body := env.do("POST", "/api/v1/login", "", fiber.Map{"username": "grace", "password": "cobol-rules"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if _, ok := body["user"]; ok {
+		t.Fatalf("tokens returned in session mode: %v", body)
+	}
+	session, _ := body["session"].(map[string]interface{})
+	if session["username"] != "grace" || session["user_id"] != userID {
+		t.Fatalf("unexpected session info %v", body)
+	}
+	if responseCookie(resp, "access_token") != nil || responseCookie(resp, "refresh_token") != nil {
+		t.Fatal("token cookies set in session mode")
+	}
+	cookie := responseCookie(resp, "session_id")
+	if cookie == nil || cookie.Value == "" || !cookie.HttpOnly || cookie.MaxAge != int((12*time.Hour).Seconds()) {
+		t.Fatalf("unexpected session_id cookie %+v", cookie)
+	}
+	sessionCookie := withCookies(map[string]string{"session_id": cookie.Value})
+	csrf := withCSRF(env.csrfToken())
+
+	resp, body = env.do("GET", "/api/v1/user/me", "", nil, sessionCookie)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["id"] != userID {
+		t.Fatalf("unexpected profile %v", body)
+	}
+
+	resp, body = env.do("GET", "/api/v1/me", "", nil, sessionCookie)
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	resp, body = env.do("POST", "/api/v1/refresh", "", nil, csrf, sessionCookie)
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	resp, body = env.do("GET", "/api/v1/user/me", "", nil, withCookies(map[string]string{"session_id": "bogus"}))
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "session_expired")
+	expectCookieCleared(t, resp, "session_id")
+
+	resp, body = env.do("POST", "/api/v1/logout", "", nil, csrf, sessionCookie)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	expectCookieCleared(t, resp, "session_id")
+	if n := len(kc.Sessions(userID)); n != 0 {
+		t.Fatalf("%d Keycloak sessions left after logout", n)
+	}
+
+	resp, body = env.do("GET", "/api/v1/user/me", "", nil, sessionCookie)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "session_expired")
+	resp, body = env.do("POST", "/api/v1/refresh", "", nil, csrf, sessionCookie)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "session_expired")
+}
+
+func TestKeycloakSessionRefreshesExpiringToken(t *testing.T) {
+	env, kc, _ := newKeycloakSessionEnv(t)
+	addKeycloakUser(kc, "ada", "analytical-engine")
+	addKeycloakUser(kc, "grace", "cobol-rules")
+
+	// Fetch and cache the admin token first, it is requested from the token
+	// endpoint as well.
+	resp, body := env.do("GET", "/api/v1/user/me", "", nil, withCookies(map[string]string{
+		"session_id": env.loginSession("ada", "analytical-engine"),
+	}))
+	expectStatus(t, resp, body, fiber.StatusOK)
+
+	kc.AccessTokenTTL = 10 * time.Second
+	sessionID := env.loginSession("grace", "cobol-rules")
+	kc.AccessTokenTTL = 5 * time.Minute
+
+	before := kc.Calls(fakekeycloak.OpToken)
+	resp, body = env.do("GET", "/api/v1/user/me", "", nil, withCookies(map[string]string{"session_id": sessionID}))
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["username"] != "grace" {
+		t.Fatalf("unexpected profile %v", body)
+	}
+	if calls := kc.Calls(fakekeycloak.OpToken) - before; calls != 1 {
+		t.Fatalf("token endpoint called %d times, want 1 refresh", calls)
+	}
+
+	resp, body = env.do("GET", "/api/v1/user/me", "", nil, withCookies(map[string]string{"session_id": sessionID}))
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if calls := kc.Calls(fakekeycloak.OpToken) - before; calls != 1 {
+		t.Fatalf("token refreshed again although it is still valid (%d calls)", calls)
+	}
+}
+
+func TestKeycloakSessionKeepsWorkingWhileKeycloakIsDown(t *testing.T) {
+	env, kc, _ := newKeycloakSessionEnv(t)
+	addKeycloakUser(kc, "grace", "cobol-rules")
+
+	kc.AccessTokenTTL = 10 * time.Second
+	sessionID := env.loginSession("grace", "cobol-rules")
+	kc.AccessTokenTTL = 5 * time.Minute
+	sessionCookie := withCookies(map[string]string{"session_id": sessionID})
+	csrf := withCSRF(env.csrfToken())
+
+	kc.Fail(fakekeycloak.OpToken, fiber.StatusServiceUnavailable)
+	resp, body := env.do("POST", "/api/v1/refresh", "", nil, csrf, sessionCookie)
+	expectProblem(t, resp, body, fiber.StatusServiceUnavailable, "keycloak_unavailable")
+	if responseCookie(resp, "session_id") != nil {
+		t.Fatal("session cookie touched although Keycloak was only unavailable")
+	}
+
+	kc.Recover(fakekeycloak.OpToken)
+	resp, body = env.do("GET", "/api/v1/user/me", "", nil, sessionCookie)
+	expectStatus(t, resp, body, fiber.StatusOK)
+}
+
+func TestKeycloakOIDCLoginStartsSession(t *testing.T) {
+	env, kc, _ := newKeycloakSessionEnv(t)
+	userID := addKeycloakUser(kc, "ada", "analytical-engine")
+
+	loginURL, state := env.startOIDCLogin("/dashboard")
+	callback := signIn(t, loginURL, "ada", "analytical-engine")
+	resp, _ := env.do("GET", callback, "", nil, withCookies(map[string]string{"oidc_state": state.Value}))
+	expectRedirect(t, resp, "http://app.test/dashboard")
+
+	if responseCookie(resp, "access_token") != nil || responseCookie(resp, "refresh_token") != nil {
+		t.Fatal("token cookies set in session mode")
+	}
+	cookie := responseCookie(resp, "session_id")
+	if cookie == nil || cookie.Value == "" {
+		t.Fatal("session_id cookie not set")
+	}
+
+	resp, body := env.do("GET", "/api/v1/user/me", "", nil, withCookies(map[string]string{"session_id": cookie.Value}))
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["id"] != userID {
+		t.Fatalf("unexpected profile %v", body)
+	}
+}
@@ -0,0 +1,94 @@
+package routes
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRequestValidation(t *testing.T) {
+	env := newTestEnv(t)
+
+	resp, body := env.do("POST", "/api/v1/register", "", fiber.Map{
+		"firstname": "Ada",
+		"lastname":  "Lovelace",
+		"username":  "ada lovelace",
+		"email":     "ada.example.com",
+		"password":  "analytical-engine",
+	})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "invalid_fields")
+	errs, _ := body["errors"].([]interface{})
+	if len(errs) != 2 || errs[0].(map[string]interface{})["code"] != "invalid_username" || errs[1].(map[string]interface{})["code"] != "invalid_email" {
+		t.Fatalf("unexpected field errors %v", body["errors"])
+	}
+
+	resp, body = env.do("POST", "/api/v1/login", "", fiber.Map{"username": "ada"})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+	expectFieldErrors(t, body, "password", "required")
+
+	resp, body = env.do("POST", "/api/v1/password/forgot", "", fiber.Map{"email": "not-an-email"})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "invalid_fields")
+	expectFieldErrors(t, body, "email", "invalid_email")
+}
+
+func TestMFARequestValidation(t *testing.T) {
+	env := newTestEnv(t)
+	env.addUser("ada", "analytical-engine")
+	accessToken, _ := env.login("ada", "analytical-engine")
+
+	resp, body := env.do("POST", "/api/v1/login/mfa", "", fiber.Map{"challenge_id": "c1", "code": " "})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+	expectFieldErrors(t, body, "code", "required")
+
+	resp, body = env.do("POST", "/api/v1/user/me/mfa/totp", accessToken, fiber.Map{"label": strings.Repeat("x", 65)})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "invalid_fields")
+	expectFieldErrors(t, body, "label", "too_long")
+
+	resp, body = env.do("POST", "/api/v1/user/me/mfa/totp/f1/confirm", accessToken, nil)
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+	expectFieldErrors(t, body, "code", "required")
+
+	resp, body = env.do("POST", "/api/v1/webauthn/login/finish", "", fiber.Map{"ceremony_id": "c1", "credential": nil})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+	expectFieldErrors(t, body, "credential", "required")
+}
+
+func TestUpdateUserKeepsOmittedFields(t *testing.T) {
+	env := newTestEnv(t)
+	userID := env.addUser("ada", "analytical-engine")
+	env.addUser("root", "cobol-rules", "admin")
+	accessToken, _ := env.login("ada", "analytical-engine")
+	adminToken, _ := env.login("root", "cobol-rules")
+
+	expectProfile := func(firstName, lastName string) {
+		t.Helper()
+		resp, body := env.do("GET", "/api/v1/user/"+userID, adminToken, nil)
+		expectStatus(t, resp, body, fiber.StatusOK)
+		if body["username"] != "ada" || body["email"] != "ada@example.com" || body["firstName"] != firstName || body["lastName"] != lastName {
+			t.Fatalf("unexpected profile %v", body)
+		}
+	}
+
+	resp, body := env.do("PUT", "/api/v1/user/me", accessToken, fiber.Map{"firstname": "Augusta", "lastname": "Lovelace"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	expectProfile("Augusta", "Lovelace")
+
+	// Blank values are rejected rather than wiping the field.
+	resp, body = env.do("PUT", "/api/v1/user/"+userID, adminToken, fiber.Map{"firstname": " ", "username": ""})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+	errs, _ := body["errors"].([]interface{})
+	if len(errs) != 2 {
+		t.Fatalf("unexpected field errors %v", body["errors"])
+	}
+	resp, body = env.do("PUT", "/api/v1/user/me", accessToken, fiber.Map{"email": ""})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+	expectFieldErrors(t, body, "email", "required")
+	resp, body = env.do("PUT", "/api/v1/user/me", accessToken, fiber.Map{})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+	expectProfile("Augusta", "Lovelace")
+
+	resp, body = env.do("PUT", "/api/v1/user/"+userID, adminToken, fiber.Map{"lastname": "King"})
+	expectStatus(t, resp, body, fiber.StatusOK)
+	expectProfile("Augusta", "King")
+}
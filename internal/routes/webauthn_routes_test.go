@@ -0,0 +1,164 @@
+package routes
+
+import (
+	"auth-service/internal/config"
+	"auth-service/internal/testing/softauthn"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newPasskey returns an authenticator on the origin the default config
+// trusts.
+func newPasskey() *softauthn.Authenticator {
+	return softauthn.New(config.Default().WebAuthn.RPOrigins[0])
+}
+
+// answer passes the options of a begun ceremony to the authenticator and
+// returns the finish request body.
+func (env *testEnv) answer(body map[string]interface{}, respond func([]byte) ([]byte, error)) fiber.Map {
+	env.t.Helper()
+	options, err := json.Marshal(body["options"])
+	if err != nil {
+		env.t.Fatal(err)
+	}
+	credential, err := respond(options)
+	if err != nil {
+		env.t.Fatalf("authenticator: %v", err)
+	}
+	return fiber.Map{"ceremony_id": body["ceremony_id"], "credential": json.RawMessage(credential)}
+}
+
+// registerPasskey registers a passkey on authenticator for the owner of token.
+func (env *testEnv) registerPasskey(token string, authenticator *softauthn.Authenticator) {
+	env.t.Helper()
+	resp, body := env.do("POST", "/api/v1/webauthn/register/begin", token, nil)
+	expectStatus(env.t, resp, body, fiber.StatusOK)
+	finish := env.answer(body, authenticator.Register)
+	finish["label"] = "laptop"
+	resp, body = env.do("POST", "/api/v1/webauthn/register/finish", token, finish)
+	expectStatus(env.t, resp, body, fiber.StatusCreated)
+}
+
+// passkeyLogin logs in with authenticator.
+func (env *testEnv) passkeyLogin(authenticator *softauthn.Authenticator) (*http.Response, map[string]interface{}) {
+	env.t.Helper()
+	resp, body := env.do("POST", "/api/v1/webauthn/login/begin", "", nil)
+	expectStatus(env.t, resp, body, fiber.StatusOK)
+	return env.do("POST", "/api/v1/webauthn/login/finish", "", env.answer(body, authenticator.Login))
+}
+
+func TestWebAuthnPasskeys(t *testing.T) {
+	env := newTestEnv(t)
+	userID := env.addUser("ada", "analytical-engine")
+	token, _ := env.login("ada", "analytical-engine")
+	authenticator := newPasskey()
+
+	resp, body := env.do("POST", "/api/v1/webauthn/register/begin", "", nil)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "authentication_required")
+
+	resp, body = env.do("POST", "/api/v1/webauthn/register/begin", token, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if resp.Header.Get(fiber.HeaderCacheControl) != "no-store" {
+		t.Fatal("ceremony options may be cached")
+	}
+	finish := env.answer(body, authenticator.Register)
+	resp, body = env.do("POST", "/api/v1/webauthn/register/finish", token, fiber.Map{"ceremony_id": finish["ceremony_id"]})
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "missing_fields")
+	resp, body = env.do("POST", "/api/v1/webauthn/register/finish", token, finish)
+	expectStatus(t, resp, body, fiber.StatusCreated)
+	credential, _ := body["credential"].(map[string]interface{})
+	if credential["label"] != "Passkey" || credential["id"] == "" {
+		t.Fatalf("unexpected credential %v", body)
+	}
+	resp, body = env.do("POST", "/api/v1/webauthn/register/finish", token, finish)
+	expectProblem(t, resp, body, fiber.StatusBadRequest, "webauthn_ceremony_expired")
+
+	resp, body = env.passkeyLogin(authenticator)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	tokens, _ := body["user"].(map[string]interface{})
+	access, _ := tokens["access_token"].(string)
+	if access == "" || responseCookie(resp, "access_token") == nil || responseCookie(resp, "refresh_token") == nil {
+		t.Fatalf("passkey login did not hand out tokens like /login: %v", body)
+	}
+	resp, body = env.do("GET", "/api/v1/user/me", access, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["id"] != userID {
+		t.Fatalf("logged in as %v", body["id"])
+	}
+
+	// A passkey registered for another origin does not work here.
+	phishing := softauthn.New("http://localhost:3000.evil.test")
+	env.registerPasskeyFails(token, phishing)
+
+	authenticator.SkipUserVerification = true
+	resp, body = env.passkeyLogin(authenticator)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "webauthn_login_failed")
+}
+
+// registerPasskeyFails expects registering a passkey on authenticator to be
+// rejected.
+func (env *testEnv) registerPasskeyFails(token string, authenticator *softauthn.Authenticator) {
+	env.t.Helper()
+	resp, body := env.do("POST", "/api/v1/webauthn/register/begin", token, nil)
+	expectStatus(env.t, resp, body, fiber.StatusOK)
+	resp, body = env.do("POST", "/api/v1/webauthn/register/finish", token, env.answer(body, authenticator.Register))
+	expectProblem(env.t, resp, body, fiber.StatusBadRequest, "webauthn_registration_failed")
+}
+
+func TestKeycloakWebAuthnLogin(t *testing.T) {
+	env, kc := newKeycloakEnv(t)
+	userID := addKeycloakUser(kc, "grace", "cobol-rules")
+	token, _ := env.login("grace", "cobol-rules")
+	authenticator := newPasskey()
+	env.registerPasskey(token, authenticator)
+
+	resp, body := env.passkeyLogin(authenticator)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	tokens, _ := body["user"].(map[string]interface{})
+	access, _ := tokens["access_token"].(string)
+	resp, body = env.do("GET", "/api/v1/user/me", access, nil)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["id"] != userID {
+		t.Fatalf("logged in as %v", body["id"])
+	}
+
+	kc.DenyImpersonation = true
+	resp, body = env.passkeyLogin(authenticator)
+	expectProblem(t, resp, body, fiber.StatusInternalServerError, "internal_error")
+	kc.DenyImpersonation = false
+
+	kc.SetEnabled(userID, false)
+	resp, body = env.passkeyLogin(authenticator)
+	expectProblem(t, resp, body, fiber.StatusUnauthorized, "account_unavailable")
+}
+
+func TestKeycloakWebAuthnLoginStartsSession(t *testing.T) {
+	env, kc, _ := newKeycloakSessionEnv(t)
+	userID := addKeycloakUser(kc, "grace", "cobol-rules")
+	session := env.loginSession("grace", "cobol-rules")
+	authenticator := newPasskey()
+
+	sessionCookie := withCookies(map[string]string{"session_id": session})
+	csrf := withCSRF(env.csrfToken())
+	resp, body := env.do("POST", "/api/v1/webauthn/register/begin", "", nil, sessionCookie)
+	expectProblem(t, resp, body, fiber.StatusForbidden, "csrf_token_invalid")
+	resp, body = env.do("POST", "/api/v1/webauthn/register/begin", "", nil, csrf, sessionCookie)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	resp, body = env.do("POST", "/api/v1/webauthn/register/finish", "", env.answer(body, authenticator.Register), csrf, sessionCookie)
+	expectStatus(t, resp, body, fiber.StatusCreated)
+
+	resp, body = env.passkeyLogin(authenticator)
+	expectStatus(t, resp, body, fiber.StatusOK)
+	cookie := responseCookie(resp, "session_id")
+	if cookie == nil || cookie.Value == "" || cookie.Value == session {
+		t.Fatalf("passkey login did not start a session: %+v", cookie)
+	}
+	resp, body = env.do("GET", "/api/v1/user/me", "", nil, withCookies(map[string]string{"session_id": cookie.Value}))
+	expectStatus(t, resp, body, fiber.StatusOK)
+	if body["id"] != userID {
+		t.Fatalf("logged in as %v", body["id"])
+	}
+}
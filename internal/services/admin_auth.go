@@ -0,0 +1,89 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// AdminAuthStrategy selects how the service authenticates against the
+// Keycloak admin API.
+type AdminAuthStrategy string
+
+const (
+	// AdminAuthPassword logs in as a (human) admin user with username/password.
+	AdminAuthPassword AdminAuthStrategy = "password"
+	// AdminAuthClientCredentials uses the client's service account via the
+	// client-credentials grant. The service account needs the realm-management
+	// roles for the operations the service performs (manage-users, view-users).
+	AdminAuthClientCredentials AdminAuthStrategy = "client_credentials"
+)
+
+var ErrAdminAuthNotConfigured = errors.New("keycloak admin authentication is not configured")
+
+// AdminAuthConfig holds the credentials for the selected admin strategy.
+type AdminAuthConfig struct {
+	Strategy AdminAuthStrategy
+
+	// Password strategy
+	Username string
+	Password string
+	Realm    string
+
+	// Client credentials strategy, defaults to the service's own client.
+	ClientID     string
+	ClientSecret string
+}
+
+// resolve fills in defaults and picks a strategy when none was set
+// explicitly. It fails when the chosen strategy lacks credentials.
+func (cfg AdminAuthConfig) resolve(clientID, clientSecret, realm string) (AdminAuthConfig, error) {
+	if cfg.ClientID == "" {
+		cfg.ClientID = clientID
+		if cfg.ClientSecret == "" {
+			cfg.ClientSecret = clientSecret
+		}
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = realm
+	}
+
+	if cfg.Strategy == "" {
+		switch {
+		case cfg.Username != "" && cfg.Password != "":
+			cfg.Strategy = AdminAuthPassword
+		case cfg.ClientID != "" && cfg.ClientSecret != "":
+			cfg.Strategy = AdminAuthClientCredentials
+		default:
+			return cfg, ErrAdminAuthNotConfigured
+		}
+	}
+
+	switch cfg.Strategy {
+	case AdminAuthPassword:
+		if cfg.Username == "" || cfg.Password == "" {
+			return cfg, fmt.Errorf("%w: password strategy requires admin username and password", ErrAdminAuthNotConfigured)
+		}
+	case AdminAuthClientCredentials:
+		if cfg.ClientID == "" || cfg.ClientSecret == "" {
+			return cfg, fmt.Errorf("%w: client_credentials strategy requires client id and secret", ErrAdminAuthNotConfigured)
+		}
+	default:
+		return cfg, fmt.Errorf("%w: unknown strategy %q", ErrAdminAuthNotConfigured, cfg.Strategy)
+	}
+	return cfg, nil
+}
+
+// loginFunc returns the admin login for the configured strategy.
+func (cfg AdminAuthConfig) loginFunc(client *gocloak.GoCloak) func(ctx context.Context) (*gocloak.JWT, error) {
+	if cfg.Strategy == AdminAuthClientCredentials {
+		return func(ctx context.Context) (*gocloak.JWT, error) {
+			return client.LoginClient(ctx, cfg.ClientID, cfg.ClientSecret, cfg.Realm)
+		}
+	}
+	return func(ctx context.Context) (*gocloak.JWT, error) {
+		return client.LoginAdmin(ctx, cfg.Username, cfg.Password, cfg.Realm)
+	}
+}
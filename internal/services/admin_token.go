@@ -0,0 +1,106 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// adminTokenRefreshMargin is how long before expiry a cached admin token is
+// replaced, so callers never receive a token that expires mid-request.
+const adminTokenRefreshMargin = 30 * time.Second
+
+// adminTokenLoginTimeout bounds the shared admin login. It does not use the
+// context of the caller that started it, whose cancellation would otherwise
+// fail every caller waiting for the same login.
+const adminTokenLoginTimeout = 15 * time.Second
+
+// adminTokenProvider caches the admin access token and refreshes it shortly
+// before it expires. Concurrent callers share a single in-flight login.
+type adminTokenProvider struct {
+	fetch func(ctx context.Context) (*gocloak.JWT, error)
+	now   func() time.Time
+
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+	inflight  *adminTokenCall
+}
+
+type adminTokenCall struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+func newAdminTokenProvider(fetch func(ctx context.Context) (*gocloak.JWT, error)) *adminTokenProvider {
+	return &adminTokenProvider{
+		fetch: fetch,
+		now:   time.Now,
+	}
+}
+
+// Token returns a valid admin access token, logging in only when the cached
+// one is missing or about to expire.
+func (p *adminTokenProvider) Token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	if p.token != "" && p.now().Before(p.refreshAt) {
+		token := p.token
+		p.mu.Unlock()
+		return token, nil
+	}
+
+	// Join the login in flight or start one.
+	call := p.inflight
+	if call == nil {
+		call = &adminTokenCall{done: make(chan struct{})}
+		p.inflight = call
+		go p.login(context.WithoutCancel(ctx), call)
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.token, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (p *adminTokenProvider) login(ctx context.Context, call *adminTokenCall) {
+	ctx, cancel := context.WithTimeout(ctx, adminTokenLoginTimeout)
+	defer cancel()
+
+	issuedAt := p.now()
+	jwt, err := p.fetch(ctx)
+
+	p.mu.Lock()
+	p.inflight = nil
+	if err == nil {
+		lifetime := time.Duration(jwt.ExpiresIn) * time.Second
+		margin := adminTokenRefreshMargin
+		if margin > lifetime/2 {
+			margin = lifetime / 2
+		}
+		p.token = jwt.AccessToken
+		p.refreshAt = issuedAt.Add(lifetime - margin)
+		call.token = jwt.AccessToken
+	}
+	call.err = err
+	p.mu.Unlock()
+
+	close(call.done)
+}
+
+// invalidate drops the cached token if it still is token, so the next call
+// logs in again.
+func (p *adminTokenProvider) invalidate(token string) {
+	p.mu.Lock()
+	if p.token == token {
+		p.token = ""
+		p.refreshAt = time.Time{}
+	}
+	p.mu.Unlock()
+}
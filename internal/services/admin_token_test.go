@@ -0,0 +1,262 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"auth-service/internal/testing/fakekeycloak"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+func newTestProvider(expiresIn int, login func(n int32) (*gocloak.JWT, error)) (*adminTokenProvider, *fakeClock, *int32) {
+	var calls int32
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	p := newAdminTokenProvider(func(ctx context.Context) (*gocloak.JWT, error) {
+		n := atomic.AddInt32(&calls, 1)
+		if login != nil {
+			return login(n)
+		}
+		return &gocloak.JWT{AccessToken: fmt.Sprintf("token-%d", n), ExpiresIn: expiresIn}, nil
+	})
+	p.now = clock.Now
+	return p, clock, &calls
+}
+
+func TestAdminTokenProviderCachesUntilRefreshMargin(t *testing.T) {
+	p, clock, calls := newTestProvider(300, nil)
+	ctx := context.Background()
+
+	first, err := p.Token(ctx)
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+
+	clock.Advance(300*time.Second - adminTokenRefreshMargin - time.Second)
+	second, err := p.Token(ctx)
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if first != second || atomic.LoadInt32(calls) != 1 {
+		t.Fatalf("expected cached token, got %q then %q after %d logins", first, second, *calls)
+	}
+
+	clock.Advance(2 * time.Second)
+	third, err := p.Token(ctx)
+	if err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if third == first || atomic.LoadInt32(calls) != 2 {
+		t.Fatalf("expected refresh inside the margin, got %q after %d logins", third, *calls)
+	}
+}
+
+func TestAdminTokenProviderShortLivedToken(t *testing.T) {
+	// A 40s token must not be considered stale right away because of the 30s margin.
+	p, clock, calls := newTestProvider(40, nil)
+	ctx := context.Background()
+
+	if _, err := p.Token(ctx); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	clock.Advance(10 * time.Second)
+	if _, err := p.Token(ctx); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Fatalf("expected 1 login, got %d", got)
+	}
+
+	clock.Advance(15 * time.Second)
+	if _, err := p.Token(ctx); err != nil {
+		t.Fatalf("Token: %v", err)
+	}
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Fatalf("expected 2 logins, got %d", got)
+	}
+}
+
+func TestAdminTokenProviderSingleFlight(t *testing.T) {
+	release := make(chan struct{})
+	p, _, calls := newTestProvider(0, func(n int32) (*gocloak.JWT, error) {
+		<-release
+		return &gocloak.JWT{AccessToken: "shared", ExpiresIn: 300}, nil
+	})
+
+	const callers = 50
+	var wg sync.WaitGroup
+	tokens := make([]string, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tokens[i], errs[i] = p.Token(context.Background())
+		}(i)
+	}
+
+	// Give every caller a chance to queue up behind the first login.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(calls); got != 1 {
+		t.Fatalf("expected a single login, got %d", got)
+	}
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil || tokens[i] != "shared" {
+			t.Fatalf("caller %d got %q, %v", i, tokens[i], errs[i])
+		}
+	}
+}
+
+func TestAdminTokenProviderDoesNotCacheErrors(t *testing.T) {
+	loginErr := errors.New("keycloak unavailable")
+	p, _, calls := newTestProvider(0, func(n int32) (*gocloak.JWT, error) {
+		if n == 1 {
+			return nil, loginErr
+		}
+		return &gocloak.JWT{AccessToken: "recovered", ExpiresIn: 300}, nil
+	})
+	ctx := context.Background()
+
+	if _, err := p.Token(ctx); !errors.Is(err, loginErr) {
+		t.Fatalf("expected login error, got %v", err)
+	}
+	token, err := p.Token(ctx)
+	if err != nil || token != "recovered" {
+		t.Fatalf("expected recovery, got %q, %v", token, err)
+	}
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Fatalf("expected 2 logins, got %d", got)
+	}
+}
+
+func TestAdminTokenProviderWaiterHonoursContext(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	p, _, _ := newTestProvider(0, func(n int32) (*gocloak.JWT, error) {
+		<-release
+		return &gocloak.JWT{AccessToken: "late", ExpiresIn: 300}, nil
+	})
+
+	go p.Token(context.Background())
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := p.Token(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestAdminTokenProviderSurvivesLeaderCancellation(t *testing.T) {
+	release := make(chan struct{})
+	loginErr := make(chan error, 1)
+	p := newAdminTokenProvider(func(ctx context.Context) (*gocloak.JWT, error) {
+		<-release
+		if _, ok := ctx.Deadline(); !ok {
+			loginErr <- errors.New("login without deadline")
+		} else {
+			loginErr <- ctx.Err()
+		}
+		return &gocloak.JWT{AccessToken: "shared", ExpiresIn: 300}, nil
+	})
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leader := make(chan error, 1)
+	go func() {
+		_, err := p.Token(leaderCtx)
+		leader <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	follower := make(chan string, 1)
+	go func() {
+		token, _ := p.Token(context.Background())
+		follower <- token
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	cancelLeader()
+	if err := <-leader; !errors.Is(err, context.Canceled) {
+		t.Fatalf("leader err = %v, want context.Canceled", err)
+	}
+	close(release)
+
+	if err := <-loginErr; err != nil {
+		t.Fatalf("login context: %v", err)
+	}
+	if token := <-follower; token != "shared" {
+		t.Fatalf("follower token = %q, want shared", token)
+	}
+}
+
+func TestAdminTokenProviderInvalidate(t *testing.T) {
+	p, _, calls := newTestProvider(300, nil)
+	ctx := context.Background()
+
+	first, _ := p.Token(ctx)
+	p.invalidate(first)
+	second, err := p.Token(ctx)
+	if err != nil || second != "token-2" {
+		t.Fatalf("token after invalidate = %q, %v, want token-2", second, err)
+	}
+
+	// A late 401 for the replaced token keeps the new one.
+	p.invalidate(first)
+	if token, _ := p.Token(ctx); token != second {
+		t.Fatalf("token = %q, want %q", token, second)
+	}
+	if got := atomic.LoadInt32(calls); got != 2 {
+		t.Fatalf("expected 2 logins, got %d", got)
+	}
+}
+
+func TestKeycloakDropsRejectedAdminToken(t *testing.T) {
+	ctx := context.Background()
+	kc := fakekeycloak.New()
+	t.Cleanup(kc.Close)
+	ks, err := NewKeycloakService(kc.ClientID, kc.ClientSecret, kc.Realm, kc.URL, AdminAuthConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID := kc.AddUser(fakekeycloak.User{Username: "ada", Email: "ada@example.com", Password: "analytical-engine"})
+
+	if _, err := ks.GetUserByID(ctx, userID); err != nil {
+		t.Fatalf("GetUserByID: %v", err)
+	}
+
+	kc.RevokeAdminTokens()
+	if _, err := ks.GetUserByID(ctx, userID); err == nil {
+		t.Fatal("GetUserByID succeeded with a revoked admin token")
+	}
+	if _, err := ks.GetUserByID(ctx, userID); err != nil {
+		t.Fatalf("GetUserByID after the 401: %v", err)
+	}
+	if got := kc.Calls(fakekeycloak.OpToken); got != 2 {
+		t.Fatalf("%d admin logins, want 2", got)
+	}
+}
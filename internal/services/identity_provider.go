@@ -0,0 +1,51 @@
+package services
+
+import (
+	"auth-service/internal/models"
+	"context"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+// IdentityProvider is everything the HTTP layer needs from an identity
+// backend. KeycloakService talks to a Keycloak realm; MemoryProvider keeps
+// users and sessions in process, for tests and local development.
+//
+// Implementations report failures as apperr errors, using the sentinels of
+// this package (ErrInvalidCredentials, ErrUserNotFound, ...) where one fits.
+type IdentityProvider interface {
+	Login(ctx context.Context, login models.LoginParams) (*models.LoginResponse, error)
+	// Register creates the account. It does not send the verification
+	// email, so a failing mail server cannot fail the registration.
+	Register(ctx context.Context, register models.RegisterParams) error
+	// SendVerificationEmail sends the email verification link to the
+	// account with this email address. It returns ErrUserNotFound if there
+	// is none and ErrEmailAlreadyVerified if it is verified already.
+	SendVerificationEmail(ctx context.Context, email string) error
+	RefreshToken(ctx context.Context, refreshToken string) (*models.LoginResponse, error)
+	Logout(ctx context.Context, refreshToken string) error
+	// LoginAsUser issues tokens for a user without their password, for
+	// logins the service verified itself, e.g. with a passkey.
+	LoginAsUser(ctx context.Context, userID string) (*models.LoginResponse, error)
+
+	GetUserByID(ctx context.Context, userID string) (*gocloak.User, error)
+	UpdateUser(ctx context.Context, userID string, user gocloak.User) error
+	DeleteUser(ctx context.Context, userID string) error
+	// GetUserProfile returns the user the access token was issued to.
+	GetUserProfile(ctx context.Context, accessToken string) (*gocloak.User, error)
+
+	// VerifyToken checks signature, issuer, audience and expiry locally.
+	// Expired tokens yield an error wrapping jwt.ErrTokenExpired.
+	VerifyToken(ctx context.Context, accessToken string) (*TokenClaims, error)
+	// IntrospectToken reports whether the token is still active, which also
+	// catches tokens whose session was revoked.
+	IntrospectToken(ctx context.Context, accessToken string) (bool, error)
+
+	ForgotPassword(ctx context.Context, email string) error
+	ResetPassword(ctx context.Context, resetToken, newPassword string) error
+	ChangePassword(ctx context.Context, userID, username, currentPassword, newPassword, keepSessionID string) error
+
+	GetUserSessions(ctx context.Context, userID string) ([]models.SessionInfo, error)
+	RevokeUserSession(ctx context.Context, userID, sessionID string) error
+	RevokeOtherSessions(ctx context.Context, userID, keepSessionID string) error
+}
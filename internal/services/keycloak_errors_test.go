@@ -0,0 +1,45 @@
+package services
+
+import (
+	"auth-service/internal/apperr"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+func TestKeycloakErrorMapping(t *testing.T) {
+	known := map[int]*apperr.Error{
+		401: ErrInvalidCredentials,
+		409: ErrUserExists,
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want *apperr.Error
+	}{
+		{"known status", &gocloak.APIError{Code: 401}, ErrInvalidCredentials},
+		{"wrapped known status", fmt.Errorf("create: %w", &gocloak.APIError{Code: 409}), ErrUserExists},
+		{"transport error", errors.New("connection refused"), ErrKeycloakUnavailable},
+		{"server error", &gocloak.APIError{Code: 502}, ErrKeycloakUnavailable},
+		{"unexpected status", &gocloak.APIError{Code: 403}, apperr.Internal(nil)},
+		{"already typed", ErrSessionNotFound, ErrSessionNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := apperr.As(keycloakError(tt.err, known))
+			if !ok {
+				t.Fatalf("keycloakError returned %T, want *apperr.Error", got)
+			}
+			if got.Code != tt.want.Code || got.Kind != tt.want.Kind {
+				t.Fatalf("got %s (kind %d), want %s (kind %d)", got.Code, got.Kind, tt.want.Code, tt.want.Kind)
+			}
+			if tt.err != nil && !errors.Is(got, tt.err) {
+				t.Fatal("cause is not preserved")
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package services
+
+import (
+	"auth-service/internal/models"
+	"auth-service/internal/testing/fakekeycloak"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestKeycloakRegisterUndoesFailedSteps(t *testing.T) {
+	register := models.RegisterParams{
+		Firstname: "Ada",
+		Lastname:  "Lovelace",
+		Username:  "ada",
+		Email:     "ada@example.com",
+		Password:  "analytical-engine",
+	}
+
+	tests := []struct {
+		name      string
+		fail      map[fakekeycloak.Operation]int
+		password  string
+		step      string
+		want      error
+		undoFails bool
+	}{
+		{
+			name: "admin login",
+			fail: map[fakekeycloak.Operation]int{fakekeycloak.OpToken: http.StatusServiceUnavailable},
+			step: RegisterStepAdminToken,
+			want: ErrKeycloakUnavailable,
+		},
+		{
+			name: "create user",
+			fail: map[fakekeycloak.Operation]int{fakekeycloak.OpCreateUser: http.StatusBadGateway},
+			step: RegisterStepCreateUser,
+			want: ErrKeycloakUnavailable,
+		},
+		{
+			name:     "password rejected",
+			password: "short",
+			step:     RegisterStepSetPassword,
+			want:     ErrPasswordPolicy,
+		},
+		{
+			name: "set password",
+			fail: map[fakekeycloak.Operation]int{fakekeycloak.OpResetPassword: http.StatusServiceUnavailable},
+			step: RegisterStepSetPassword,
+			want: ErrKeycloakUnavailable,
+		},
+		{
+			name: "set password and undo",
+			fail: map[fakekeycloak.Operation]int{
+				fakekeycloak.OpResetPassword: http.StatusServiceUnavailable,
+				fakekeycloak.OpDeleteUser:    http.StatusServiceUnavailable,
+			},
+			step:      RegisterStepSetPassword,
+			want:      ErrKeycloakUnavailable,
+			undoFails: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			kc := fakekeycloak.New()
+			t.Cleanup(kc.Close)
+			kc.MinPasswordLength = 8
+			ks, err := NewKeycloakService(kc.ClientID, kc.ClientSecret, kc.Realm, kc.URL, AdminAuthConfig{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for op, status := range tt.fail {
+				kc.FailNext(op, status)
+			}
+			params := register
+			if tt.password != "" {
+				params.Password = tt.password
+			}
+			err = ks.Register(ctx, params)
+
+			var sagaErr *SagaError
+			if !errors.As(err, &sagaErr) || sagaErr.Step != tt.step {
+				t.Fatalf("err = %v, want a failure of step %s", err, tt.step)
+			}
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+			_, exists := kc.UserByUsername("ada")
+			if tt.undoFails {
+				if sagaErr.UndoErr == nil || !exists {
+					t.Fatalf("undo failure not reported (user exists: %v): %v", exists, err)
+				}
+				return
+			}
+			if sagaErr.UndoErr != nil || exists {
+				t.Fatalf("user left behind (undo error: %v)", sagaErr.UndoErr)
+			}
+
+			// Nothing is left in the way of registering again.
+			if err := ks.Register(ctx, register); err != nil {
+				t.Fatalf("retry failed: %v", err)
+			}
+			if user, ok := kc.UserByUsername("ada"); !ok || user.Password != register.Password {
+				t.Fatalf("user not registered on retry: %+v", user)
+			}
+		})
+	}
+}
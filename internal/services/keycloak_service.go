@@ -1,185 +1,560 @@
 package services
 
 import (
+	"auth-service/internal/apperr"
 	"auth-service/internal/models"
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"log/slog"
+	"net/url"
+	"sort"
+	"time"
 
 	"github.com/Nerzal/gocloak/v13"
 )
 
 var (
-	KEYCLOAK_ADMIN_USERNAME = os.Getenv("KEYCLOAK_ADMIN_USERNAME")
-	KEYCLOAK_ADMIN_PASSWORD = os.Getenv("KEYCLOAK_ADMIN_PASSWORD")
-	KEYCLOAK_ADMIN_REALM    = os.Getenv("KEYCLOAK_ADMIN_REALM")
+	ErrInvalidCredentials     = apperr.Unauthorized("invalid_credentials", "invalid username or password")
+	ErrAccountUnavailable     = apperr.Unauthorized("account_unavailable", "account is disabled or not fully set up")
+	ErrInvalidCurrentPassword = apperr.Unauthorized("invalid_current_password", "current password is incorrect")
+	ErrInvalidRefreshToken    = apperr.Unauthorized("invalid_refresh_token", "refresh token is invalid or expired")
+	ErrInvalidAccessToken     = apperr.Unauthorized("invalid_token", "access token is invalid or expired")
+	ErrPasswordPolicy         = apperr.Validation("password_policy_violation", "password rejected by realm policy")
+	ErrUserExists             = apperr.Conflict("user_exists", "a user with this username or email already exists")
+	ErrUserRejected           = apperr.Validation("invalid_user", "user data rejected by identity provider")
+	ErrUserNotFound           = apperr.NotFound("user_not_found", "user not found")
+	ErrSessionNotFound        = apperr.NotFound("session_not_found", "session not found")
+	ErrEmailNotVerified       = apperr.Forbidden("email_not_verified", "email address is not verified, use the link in the verification email or request a new one")
+	ErrEmailAlreadyVerified   = apperr.Conflict("email_already_verified", "email address is already verified")
+	ErrKeycloakUnavailable    = apperr.UpstreamUnavailable("keycloak_unavailable", "identity provider is unavailable")
 )
 
+// KeycloakService is the IdentityProvider backed by a Keycloak realm.
 type KeycloakService struct {
 	Gocloak      *gocloak.GoCloak
 	ClientId     string
 	ClientSecret string
 	Realm        string
 	Hostname     string
+	Verifier     *TokenVerifier
+	AdminAuth    AdminAuthStrategy
+
+	// VerifyEmailRedirectURI is where Keycloak sends users after they click
+	// the verification link.
+	VerifyEmailRedirectURI string
+	// PasswordResetRedirectURI receives the service reset token as the
+	// "token" query parameter once Keycloak's reset email link was used.
+	PasswordResetRedirectURI string
+	PasswordResetTTL         time.Duration
+
+	adminTokens *adminTokenProvider
+	resetTokens *resetTokenStore
 }
 
-func NewKeycloakService(client_id string, client_secret string, realm string, hostname string) *KeycloakService {
+func NewKeycloakService(client_id string, client_secret string, realm string, hostname string, adminAuth AdminAuthConfig) (*KeycloakService, error) {
+	adminAuth, err := adminAuth.resolve(client_id, client_secret, realm)
+	if err != nil {
+		return nil, err
+	}
+
+	client := gocloak.NewClient(hostname)
 	return &KeycloakService{
-		Gocloak:      gocloak.NewClient(hostname),
+		Gocloak:      client,
 		ClientId:     client_id,
 		ClientSecret: client_secret,
 		Realm:        realm,
 		Hostname:     hostname,
+		Verifier:     NewTokenVerifier(hostname, realm, client_id),
+		AdminAuth:    adminAuth.Strategy,
+
+		VerifyEmailRedirectURI:   "http://localhost:3000/",
+		PasswordResetRedirectURI: "http://localhost:3000/reset-password",
+		PasswordResetTTL:         15 * time.Minute,
+
+		adminTokens: newAdminTokenProvider(adminAuth.loginFunc(client)),
+		resetTokens: newResetTokenStore(),
+	}, nil
+}
+
+var _ IdentityProvider = (*KeycloakService)(nil)
+
+// adminToken returns a cached admin access token, refreshing it when needed.
+func (ks *KeycloakService) adminToken(ctx context.Context) (string, error) {
+	token, err := ks.adminTokens.Token(ctx)
+	if err != nil {
+		return "", keycloakError(fmt.Errorf("admin login failed: %w", err), nil)
 	}
+	return token, nil
 }
 
-func (ks *KeycloakService) Login(login models.LoginParams) (*models.LoginResponse, error) {
-	ctx := context.Background()
-	
+func (ks *KeycloakService) Login(ctx context.Context, login models.LoginParams) (*models.LoginResponse, error) {
 	// Keycloak Login artık username ile yapılıyor
 	token, err := ks.Gocloak.Login(ctx, ks.ClientId, ks.ClientSecret, ks.Realm, login.Username, login.Password)
 	if err != nil {
-		return nil, fmt.Errorf("login fail: %w", err)
+		return nil, keycloakError(err, map[int]*apperr.Error{
+			400: ErrAccountUnavailable,
+			401: ErrInvalidCredentials,
+		})
 	}
 
 	// Response modelimize dönüştür
 	response := &models.LoginResponse{
-		AccessToken:  token.AccessToken,
-		RefreshToken: token.RefreshToken,
-		ExpiresIn:    token.ExpiresIn,
-		TokenType:    token.TokenType,
+		AccessToken:      token.AccessToken,
+		RefreshToken:     token.RefreshToken,
+		ExpiresIn:        token.ExpiresIn,
+		RefreshExpiresIn: token.RefreshExpiresIn,
+		TokenType:        token.TokenType,
 	}
 	return response, nil
 }
 
-func (ks *KeycloakService) Register(register models.RegisterParams) error {
-	ctx := context.Background()
-
-	adminToken, err := ks.Gocloak.LoginAdmin(ctx, KEYCLOAK_ADMIN_USERNAME, KEYCLOAK_ADMIN_PASSWORD, KEYCLOAK_ADMIN_REALM)
+// LoginAsUser exchanges the client's credentials for tokens of the user
+// (direct naked impersonation). The realm needs token exchange enabled and
+// the client the impersonation permission for its users.
+func (ks *KeycloakService) LoginAsUser(ctx context.Context, userID string) (*models.LoginResponse, error) {
+	token, err := ks.Gocloak.GetToken(ctx, ks.Realm, gocloak.TokenOptions{
+		ClientID:           gocloak.StringP(ks.ClientId),
+		ClientSecret:       gocloak.StringP(ks.ClientSecret),
+		GrantType:          gocloak.StringP("urn:ietf:params:oauth:grant-type:token-exchange"),
+		RequestedSubject:   gocloak.StringP(userID),
+		RequestedTokenType: gocloak.StringP("urn:ietf:params:oauth:token-type:refresh_token"),
+	})
 	if err != nil {
-		return fmt.Errorf("admin login failed: %w", err)
+		return nil, keycloakError(fmt.Errorf("token exchange failed: %w", err), map[int]*apperr.Error{
+			400: ErrAccountUnavailable,
+		})
 	}
 
-	user := gocloak.User{
-		FirstName: gocloak.StringP(register.Firstname),
-		LastName:  gocloak.StringP(register.Lastname),
-		Username:  gocloak.StringP(register.Username),
-		Email:     gocloak.StringP(register.Email), // Email ayrı olarak set ediliyor
-		Enabled:   gocloak.BoolP(true),
-	}
+	return &models.LoginResponse{
+		AccessToken:      token.AccessToken,
+		RefreshToken:     token.RefreshToken,
+		ExpiresIn:        token.ExpiresIn,
+		RefreshExpiresIn: token.RefreshExpiresIn,
+		TokenType:        token.TokenType,
+	}, nil
+}
+
+// Register creates the user and sets their password as a saga: if a step
+// fails, the steps before it are undone, so a failed registration leaves no
+// user without a password behind that would block the retry. Failures are
+// *SagaError naming the RegisterStep that failed.
+func (ks *KeycloakService) Register(ctx context.Context, register models.RegisterParams) error {
+	var adminToken, userID string
 
-	userID, err := ks.Gocloak.CreateUser(ctx, adminToken.AccessToken, ks.Realm, user)
+	return runSaga(ctx,
+		sagaStep{
+			Name: RegisterStepAdminToken,
+			Do: func(ctx context.Context) (err error) {
+				adminToken, err = ks.adminToken(ctx)
+				return err
+			},
+		},
+		sagaStep{
+			Name: RegisterStepCreateUser,
+			Do: func(ctx context.Context) (err error) {
+				user := gocloak.User{
+					FirstName: gocloak.StringP(register.Firstname),
+					LastName:  gocloak.StringP(register.Lastname),
+					Username:  gocloak.StringP(register.Username),
+					Email:     gocloak.StringP(register.Email), // Email ayrı olarak set ediliyor
+					Enabled:   gocloak.BoolP(true),
+				}
+				userID, err = ks.Gocloak.CreateUser(ctx, adminToken, ks.Realm, user)
+				if err != nil {
+					return ks.adminError(adminToken, err, map[int]*apperr.Error{
+						400: ErrUserRejected,
+						409: ErrUserExists,
+					})
+				}
+				return nil
+			},
+			Undo: func(ctx context.Context) error {
+				if err := ks.DeleteUser(ctx, userID); err != nil && !errors.Is(err, ErrUserNotFound) {
+					return err
+				}
+				return nil
+			},
+		},
+		sagaStep{
+			Name: RegisterStepSetPassword,
+			Do: func(ctx context.Context) error {
+				err := ks.Gocloak.SetPassword(ctx, adminToken, userID, ks.Realm, register.Password, false)
+				if err != nil {
+					return ks.adminError(adminToken, err, map[int]*apperr.Error{400: ErrPasswordPolicy})
+				}
+				return nil
+			},
+		},
+	)
+}
+
+// SendVerificationEmail has Keycloak email the verification link to the
+// account with this email address.
+func (ks *KeycloakService) SendVerificationEmail(ctx context.Context, email string) error {
+	adminToken, err := ks.adminToken(ctx)
 	if err != nil {
-		fmt.Println("keycloak createUser error:", err)
-		return fmt.Errorf("create user failed: %w", err)
+		return err
 	}
 
-	cred := gocloak.CredentialRepresentation{
-		Type:      gocloak.StringP("password"),
-		Value:     gocloak.StringP(register.Password),
-		Temporary: gocloak.BoolP(false),
-	}
-	err = ks.Gocloak.SetPassword(ctx, adminToken.AccessToken, userID, ks.Realm, *cred.Value, false)
+	users, err := ks.Gocloak.GetUsers(ctx, adminToken, ks.Realm, gocloak.GetUsersParams{
+		Email: gocloak.StringP(email),
+		Exact: gocloak.BoolP(true),
+	})
 	if err != nil {
-		return fmt.Errorf("setting password fail: %w", err)
+		return ks.adminError(adminToken, fmt.Errorf("find user failed: %w", err), nil)
+	}
+	if len(users) == 0 || users[0].ID == nil {
+		return ErrUserNotFound
+	}
+	if gocloak.PBool(users[0].EmailVerified) {
+		return ErrEmailAlreadyVerified
 	}
 
-	err = ks.Gocloak.SendVerifyEmail(ctx, adminToken.AccessToken, userID,ks.Realm , gocloak.SendVerificationMailParams{
-		ClientID: gocloak.StringP(ks.ClientId),
-		RedirectURI: gocloak.StringP("http://localhost:3000/"),
+	err = ks.Gocloak.SendVerifyEmail(ctx, adminToken, *users[0].ID, ks.Realm, gocloak.SendVerificationMailParams{
+		ClientID:    gocloak.StringP(ks.ClientId),
+		RedirectURI: gocloak.StringP(ks.VerifyEmailRedirectURI),
 	})
 	if err != nil {
-		return fmt.Errorf("send verify email failed: %w", err)
+		return ks.adminError(adminToken, fmt.Errorf("send verify email failed: %w", err), map[int]*apperr.Error{404: ErrUserNotFound})
 	}
 	return nil
 }
 
-func (ks *KeycloakService) GetUserByID(userID string) (*gocloak.User, error) {
-	ctx := context.Background()
-	adminToken, err := ks.Gocloak.LoginAdmin(ctx, KEYCLOAK_ADMIN_USERNAME, KEYCLOAK_ADMIN_PASSWORD, KEYCLOAK_ADMIN_REALM)
+func (ks *KeycloakService) GetUserByID(ctx context.Context, userID string) (*gocloak.User, error) {
+	adminToken, err := ks.adminToken(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("admin login failed: %w", err)
+		return nil, err
 	}
 
-	user, err := ks.Gocloak.GetUserByID(ctx, adminToken.AccessToken, ks.Realm, userID)
+	user, err := ks.Gocloak.GetUserByID(ctx, adminToken, ks.Realm, userID)
 	if err != nil {
-		return nil, fmt.Errorf("get user failed: %w", err)
+		return nil, ks.adminError(adminToken, err, map[int]*apperr.Error{404: ErrUserNotFound})
 	}
 	return user, nil
 }
 
-func (ks *KeycloakService) UpdateUser(userID string, user gocloak.User) error {
-	ctx := context.Background()
-	adminToken, err := ks.Gocloak.LoginAdmin(ctx, KEYCLOAK_ADMIN_USERNAME, KEYCLOAK_ADMIN_PASSWORD, KEYCLOAK_ADMIN_REALM)
+func (ks *KeycloakService) UpdateUser(ctx context.Context, userID string, user gocloak.User) error {
+	adminToken, err := ks.adminToken(ctx)
 	if err != nil {
-		return fmt.Errorf("admin login failed: %w", err)
+		return err
 	}
 
 	user.ID = gocloak.StringP(userID)
 
-	err = ks.Gocloak.UpdateUser(ctx, adminToken.AccessToken, ks.Realm, user)
+	err = ks.Gocloak.UpdateUser(ctx, adminToken, ks.Realm, user)
 	if err != nil {
-		return fmt.Errorf("update user failed: %w", err)
+		return ks.adminError(adminToken, err, map[int]*apperr.Error{
+			400: ErrUserRejected,
+			404: ErrUserNotFound,
+			409: ErrUserExists,
+		})
 	}
 	return nil
 }
 
-func (ks *KeycloakService) DeleteUser(userID string) error {
-	ctx := context.Background()
-	adminToken, err := ks.Gocloak.LoginAdmin(ctx, KEYCLOAK_ADMIN_USERNAME, KEYCLOAK_ADMIN_PASSWORD, KEYCLOAK_ADMIN_REALM)
+func (ks *KeycloakService) DeleteUser(ctx context.Context, userID string) error {
+	adminToken, err := ks.adminToken(ctx)
 	if err != nil {
-		return fmt.Errorf("admin login failed: %w", err)
+		return err
 	}
 
-	err = ks.Gocloak.DeleteUser(ctx, adminToken.AccessToken, ks.Realm, userID)
+	err = ks.Gocloak.DeleteUser(ctx, adminToken, ks.Realm, userID)
 	if err != nil {
-		return fmt.Errorf("delete user failed: %w", err)
+		return ks.adminError(adminToken, err, map[int]*apperr.Error{404: ErrUserNotFound})
 	}
 	return nil
 }
 
-func (ks *KeycloakService) GetUserProfile(accessToken string) (*gocloak.User, error) {
-	ctx := context.Background()
-	
+func (ks *KeycloakService) GetUserProfile(ctx context.Context, accessToken string) (*gocloak.User, error) {
 	userInfo, err := ks.Gocloak.GetUserInfo(ctx, accessToken, ks.Realm)
 	if err != nil {
-		return nil, fmt.Errorf("get user info failed: %w", err)
+		return nil, keycloakError(err, map[int]*apperr.Error{
+			401: ErrInvalidAccessToken,
+			403: ErrInvalidAccessToken,
+		})
 	}
 
 	// Admin token ile kullanıcı detaylarını al
-	adminToken, err := ks.Gocloak.LoginAdmin(ctx, KEYCLOAK_ADMIN_USERNAME, KEYCLOAK_ADMIN_PASSWORD, KEYCLOAK_ADMIN_REALM)
+	adminToken, err := ks.adminToken(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("admin login failed: %w", err)
+		return nil, err
 	}
 
 	// UserInfo'dan gelen sub (subject) ID'sini kullanarak tam kullanıcı bilgisini al
-	user, err := ks.Gocloak.GetUserByID(ctx, adminToken.AccessToken, ks.Realm, *userInfo.Sub)
+	user, err := ks.Gocloak.GetUserByID(ctx, adminToken, ks.Realm, *userInfo.Sub)
 	if err != nil {
-		return nil, fmt.Errorf("get user failed: %w", err)
+		return nil, ks.adminError(adminToken, err, map[int]*apperr.Error{404: ErrUserNotFound})
 	}
 	
 	return user, nil
 }
 
-func (ks *KeycloakService) RefreshToken(refreshToken string) (*models.LoginResponse, error) {
-	ctx := context.Background()
-	
-	refresh_token, err := ks.Gocloak.RefreshToken(ctx, ks.ClientId, ks.ClientSecret, ks.Realm, refreshToken)
+func (ks *KeycloakService) RefreshToken(ctx context.Context, refreshToken string) (*models.LoginResponse, error) {
+	refresh_token, err := ks.Gocloak.RefreshToken(ctx, refreshToken, ks.ClientId, ks.ClientSecret, ks.Realm)
 	if err != nil {
-		return nil, fmt.Errorf("refresh token failed: %w", err)
+		return nil, keycloakError(err, map[int]*apperr.Error{
+			400: ErrInvalidRefreshToken,
+			401: ErrInvalidRefreshToken,
+		})
 	}
 	return &models.LoginResponse{
-		AccessToken:  refresh_token.AccessToken,
-		RefreshToken: refresh_token.RefreshToken,
-		ExpiresIn:    refresh_token.ExpiresIn,
-		TokenType:    refresh_token.TokenType,
+		AccessToken:      refresh_token.AccessToken,
+		RefreshToken:     refresh_token.RefreshToken,
+		ExpiresIn:        refresh_token.ExpiresIn,
+		RefreshExpiresIn: refresh_token.RefreshExpiresIn,
+		TokenType:        refresh_token.TokenType,
 	}, nil
 }
-func (ks *KeycloakService) Logout(refreshToken string) error {
-	ctx := context.Background()
+func (ks *KeycloakService) Logout(ctx context.Context, refreshToken string) error {
 	err := ks.Gocloak.Logout(ctx, ks.ClientId, ks.ClientSecret, ks.Realm, refreshToken)
 	if err != nil {
-		return fmt.Errorf("logout failed: %w", err)
+		return keycloakError(err, map[int]*apperr.Error{
+			400: ErrInvalidRefreshToken,
+			401: ErrInvalidRefreshToken,
+		})
+	}
+	return nil
+}
+
+// VerifyToken validates an access token locally against the realm keys.
+func (ks *KeycloakService) VerifyToken(ctx context.Context, accessToken string) (*TokenClaims, error) {
+	return ks.Verifier.Verify(ctx, accessToken)
+}
+
+// IntrospectToken asks Keycloak whether the token is still active. Unlike
+// VerifyToken it also catches revoked tokens, at the cost of a round-trip.
+func (ks *KeycloakService) IntrospectToken(ctx context.Context, accessToken string) (bool, error) {
+	result, err := ks.Gocloak.RetrospectToken(ctx, accessToken, ks.ClientId, ks.ClientSecret, ks.Realm)
+	if err != nil {
+		return false, keycloakError(fmt.Errorf("introspect token failed: %w", err), nil)
+	}
+	return result.Active != nil && *result.Active, nil
+}
+
+// ForgotPassword starts a password reset for the account with the given
+// email: it issues a single-use reset token and has Keycloak send its
+// UPDATE_PASSWORD action email, whose redirect carries that token. Unknown
+// emails are not an error, so callers cannot tell which accounts exist.
+func (ks *KeycloakService) ForgotPassword(ctx context.Context, email string) error {
+	adminToken, err := ks.adminToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	users, err := ks.Gocloak.GetUsers(ctx, adminToken, ks.Realm, gocloak.GetUsersParams{
+		Email: gocloak.StringP(email),
+		Exact: gocloak.BoolP(true),
+	})
+	if err != nil {
+		return ks.adminError(adminToken, fmt.Errorf("find user failed: %w", err), nil)
+	}
+	if len(users) == 0 || users[0].ID == nil {
+		return nil
+	}
+	userID := *users[0].ID
+
+	resetToken, err := ks.resetTokens.Issue(userID, ks.PasswordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	redirectURI, err := url.Parse(ks.PasswordResetRedirectURI)
+	if err != nil {
+		return fmt.Errorf("invalid password reset redirect: %w", err)
+	}
+	query := redirectURI.Query()
+	query.Set("token", resetToken)
+	redirectURI.RawQuery = query.Encode()
+
+	err = ks.Gocloak.ExecuteActionsEmail(ctx, adminToken, ks.Realm, gocloak.ExecuteActionsEmail{
+		UserID:      gocloak.StringP(userID),
+		ClientID:    gocloak.StringP(ks.ClientId),
+		Lifespan:    gocloak.IntP(int(ks.PasswordResetTTL.Seconds())),
+		RedirectURI: gocloak.StringP(redirectURI.String()),
+		Actions:     &[]string{"UPDATE_PASSWORD"},
+	})
+	if err != nil {
+		return ks.adminError(adminToken, fmt.Errorf("send reset email failed: %w", err), nil)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// ResetPassword completes a reset started by ForgotPassword. The token can
+// only be used once, but stays valid when the new password is rejected;
+// all existing sessions of the user are logged out.
+func (ks *KeycloakService) ResetPassword(ctx context.Context, resetToken string, newPassword string) error {
+	userID, err := ks.resetTokens.Claim(resetToken)
+	if err != nil {
+		return err
+	}
+
+	adminToken, err := ks.adminToken(ctx)
+	if err != nil {
+		ks.resetTokens.Release(resetToken)
+		return err
+	}
+
+	err = ks.Gocloak.SetPassword(ctx, adminToken, userID, ks.Realm, newPassword, false)
+	if err != nil {
+		ks.resetTokens.Release(resetToken)
+		return ks.adminError(adminToken, err, map[int]*apperr.Error{400: ErrPasswordPolicy})
+	}
+	ks.resetTokens.Consume(resetToken)
+
+	err = ks.Gocloak.LogoutAllSessions(ctx, adminToken, ks.Realm, userID)
+	if err != nil {
+		slog.Warn("logging out sessions after password reset failed", slog.String("user_id", userID), slog.Any("error", err))
+	}
+	return nil
+}
+
+// ChangePassword sets a new password for the user after re-verifying the
+// current one with a Keycloak login. When keepSessionID is not empty, every
+// other session of the user is logged out.
+func (ks *KeycloakService) ChangePassword(ctx context.Context, userID, username, currentPassword, newPassword, keepSessionID string) error {
+	token, err := ks.Gocloak.Login(ctx, ks.ClientId, ks.ClientSecret, ks.Realm, username, currentPassword)
+	if err != nil {
+		return keycloakError(err, map[int]*apperr.Error{
+			400: ErrAccountUnavailable,
+			401: ErrInvalidCurrentPassword,
+		})
+	}
+	// The verification login opened a session of its own, close it again.
+	if err := ks.Gocloak.Logout(ctx, ks.ClientId, ks.ClientSecret, ks.Realm, token.RefreshToken); err != nil {
+		slog.Warn("closing password verification session failed", slog.String("user_id", userID), slog.Any("error", err))
+	}
+
+	adminToken, err := ks.adminToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = ks.Gocloak.SetPassword(ctx, adminToken, userID, ks.Realm, newPassword, false)
+	if err != nil {
+		return ks.adminError(adminToken, err, map[int]*apperr.Error{400: ErrPasswordPolicy})
+	}
+
+	if keepSessionID == "" {
+		return nil
+	}
+	return ks.RevokeOtherSessions(ctx, userID, keepSessionID)
+}
+
+// GetUserSessions lists the active sessions of the user.
+func (ks *KeycloakService) GetUserSessions(ctx context.Context, userID string) ([]models.SessionInfo, error) {
+	adminToken, err := ks.adminToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := ks.Gocloak.GetUserSessions(ctx, adminToken, ks.Realm, userID)
+	if err != nil {
+		return nil, ks.adminError(adminToken, err, map[int]*apperr.Error{404: ErrUserNotFound})
+	}
+
+	result := make([]models.SessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		info := models.SessionInfo{
+			ID:        gocloak.PString(session.ID),
+			IPAddress: gocloak.PString(session.IPAddress),
+		}
+		if session.Start != nil {
+			info.Start = time.UnixMilli(*session.Start).UTC()
+		}
+		if session.LastAccess != nil {
+			info.LastAccess = time.UnixMilli(*session.LastAccess).UTC()
+		}
+		if session.Clients != nil {
+			for _, clientID := range *session.Clients {
+				info.Clients = append(info.Clients, clientID)
+			}
+			sort.Strings(info.Clients)
+		}
+		result = append(result, info)
+	}
+	return result, nil
+}
+
+// RevokeUserSession logs out one session, provided it belongs to the user.
+func (ks *KeycloakService) RevokeUserSession(ctx context.Context, userID, sessionID string) error {
+	sessions, err := ks.GetUserSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.ID == sessionID {
+			return ks.logoutSession(ctx, sessionID)
+		}
+	}
+	return ErrSessionNotFound
+}
+
+// RevokeOtherSessions logs out every session of the user except keepSessionID.
+func (ks *KeycloakService) RevokeOtherSessions(ctx context.Context, userID, keepSessionID string) error {
+	sessions, err := ks.GetUserSessions(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, session := range sessions {
+		if session.ID == "" || session.ID == keepSessionID {
+			continue
+		}
+		if err := ks.logoutSession(ctx, session.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ks *KeycloakService) logoutSession(ctx context.Context, sessionID string) error {
+	adminToken, err := ks.adminToken(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = ks.Gocloak.LogoutUserSession(ctx, adminToken, ks.Realm, sessionID)
+	if err != nil {
+		return ks.adminError(adminToken, err, map[int]*apperr.Error{404: ErrSessionNotFound})
+	}
+	return nil
+}
+
+// adminError is keycloakError for calls made with adminToken. A 401 means
+// Keycloak no longer accepts the cached token, so it is dropped and the next
+// call logs in again.
+func (ks *KeycloakService) adminError(adminToken string, err error, known map[int]*apperr.Error) error {
+	if apiErrorCode(err) == 401 {
+		ks.adminTokens.invalidate(adminToken)
+	}
+	return keycloakError(err, known)
+}
+
+// apiErrorCode returns the HTTP status Keycloak answered with, or 0.
+func apiErrorCode(err error) int {
+	var apiErr *gocloak.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	return 0
+}
+
+// keycloakError translates a Keycloak failure into an apperr error. known
+// maps the HTTP statuses an operation expects to the error clients see.
+// Transport failures and 5xx answers mean Keycloak is unavailable; any
+// other status points to a bug or misconfiguration on our side.
+func keycloakError(err error, known map[int]*apperr.Error) error {
+	if _, ok := apperr.As(err); ok {
+		return err
+	}
+	code := apiErrorCode(err)
+	if appErr, ok := known[code]; ok {
+		return appErr.WithCause(err)
+	}
+	if code == 0 || code >= 500 {
+		return ErrKeycloakUnavailable.WithCause(err)
+	}
+	return apperr.Internal(err)
+}
@@ -0,0 +1,611 @@
+package services
+
+import (
+	"auth-service/internal/models"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// MemoryProvider is an IdentityProvider that keeps users and sessions in
+// process. It issues RS256-signed access tokens shaped like Keycloak's, so
+// the HTTP layer can be exercised end-to-end without a Keycloak. Nothing is
+// persisted and passwords are only hashed with a salted SHA-256: it is meant
+// for tests and local development, not production.
+type MemoryProvider struct {
+	Issuer          string
+	ClientID        string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+
+	PasswordResetTTL time.Duration
+	// OnPasswordReset receives the reset token issued by ForgotPassword, in
+	// place of the email a real provider would send.
+	OnPasswordReset func(email, resetToken string)
+	// OnVerificationEmail is called by SendVerificationEmail in place of
+	// sending the email. An error is returned as the send failure.
+	OnVerificationEmail func(email string) error
+
+	signingKey *rsa.PrivateKey
+	keyID      string
+	verifier   *TokenVerifier
+	now        func() time.Time
+
+	mu            sync.Mutex
+	users         map[string]*memoryUser
+	sessions      map[string]*memorySession
+	refreshTokens map[string]string
+	resetTokens   *resetTokenStore
+}
+
+type memoryUser struct {
+	user         gocloak.User
+	salt         []byte
+	passwordHash []byte
+	realmRoles   []string
+}
+
+type memorySession struct {
+	id               string
+	userID           string
+	start            time.Time
+	lastAccess       time.Time
+	refreshHash      string
+	refreshExpiresAt time.Time
+}
+
+var _ IdentityProvider = (*MemoryProvider)(nil)
+
+func NewMemoryProvider(issuer string, clientID string) (*MemoryProvider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, fmt.Errorf("generate signing key failed: %w", err)
+	}
+	keyID, err := randomToken(8)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MemoryProvider{
+		Issuer:           issuer,
+		ClientID:         clientID,
+		AccessTokenTTL:   5 * time.Minute,
+		RefreshTokenTTL:  30 * time.Minute,
+		PasswordResetTTL: 15 * time.Minute,
+
+		signingKey: key,
+		keyID:      keyID,
+		verifier:   NewStaticTokenVerifier(issuer, clientID, map[string]crypto.PublicKey{keyID: &key.PublicKey}),
+		now:        time.Now,
+
+		users:         make(map[string]*memoryUser),
+		sessions:      make(map[string]*memorySession),
+		refreshTokens: make(map[string]string),
+		resetTokens:   newResetTokenStore(),
+	}, nil
+}
+
+// PublicKey returns the key ID and public key access tokens are signed with.
+func (mp *MemoryProvider) PublicKey() (string, *rsa.PublicKey) {
+	return mp.keyID, &mp.signingKey.PublicKey
+}
+
+// AddUser creates a user with the given password and realm roles and returns
+// its ID. Users are enabled unless user.Enabled says otherwise.
+func (mp *MemoryProvider) AddUser(user gocloak.User, password string, realmRoles ...string) (string, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if mp.conflicts("", user) {
+		return "", ErrUserExists
+	}
+
+	userID, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	user.ID = gocloak.StringP(userID)
+	if user.Enabled == nil {
+		user.Enabled = gocloak.BoolP(true)
+	}
+	if user.EmailVerified == nil {
+		user.EmailVerified = gocloak.BoolP(false)
+	}
+	user.CreatedTimestamp = gocloak.Int64P(mp.now().UnixMilli())
+
+	u := &memoryUser{user: user, realmRoles: append([]string(nil), realmRoles...)}
+	if err := u.setPassword(password); err != nil {
+		return "", err
+	}
+	mp.users[userID] = u
+	return userID, nil
+}
+
+func (mp *MemoryProvider) Login(ctx context.Context, login models.LoginParams) (*models.LoginResponse, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	u := mp.findUser(login.Username)
+	if u == nil || !u.checkPassword(login.Password) {
+		return nil, ErrInvalidCredentials
+	}
+	if !gocloak.PBool(u.user.Enabled) {
+		return nil, ErrAccountUnavailable
+	}
+
+	sessionID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	now := mp.now()
+	session := &memorySession{id: sessionID, userID: *u.user.ID, start: now, lastAccess: now}
+	mp.sessions[sessionID] = session
+	return mp.issueTokens(u, session)
+}
+
+func (mp *MemoryProvider) LoginAsUser(ctx context.Context, userID string) (*models.LoginResponse, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	u, ok := mp.users[userID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	if !gocloak.PBool(u.user.Enabled) {
+		return nil, ErrAccountUnavailable
+	}
+
+	sessionID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+	now := mp.now()
+	session := &memorySession{id: sessionID, userID: userID, start: now, lastAccess: now}
+	mp.sessions[sessionID] = session
+	return mp.issueTokens(u, session)
+}
+
+func (mp *MemoryProvider) Register(ctx context.Context, register models.RegisterParams) error {
+	_, err := mp.AddUser(gocloak.User{
+		FirstName: gocloak.StringP(register.Firstname),
+		LastName:  gocloak.StringP(register.Lastname),
+		Username:  gocloak.StringP(strings.ToLower(register.Username)),
+		Email:     gocloak.StringP(strings.ToLower(register.Email)),
+	}, register.Password)
+	return err
+}
+
+func (mp *MemoryProvider) SendVerificationEmail(ctx context.Context, email string) error {
+	mp.mu.Lock()
+	u := mp.findUserByEmail(email)
+	verified := u != nil && gocloak.PBool(u.user.EmailVerified)
+	mp.mu.Unlock()
+
+	switch {
+	case u == nil:
+		return ErrUserNotFound
+	case verified:
+		return ErrEmailAlreadyVerified
+	case mp.OnVerificationEmail != nil:
+		return mp.OnVerificationEmail(email)
+	}
+	return nil
+}
+
+func (mp *MemoryProvider) RefreshToken(ctx context.Context, refreshToken string) (*models.LoginResponse, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	session := mp.sessionByRefreshToken(refreshToken)
+	if session == nil {
+		return nil, ErrInvalidRefreshToken
+	}
+	u, ok := mp.users[session.userID]
+	if !ok || !gocloak.PBool(u.user.Enabled) {
+		mp.endSession(session.id)
+		return nil, ErrInvalidRefreshToken
+	}
+
+	// Refresh tokens are single use, like with Keycloak's revoke refresh token.
+	delete(mp.refreshTokens, session.refreshHash)
+	session.lastAccess = mp.now()
+	return mp.issueTokens(u, session)
+}
+
+func (mp *MemoryProvider) Logout(ctx context.Context, refreshToken string) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	session := mp.sessionByRefreshToken(refreshToken)
+	if session == nil {
+		return ErrInvalidRefreshToken
+	}
+	mp.endSession(session.id)
+	return nil
+}
+
+func (mp *MemoryProvider) GetUserByID(ctx context.Context, userID string) (*gocloak.User, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	u, ok := mp.users[userID]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	user := u.user
+	return &user, nil
+}
+
+// UpdateUser applies the non-nil fields of user, like Keycloak's partial
+// user representation updates.
+func (mp *MemoryProvider) UpdateUser(ctx context.Context, userID string, user gocloak.User) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	u, ok := mp.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if mp.conflicts(userID, user) {
+		return ErrUserExists
+	}
+
+	if user.Username != nil {
+		u.user.Username = gocloak.StringP(strings.ToLower(*user.Username))
+	}
+	if user.Email != nil {
+		u.user.Email = gocloak.StringP(strings.ToLower(*user.Email))
+	}
+	if user.FirstName != nil {
+		u.user.FirstName = user.FirstName
+	}
+	if user.LastName != nil {
+		u.user.LastName = user.LastName
+	}
+	if user.Enabled != nil {
+		u.user.Enabled = user.Enabled
+	}
+	if user.EmailVerified != nil {
+		u.user.EmailVerified = user.EmailVerified
+	}
+	return nil
+}
+
+func (mp *MemoryProvider) DeleteUser(ctx context.Context, userID string) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if _, ok := mp.users[userID]; !ok {
+		return ErrUserNotFound
+	}
+	delete(mp.users, userID)
+	mp.endUserSessions(userID, "")
+	return nil
+}
+
+func (mp *MemoryProvider) GetUserProfile(ctx context.Context, accessToken string) (*gocloak.User, error) {
+	claims, err := mp.VerifyToken(ctx, accessToken)
+	if err != nil {
+		return nil, ErrInvalidAccessToken.WithCause(err)
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if _, ok := mp.sessions[claims.SessionID]; !ok {
+		return nil, ErrInvalidAccessToken
+	}
+	u, ok := mp.users[claims.Subject]
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	user := u.user
+	return &user, nil
+}
+
+func (mp *MemoryProvider) VerifyToken(ctx context.Context, accessToken string) (*TokenClaims, error) {
+	return mp.verifier.Verify(ctx, accessToken)
+}
+
+// IntrospectToken reports a token as active while it verifies and its
+// session has not ended.
+func (mp *MemoryProvider) IntrospectToken(ctx context.Context, accessToken string) (bool, error) {
+	claims, err := mp.VerifyToken(ctx, accessToken)
+	if err != nil {
+		return false, nil
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+	_, ok := mp.sessions[claims.SessionID]
+	return ok, nil
+}
+
+func (mp *MemoryProvider) ForgotPassword(ctx context.Context, email string) error {
+	mp.mu.Lock()
+	u := mp.findUserByEmail(email)
+	mp.mu.Unlock()
+
+	if u == nil {
+		return nil
+	}
+	userID := *u.user.ID
+	resetToken, err := mp.resetTokens.Issue(userID, mp.PasswordResetTTL)
+	if err != nil {
+		return err
+	}
+	if mp.OnPasswordReset != nil {
+		mp.OnPasswordReset(email, resetToken)
+	}
+	return nil
+}
+
+func (mp *MemoryProvider) ResetPassword(ctx context.Context, resetToken, newPassword string) error {
+	userID, err := mp.resetTokens.Claim(resetToken)
+	if err != nil {
+		return err
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	u, ok := mp.users[userID]
+	if !ok {
+		mp.resetTokens.Consume(resetToken)
+		return ErrUserNotFound
+	}
+	if err := u.setPassword(newPassword); err != nil {
+		mp.resetTokens.Release(resetToken)
+		return err
+	}
+	mp.resetTokens.Consume(resetToken)
+	mp.endUserSessions(userID, "")
+	return nil
+}
+
+func (mp *MemoryProvider) ChangePassword(ctx context.Context, userID, username, currentPassword, newPassword, keepSessionID string) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	u, ok := mp.users[userID]
+	if !ok {
+		return ErrUserNotFound
+	}
+	if !u.checkPassword(currentPassword) {
+		return ErrInvalidCurrentPassword
+	}
+	if !gocloak.PBool(u.user.Enabled) {
+		return ErrAccountUnavailable
+	}
+	if err := u.setPassword(newPassword); err != nil {
+		return err
+	}
+	if keepSessionID != "" {
+		mp.endUserSessions(userID, keepSessionID)
+	}
+	return nil
+}
+
+func (mp *MemoryProvider) GetUserSessions(ctx context.Context, userID string) ([]models.SessionInfo, error) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	if _, ok := mp.users[userID]; !ok {
+		return nil, ErrUserNotFound
+	}
+
+	result := []models.SessionInfo{}
+	for _, session := range mp.sessions {
+		if session.userID != userID {
+			continue
+		}
+		result = append(result, models.SessionInfo{
+			ID:         session.id,
+			Start:      session.start.UTC(),
+			LastAccess: session.lastAccess.UTC(),
+			Clients:    []string{mp.ClientID},
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+	return result, nil
+}
+
+func (mp *MemoryProvider) RevokeUserSession(ctx context.Context, userID, sessionID string) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	session, ok := mp.sessions[sessionID]
+	if !ok || session.userID != userID {
+		return ErrSessionNotFound
+	}
+	mp.endSession(sessionID)
+	return nil
+}
+
+func (mp *MemoryProvider) RevokeOtherSessions(ctx context.Context, userID, keepSessionID string) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.endUserSessions(userID, keepSessionID)
+	return nil
+}
+
+// issueTokens signs a new access token for the session and rotates its
+// refresh token. mp.mu must be held.
+func (mp *MemoryProvider) issueTokens(u *memoryUser, session *memorySession) (*models.LoginResponse, error) {
+	now := mp.now()
+	tokenID, err := newUUID()
+	if err != nil {
+		return nil, err
+	}
+
+	claims := TokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
+			Issuer:    mp.Issuer,
+			Subject:   *u.user.ID,
+			Audience:  jwt.ClaimStrings{"account"},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(mp.AccessTokenTTL)),
+		},
+		SessionID:         session.id,
+		PreferredUsername: gocloak.PString(u.user.Username),
+		Email:             gocloak.PString(u.user.Email),
+		EmailVerified:     gocloak.PBool(u.user.EmailVerified),
+		AuthorizedParty:   mp.ClientID,
+		RealmAccess:       RoleClaim{Roles: append([]string(nil), u.realmRoles...)},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = mp.keyID
+	accessToken, err := token.SignedString(mp.signingKey)
+	if err != nil {
+		return nil, fmt.Errorf("sign access token failed: %w", err)
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	session.refreshHash = hashToken(refreshToken)
+	session.refreshExpiresAt = now.Add(mp.RefreshTokenTTL)
+	mp.refreshTokens[session.refreshHash] = session.id
+
+	return &models.LoginResponse{
+		AccessToken:      accessToken,
+		RefreshToken:     refreshToken,
+		ExpiresIn:        int(mp.AccessTokenTTL.Seconds()),
+		RefreshExpiresIn: int(mp.RefreshTokenTTL.Seconds()),
+		TokenType:        "Bearer",
+	}, nil
+}
+
+// sessionByRefreshToken returns the live session the refresh token belongs
+// to, or nil. mp.mu must be held.
+func (mp *MemoryProvider) sessionByRefreshToken(refreshToken string) *memorySession {
+	hash := hashToken(refreshToken)
+	sessionID, ok := mp.refreshTokens[hash]
+	if !ok {
+		return nil
+	}
+	session, ok := mp.sessions[sessionID]
+	if !ok || session.refreshHash != hash {
+		delete(mp.refreshTokens, hash)
+		return nil
+	}
+	if mp.now().After(session.refreshExpiresAt) {
+		mp.endSession(sessionID)
+		return nil
+	}
+	return session
+}
+
+// endUserSessions ends every session of the user except keepSessionID.
+// mp.mu must be held.
+func (mp *MemoryProvider) endUserSessions(userID, keepSessionID string) {
+	for id, session := range mp.sessions {
+		if session.userID == userID && id != keepSessionID {
+			mp.endSession(id)
+		}
+	}
+}
+
+func (mp *MemoryProvider) endSession(sessionID string) {
+	if session, ok := mp.sessions[sessionID]; ok {
+		delete(mp.refreshTokens, session.refreshHash)
+		delete(mp.sessions, sessionID)
+	}
+}
+
+// findUser looks a user up by username or email, both case-insensitive.
+// mp.mu must be held.
+func (mp *MemoryProvider) findUser(usernameOrEmail string) *memoryUser {
+	for _, u := range mp.users {
+		if strings.EqualFold(gocloak.PString(u.user.Username), usernameOrEmail) ||
+			strings.EqualFold(gocloak.PString(u.user.Email), usernameOrEmail) {
+			return u
+		}
+	}
+	return nil
+}
+
+// findUserByEmail returns the user with the email address. mp.mu must be
+// held.
+func (mp *MemoryProvider) findUserByEmail(email string) *memoryUser {
+	for _, u := range mp.users {
+		if strings.EqualFold(gocloak.PString(u.user.Email), email) {
+			return u
+		}
+	}
+	return nil
+}
+
+// conflicts reports whether another user than userID already has the
+// username or email of user. mp.mu must be held.
+func (mp *MemoryProvider) conflicts(userID string, user gocloak.User) bool {
+	for id, u := range mp.users {
+		if id == userID {
+			continue
+		}
+		if user.Username != nil && strings.EqualFold(gocloak.PString(u.user.Username), *user.Username) {
+			return true
+		}
+		if user.Email != nil && *user.Email != "" && strings.EqualFold(gocloak.PString(u.user.Email), *user.Email) {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *memoryUser) setPassword(password string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("generate salt failed: %w", err)
+	}
+	u.salt = salt
+	u.passwordHash = saltedHash(salt, password)
+	return nil
+}
+
+func (u *memoryUser) checkPassword(password string) bool {
+	return subtle.ConstantTimeCompare(u.passwordHash, saltedHash(u.salt, password)) == 1
+}
+
+func saltedHash(salt []byte, password string) []byte {
+	h := sha256.New()
+	h.Write(salt)
+	h.Write([]byte(password))
+	return h.Sum(nil)
+}
+
+func randomToken(size int) (string, error) {
+	raw := make([]byte, size)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("generate token failed: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// newUUID returns a random (version 4) UUID, the ID format Keycloak uses.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate id failed: %w", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
@@ -0,0 +1,502 @@
+package services
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/models"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+var (
+	ErrInvalidMFACode      = apperr.Unauthorized("invalid_mfa_code", "verification code is invalid")
+	ErrMFAChallengeExpired = apperr.Unauthorized("mfa_challenge_expired", "login challenge is invalid or expired, log in again")
+	ErrMFAFactorNotFound   = apperr.NotFound("mfa_factor_not_found", "mfa factor not found")
+	ErrMFAAlreadyConfirmed = apperr.Conflict("mfa_already_confirmed", "mfa factor is already confirmed")
+	ErrMFANotEnabled       = apperr.Conflict("mfa_not_enabled", "confirm an authenticator app first")
+	ErrMFACodeRequired     = apperr.Forbidden("mfa_code_required", "confirm this change with a code from your authenticator app or a recovery code")
+)
+
+const (
+	FactorTOTP = "totp"
+	// FactorRecoveryCode holds the hashes of the user's unused recovery
+	// codes. It is not a factor of its own: it only exists while the user has
+	// a confirmed TOTP factor.
+	FactorRecoveryCode = "recovery_code"
+
+	// mfaChallengeAttempts bounds the codes tried per login challenge; the
+	// password has to be entered again afterwards.
+	mfaChallengeAttempts = 5
+	totpQRCodeSize       = 256
+)
+
+// MFAService manages second factors and the second step of logins of users
+// who have one. Factors live in an MFAStore; login challenges are kept in
+// memory, so a challenge has to be completed on the instance that issued it.
+type MFAService struct {
+	Store MFAStore
+	// Issuer is the name authenticator apps show next to the account.
+	Issuer string
+	// ChallengeTTL bounds the time between password and code at login.
+	ChallengeTTL time.Duration
+	// Notifier tells users when a recovery code was used or the codes were
+	// regenerated.
+	Notifier Notifier
+
+	// mu serializes read-modify-write cycles on the store.
+	mu              sync.Mutex
+	challenges      *mfaChallengeStore
+	recoveryCodeKey []byte
+	now             func() time.Time
+}
+
+// NewMFAService returns a service keeping factors in store. recoveryCodeKey
+// keys the recovery code hashes; changing it invalidates all recovery codes.
+func NewMFAService(store MFAStore, issuer string, challengeTTL time.Duration, recoveryCodeKey []byte) *MFAService {
+	return &MFAService{
+		Store:           store,
+		Issuer:          issuer,
+		ChallengeTTL:    challengeTTL,
+		Notifier:        LogNotifier{},
+		challenges:      newMFAChallengeStore(),
+		recoveryCodeKey: recoveryCodeKey,
+		now:             time.Now,
+	}
+}
+
+// TOTPEnrollment is a started TOTP enrollment. The secret is shown once; the
+// user adds it to an authenticator app and confirms with a code.
+type TOTPEnrollment struct {
+	FactorID string
+	Secret   string
+	URI      string
+	// QRCode is a PNG of URI.
+	QRCode []byte
+}
+
+// BeginTOTP adds an unconfirmed TOTP factor for the user, replacing an
+// enrollment that was started but never confirmed.
+func (ms *MFAService) BeginTOTP(ctx context.Context, userID, accountName, label string) (*TOTPEnrollment, error) {
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	id, err := newUUID()
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	uri := totpURI(ms.Issuer, accountName, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, totpQRCodeSize)
+	if err != nil {
+		return nil, apperr.Internal(fmt.Errorf("render qr code failed: %w", err))
+	}
+	if label == "" {
+		label = "Authenticator app"
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	factors, err := ms.factors(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	kept := factors[:0]
+	for _, f := range factors {
+		if f.Confirmed {
+			kept = append(kept, f)
+		}
+	}
+	kept = append(kept, MFAFactor{
+		ID:        id,
+		Type:      FactorTOTP,
+		Label:     label,
+		Secret:    secret,
+		CreatedAt: ms.now(),
+	})
+	if err := ms.save(ctx, userID, kept); err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{FactorID: id, Secret: secret, URI: uri, QRCode: png}, nil
+}
+
+// ConfirmTOTP completes an enrollment with a code from the authenticator app.
+// Confirming the first factor also generates the user's recovery codes,
+// which are returned; they are nil when the user already has codes.
+func (ms *MFAService) ConfirmTOTP(ctx context.Context, userID, factorID, code string) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	factors, err := ms.factors(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range factors {
+		f := &factors[i]
+		if f.ID != factorID || f.Type != FactorTOTP {
+			continue
+		}
+		if f.Confirmed {
+			return nil, ErrMFAAlreadyConfirmed
+		}
+		step, ok := matchTOTP(f.Secret, code, ms.now())
+		if !ok {
+			return nil, ErrInvalidMFACode
+		}
+		f.Confirmed = true
+		f.LastUsedStep = step
+
+		var codes []string
+		if recoveryCodes(factors) == nil {
+			if codes, factors, err = ms.replaceRecoveryCodes(factors); err != nil {
+				return nil, err
+			}
+		}
+		if err := ms.save(ctx, userID, factors); err != nil {
+			return nil, err
+		}
+		return codes, nil
+	}
+	return nil, ErrMFAFactorNotFound
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes with new ones
+// and returns them. The old codes stop working. code is a current code of
+// the user, so a stolen access token alone cannot mint recovery codes.
+func (ms *MFAService) RegenerateRecoveryCodes(ctx context.Context, userID, code string) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	factors, err := ms.factors(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !hasConfirmedTOTP(factors) {
+		return nil, ErrMFANotEnabled
+	}
+	if err := ms.stepUp(factors, code); err != nil {
+		return nil, err
+	}
+	codes, factors, err := ms.replaceRecoveryCodes(factors)
+	if err != nil {
+		return nil, err
+	}
+	if err := ms.save(ctx, userID, factors); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// RecoveryCodesLeft returns the number of unused recovery codes.
+func (ms *MFAService) RecoveryCodesLeft(ctx context.Context, userID string) (int, error) {
+	factors, err := ms.factors(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	if f := recoveryCodes(factors); f != nil {
+		return len(f.CodeHashes), nil
+	}
+	return 0, nil
+}
+
+// Factors returns the user's factors, confirmed or pending.
+func (ms *MFAService) Factors(ctx context.Context, userID string) ([]MFAFactor, error) {
+	return ms.factors(ctx, userID)
+}
+
+// Enabled reports whether logins of the user need a second factor.
+func (ms *MFAService) Enabled(ctx context.Context, userID string) (bool, error) {
+	factors, err := ms.factors(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return hasConfirmedTOTP(factors), nil
+}
+
+// RemoveFactor deletes a factor. Removing the last confirmed factor turns
+// MFA off for the user and deletes the recovery codes with it. Once MFA is
+// on, code has to be a current code of the user, so a stolen access token
+// alone cannot turn it off.
+func (ms *MFAService) RemoveFactor(ctx context.Context, userID, factorID, code string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	factors, err := ms.factors(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for i, f := range factors {
+		if f.ID != factorID || f.Type == FactorRecoveryCode {
+			continue
+		}
+		if hasConfirmedTOTP(factors) {
+			if err := ms.stepUp(factors, code); err != nil {
+				return err
+			}
+		}
+		factors = append(factors[:i], factors[i+1:]...)
+		if !hasConfirmedTOTP(factors) {
+			factors = withoutRecoveryCodes(factors)
+		}
+		return ms.save(ctx, userID, factors)
+	}
+	return ErrMFAFactorNotFound
+}
+
+// MFAVerification tells how a code was verified.
+type MFAVerification struct {
+	// Method is FactorTOTP or FactorRecoveryCode.
+	Method string
+	// RecoveryCodesLeft is the number of unused recovery codes after a
+	// recovery code was used.
+	RecoveryCodesLeft int
+}
+
+// Verify checks a code against the user's confirmed factors and marks it
+// used. The code is either from the authenticator app or a recovery code.
+func (ms *MFAService) Verify(ctx context.Context, userID, code string) (*MFAVerification, error) {
+	return ms.verify(ctx, userID, code, nil)
+}
+
+// verify is Verify calling claim, when set, between checking and using up
+// the code. If claim returns false the code stays unused and
+// ErrMFAChallengeExpired is returned.
+func (ms *MFAService) verify(ctx context.Context, userID, code string, claim func() bool) (*MFAVerification, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	factors, err := ms.factors(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !hasConfirmedTOTP(factors) {
+		return nil, ErrInvalidMFACode
+	}
+
+	verification := ms.useCode(factors, code)
+	if verification == nil {
+		return nil, ErrInvalidMFACode
+	}
+	if claim != nil && !claim() {
+		return nil, ErrMFAChallengeExpired
+	}
+	if err := ms.save(ctx, userID, factors); err != nil {
+		return nil, err
+	}
+	return verification, nil
+}
+
+// stepUp checks code before a change to the user's factors and marks it
+// used in factors, which the caller saves with the change.
+func (ms *MFAService) stepUp(factors []MFAFactor, code string) error {
+	if code == "" {
+		return ErrMFACodeRequired
+	}
+	if ms.useCode(factors, code) == nil {
+		return ErrInvalidMFACode
+	}
+	return nil
+}
+
+// useCode marks code used in factors, which the caller still has to save,
+// and returns how it verified; nil if it did not.
+func (ms *MFAService) useCode(factors []MFAFactor, code string) *MFAVerification {
+	now := ms.now()
+	for i := range factors {
+		f := &factors[i]
+		if !f.Confirmed || f.Type != FactorTOTP {
+			continue
+		}
+		if step, ok := matchTOTP(f.Secret, code, now); ok && step > f.LastUsedStep {
+			f.LastUsedStep = step
+			return &MFAVerification{Method: FactorTOTP}
+		}
+	}
+
+	if f := recoveryCodes(factors); f != nil {
+		if i := ms.matchRecoveryCode(f, code); i >= 0 {
+			// A copy, the stored factors may share the slice.
+			f.CodeHashes = slices.Delete(slices.Clone(f.CodeHashes), i, i+1)
+			return &MFAVerification{Method: FactorRecoveryCode, RecoveryCodesLeft: len(f.CodeHashes)}
+		}
+	}
+	return nil
+}
+
+// MFAChallenge is the first step of a login that needs a second factor.
+type MFAChallenge struct {
+	ID        string
+	Methods   []string
+	ExpiresAt time.Time
+}
+
+// MFALogin is a password login waiting for its second factor.
+type MFALogin struct {
+	UserID string
+	// Username is the name the user logged in with, which login lockouts
+	// are keyed by.
+	Username string
+	Email    string
+	Token    *models.LoginResponse
+	// Verification is set once the second factor is verified.
+	Verification *MFAVerification
+}
+
+// StartChallenge holds the tokens of a password login until the user proves
+// the second factor with CompleteChallenge. Methods lists FactorRecoveryCode
+// too while the user has unused recovery codes.
+func (ms *MFAService) StartChallenge(ctx context.Context, login MFALogin) (*MFAChallenge, error) {
+	methods := []string{FactorTOTP}
+	left, err := ms.RecoveryCodesLeft(ctx, login.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if left > 0 {
+		methods = append(methods, FactorRecoveryCode)
+	}
+
+	id, err := randomToken(32)
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	now := ms.now()
+	expiresAt := now.Add(ms.ChallengeTTL)
+	ms.challenges.Put(id, &mfaChallenge{login: login, expiresAt: expiresAt}, now)
+	return &MFAChallenge{ID: id, Methods: methods, ExpiresAt: expiresAt}, nil
+}
+
+// ChallengeUser returns the user a pending challenge belongs to, without
+// tokens, so callers can check the account before a code is tried.
+func (ms *MFAService) ChallengeUser(challengeID string) (*MFALogin, error) {
+	challenge, ok := ms.challenges.Peek(challengeID, ms.now())
+	if !ok {
+		return nil, ErrMFAChallengeExpired
+	}
+	return &MFALogin{UserID: challenge.login.UserID, Username: challenge.login.Username, Email: challenge.login.Email}, nil
+}
+
+// CompleteChallenge returns the held login once code verifies. A challenge
+// is spent on success or after too many codes; every call uses up an
+// attempt. When the code is wrong the returned login names the user but
+// carries no tokens.
+//
+// The tokens of abandoned challenges are never handed out; their identity
+// provider session ends with its idle timeout.
+func (ms *MFAService) CompleteChallenge(ctx context.Context, challengeID, code string) (*MFALogin, error) {
+	challenge, attempt, ok := ms.challenges.Attempt(challengeID, ms.now())
+	if !ok {
+		return nil, ErrMFAChallengeExpired
+	}
+	failed := &MFALogin{UserID: challenge.login.UserID, Username: challenge.login.Username, Email: challenge.login.Email}
+
+	// The code is only used up if this request still gets the challenge,
+	// so losing a race against a concurrent request does not burn it.
+	verification, err := ms.verify(ctx, challenge.login.UserID, code, func() bool {
+		return ms.challenges.Take(challengeID)
+	})
+	if err != nil {
+		if !errors.Is(err, ErrInvalidMFACode) {
+			return nil, err
+		}
+		if attempt >= mfaChallengeAttempts {
+			ms.challenges.Take(challengeID)
+			return failed, ErrMFAChallengeExpired.WithCause(err)
+		}
+		return failed, err
+	}
+	login := challenge.login
+	login.Verification = verification
+	return &login, nil
+}
+
+func (ms *MFAService) factors(ctx context.Context, userID string) ([]MFAFactor, error) {
+	factors, err := ms.Store.Factors(ctx, userID)
+	if err != nil {
+		return nil, apperr.Internal(fmt.Errorf("load mfa factors failed: %w", err))
+	}
+	return factors, nil
+}
+
+func (ms *MFAService) save(ctx context.Context, userID string, factors []MFAFactor) error {
+	if err := ms.Store.SaveFactors(ctx, userID, factors); err != nil {
+		return apperr.Internal(fmt.Errorf("save mfa factors failed: %w", err))
+	}
+	return nil
+}
+
+type mfaChallenge struct {
+	login     MFALogin
+	attempts  int
+	expiresAt time.Time
+}
+
+// mfaChallengeStore keeps pending logins keyed by the SHA-256 of their ID,
+// like pendingLoginStore.
+type mfaChallengeStore struct {
+	mu      sync.Mutex
+	entries map[string]*mfaChallenge
+}
+
+func newMFAChallengeStore() *mfaChallengeStore {
+	return &mfaChallengeStore{entries: make(map[string]*mfaChallenge)}
+}
+
+func (s *mfaChallengeStore) Put(id string, challenge *mfaChallenge, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		if now.After(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+	s.entries[hashToken(id)] = challenge
+}
+
+// Peek returns the challenge if it can still be attempted.
+func (s *mfaChallengeStore) Peek(id string, now time.Time) (mfaChallenge, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge, ok := s.usable(id, now)
+	if !ok {
+		return mfaChallenge{}, false
+	}
+	return *challenge, true
+}
+
+// Attempt reserves one of the challenge's attempts and returns the
+// challenge with the number of the attempt. Reserving before the code is
+// checked keeps parallel requests from trying more codes than allowed.
+func (s *mfaChallengeStore) Attempt(id string, now time.Time) (mfaChallenge, int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	challenge, ok := s.usable(id, now)
+	if !ok {
+		return mfaChallenge{}, 0, false
+	}
+	challenge.attempts++
+	return *challenge, challenge.attempts, true
+}
+
+func (s *mfaChallengeStore) usable(id string, now time.Time) (*mfaChallenge, bool) {
+	challenge, ok := s.entries[hashToken(id)]
+	if !ok || now.After(challenge.expiresAt) || challenge.attempts >= mfaChallengeAttempts {
+		return nil, false
+	}
+	return challenge, true
+}
+
+// Take removes the challenge and reports whether it was still there.
+func (s *mfaChallengeStore) Take(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hashToken(id)
+	_, ok := s.entries[key]
+	delete(s.entries, key)
+	return ok
+}
@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// MFAFactor is a second factor of a user. Unconfirmed factors are pending
+// enrollments and are not asked for at login.
+type MFAFactor struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Label     string    `json:"label"`
+	Secret    string    `json:"secret"`
+	Confirmed bool      `json:"confirmed"`
+	CreatedAt time.Time `json:"created_at"`
+	// LastUsedStep is the TOTP time step of the last accepted code, so a
+	// code cannot be used twice.
+	LastUsedStep int64 `json:"last_used_step"`
+	// CodeHashes are the SHA-256 hashes of the unused recovery codes of a
+	// FactorRecoveryCode factor.
+	CodeHashes []string `json:"code_hashes,omitempty"`
+}
+
+// MFAStore persists the factors of each user. Implementations must be safe
+// for concurrent use.
+type MFAStore interface {
+	// Factors returns the user's factors, none if the user has no factors.
+	Factors(ctx context.Context, userID string) ([]MFAFactor, error)
+	// SaveFactors replaces the user's factors; an empty list removes them.
+	SaveFactors(ctx context.Context, userID string, factors []MFAFactor) error
+}
+
+// MemoryMFAStore keeps factors in process, for tests and local development.
+type MemoryMFAStore struct {
+	mu      sync.Mutex
+	factors map[string][]MFAFactor
+}
+
+func NewMemoryMFAStore() *MemoryMFAStore {
+	return &MemoryMFAStore{factors: make(map[string][]MFAFactor)}
+}
+
+func (s *MemoryMFAStore) Factors(ctx context.Context, userID string) ([]MFAFactor, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]MFAFactor(nil), s.factors[userID]...), nil
+}
+
+func (s *MemoryMFAStore) SaveFactors(ctx context.Context, userID string, factors []MFAFactor) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(factors) == 0 {
+		delete(s.factors, userID)
+		return nil
+	}
+	s.factors[userID] = append([]MFAFactor(nil), factors...)
+	return nil
+}
+
+// FileMFAStore keeps each user's factors in a JSON file under Dir, replaced
+// atomically like FileSessionStore's. The files hold the TOTP secrets and are
+// only readable by the service user.
+type FileMFAStore struct {
+	Dir string
+}
+
+func NewFileMFAStore(dir string) (*FileMFAStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create mfa directory failed: %w", err)
+	}
+	return &FileMFAStore{Dir: dir}, nil
+}
+
+func (s *FileMFAStore) Factors(ctx context.Context, userID string) ([]MFAFactor, error) {
+	path := s.path(userID)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var factors []MFAFactor
+	if err := json.Unmarshal(data, &factors); err != nil {
+		return nil, fmt.Errorf("decode %s failed: %w", filepath.Base(path), err)
+	}
+	return factors, nil
+}
+
+func (s *FileMFAStore) SaveFactors(ctx context.Context, userID string, factors []MFAFactor) error {
+	if len(factors) == 0 {
+		if err := os.Remove(s.path(userID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.Marshal(factors)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(userID))
+}
+
+func (s *FileMFAStore) path(userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return filepath.Join(s.Dir, hex.EncodeToString(sum[:])+".json")
+}
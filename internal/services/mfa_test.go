@@ -0,0 +1,318 @@
+package services
+
+import (
+	"auth-service/internal/models"
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHOTPVectors(t *testing.T) {
+	// RFC 6238 appendix B, SHA-1, truncated to six digits.
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		got, err := TOTPCode(secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("TOTPCode at %d = %s, want %s", unix, got, want)
+		}
+	}
+}
+
+func newTestMFA(t *testing.T, store MFAStore) (*MFAService, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	mfa := NewMFAService(store, "auth-service", 5*time.Minute, []byte("test-recovery-code-key"))
+	mfa.now = clock.Now
+	return mfa, clock
+}
+
+// enroll enrolls and confirms a TOTP factor and returns its secret.
+func enroll(t *testing.T, mfa *MFAService, clock *fakeClock, userID string) string {
+	t.Helper()
+	ctx := context.Background()
+	enrollment, err := mfa.BeginTOTP(ctx, userID, "alice@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := TOTPCode(enrollment.Secret, clock.Now())
+	if _, err := mfa.ConfirmTOTP(ctx, userID, enrollment.FactorID, code); err != nil {
+		t.Fatalf("confirm: %v", err)
+	}
+	return enrollment.Secret
+}
+
+func TestMFAEnrollAndVerify(t *testing.T) {
+	for name, store := range map[string]func(t *testing.T) MFAStore{
+		"memory": func(t *testing.T) MFAStore { return NewMemoryMFAStore() },
+		"file": func(t *testing.T) MFAStore {
+			store, err := NewFileMFAStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return store
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			mfa, clock := newTestMFA(t, store(t))
+
+			enrollment, err := mfa.BeginTOTP(ctx, "user-1", "alice@example.com", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if enabled, _ := mfa.Enabled(ctx, "user-1"); enabled {
+				t.Fatal("unconfirmed factor enables mfa")
+			}
+			if _, err := mfa.ConfirmTOTP(ctx, "user-1", enrollment.FactorID, "123456"); !errors.Is(err, ErrInvalidMFACode) {
+				t.Fatalf("confirm with wrong code: %v", err)
+			}
+			code, _ := TOTPCode(enrollment.Secret, clock.Now())
+			if _, err := mfa.ConfirmTOTP(ctx, "user-1", enrollment.FactorID, code); err != nil {
+				t.Fatalf("confirm: %v", err)
+			}
+			if _, err := mfa.ConfirmTOTP(ctx, "user-1", enrollment.FactorID, code); !errors.Is(err, ErrMFAAlreadyConfirmed) {
+				t.Fatalf("confirm twice: %v", err)
+			}
+			if enabled, _ := mfa.Enabled(ctx, "user-1"); !enabled {
+				t.Fatal("confirmed factor does not enable mfa")
+			}
+
+			// The confirmation code is spent; the next step's code works once.
+			if _, err := mfa.Verify(ctx, "user-1", code); !errors.Is(err, ErrInvalidMFACode) {
+				t.Fatalf("replayed code: %v", err)
+			}
+			clock.Advance(totpPeriod)
+			next, _ := TOTPCode(enrollment.Secret, clock.Now())
+			if v, err := mfa.Verify(ctx, "user-1", next); err != nil || v.Method != FactorTOTP {
+				t.Fatalf("verify: %+v, %v", v, err)
+			}
+			if _, err := mfa.Verify(ctx, "user-1", next); !errors.Is(err, ErrInvalidMFACode) {
+				t.Fatalf("replayed code: %v", err)
+			}
+
+			// Codes of a factor of another user do not count.
+			if _, err := mfa.Verify(ctx, "user-2", next); !errors.Is(err, ErrInvalidMFACode) {
+				t.Fatalf("verify other user: %v", err)
+			}
+
+			// Turning MFA off takes a current code.
+			if err := mfa.RemoveFactor(ctx, "user-1", enrollment.FactorID, ""); !errors.Is(err, ErrMFACodeRequired) {
+				t.Fatalf("remove without code: %v", err)
+			}
+			if err := mfa.RemoveFactor(ctx, "user-1", enrollment.FactorID, next); !errors.Is(err, ErrInvalidMFACode) {
+				t.Fatalf("remove with a used code: %v", err)
+			}
+			clock.Advance(totpPeriod)
+			code, _ = TOTPCode(enrollment.Secret, clock.Now())
+			if err := mfa.RemoveFactor(ctx, "user-1", enrollment.FactorID, code); err != nil {
+				t.Fatal(err)
+			}
+			if enabled, _ := mfa.Enabled(ctx, "user-1"); enabled {
+				t.Fatal("mfa still enabled after removing the factor")
+			}
+			if err := mfa.RemoveFactor(ctx, "user-1", enrollment.FactorID, ""); !errors.Is(err, ErrMFAFactorNotFound) {
+				t.Fatalf("remove twice: %v", err)
+			}
+		})
+	}
+}
+
+func TestMFAChallenge(t *testing.T) {
+	ctx := context.Background()
+	mfa, clock := newTestMFA(t, NewMemoryMFAStore())
+	secret := enroll(t, mfa, clock, "user-1")
+	login := MFALogin{UserID: "user-1", Username: "alice", Token: &models.LoginResponse{AccessToken: "access"}}
+
+	t.Run("wrong codes", func(t *testing.T) {
+		challenge, err := mfa.StartChallenge(ctx, login)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(challenge.Methods, []string{FactorTOTP, FactorRecoveryCode}) {
+			t.Fatalf("methods = %v", challenge.Methods)
+		}
+		// Without recovery codes only the app is offered.
+		if other, _ := mfa.StartChallenge(ctx, MFALogin{UserID: "user-2"}); !slices.Equal(other.Methods, []string{FactorTOTP}) {
+			t.Fatalf("methods without recovery codes = %v", other.Methods)
+		}
+		for i := 1; i < mfaChallengeAttempts; i++ {
+			failed, err := mfa.CompleteChallenge(ctx, challenge.ID, "000000")
+			if !errors.Is(err, ErrInvalidMFACode) || failed == nil || failed.Username != "alice" || failed.Token != nil {
+				t.Fatalf("attempt %d: %+v, %v", i, failed, err)
+			}
+		}
+		if _, err := mfa.CompleteChallenge(ctx, challenge.ID, "000000"); !errors.Is(err, ErrMFAChallengeExpired) {
+			t.Fatalf("last attempt: %v", err)
+		}
+		clock.Advance(totpPeriod)
+		code, _ := TOTPCode(secret, clock.Now())
+		if _, err := mfa.CompleteChallenge(ctx, challenge.ID, code); !errors.Is(err, ErrMFAChallengeExpired) {
+			t.Fatalf("after too many attempts: %v", err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		challenge, _ := mfa.StartChallenge(ctx, login)
+		clock.Advance(mfa.ChallengeTTL + time.Second)
+		code, _ := TOTPCode(secret, clock.Now())
+		if _, err := mfa.CompleteChallenge(ctx, challenge.ID, code); !errors.Is(err, ErrMFAChallengeExpired) {
+			t.Fatalf("expired challenge: %v", err)
+		}
+	})
+
+	t.Run("success", func(t *testing.T) {
+		challenge, _ := mfa.StartChallenge(ctx, login)
+		clock.Advance(totpPeriod)
+		code, _ := TOTPCode(secret, clock.Now())
+		got, err := mfa.CompleteChallenge(ctx, challenge.ID, code)
+		if err != nil || got.Token == nil || got.Token.AccessToken != "access" {
+			t.Fatalf("complete: %+v, %v", got, err)
+		}
+		clock.Advance(totpPeriod)
+		code, _ = TOTPCode(secret, clock.Now())
+		if _, err := mfa.CompleteChallenge(ctx, challenge.ID, code); !errors.Is(err, ErrMFAChallengeExpired) {
+			t.Fatalf("challenge used twice: %v", err)
+		}
+	})
+	t.Run("parallel attempts", func(t *testing.T) {
+		challenge, _ := mfa.StartChallenge(ctx, login)
+		var wg sync.WaitGroup
+		var tried atomic.Int32
+		for i := 0; i < 4*mfaChallengeAttempts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				// Only calls that got an attempt learn whose challenge it is.
+				if failed, _ := mfa.CompleteChallenge(ctx, challenge.ID, "000000"); failed != nil {
+					tried.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if n := tried.Load(); n != mfaChallengeAttempts {
+			t.Fatalf("%d codes tried, want %d", n, mfaChallengeAttempts)
+		}
+	})
+
+	t.Run("lost race keeps the code", func(t *testing.T) {
+		clock.Advance(totpPeriod)
+		code, _ := TOTPCode(secret, clock.Now())
+		codes, err := mfa.RegenerateRecoveryCodes(ctx, "user-1", code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A concurrent request took the challenge between check and use.
+		lost := func() bool { return false }
+		if _, err := mfa.verify(ctx, "user-1", codes[0], lost); !errors.Is(err, ErrMFAChallengeExpired) {
+			t.Fatalf("lost race: %v", err)
+		}
+		if _, err := mfa.Verify(ctx, "user-1", codes[0]); err != nil {
+			t.Fatalf("code burned by the lost race: %v", err)
+		}
+	})
+}
+
+func TestMFARecoveryCodes(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileMFAStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfa, clock := newTestMFA(t, store)
+
+	if _, err := mfa.RegenerateRecoveryCodes(ctx, "user-1", ""); !errors.Is(err, ErrMFANotEnabled) {
+		t.Fatalf("regenerate without mfa: %v", err)
+	}
+
+	enrollment, _ := mfa.BeginTOTP(ctx, "user-1", "alice@example.com", "")
+	code, _ := TOTPCode(enrollment.Secret, clock.Now())
+	codes, err := mfa.ConfirmTOTP(ctx, "user-1", enrollment.FactorID, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d recovery codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	// Only the hashes are stored.
+	factors, _ := store.Factors(ctx, "user-1")
+	for _, f := range factors {
+		for _, h := range f.CodeHashes {
+			for _, c := range codes {
+				if h == c || h == normalizeRecoveryCode(c) {
+					t.Fatalf("recovery code %s stored in plain text", c)
+				}
+				if h == hashToken(normalizeRecoveryCode(c)) {
+					t.Fatalf("recovery code %s stored as an unkeyed hash", c)
+				}
+			}
+		}
+	}
+
+	// The hashes are worthless without the key.
+	otherKey := NewMFAService(store, "auth-service", 5*time.Minute, []byte("another-recovery-code-key"))
+	if _, err := otherKey.Verify(ctx, "user-1", codes[0]); !errors.Is(err, ErrInvalidMFACode) {
+		t.Fatalf("code verified under another key: %v", err)
+	}
+
+	// Codes are accepted in any case and without the dash, once.
+	typed := strings.ToUpper(strings.ReplaceAll(codes[3], "-", ""))
+	v, err := mfa.Verify(ctx, "user-1", typed)
+	if err != nil || v.Method != FactorRecoveryCode || v.RecoveryCodesLeft != recoveryCodeCount-1 {
+		t.Fatalf("redeem: %+v, %v", v, err)
+	}
+	if _, err := mfa.Verify(ctx, "user-1", codes[3]); !errors.Is(err, ErrInvalidMFACode) {
+		t.Fatalf("recovery code used twice: %v", err)
+	}
+	if left, _ := mfa.RecoveryCodesLeft(ctx, "user-1"); left != recoveryCodeCount-1 {
+		t.Fatalf("%d codes left", left)
+	}
+
+	// Enrolling another app keeps the codes.
+	second, _ := mfa.BeginTOTP(ctx, "user-1", "alice@example.com", "tablet")
+	code, _ = TOTPCode(second.Secret, clock.Now())
+	if more, err := mfa.ConfirmTOTP(ctx, "user-1", second.FactorID, code); err != nil || more != nil {
+		t.Fatalf("second factor: %v, %v", more, err)
+	}
+
+	// Regenerating takes a current code, a recovery code will do.
+	if _, err := mfa.RegenerateRecoveryCodes(ctx, "user-1", ""); !errors.Is(err, ErrMFACodeRequired) {
+		t.Fatalf("regenerate without code: %v", err)
+	}
+	if _, err := mfa.RegenerateRecoveryCodes(ctx, "user-1", codes[3]); !errors.Is(err, ErrInvalidMFACode) {
+		t.Fatalf("regenerate with a used code: %v", err)
+	}
+	regenerated, err := mfa.RegenerateRecoveryCodes(ctx, "user-1", codes[5])
+	if err != nil || len(regenerated) != recoveryCodeCount {
+		t.Fatalf("regenerate: %v, %v", regenerated, err)
+	}
+	if _, err := mfa.Verify(ctx, "user-1", codes[4]); !errors.Is(err, ErrInvalidMFACode) {
+		t.Fatalf("old code after regenerating: %v", err)
+	}
+	if _, err := mfa.Verify(ctx, "user-1", regenerated[0]); err != nil {
+		t.Fatalf("new code: %v", err)
+	}
+
+	// The codes go with the last authenticator app.
+	for i, id := range []string{enrollment.FactorID, second.FactorID} {
+		if err := mfa.RemoveFactor(ctx, "user-1", id, regenerated[i+1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if factors, _ := store.Factors(ctx, "user-1"); len(factors) != 0 {
+		t.Fatalf("factors left after removing all apps: %+v", factors)
+	}
+}
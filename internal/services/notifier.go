@@ -0,0 +1,86 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Security events users are told about.
+const (
+	EventRecoveryCodeUsed         = "mfa.recovery_code_used"
+	EventRecoveryCodesRegenerated = "mfa.recovery_codes_regenerated"
+)
+
+// Notification tells a user about a security relevant change to their
+// account.
+type Notification struct {
+	Event    string            `json:"event"`
+	UserID   string            `json:"user_id"`
+	Username string            `json:"username,omitempty"`
+	Email    string            `json:"email,omitempty"`
+	Time     time.Time         `json:"time"`
+	Details  map[string]string `json:"details,omitempty"`
+}
+
+// Notifier delivers notifications to users. Keycloak can only send its own
+// action emails, so delivery is left to an external service.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// LogNotifier only logs notifications, for deployments without a delivery
+// service.
+type LogNotifier struct {
+	Logger *slog.Logger
+}
+
+func (ln LogNotifier) Notify(ctx context.Context, n Notification) error {
+	logger := ln.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger.InfoContext(ctx, "user notification",
+		slog.String("event", n.Event),
+		slog.String("user_id", n.UserID),
+		slog.Any("details", n.Details),
+	)
+	return nil
+}
+
+// WebhookNotifier posts notifications as JSON to URL, e.g. to a mail
+// service that renders and sends them.
+type WebhookNotifier struct {
+	URL        string
+	HTTPClient *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, HTTPClient: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (wn *WebhookNotifier) Notify(ctx context.Context, n Notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wn.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wn.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("notification webhook failed: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook failed: %s", resp.Status)
+	}
+	return nil
+}
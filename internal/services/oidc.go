@@ -0,0 +1,256 @@
+package services
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/models"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidOIDCState         = apperr.Validation("invalid_oidc_state", "login request is invalid or expired")
+	ErrAuthorizationDenied      = apperr.Unauthorized("authorization_denied", "login was cancelled or denied by the identity provider")
+	ErrInvalidAuthorizationCode = apperr.Unauthorized("invalid_authorization_code", "authorization code is invalid or expired")
+	ErrInvalidIDToken           = apperr.Unauthorized("invalid_id_token", "id token is invalid")
+)
+
+// OIDCClient runs the OpenID Connect authorization code flow with PKCE
+// against the realm, so browsers can log in through Keycloak's own pages
+// (SSO, MFA, social login) while tokens stay with this backend.
+type OIDCClient struct {
+	AuthURL      string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	// RedirectURI is this service's callback endpoint. It must be registered
+	// as a valid redirect URI of the client in Keycloak.
+	RedirectURI string
+	Scopes      []string
+	// StateTTL bounds how long a user may take on the Keycloak login page.
+	StateTTL   time.Duration
+	Verifier   *TokenVerifier
+	HTTPClient *http.Client
+
+	pending *pendingLoginStore
+}
+
+func NewOIDCClient(hostname string, realm string, clientID string, clientSecret string, redirectURI string) *OIDCClient {
+	endpoint := strings.TrimRight(hostname, "/") + "/realms/" + realm + "/protocol/openid-connect"
+	return &OIDCClient{
+		AuthURL:      endpoint + "/auth",
+		TokenURL:     endpoint + "/token",
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RedirectURI:  redirectURI,
+		Scopes:       []string{"openid", "profile", "email"},
+		StateTTL:     10 * time.Minute,
+		Verifier:     NewTokenVerifier(hostname, realm, clientID),
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+
+		pending: newPendingLoginStore(),
+	}
+}
+
+// AuthorizationRequest is a started login. The caller redirects the browser
+// to URL and must bind State to it, the callback only completes for the
+// browser that started the login.
+type AuthorizationRequest struct {
+	URL   string
+	State string
+}
+
+// OIDCLogin is the outcome of a completed authorization code flow.
+type OIDCLogin struct {
+	Token    *models.LoginResponse
+	IDToken  string
+	Claims   *IDTokenClaims
+	ReturnTo string
+}
+
+// Begin starts a login and remembers its PKCE verifier and nonce until the
+// callback. returnTo is handed back by Complete untouched.
+func (oc *OIDCClient) Begin(returnTo string) (*AuthorizationRequest, error) {
+	state, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := randomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	oc.pending.Put(state, pendingLogin{
+		codeVerifier: verifier,
+		nonce:        nonce,
+		returnTo:     returnTo,
+	}, oc.StateTTL)
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oc.ClientID},
+		"redirect_uri":          {oc.RedirectURI},
+		"scope":                 {strings.Join(oc.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	return &AuthorizationRequest{
+		URL:   oc.AuthURL + "?" + query.Encode(),
+		State: state,
+	}, nil
+}
+
+// Complete exchanges the authorization code of the login identified by
+// state and validates the returned ID token. A state can be completed once.
+func (oc *OIDCClient) Complete(ctx context.Context, state string, code string) (*OIDCLogin, error) {
+	login, ok := oc.pending.Take(state)
+	if !ok {
+		return nil, ErrInvalidOIDCState
+	}
+
+	token, idToken, err := oc.exchange(ctx, code, login.codeVerifier)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := oc.Verifier.VerifyIDToken(ctx, idToken, login.nonce)
+	if err != nil {
+		return nil, ErrInvalidIDToken.WithCause(err)
+	}
+
+	return &OIDCLogin{
+		Token:    token,
+		IDToken:  idToken,
+		Claims:   claims,
+		ReturnTo: login.returnTo,
+	}, nil
+}
+
+type codeExchangeResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	IDToken          string `json:"id_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
+	TokenType        string `json:"token_type"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// exchange redeems the code at the token endpoint. gocloak's TokenOptions
+// has no code_verifier, so the request is made directly.
+func (oc *OIDCClient) exchange(ctx context.Context, code string, codeVerifier string) (*models.LoginResponse, string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oc.RedirectURI},
+		"code_verifier": {codeVerifier},
+		"client_id":     {oc.ClientID},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, oc.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, "", apperr.Internal(fmt.Errorf("build token request failed: %w", err))
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if oc.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oc.ClientID), url.QueryEscape(oc.ClientSecret))
+	}
+
+	resp, err := oc.HTTPClient.Do(req)
+	if err != nil {
+		return nil, "", ErrKeycloakUnavailable.WithCause(fmt.Errorf("code exchange failed: %w", err))
+	}
+	defer resp.Body.Close()
+
+	var body codeExchangeResponse
+	decodeErr := json.NewDecoder(resp.Body).Decode(&body)
+
+	switch {
+	case resp.StatusCode >= 500:
+		return nil, "", ErrKeycloakUnavailable.WithCause(fmt.Errorf("code exchange failed: unexpected status %s", resp.Status))
+	case resp.StatusCode == http.StatusBadRequest && body.Error == "invalid_grant":
+		return nil, "", ErrInvalidAuthorizationCode.WithCause(fmt.Errorf("code exchange failed: %s", body.ErrorDescription))
+	case resp.StatusCode != http.StatusOK:
+		return nil, "", apperr.Internal(fmt.Errorf("code exchange failed: %s: %s %s", resp.Status, body.Error, body.ErrorDescription))
+	case decodeErr != nil:
+		return nil, "", apperr.Internal(fmt.Errorf("decode token response failed: %w", decodeErr))
+	case body.IDToken == "":
+		return nil, "", ErrInvalidIDToken.WithCause(errors.New("token response has no id_token, is the openid scope requested?"))
+	}
+
+	return &models.LoginResponse{
+		AccessToken:      body.AccessToken,
+		RefreshToken:     body.RefreshToken,
+		ExpiresIn:        body.ExpiresIn,
+		RefreshExpiresIn: body.RefreshExpiresIn,
+		TokenType:        body.TokenType,
+	}, body.IDToken, nil
+}
+
+type pendingLogin struct {
+	codeVerifier string
+	nonce        string
+	returnTo     string
+	expiresAt    time.Time
+}
+
+// pendingLoginStore keeps started logins in memory, keyed by the SHA-256 of
+// their state like resetTokenStore.
+type pendingLoginStore struct {
+	mu      sync.Mutex
+	entries map[string]pendingLogin
+	now     func() time.Time
+}
+
+func newPendingLoginStore() *pendingLoginStore {
+	return &pendingLoginStore{
+		entries: make(map[string]pendingLogin),
+		now:     time.Now,
+	}
+}
+
+func (s *pendingLoginStore) Put(state string, login pendingLogin, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	for key, entry := range s.entries {
+		if now.After(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+	login.expiresAt = now.Add(ttl)
+	s.entries[hashToken(state)] = login
+}
+
+// Take returns the login started with state and forgets it.
+func (s *pendingLoginStore) Take(state string) (pendingLogin, bool) {
+	key := hashToken(state)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	login, ok := s.entries[key]
+	if !ok {
+		return pendingLogin{}, false
+	}
+	delete(s.entries, key)
+	if s.now().After(login.expiresAt) {
+		return pendingLogin{}, false
+	}
+	return login, true
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	recoveryCodeCount = 10
+	// recoveryCodeLength characters of base32 carry 50 bits, too many to
+	// guess within the attempts a login challenge allows.
+	recoveryCodeLength = 10
+)
+
+var recoveryCodeEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newRecoveryCode returns a code like "k3xq7-m2pva", shown to the user once.
+func newRecoveryCode() (string, error) {
+	raw := make([]byte, 7)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("generate recovery code failed: %w", err)
+	}
+	code := strings.ToLower(recoveryCodeEncoding.EncodeToString(raw)[:recoveryCodeLength])
+	return code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:], nil
+}
+
+// normalizeRecoveryCode accepts codes typed with or without the dash, in
+// any case and with spaces.
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// replaceRecoveryCodes generates a new set of recovery codes and returns it
+// with factors, whose previous codes are dropped. Only the hashes are kept.
+func (ms *MFAService) replaceRecoveryCodes(factors []MFAFactor) ([]string, []MFAFactor, error) {
+	id, err := newUUID()
+	if err != nil {
+		return nil, nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = newRecoveryCode(); err != nil {
+			return nil, nil, err
+		}
+		hashes[i] = ms.recoveryCodeHash(normalizeRecoveryCode(codes[i]))
+	}
+
+	factors = append(withoutRecoveryCodes(factors), MFAFactor{
+		ID:         id,
+		Type:       FactorRecoveryCode,
+		Label:      "Recovery codes",
+		Confirmed:  true,
+		CreatedAt:  ms.now(),
+		CodeHashes: hashes,
+	})
+	return codes, factors, nil
+}
+
+// recoveryCodeHash is the HMAC-SHA256 of a normalized code under the
+// server's key. The codes carry 50 bits, which a plain hash would not protect
+// against brute force once the MFA store leaks; without the key, the hashes
+// are useless.
+func (ms *MFAService) recoveryCodeHash(code string) string {
+	mac := hmac.New(sha256.New, ms.recoveryCodeKey)
+	mac.Write([]byte(code))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// matchRecoveryCode returns the index of the hash of code in f, or -1.
+func (ms *MFAService) matchRecoveryCode(f *MFAFactor, code string) int {
+	code = normalizeRecoveryCode(code)
+	if len(code) != recoveryCodeLength {
+		return -1
+	}
+	hash := []byte(ms.recoveryCodeHash(code))
+	for i, h := range f.CodeHashes {
+		if subtle.ConstantTimeCompare([]byte(h), hash) == 1 {
+			return i
+		}
+	}
+	return -1
+}
+
+func recoveryCodes(factors []MFAFactor) *MFAFactor {
+	for i := range factors {
+		if factors[i].Type == FactorRecoveryCode {
+			return &factors[i]
+		}
+	}
+	return nil
+}
+
+func withoutRecoveryCodes(factors []MFAFactor) []MFAFactor {
+	kept := factors[:0]
+	for _, f := range factors {
+		if f.Type != FactorRecoveryCode {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+func hasConfirmedTOTP(factors []MFAFactor) bool {
+	for _, f := range factors {
+		if f.Type == FactorTOTP && f.Confirmed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"auth-service/internal/apperr"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrInvalidResetToken = apperr.Validation("invalid_reset_token", "invalid or expired password reset token")
+
+type resetTokenEntry struct {
+	userID    string
+	expiresAt time.Time
+	// claimed is set while a reset with the token runs.
+	claimed bool
+}
+
+// resetTokenStore keeps single-use password reset tokens in memory. Only
+// the SHA-256 of a token is stored, so a memory dump does not leak them.
+type resetTokenStore struct {
+	mu      sync.Mutex
+	entries map[string]resetTokenEntry
+	now     func() time.Time
+}
+
+func newResetTokenStore() *resetTokenStore {
+	return &resetTokenStore{
+		entries: make(map[string]resetTokenEntry),
+		now:     time.Now,
+	}
+}
+
+// Issue creates a new token for userID that is valid for ttl.
+func (s *resetTokenStore) Issue(userID string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("generate reset token failed: %w", err)
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.purgeExpired()
+	s.entries[hashToken(token)] = resetTokenEntry{
+		userID:    userID,
+		expiresAt: s.now().Add(ttl),
+	}
+	return token, nil
+}
+
+// Claim returns the user the token was issued for and holds the token, so
+// concurrent resets cannot use it too. Consume ends a successful reset;
+// Release makes the token usable again after a failed one, so a password
+// the identity provider rejects does not cost the user the reset link.
+func (s *resetTokenStore) Claim(token string) (string, error) {
+	key := hashToken(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.entries[key]
+	if !ok || entry.claimed {
+		return "", ErrInvalidResetToken
+	}
+	if s.now().After(entry.expiresAt) {
+		delete(s.entries, key)
+		return "", ErrInvalidResetToken
+	}
+	entry.claimed = true
+	s.entries[key] = entry
+	return entry.userID, nil
+}
+
+// Release returns a claimed token.
+func (s *resetTokenStore) Release(token string) {
+	key := hashToken(token)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry, ok := s.entries[key]; ok {
+		entry.claimed = false
+		s.entries[key] = entry
+	}
+}
+
+// Consume invalidates a claimed token.
+func (s *resetTokenStore) Consume(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, hashToken(token))
+}
+
+func (s *resetTokenStore) purgeExpired() {
+	now := s.now()
+	for key, entry := range s.entries {
+		if now.After(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Steps of KeycloakService.Register, as reported by SagaError.Step.
+const (
+	RegisterStepAdminToken  = "admin_token"
+	RegisterStepCreateUser  = "create_user"
+	RegisterStepSetPassword = "set_password"
+)
+
+// SagaError reports which step of a multi-step operation failed. It unwraps
+// to the step's error, so the apperr of the step still decides the
+// response. UndoErr is set when undoing the completed steps failed as well,
+// which leaves their effects in place.
+type SagaError struct {
+	Step    string
+	Err     error
+	UndoErr error
+}
+
+func (e *SagaError) Error() string {
+	if e.UndoErr != nil {
+		return fmt.Sprintf("%s failed: %v (undo failed: %v)", e.Step, e.Err, e.UndoErr)
+	}
+	return fmt.Sprintf("%s failed: %v", e.Step, e.Err)
+}
+
+func (e *SagaError) Unwrap() error {
+	return e.Err
+}
+
+// sagaStep is one step of a saga. Undo, if set, reverts the step when a
+// later step fails.
+type sagaStep struct {
+	Name string
+	Do   func(ctx context.Context) error
+	Undo func(ctx context.Context) error
+}
+
+// runSaga runs steps in order. When one fails, the completed steps are
+// undone in reverse order and a *SagaError is returned. Undo runs even if
+// ctx was canceled meanwhile, e.g. by the client going away.
+func runSaga(ctx context.Context, steps ...sagaStep) error {
+	for i, step := range steps {
+		err := step.Do(ctx)
+		if err == nil {
+			continue
+		}
+
+		undoCtx := context.WithoutCancel(ctx)
+		var undoErrs []error
+		for j := i - 1; j >= 0; j-- {
+			if steps[j].Undo == nil {
+				continue
+			}
+			if err := steps[j].Undo(undoCtx); err != nil {
+				undoErrs = append(undoErrs, fmt.Errorf("undo %s: %w", steps[j].Name, err))
+			}
+		}
+		return &SagaError{Step: step.Name, Err: err, UndoErr: errors.Join(undoErrs...)}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package services
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/models"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrSessionExpired = apperr.Unauthorized("session_expired", "session expired")
+
+const (
+	sessionKeyPrefix = "session:"
+	// sessionRefreshLeeway renews access tokens shortly before they expire,
+	// so they do not run out while a request is being handled.
+	sessionRefreshLeeway = 30 * time.Second
+	// sessionTouchInterval limits how often activity is written back to the
+	// store; the idle timeout is only as precise as this.
+	sessionTouchInterval = time.Minute
+	// sessionRefreshTimeout bounds a refresh, which runs detached from the
+	// request that started it.
+	sessionRefreshTimeout = 15 * time.Second
+)
+
+// SessionStore holds serialized sessions with a TTL. kvstore.MemoryStore and
+// kvstore.RedisStore (any Redis-protocol server) implement it;
+// FileSessionStore keeps sessions across restarts of a single instance.
+type SessionStore interface {
+	// Get returns the value at key, or "" if it does not exist.
+	Get(ctx context.Context, key string) (string, error)
+	// Set stores value at key for ttl.
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+	// Del removes the keys.
+	Del(ctx context.Context, keys ...string) error
+}
+
+// Session is a login whose tokens are kept server side. The browser only
+// holds the opaque ID.
+type Session struct {
+	ID              string    `json:"-"`
+	UserID          string    `json:"user_id"`
+	Username        string    `json:"username"`
+	AccessToken     string    `json:"access_token"`
+	RefreshToken    string    `json:"refresh_token"`
+	AccessExpiresAt time.Time `json:"access_expires_at"`
+	CreatedAt       time.Time `json:"created_at"`
+	LastSeenAt      time.Time `json:"last_seen_at"`
+}
+
+// SessionManager creates, resolves and refreshes server-side sessions.
+type SessionManager struct {
+	Store    SessionStore
+	Identity IdentityProvider
+	// IdleTimeout ends sessions that were not used for this long.
+	IdleTimeout time.Duration
+	// AbsoluteTimeout ends sessions this long after login, however active.
+	AbsoluteTimeout time.Duration
+
+	// refreshing holds the refresh in flight per session ID, so concurrent
+	// requests of one session do not redeem the same refresh token twice
+	// while other sessions refresh independently.
+	refreshMu  sync.Mutex
+	refreshing map[string]*sessionRefresh
+	now        func() time.Time
+}
+
+type sessionRefresh struct {
+	done    chan struct{}
+	session Session
+	err     error
+}
+
+func NewSessionManager(store SessionStore, identity IdentityProvider, idleTimeout time.Duration, absoluteTimeout time.Duration) *SessionManager {
+	return &SessionManager{
+		Store:           store,
+		Identity:        identity,
+		IdleTimeout:     idleTimeout,
+		AbsoluteTimeout: absoluteTimeout,
+		refreshing:      make(map[string]*sessionRefresh),
+		now:             time.Now,
+	}
+}
+
+// Create stores a new session for the tokens of a successful login.
+func (m *SessionManager) Create(ctx context.Context, token *models.LoginResponse) (*Session, error) {
+	claims, err := m.Identity.VerifyToken(ctx, token.AccessToken)
+	if err != nil {
+		return nil, ErrInvalidAccessToken.WithCause(err)
+	}
+
+	id, err := randomToken(32)
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+
+	now := m.now()
+	session := &Session{
+		ID:              id,
+		UserID:          claims.Subject,
+		Username:        claims.PreferredUsername,
+		AccessToken:     token.AccessToken,
+		RefreshToken:    token.RefreshToken,
+		AccessExpiresAt: now.Add(time.Duration(token.ExpiresIn) * time.Second),
+		CreatedAt:       now,
+		LastSeenAt:      now,
+	}
+	if err := m.save(ctx, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Get resolves a session ID, records the activity and refreshes the access
+// token when it is about to expire. Unknown, idle and expired sessions, and
+// sessions whose refresh token was rejected, yield ErrSessionExpired.
+func (m *SessionManager) Get(ctx context.Context, id string) (*Session, error) {
+	session, err := m.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	now := m.now()
+	if now.Sub(session.LastSeenAt) > m.IdleTimeout || now.Sub(session.CreatedAt) > m.AbsoluteTimeout {
+		m.Delete(ctx, id)
+		return nil, ErrSessionExpired
+	}
+
+	if !session.AccessExpiresAt.After(now.Add(sessionRefreshLeeway)) {
+		if err := m.Refresh(ctx, session); err != nil {
+			return nil, err
+		}
+		return session, nil
+	}
+	if now.Sub(session.LastSeenAt) >= sessionTouchInterval {
+		session.LastSeenAt = now
+		if err := m.save(ctx, session); err != nil {
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// Refresh renews the session's tokens with its refresh token. When the
+// identity provider rejects it the session is deleted. Concurrent refreshes
+// of one session share a single call to the identity provider.
+func (m *SessionManager) Refresh(ctx context.Context, session *Session) error {
+	m.refreshMu.Lock()
+	if call, ok := m.refreshing[session.ID]; ok {
+		m.refreshMu.Unlock()
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if call.err == nil {
+			*session = call.session
+		}
+		return call.err
+	}
+	call := &sessionRefresh{done: make(chan struct{})}
+	m.refreshing[session.ID] = call
+	m.refreshMu.Unlock()
+
+	// The waiting requests depend on the outcome, so the refresh is not
+	// cancelled with the request that happens to run it.
+	refreshCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), sessionRefreshTimeout)
+	call.err = m.refresh(refreshCtx, session)
+	cancel()
+	call.session = *session
+
+	m.refreshMu.Lock()
+	delete(m.refreshing, session.ID)
+	m.refreshMu.Unlock()
+	close(call.done)
+	return call.err
+}
+
+func (m *SessionManager) refresh(ctx context.Context, session *Session) error {
+	// Another request may have refreshed the session before this one.
+	if current, err := m.load(ctx, session.ID); err == nil && current.AccessExpiresAt.After(session.AccessExpiresAt) {
+		*session = *current
+		return nil
+	}
+
+	token, err := m.Identity.RefreshToken(ctx, session.RefreshToken)
+	if errors.Is(err, ErrKeycloakUnavailable) {
+		// Keep the session, it may still be valid.
+		return err
+	}
+	if err != nil {
+		m.Delete(ctx, session.ID)
+		return ErrSessionExpired.WithCause(err)
+	}
+
+	now := m.now()
+	session.AccessToken = token.AccessToken
+	session.RefreshToken = token.RefreshToken
+	session.AccessExpiresAt = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	session.LastSeenAt = now
+	return m.save(ctx, session)
+}
+
+// End logs the session out at the identity provider and deletes it. The
+// session is deleted even when the provider logout fails; unknown sessions
+// are already ended.
+func (m *SessionManager) End(ctx context.Context, id string) error {
+	session, err := m.load(ctx, id)
+	if errors.Is(err, ErrSessionExpired) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	logoutErr := m.Identity.Logout(ctx, session.RefreshToken)
+	if err := m.Delete(ctx, id); err != nil {
+		return err
+	}
+	return logoutErr
+}
+
+// Delete removes the session. Deleting an unknown session is not an error.
+func (m *SessionManager) Delete(ctx context.Context, id string) error {
+	if err := m.Store.Del(ctx, sessionKey(id)); err != nil {
+		return apperr.Internal(fmt.Errorf("delete session failed: %w", err))
+	}
+	return nil
+}
+
+// ExpiresAt is when the session ends at the latest.
+func (m *SessionManager) ExpiresAt(session *Session) time.Time {
+	return session.CreatedAt.Add(m.AbsoluteTimeout)
+}
+
+func (m *SessionManager) load(ctx context.Context, id string) (*Session, error) {
+	if id == "" {
+		return nil, ErrSessionExpired
+	}
+
+	raw, err := m.Store.Get(ctx, sessionKey(id))
+	if err != nil {
+		return nil, apperr.Internal(fmt.Errorf("load session failed: %w", err))
+	}
+	if raw == "" {
+		return nil, ErrSessionExpired
+	}
+
+	session := &Session{}
+	if err := json.Unmarshal([]byte(raw), session); err != nil {
+		return nil, ErrSessionExpired.WithCause(fmt.Errorf("decode session failed: %w", err))
+	}
+	session.ID = id
+	return session, nil
+}
+
+// save stores the session until its idle or absolute timeout, whichever
+// comes first.
+func (m *SessionManager) save(ctx context.Context, session *Session) error {
+	ttl := m.IdleTimeout
+	if remaining := m.ExpiresAt(session).Sub(m.now()); remaining < ttl {
+		ttl = remaining
+	}
+	if ttl <= 0 {
+		m.Delete(ctx, session.ID)
+		return ErrSessionExpired
+	}
+
+	raw, err := json.Marshal(session)
+	if err != nil {
+		return apperr.Internal(fmt.Errorf("encode session failed: %w", err))
+	}
+	if err := m.Store.Set(ctx, sessionKey(session.ID), string(raw), ttl); err != nil {
+		return apperr.Internal(fmt.Errorf("save session failed: %w", err))
+	}
+	return nil
+}
+
+// sessionKey stores sessions under the hash of their ID, so the contents of
+// the store cannot be replayed as session cookies.
+func sessionKey(id string) string {
+	return sessionKeyPrefix + hashToken(id)
+}
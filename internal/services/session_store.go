@@ -0,0 +1,131 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// filePurgeInterval bounds how often expired session files are swept.
+const filePurgeInterval = 10 * time.Minute
+
+type fileEntry struct {
+	Value     string    `json:"value"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// FileSessionStore keeps each value in its own file under Dir, so sessions
+// survive restarts of a single instance without an external store. Files are
+// replaced atomically and only readable by the service user.
+type FileSessionStore struct {
+	Dir string
+
+	mu        sync.Mutex
+	lastPurge time.Time
+	now       func() time.Time
+}
+
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create session directory failed: %w", err)
+	}
+	return &FileSessionStore{Dir: dir, now: time.Now}, nil
+}
+
+func (s *FileSessionStore) Get(ctx context.Context, key string) (string, error) {
+	path := s.path(key)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var entry fileEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return "", fmt.Errorf("decode %s failed: %w", filepath.Base(path), err)
+	}
+	if s.now().After(entry.ExpiresAt) {
+		os.Remove(path)
+		return "", nil
+	}
+	return entry.Value, nil
+}
+
+func (s *FileSessionStore) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	s.purgeExpired()
+
+	data, err := json.Marshal(fileEntry{Value: value, ExpiresAt: s.now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(key))
+}
+
+func (s *FileSessionStore) Del(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// path maps any key to a safe file name.
+func (s *FileSessionStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (s *FileSessionStore) purgeExpired() {
+	s.mu.Lock()
+	now := s.now()
+	if now.Sub(s.lastPurge) < filePurgeInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.lastPurge = now
+	s.mu.Unlock()
+
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.Dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var stored fileEntry
+		if json.Unmarshal(data, &stored) == nil && now.After(stored.ExpiresAt) {
+			os.Remove(path)
+		}
+	}
+}
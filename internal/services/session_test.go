@@ -0,0 +1,321 @@
+package services
+
+import (
+	"auth-service/internal/kvstore"
+	"auth-service/internal/models"
+	"auth-service/internal/testing/fakeredis"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+func newTestSessions(t *testing.T, store SessionStore) (*SessionManager, *MemoryProvider, *fakeClock) {
+	t.Helper()
+	mp, err := NewMemoryProvider("http://issuer.test/realms/test", "auth-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mp.AddUser(gocloak.User{Username: gocloak.StringP("alice"), Email: gocloak.StringP("alice@example.com")}, "Secret123!"); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &fakeClock{now: time.Now()}
+	sessions := NewSessionManager(store, mp, 30*time.Minute, 2*time.Hour)
+	sessions.now = clock.Now
+	return sessions, mp, clock
+}
+
+func createTestSession(t *testing.T, sessions *SessionManager, mp *MemoryProvider) *Session {
+	t.Helper()
+	token, err := mp.Login(context.Background(), models.LoginParams{Username: "alice", Password: "Secret123!"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := sessions.Create(context.Background(), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
+
+func TestSessionStores(t *testing.T) {
+	redis := fakeredis.New()
+	defer redis.Close()
+
+	fileStore, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stores := map[string]SessionStore{
+		"memory": kvstore.NewMemoryStore(),
+		"file":   fileStore,
+		"redis":  kvstore.NewRedisStore(redis.Addr, ""),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			sessions, mp, _ := newTestSessions(t, store)
+			session := createTestSession(t, sessions, mp)
+
+			if session.Username != "alice" || session.UserID == "" {
+				t.Fatalf("session = %+v, want alice's", session)
+			}
+			if raw, _ := store.Get(ctx, sessionKeyPrefix+session.ID); raw != "" {
+				t.Fatal("session is stored under its plain ID")
+			}
+
+			got, err := sessions.Get(ctx, session.ID)
+			if err != nil {
+				t.Fatalf("Get: %v", err)
+			}
+			if got.AccessToken != session.AccessToken || got.RefreshToken != session.RefreshToken {
+				t.Fatal("Get returned different tokens than Create stored")
+			}
+
+			if err := sessions.End(ctx, session.ID); err != nil {
+				t.Fatalf("End: %v", err)
+			}
+			if _, err := sessions.Get(ctx, session.ID); !errors.Is(err, ErrSessionExpired) {
+				t.Fatalf("Get after End = %v, want ErrSessionExpired", err)
+			}
+			if _, err := mp.RefreshToken(ctx, session.RefreshToken); err == nil {
+				t.Fatal("End did not log out at the identity provider")
+			}
+			if err := sessions.End(ctx, session.ID); err != nil {
+				t.Fatalf("End of an ended session = %v, want nil", err)
+			}
+		})
+	}
+}
+
+func TestSessionTimeouts(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("idle", func(t *testing.T) {
+		sessions, mp, clock := newTestSessions(t, kvstore.NewMemoryStore())
+		session := createTestSession(t, sessions, mp)
+
+		clock.Advance(31 * time.Minute)
+		if _, err := sessions.Get(ctx, session.ID); !errors.Is(err, ErrSessionExpired) {
+			t.Fatalf("Get after idle timeout = %v, want ErrSessionExpired", err)
+		}
+		if raw, _ := sessions.Store.Get(ctx, sessionKey(session.ID)); raw != "" {
+			t.Fatal("idle session was not deleted")
+		}
+	})
+
+	t.Run("activity extends idle timeout", func(t *testing.T) {
+		sessions, mp, clock := newTestSessions(t, kvstore.NewMemoryStore())
+		session := createTestSession(t, sessions, mp)
+
+		for i := 0; i < 3; i++ {
+			clock.Advance(2 * time.Minute)
+			if _, err := sessions.Get(ctx, session.ID); err != nil {
+				t.Fatalf("Get %d: %v", i, err)
+			}
+		}
+	})
+
+	t.Run("absolute", func(t *testing.T) {
+		sessions, mp, clock := newTestSessions(t, kvstore.NewMemoryStore())
+		sessions.IdleTimeout = 3 * time.Hour
+		session := createTestSession(t, sessions, mp)
+
+		clock.Advance(2*time.Hour + time.Second)
+		if _, err := sessions.Get(ctx, session.ID); !errors.Is(err, ErrSessionExpired) {
+			t.Fatalf("Get after absolute timeout = %v, want ErrSessionExpired", err)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		sessions, _, _ := newTestSessions(t, kvstore.NewMemoryStore())
+		for _, id := range []string{"", "does-not-exist"} {
+			if _, err := sessions.Get(ctx, id); !errors.Is(err, ErrSessionExpired) {
+				t.Fatalf("Get(%q) = %v, want ErrSessionExpired", id, err)
+			}
+		}
+	})
+}
+
+func TestSessionRefresh(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("expiring access token", func(t *testing.T) {
+		sessions, mp, clock := newTestSessions(t, kvstore.NewMemoryStore())
+		session := createTestSession(t, sessions, mp)
+
+		clock.Advance(mp.AccessTokenTTL - 10*time.Second)
+		got, err := sessions.Get(ctx, session.ID)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if got.RefreshToken == session.RefreshToken {
+			t.Fatal("tokens were not refreshed")
+		}
+		if !got.AccessExpiresAt.After(clock.Now().Add(sessionRefreshLeeway)) {
+			t.Fatalf("access token still expires at %s", got.AccessExpiresAt)
+		}
+
+		stored, err := sessions.Get(ctx, session.ID)
+		if err != nil || stored.RefreshToken != got.RefreshToken {
+			t.Fatalf("refreshed tokens were not stored: %v", err)
+		}
+	})
+
+	t.Run("rejected refresh token", func(t *testing.T) {
+		sessions, mp, clock := newTestSessions(t, kvstore.NewMemoryStore())
+		session := createTestSession(t, sessions, mp)
+		if err := mp.Logout(ctx, session.RefreshToken); err != nil {
+			t.Fatal(err)
+		}
+
+		clock.Advance(mp.AccessTokenTTL)
+		if _, err := sessions.Get(ctx, session.ID); !errors.Is(err, ErrSessionExpired) {
+			t.Fatalf("Get = %v, want ErrSessionExpired", err)
+		}
+		if raw, _ := sessions.Store.Get(ctx, sessionKey(session.ID)); raw != "" {
+			t.Fatal("session with a rejected refresh token was not deleted")
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		sessions, mp, clock := newTestSessions(t, kvstore.NewMemoryStore())
+		slow, other := createTestSession(t, sessions, mp), createTestSession(t, sessions, mp)
+		gated := &gatedRefresh{IdentityProvider: mp, token: slow.RefreshToken, gate: make(chan struct{})}
+		sessions.Identity = gated
+		clock.Advance(time.Minute)
+
+		copies := make([]Session, 5)
+		errs := make([]error, len(copies))
+		var wg sync.WaitGroup
+		for i := range copies {
+			copies[i] = *slow
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = sessions.Refresh(ctx, &copies[i])
+			}(i)
+		}
+		for gated.calls.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		// The refresh of one session does not hold up the others.
+		done := make(chan error, 1)
+		go func() { done <- sessions.Refresh(ctx, other) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("Refresh of another session: %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			close(gated.gate)
+			t.Fatal("Refresh of another session waited for the first one")
+		}
+
+		close(gated.gate)
+		wg.Wait()
+		for i, err := range errs {
+			if err != nil || copies[i].RefreshToken == slow.RefreshToken || copies[i].RefreshToken != copies[0].RefreshToken {
+				t.Fatalf("copy %d: err=%v, refreshed=%v", i, err, copies[i].RefreshToken != slow.RefreshToken)
+			}
+		}
+		if n := gated.calls.Load(); n != 1 {
+			t.Fatalf("refresh token redeemed %d times, want 1", n)
+		}
+	})
+
+	t.Run("stale copy", func(t *testing.T) {
+		sessions, mp, clock := newTestSessions(t, kvstore.NewMemoryStore())
+		session := createTestSession(t, sessions, mp)
+		stale := *session
+
+		clock.Advance(time.Minute)
+		if err := sessions.Refresh(ctx, session); err != nil {
+			t.Fatalf("Refresh: %v", err)
+		}
+		// A request that loaded the session before the refresh must pick up
+		// the new tokens instead of redeeming the spent refresh token.
+		if err := sessions.Refresh(ctx, &stale); err != nil {
+			t.Fatalf("Refresh of stale copy: %v", err)
+		}
+		if stale.RefreshToken != session.RefreshToken {
+			t.Fatal("stale copy was not updated to the refreshed tokens")
+		}
+	})
+}
+
+func TestFileSessionStoreExpiry(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{now: time.Now()}
+	store.now = clock.Now
+
+	if err := store.Set(ctx, "a", "1", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Set(ctx, "b", "2", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := store.Get(ctx, "a"); got != "1" {
+		t.Fatalf("Get(a) = %q, want 1", got)
+	}
+
+	clock.Advance(2 * time.Minute)
+	if got, _ := store.Get(ctx, "a"); got != "" {
+		t.Fatalf("Get(a) after expiry = %q, want empty", got)
+	}
+	if got, _ := store.Get(ctx, "b"); got != "2" {
+		t.Fatalf("Get(b) = %q, want 2", got)
+	}
+
+	// Expired entries nobody reads again are swept on a later write.
+	if err := store.Set(ctx, "c", "3", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(filePurgeInterval + time.Minute)
+	if err := store.Set(ctx, "d", "4", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(store.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("%d files left after purge, want 2 (b and d)", len(entries))
+	}
+
+	if err := store.Del(ctx, "b", "missing"); err != nil {
+		t.Fatalf("Del: %v", err)
+	}
+	if got, _ := store.Get(ctx, "b"); got != "" {
+		t.Fatalf("Get(b) after Del = %q, want empty", got)
+	}
+}
+
+// gatedRefresh holds refreshes of one refresh token until gate is closed.
+type gatedRefresh struct {
+	IdentityProvider
+	token string
+	gate  chan struct{}
+	calls atomic.Int32
+}
+
+func (g *gatedRefresh) RefreshToken(ctx context.Context, refreshToken string) (*models.LoginResponse, error) {
+	if refreshToken == g.token {
+		g.calls.Add(1)
+		<-g.gate
+	}
+	return g.IdentityProvider.RefreshToken(ctx, refreshToken)
+}
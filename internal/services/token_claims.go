@@ -0,0 +1,54 @@
+package services
+
+import "github.com/golang-jwt/jwt/v5"
+
+// RoleClaim mirrors Keycloak's realm_access / resource_access entries.
+type RoleClaim struct {
+	Roles []string `json:"roles"`
+}
+
+// TokenClaims holds the Keycloak access token claims the service cares about.
+type TokenClaims struct {
+	jwt.RegisteredClaims
+	SessionID         string               `json:"sid,omitempty"`
+	PreferredUsername string               `json:"preferred_username,omitempty"`
+	Email             string               `json:"email,omitempty"`
+	EmailVerified     bool                 `json:"email_verified,omitempty"`
+	AuthorizedParty   string               `json:"azp,omitempty"`
+	RealmAccess       RoleClaim            `json:"realm_access,omitempty"`
+	ResourceAccess    map[string]RoleClaim `json:"resource_access,omitempty"`
+}
+
+// HasRealmRole reports whether the token carries the given realm role.
+func (tc *TokenClaims) HasRealmRole(role string) bool {
+	for _, r := range tc.RealmAccess.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// HasClientRole reports whether the token carries the given role for clientID.
+func (tc *TokenClaims) HasClientRole(clientID, role string) bool {
+	access, ok := tc.ResourceAccess[clientID]
+	if !ok {
+		return false
+	}
+	for _, r := range access.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// IDTokenClaims holds the OpenID Connect ID token claims checked at login.
+type IDTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce,omitempty"`
+	SessionID         string `json:"sid,omitempty"`
+	PreferredUsername string `json:"preferred_username,omitempty"`
+	Email             string `json:"email,omitempty"`
+	AuthorizedParty   string `json:"azp,omitempty"`
+}
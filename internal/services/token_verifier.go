@@ -0,0 +1,296 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// jwksRefreshInterval is how long a fetched key set is trusted. The next
+	// verification after that refetches it synchronously, keeping the cached
+	// key if Keycloak cannot be reached.
+	jwksRefreshInterval = time.Hour
+	// jwksMinRefreshInterval limits refetches triggered by unknown key IDs, so a
+	// flood of forged tokens cannot turn into a flood of certs requests.
+	jwksMinRefreshInterval = 10 * time.Second
+)
+
+var ErrUnknownSigningKey = errors.New("unknown signing key")
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// TokenVerifier validates access tokens locally against the realm JWKS
+// (signature, exp, nbf, iss and aud) without a Keycloak round-trip per request.
+type TokenVerifier struct {
+	CertsURL   string
+	Issuer     string
+	Audience   string
+	HTTPClient *http.Client
+
+	mu        sync.RWMutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+
+	// fetchMu makes concurrent refreshes collapse into a single certs request.
+	fetchMu sync.Mutex
+	// static verifiers never fetch, their keys are fixed at construction.
+	static bool
+}
+
+func NewTokenVerifier(hostname string, realm string, audience string) *TokenVerifier {
+	issuer := strings.TrimRight(hostname, "/") + "/realms/" + realm
+	return &TokenVerifier{
+		CertsURL:   issuer + "/protocol/openid-connect/certs",
+		Issuer:     issuer,
+		Audience:   audience,
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// NewStaticTokenVerifier returns a verifier for a fixed key set, for issuers
+// that sign tokens in process rather than publishing a JWKS endpoint.
+func NewStaticTokenVerifier(issuer string, audience string, keys map[string]crypto.PublicKey) *TokenVerifier {
+	return &TokenVerifier{
+		Issuer:   issuer,
+		Audience: audience,
+		keys:     keys,
+		static:   true,
+	}
+}
+
+// Verify checks the token and returns its claims. Expired tokens yield an
+// error wrapping jwt.ErrTokenExpired so callers can attempt a refresh.
+func (tv *TokenVerifier) Verify(ctx context.Context, accessToken string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	if err := tv.parse(ctx, accessToken, claims); err != nil {
+		return nil, fmt.Errorf("token verification failed: %w", err)
+	}
+
+	if err := tv.checkAudience(claims); err != nil {
+		return nil, fmt.Errorf("token verification failed: %w", err)
+	}
+	return claims, nil
+}
+
+// VerifyIDToken checks an OpenID Connect ID token. Unlike access tokens, the
+// configured audience must be listed in aud, azp must name it when present
+// and the nonce must match the one sent with the authorization request.
+func (tv *TokenVerifier) VerifyIDToken(ctx context.Context, idToken string, nonce string) (*IDTokenClaims, error) {
+	claims := &IDTokenClaims{}
+	if err := tv.parse(ctx, idToken, claims, jwt.WithAudience(tv.Audience)); err != nil {
+		return nil, fmt.Errorf("id token verification failed: %w", err)
+	}
+
+	if claims.AuthorizedParty != "" && claims.AuthorizedParty != tv.Audience {
+		return nil, fmt.Errorf("id token verification failed: %w", jwt.ErrTokenInvalidAudience)
+	}
+	if nonce == "" || subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1 {
+		return nil, errors.New("id token verification failed: nonce mismatch")
+	}
+	return claims, nil
+}
+
+// UnverifiedClaims reads the claims of an access token without verifying
+// it. Only use it on tokens received from the identity provider directly,
+// like those of a login response, which may already have expired.
+func UnverifiedClaims(accessToken string) (*TokenClaims, error) {
+	claims := &TokenClaims{}
+	if _, _, err := jwt.NewParser().ParseUnverified(accessToken, claims); err != nil {
+		return nil, fmt.Errorf("parse access token failed: %w", err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("parse access token failed: %w", jwt.ErrTokenRequiredClaimMissing)
+	}
+	return claims, nil
+}
+
+func (tv *TokenVerifier) parse(ctx context.Context, raw string, claims jwt.Claims, opts ...jwt.ParserOption) error {
+	parser := jwt.NewParser(append([]jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(tv.Issuer),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}, opts...)...)
+
+	_, err := parser.ParseWithClaims(raw, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return tv.key(ctx, kid)
+	})
+	return err
+}
+
+// checkAudience accepts the token when the configured audience is listed in
+// aud, or is the authorized party. Keycloak only adds the client to aud when
+// an audience mapper is configured, while azp is always the requesting client.
+func (tv *TokenVerifier) checkAudience(claims *TokenClaims) error {
+	if tv.Audience == "" {
+		return nil
+	}
+	for _, aud := range claims.Audience {
+		if aud == tv.Audience {
+			return nil
+		}
+	}
+	if claims.AuthorizedParty == tv.Audience {
+		return nil
+	}
+	return jwt.ErrTokenInvalidAudience
+}
+
+func (tv *TokenVerifier) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	tv.mu.RLock()
+	key, ok := tv.keys[kid]
+	stale := time.Since(tv.fetchedAt) > jwksRefreshInterval
+	tv.mu.RUnlock()
+
+	if ok && (!stale || tv.static) {
+		return key, nil
+	}
+	if tv.static {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownSigningKey, kid)
+	}
+
+	// Unknown kid means the realm keys were probably rotated.
+	if err := tv.refresh(ctx, ok); err != nil {
+		if ok {
+			// Keep serving the cached key if Keycloak is unreachable.
+			return key, nil
+		}
+		return nil, err
+	}
+
+	tv.mu.RLock()
+	defer tv.mu.RUnlock()
+	if key, ok := tv.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrUnknownSigningKey, kid)
+}
+
+func (tv *TokenVerifier) refresh(ctx context.Context, onlyIfStale bool) error {
+	tv.fetchMu.Lock()
+	defer tv.fetchMu.Unlock()
+
+	// Another goroutine may have refreshed while we were waiting.
+	tv.mu.RLock()
+	since := time.Since(tv.fetchedAt)
+	tv.mu.RUnlock()
+	if since < jwksMinRefreshInterval || (onlyIfStale && since <= jwksRefreshInterval) {
+		return nil
+	}
+
+	keys, err := tv.fetchKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	tv.mu.Lock()
+	tv.keys = keys
+	tv.fetchedAt = time.Now()
+	tv.mu.Unlock()
+	return nil
+}
+
+func (tv *TokenVerifier) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tv.CertsURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build certs request failed: %w", err)
+	}
+
+	resp, err := tv.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch certs failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch certs failed: unexpected status %s", resp.Status)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("decode certs failed: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			// Skip key types we cannot use instead of failing the whole set.
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
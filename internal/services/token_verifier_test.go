@@ -0,0 +1,217 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testIssuer = "http://issuer.test/realms/test"
+
+// certsServer publishes a changeable JWKS and counts the requests for it.
+type certsServer struct {
+	*httptest.Server
+
+	mu      sync.Mutex
+	keys    map[string]*rsa.PrivateKey
+	fail    bool
+	fetches int
+}
+
+func newCertsServer(t *testing.T, kids ...string) *certsServer {
+	t.Helper()
+	cs := &certsServer{keys: map[string]*rsa.PrivateKey{}}
+	for _, kid := range kids {
+		cs.addKey(t, kid)
+	}
+	cs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		cs.fetches++
+		if cs.fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		for kid, key := range cs.keys {
+			set.Keys = append(set.Keys, jwk{
+				Kid: kid,
+				Kty: "RSA",
+				Alg: "RS256",
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(cs.Close)
+	return cs
+}
+
+func (cs *certsServer) addKey(t *testing.T, kid string) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.mu.Lock()
+	cs.keys[kid] = key
+	cs.mu.Unlock()
+	return key
+}
+
+func (cs *certsServer) Fetches() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.fetches
+}
+
+func newTestVerifier(cs *certsServer) *TokenVerifier {
+	tv := NewTokenVerifier("http://issuer.test", "test", "auth-service")
+	tv.CertsURL = cs.URL
+	return tv
+}
+
+func validClaims() jwt.MapClaims {
+	now := time.Now()
+	return jwt.MapClaims{
+		"iss": testIssuer,
+		"sub": "user-1",
+		"azp": "auth-service",
+		"iat": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+	}
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = kid
+	raw, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestTokenVerifierKeyRotation(t *testing.T) {
+	cs := newCertsServer(t, "k1")
+	tv := newTestVerifier(cs)
+	ctx := context.Background()
+
+	if _, err := tv.Verify(ctx, signRS256(t, cs.keys["k1"], "k1", validClaims())); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if n := cs.Fetches(); n != 1 {
+		t.Fatalf("%d certs requests, want 1", n)
+	}
+
+	// A token signed with a key published after the last fetch makes the
+	// verifier fetch the certs again.
+	k2 := cs.addKey(t, "k2")
+	tv.fetchedAt = time.Now().Add(-jwksMinRefreshInterval)
+	if _, err := tv.Verify(ctx, signRS256(t, k2, "k2", validClaims())); err != nil {
+		t.Fatalf("Verify after rotation: %v", err)
+	}
+	if n := cs.Fetches(); n != 2 {
+		t.Fatalf("%d certs requests, want 2", n)
+	}
+
+	// Unknown key IDs do not refetch more often than jwksMinRefreshInterval.
+	k3 := cs.addKey(t, "k3")
+	for i := 0; i < 5; i++ {
+		if _, err := tv.Verify(ctx, signRS256(t, k3, "k3", validClaims())); !errors.Is(err, ErrUnknownSigningKey) {
+			t.Fatalf("err = %v, want ErrUnknownSigningKey", err)
+		}
+	}
+	if n := cs.Fetches(); n != 2 {
+		t.Fatalf("%d certs requests, want the refetch throttled at 2", n)
+	}
+}
+
+func TestTokenVerifierKeepsStaleKeys(t *testing.T) {
+	cs := newCertsServer(t, "k1")
+	tv := newTestVerifier(cs)
+	ctx := context.Background()
+	token := signRS256(t, cs.keys["k1"], "k1", validClaims())
+
+	if _, err := tv.Verify(ctx, token); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	// The cached key outlived jwksRefreshInterval and Keycloak is down.
+	cs.mu.Lock()
+	cs.fail = true
+	cs.mu.Unlock()
+	tv.fetchedAt = time.Now().Add(-2 * jwksRefreshInterval)
+	if _, err := tv.Verify(ctx, token); err != nil {
+		t.Fatalf("Verify with the stale key: %v", err)
+	}
+	if n := cs.Fetches(); n != 2 {
+		t.Fatalf("%d certs requests, want a refresh attempt", n)
+	}
+}
+
+func TestTokenVerifierRejects(t *testing.T) {
+	cs := newCertsServer(t, "k1")
+	tv := newTestVerifier(cs)
+	key := cs.keys["k1"]
+
+	with := func(change func(jwt.MapClaims)) jwt.MapClaims {
+		claims := validClaims()
+		change(claims)
+		return claims
+	}
+	hs256, err := jwt.NewWithClaims(jwt.SigningMethodHS256, validClaims()).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, validClaims()).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  error
+	}{
+		{"wrong issuer", signRS256(t, key, "k1", with(func(c jwt.MapClaims) { c["iss"] = "http://evil.test/realms/test" })), jwt.ErrTokenInvalidIssuer},
+		{"wrong azp", signRS256(t, key, "k1", with(func(c jwt.MapClaims) { c["azp"] = "other-client" })), jwt.ErrTokenInvalidAudience},
+		{"wrong aud", signRS256(t, key, "k1", with(func(c jwt.MapClaims) { c["azp"] = "other-client"; c["aud"] = []string{"account"} })), jwt.ErrTokenInvalidAudience},
+		{"future nbf", signRS256(t, key, "k1", with(func(c jwt.MapClaims) { c["nbf"] = time.Now().Add(time.Minute).Unix() })), jwt.ErrTokenNotValidYet},
+		{"expired", signRS256(t, key, "k1", with(func(c jwt.MapClaims) { c["exp"] = time.Now().Add(-time.Minute).Unix() })), jwt.ErrTokenExpired},
+		{"no exp", signRS256(t, key, "k1", with(func(c jwt.MapClaims) { delete(c, "exp") })), jwt.ErrTokenRequiredClaimMissing},
+		{"alg none", none, jwt.ErrTokenSignatureInvalid},
+		{"HS256", hs256, jwt.ErrTokenSignatureInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tv.Verify(context.Background(), tt.token)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	// The aud claim alone is enough when azp names another client.
+	claims := with(func(c jwt.MapClaims) { c["azp"] = "other-client"; c["aud"] = []string{"auth-service"} })
+	if _, err := tv.Verify(context.Background(), signRS256(t, key, "k1", claims)); err != nil {
+		t.Fatalf("token for the audience rejected: %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+package services
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/models"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+var (
+	ErrWebAuthnCeremonyExpired    = apperr.Validation("webauthn_ceremony_expired", "webauthn ceremony is invalid or expired, start again")
+	ErrWebAuthnRegistrationFailed = apperr.Validation("webauthn_registration_failed", "passkey could not be verified")
+	ErrWebAuthnLoginFailed        = apperr.Unauthorized("webauthn_login_failed", "passkey could not be verified")
+)
+
+// WebAuthnService runs WebAuthn registration and login ceremonies for
+// passkeys. Logins are passwordless: the passkey is verified with user
+// verification, so it counts as both factors, and the tokens come from the
+// identity provider's LoginAsUser. Ceremonies are kept in memory, so they
+// have to be finished on the instance that began them.
+type WebAuthnService struct {
+	WebAuthn    *webauthn.WebAuthn
+	Credentials WebAuthnCredentialRepository
+	Identity    IdentityProvider
+	// CeremonyTTL bounds the time between begin and finish.
+	CeremonyTTL time.Duration
+
+	// mu serializes read-modify-write cycles on the repository.
+	mu         sync.Mutex
+	ceremonies *webauthnCeremonyStore
+	now        func() time.Time
+}
+
+// NewWebAuthnService returns a service for the relying party rpID (the site's
+// domain) whose pages run on one of origins.
+func NewWebAuthnService(rpID, rpDisplayName string, origins []string, credentials WebAuthnCredentialRepository, identity IdentityProvider, ceremonyTTL time.Duration) (*WebAuthnService, error) {
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: ceremonyTTL, TimeoutUVD: ceremonyTTL}
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: rpDisplayName,
+		RPOrigins:     origins,
+		Timeouts:      webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("webauthn setup failed: %w", err)
+	}
+
+	return &WebAuthnService{
+		WebAuthn:    wa,
+		Credentials: credentials,
+		Identity:    identity,
+		CeremonyTTL: ceremonyTTL,
+		ceremonies:  newWebAuthnCeremonyStore(),
+		now:         time.Now,
+	}, nil
+}
+
+// WebAuthnCeremony is a begun ceremony: Options go to the browser's
+// navigator.credentials API, ID comes back with its answer.
+type WebAuthnCeremony struct {
+	ID      string
+	Options interface{}
+}
+
+// WebAuthnUser names the user a passkey is registered for. Name is shown by
+// the authenticator to tell accounts apart.
+type WebAuthnUser struct {
+	ID          string
+	Name        string
+	DisplayName string
+}
+
+// BeginRegistration starts registering a passkey for a logged in user.
+// Passkeys the user already has are excluded, so an authenticator is not
+// registered twice.
+func (ws *WebAuthnService) BeginRegistration(ctx context.Context, user WebAuthnUser) (*WebAuthnCeremony, error) {
+	credentials, err := ws.credentials(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	waUser := newWebAuthnUser(user, credentials)
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(credentials))
+	for _, c := range credentials {
+		exclusions = append(exclusions, c.Credential.Descriptor())
+	}
+
+	creation, session, err := ws.WebAuthn.BeginRegistration(waUser,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			UserVerification:   protocol.VerificationRequired,
+		}),
+	)
+	if err != nil {
+		return nil, apperr.Internal(fmt.Errorf("begin webauthn registration failed: %w", err))
+	}
+	return ws.startCeremony(webauthnRegistration, user.ID, session, creation)
+}
+
+// FinishRegistration verifies the authenticator's answer to a registration
+// ceremony of the user and stores the new passkey.
+func (ws *WebAuthnService) FinishRegistration(ctx context.Context, user WebAuthnUser, ceremonyID, label string, response []byte) (*WebAuthnCredential, error) {
+	ceremony, ok := ws.ceremonies.Take(ceremonyID, ws.now())
+	if !ok || ceremony.kind != webauthnRegistration || ceremony.userID != user.ID {
+		return nil, ErrWebAuthnCeremonyExpired
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return nil, ErrWebAuthnRegistrationFailed.WithCause(err)
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	credentials, err := ws.credentials(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := ws.WebAuthn.CreateCredential(newWebAuthnUser(user, credentials), ceremony.session, parsed)
+	if err != nil {
+		return nil, ErrWebAuthnRegistrationFailed.WithCause(err)
+	}
+	for _, c := range credentials {
+		if bytes.Equal(c.Credential.ID, credential.ID) {
+			return nil, ErrWebAuthnRegistrationFailed.WithCause(errors.New("credential is already registered"))
+		}
+	}
+
+	if label == "" {
+		label = "Passkey"
+	}
+	registered := WebAuthnCredential{
+		UserID:     user.ID,
+		Label:      label,
+		Credential: *credential,
+		CreatedAt:  ws.now(),
+	}
+	if err := ws.save(ctx, registered); err != nil {
+		return nil, err
+	}
+	return &registered, nil
+}
+
+// BeginLogin starts a passwordless login. The browser lets the user pick
+// one of their passkeys for the site, so no username is needed.
+func (ws *WebAuthnService) BeginLogin(ctx context.Context) (*WebAuthnCeremony, error) {
+	assertion, session, err := ws.WebAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		return nil, apperr.Internal(fmt.Errorf("begin webauthn login failed: %w", err))
+	}
+	return ws.startCeremony(webauthnLogin, "", session, assertion)
+}
+
+// WebAuthnLogin is a completed passkey login.
+type WebAuthnLogin struct {
+	UserID string
+	Token  *models.LoginResponse
+}
+
+// FinishLogin verifies the authenticator's answer to a login ceremony and
+// logs the passkey's user in.
+func (ws *WebAuthnService) FinishLogin(ctx context.Context, ceremonyID string, response []byte) (*WebAuthnLogin, error) {
+	ceremony, ok := ws.ceremonies.Take(ceremonyID, ws.now())
+	if !ok || ceremony.kind != webauthnLogin {
+		return nil, ErrWebAuthnCeremonyExpired
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return nil, ErrWebAuthnLoginFailed.WithCause(err)
+	}
+
+	userID, err := ws.verifyLogin(ctx, ceremony, parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	// The token exchange is a Keycloak round trip, it runs without ws.mu.
+	token, err := ws.Identity.LoginAsUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnLogin{UserID: userID, Token: token}, nil
+}
+
+// verifyLogin checks the assertion against the user's stored passkeys and
+// saves the new signature counter. It returns the passkey's user.
+func (ws *WebAuthnService) verifyLogin(ctx context.Context, ceremony *webauthnCeremony, parsed *protocol.ParsedCredentialAssertionData) (string, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+
+	var stored []WebAuthnCredential
+	credential, err := ws.WebAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		var err error
+		if stored, err = ws.credentials(ctx, string(userHandle)); err != nil {
+			return nil, err
+		}
+		return newWebAuthnUser(WebAuthnUser{ID: string(userHandle)}, stored), nil
+	}, ceremony.session, parsed)
+	if err != nil {
+		return "", ErrWebAuthnLoginFailed.WithCause(err)
+	}
+	// A signature counter that did not increase means the private key
+	// exists more than once.
+	if credential.Authenticator.CloneWarning {
+		return "", ErrWebAuthnLoginFailed.WithCause(errors.New("signature counter did not increase, authenticator may be cloned"))
+	}
+
+	userID := string(parsed.Response.UserHandle)
+	for _, c := range stored {
+		if bytes.Equal(c.Credential.ID, credential.ID) {
+			c.Credential.Authenticator.SignCount = credential.Authenticator.SignCount
+			c.Credential.Flags.BackupState = credential.Flags.BackupState
+			c.LastUsedAt = ws.now()
+			if err := ws.save(ctx, c); err != nil {
+				return "", err
+			}
+		}
+	}
+	return userID, nil
+}
+
+func (ws *WebAuthnService) startCeremony(kind webauthnCeremonyKind, userID string, session *webauthn.SessionData, options interface{}) (*WebAuthnCeremony, error) {
+	id, err := randomToken(32)
+	if err != nil {
+		return nil, apperr.Internal(err)
+	}
+	now := ws.now()
+	ws.ceremonies.Put(id, &webauthnCeremony{
+		kind:      kind,
+		userID:    userID,
+		session:   *session,
+		expiresAt: now.Add(ws.CeremonyTTL),
+	}, now)
+	return &WebAuthnCeremony{ID: id, Options: options}, nil
+}
+
+func (ws *WebAuthnService) credentials(ctx context.Context, userID string) ([]WebAuthnCredential, error) {
+	credentials, err := ws.Credentials.Credentials(ctx, userID)
+	if err != nil {
+		return nil, apperr.Internal(fmt.Errorf("load webauthn credentials failed: %w", err))
+	}
+	return credentials, nil
+}
+
+func (ws *WebAuthnService) save(ctx context.Context, credential WebAuthnCredential) error {
+	if err := ws.Credentials.SaveCredential(ctx, credential); err != nil {
+		return apperr.Internal(fmt.Errorf("save webauthn credential failed: %w", err))
+	}
+	return nil
+}
+
+// webauthnUser adapts a user and their passkeys to webauthn.User. The user
+// handle is the user ID, which is how logins find the user again.
+type webauthnUser struct {
+	user        WebAuthnUser
+	credentials []webauthn.Credential
+}
+
+func newWebAuthnUser(user WebAuthnUser, stored []WebAuthnCredential) *webauthnUser {
+	credentials := make([]webauthn.Credential, len(stored))
+	for i, c := range stored {
+		credentials[i] = c.Credential
+	}
+	return &webauthnUser{user: user, credentials: credentials}
+}
+
+func (u *webauthnUser) WebAuthnID() []byte                         { return []byte(u.user.ID) }
+func (u *webauthnUser) WebAuthnName() string                       { return u.user.Name }
+func (u *webauthnUser) WebAuthnDisplayName() string                { return u.user.DisplayName }
+func (u *webauthnUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+func (u *webauthnUser) WebAuthnIcon() string                       { return "" }
+
+type webauthnCeremonyKind int
+
+const (
+	webauthnRegistration webauthnCeremonyKind = iota + 1
+	webauthnLogin
+)
+
+type webauthnCeremony struct {
+	kind      webauthnCeremonyKind
+	userID    string
+	session   webauthn.SessionData
+	expiresAt time.Time
+}
+
+// webauthnCeremonyStore keeps begun ceremonies keyed by the SHA-256 of their
+// ID, like mfaChallengeStore. Each ceremony can be finished once.
+type webauthnCeremonyStore struct {
+	mu      sync.Mutex
+	entries map[string]*webauthnCeremony
+}
+
+func newWebAuthnCeremonyStore() *webauthnCeremonyStore {
+	return &webauthnCeremonyStore{entries: make(map[string]*webauthnCeremony)}
+}
+
+func (s *webauthnCeremonyStore) Put(id string, ceremony *webauthnCeremony, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, entry := range s.entries {
+		if now.After(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+	s.entries[hashToken(id)] = ceremony
+}
+
+func (s *webauthnCeremonyStore) Take(id string, now time.Time) (*webauthnCeremony, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := hashToken(id)
+	ceremony, ok := s.entries[key]
+	delete(s.entries, key)
+	if !ok || now.After(ceremony.expiresAt) {
+		return nil, false
+	}
+	return ceremony, true
+}
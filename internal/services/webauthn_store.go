@@ -0,0 +1,140 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// WebAuthnCredential is a passkey registered by a user.
+type WebAuthnCredential struct {
+	UserID     string              `json:"user_id"`
+	Label      string              `json:"label"`
+	Credential webauthn.Credential `json:"credential"`
+	CreatedAt  time.Time           `json:"created_at"`
+	LastUsedAt time.Time           `json:"last_used_at,omitempty"`
+}
+
+// WebAuthnCredentialRepository persists passkeys. Login looks credentials
+// up by the user handle the authenticator returns, which is the user ID, so
+// lookups are always per user. Implementations must be safe for concurrent
+// use.
+type WebAuthnCredentialRepository interface {
+	// Credentials returns the user's credentials, none if the user has none.
+	Credentials(ctx context.Context, userID string) ([]WebAuthnCredential, error)
+	// SaveCredential adds the credential, or replaces the user's credential
+	// with the same ID.
+	SaveCredential(ctx context.Context, credential WebAuthnCredential) error
+}
+
+// MemoryWebAuthnRepository keeps credentials in process, for tests and local
+// development.
+type MemoryWebAuthnRepository struct {
+	mu          sync.Mutex
+	credentials map[string][]WebAuthnCredential
+}
+
+func NewMemoryWebAuthnRepository() *MemoryWebAuthnRepository {
+	return &MemoryWebAuthnRepository{credentials: make(map[string][]WebAuthnCredential)}
+}
+
+func (r *MemoryWebAuthnRepository) Credentials(ctx context.Context, userID string) ([]WebAuthnCredential, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]WebAuthnCredential(nil), r.credentials[userID]...), nil
+}
+
+func (r *MemoryWebAuthnRepository) SaveCredential(ctx context.Context, credential WebAuthnCredential) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.credentials[credential.UserID] = upsertCredential(r.credentials[credential.UserID], credential)
+	return nil
+}
+
+// FileWebAuthnRepository keeps each user's credentials in a JSON file under
+// Dir, replaced atomically like FileMFAStore's.
+type FileWebAuthnRepository struct {
+	Dir string
+
+	// mu serializes read-modify-write cycles on the files.
+	mu sync.Mutex
+}
+
+func NewFileWebAuthnRepository(dir string) (*FileWebAuthnRepository, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create webauthn directory failed: %w", err)
+	}
+	return &FileWebAuthnRepository{Dir: dir}, nil
+}
+
+func (r *FileWebAuthnRepository) Credentials(ctx context.Context, userID string) ([]WebAuthnCredential, error) {
+	path := r.path(userID)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var credentials []WebAuthnCredential
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, fmt.Errorf("decode %s failed: %w", filepath.Base(path), err)
+	}
+	return credentials, nil
+}
+
+func (r *FileWebAuthnRepository) SaveCredential(ctx context.Context, credential WebAuthnCredential) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	credentials, err := r.Credentials(ctx, credential.UserID)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(upsertCredential(credentials, credential))
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(r.Dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path(credential.UserID))
+}
+
+func (r *FileWebAuthnRepository) path(userID string) string {
+	sum := sha256.Sum256([]byte(userID))
+	return filepath.Join(r.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func upsertCredential(credentials []WebAuthnCredential, credential WebAuthnCredential) []WebAuthnCredential {
+	credentials = append([]WebAuthnCredential(nil), credentials...)
+	for i := range credentials {
+		if bytes.Equal(credentials[i].Credential.ID, credential.Credential.ID) {
+			credentials[i] = credential
+			return credentials
+		}
+	}
+	return append(credentials, credential)
+}
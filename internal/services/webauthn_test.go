@@ -0,0 +1,257 @@
+package services
+
+import (
+	"auth-service/internal/testing/softauthn"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"auth-service/internal/models"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+const testOrigin = "https://app.example.com"
+
+func newTestWebAuthn(t *testing.T, repo WebAuthnCredentialRepository) (*WebAuthnService, *MemoryProvider, string) {
+	t.Helper()
+	mp, err := NewMemoryProvider("http://issuer.test/realms/test", "auth-service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, err := mp.AddUser(gocloak.User{Username: gocloak.StringP("alice"), Email: gocloak.StringP("alice@example.com")}, "Secret123!")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws, err := NewWebAuthnService("app.example.com", "Example", []string{testOrigin}, repo, mp, 5*time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws, mp, userID
+}
+
+func options(t *testing.T, ceremony *WebAuthnCeremony) []byte {
+	t.Helper()
+	data, err := json.Marshal(ceremony.Options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// registerPasskey runs a registration ceremony with authenticator.
+func registerPasskey(t *testing.T, ws *WebAuthnService, authenticator *softauthn.Authenticator, user WebAuthnUser) *WebAuthnCredential {
+	t.Helper()
+	ctx := context.Background()
+	ceremony, err := ws.BeginRegistration(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := authenticator.Register(options(t, ceremony))
+	if err != nil {
+		t.Fatal(err)
+	}
+	credential, err := ws.FinishRegistration(ctx, user, ceremony.ID, "laptop", response)
+	if err != nil {
+		t.Fatalf("finish registration: %v", err)
+	}
+	return credential
+}
+
+// loginPasskey runs a login ceremony with authenticator.
+func loginPasskey(t *testing.T, ws *WebAuthnService, authenticator *softauthn.Authenticator) (*WebAuthnLogin, error) {
+	t.Helper()
+	ctx := context.Background()
+	ceremony, err := ws.BeginLogin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := authenticator.Login(options(t, ceremony))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws.FinishLogin(ctx, ceremony.ID, response)
+}
+
+func TestWebAuthnRegisterAndLogin(t *testing.T) {
+	for name, repo := range map[string]func(t *testing.T) WebAuthnCredentialRepository{
+		"memory": func(t *testing.T) WebAuthnCredentialRepository { return NewMemoryWebAuthnRepository() },
+		"file": func(t *testing.T) WebAuthnCredentialRepository {
+			repo, err := NewFileWebAuthnRepository(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return repo
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			ws, mp, userID := newTestWebAuthn(t, repo(t))
+			authenticator := softauthn.New(testOrigin)
+			user := WebAuthnUser{ID: userID, Name: "alice@example.com", DisplayName: "alice"}
+
+			registered := registerPasskey(t, ws, authenticator, user)
+			if registered.Label != "laptop" || !registered.Credential.Flags.UserVerified {
+				t.Fatalf("registered = %+v", registered)
+			}
+
+			// The same authenticator is excluded from registering again.
+			ceremony, _ := ws.BeginRegistration(ctx, user)
+			if _, err := authenticator.Register(options(t, ceremony)); err == nil {
+				t.Fatal("existing passkey not excluded")
+			}
+
+			for i := 1; i <= 2; i++ {
+				login, err := loginPasskey(t, ws, authenticator)
+				if err != nil {
+					t.Fatalf("login %d: %v", i, err)
+				}
+				claims, err := mp.VerifyToken(ctx, login.Token.AccessToken)
+				if err != nil || claims.Subject != userID || login.UserID != userID {
+					t.Fatalf("login %d: tokens of %v (%v)", i, claims, err)
+				}
+			}
+
+			stored, _ := ws.Credentials.Credentials(ctx, userID)
+			if len(stored) != 1 || stored[0].Credential.Authenticator.SignCount != 2 || stored[0].LastUsedAt.IsZero() {
+				t.Fatalf("stored credential not updated: %+v", stored)
+			}
+		})
+	}
+}
+
+func TestWebAuthnRejects(t *testing.T) {
+	ctx := context.Background()
+	ws, mp, userID := newTestWebAuthn(t, NewMemoryWebAuthnRepository())
+	authenticator := softauthn.New(testOrigin)
+	user := WebAuthnUser{ID: userID, Name: "alice@example.com", DisplayName: "alice"}
+	registerPasskey(t, ws, authenticator, user)
+
+	t.Run("registration ceremony of another user", func(t *testing.T) {
+		ceremony, _ := ws.BeginRegistration(ctx, user)
+		response, _ := softauthn.New(testOrigin).Register(options(t, ceremony))
+		_, err := ws.FinishRegistration(ctx, WebAuthnUser{ID: "someone-else", Name: "eve"}, ceremony.ID, "", response)
+		if !errors.Is(err, ErrWebAuthnCeremonyExpired) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("ceremony used twice", func(t *testing.T) {
+		ceremony, _ := ws.BeginLogin(ctx)
+		response, _ := authenticator.Login(options(t, ceremony))
+		if _, err := ws.FinishLogin(ctx, ceremony.ID, response); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ws.FinishLogin(ctx, ceremony.ID, response); !errors.Is(err, ErrWebAuthnCeremonyExpired) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("expired ceremony", func(t *testing.T) {
+		clock := &fakeClock{now: time.Now()}
+		ws.now = clock.Now
+		defer func() { ws.now = time.Now }()
+		ceremony, _ := ws.BeginLogin(ctx)
+		response, _ := authenticator.Login(options(t, ceremony))
+		clock.Advance(ws.CeremonyTTL + time.Second)
+		if _, err := ws.FinishLogin(ctx, ceremony.ID, response); !errors.Is(err, ErrWebAuthnCeremonyExpired) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("registration ceremony used to log in", func(t *testing.T) {
+		ceremony, _ := ws.BeginRegistration(ctx, user)
+		login, _ := ws.BeginLogin(ctx)
+		response, _ := authenticator.Login(options(t, login))
+		if _, err := ws.FinishLogin(ctx, ceremony.ID, response); !errors.Is(err, ErrWebAuthnCeremonyExpired) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("other origin", func(t *testing.T) {
+		authenticator.Origin = "https://app.example.com.evil.test"
+		defer func() { authenticator.Origin = testOrigin }()
+		if _, err := loginPasskey(t, ws, authenticator); !errors.Is(err, ErrWebAuthnLoginFailed) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("no user verification", func(t *testing.T) {
+		authenticator.SkipUserVerification = true
+		defer func() { authenticator.SkipUserVerification = false }()
+		if _, err := loginPasskey(t, ws, authenticator); !errors.Is(err, ErrWebAuthnLoginFailed) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("unknown passkey", func(t *testing.T) {
+		stranger := softauthn.New(testOrigin)
+		ceremony, _ := ws.BeginRegistration(ctx, WebAuthnUser{ID: "unregistered", Name: "bob"})
+		stranger.Register(options(t, ceremony))
+		if _, err := loginPasskey(t, ws, stranger); !errors.Is(err, ErrWebAuthnLoginFailed) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("cloned authenticator", func(t *testing.T) {
+		cred := authenticator.Credentials()[0]
+		cred.SignCount = 0
+		if _, err := loginPasskey(t, ws, authenticator); !errors.Is(err, ErrWebAuthnLoginFailed) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+
+	t.Run("disabled user", func(t *testing.T) {
+		other := softauthn.New(testOrigin)
+		registerPasskey(t, ws, other, user)
+		if err := mp.UpdateUser(ctx, userID, gocloak.User{Enabled: gocloak.BoolP(false)}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loginPasskey(t, ws, other); !errors.Is(err, ErrAccountUnavailable) {
+			t.Fatalf("err = %v", err)
+		}
+	})
+}
+
+// stalledImpersonation makes the first LoginAsUser call wait for release.
+type stalledImpersonation struct {
+	IdentityProvider
+	stalled atomic.Bool
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (s *stalledImpersonation) LoginAsUser(ctx context.Context, userID string) (*models.LoginResponse, error) {
+	if s.stalled.CompareAndSwap(false, true) {
+		close(s.entered)
+		<-s.release
+	}
+	return s.IdentityProvider.LoginAsUser(ctx, userID)
+}
+
+func TestWebAuthnLoginsDoNotWaitForTokenExchange(t *testing.T) {
+	ws, mp, userID := newTestWebAuthn(t, NewMemoryWebAuthnRepository())
+	stalled := &stalledImpersonation{IdentityProvider: mp, entered: make(chan struct{}), release: make(chan struct{})}
+	ws.Identity = stalled
+	authenticator := softauthn.New(testOrigin)
+	registerPasskey(t, ws, authenticator, WebAuthnUser{ID: userID, Name: "alice@example.com", DisplayName: "alice"})
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := loginPasskey(t, ws, authenticator)
+		first <- err
+	}()
+	<-stalled.entered
+
+	// The first login waits for Keycloak, a second one still gets through.
+	if _, err := loginPasskey(t, ws, authenticator); err != nil {
+		t.Fatalf("second login: %v", err)
+	}
+	close(stalled.release)
+	if err := <-first; err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+}
@@ -0,0 +1,420 @@
+// Package fakekeycloak serves the parts of the Keycloak REST and OpenID
+// Connect API that gocloak and the token verifier use, backed by in-memory
+// state. It lets tests run the real KeycloakService without a Keycloak:
+//
+//	kc := fakekeycloak.New()
+//	defer kc.Close()
+//	kc.AddUser(fakekeycloak.User{Username: "ada", Password: "secret"})
+//	ks, _ := services.NewKeycloakService(kc.ClientID, kc.ClientSecret, kc.Realm, kc.URL, services.AdminAuthConfig{})
+//
+// Failures can be injected per operation with Fail and FailNext.
+package fakekeycloak
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Operation names an endpoint for failure injection.
+type Operation string
+
+const (
+	OpAuthorize           Operation = "authorize"
+	OpToken               Operation = "token"
+	OpIntrospect          Operation = "introspect"
+	OpUserInfo            Operation = "userinfo"
+	OpLogout              Operation = "logout"
+	OpCerts               Operation = "certs"
+	OpListUsers           Operation = "list-users"
+	OpCreateUser          Operation = "create-user"
+	OpGetUser             Operation = "get-user"
+	OpUpdateUser          Operation = "update-user"
+	OpDeleteUser          Operation = "delete-user"
+	OpResetPassword       Operation = "reset-password"
+	OpSendVerifyEmail     Operation = "send-verify-email"
+	OpExecuteActionsEmail Operation = "execute-actions-email"
+	OpLogoutAllSessions   Operation = "logout-all-sessions"
+	OpUserSessions        Operation = "user-sessions"
+	OpDeleteSession       Operation = "delete-session"
+)
+
+// User is a realm user as the fake stores it.
+type User struct {
+	ID            string
+	Username      string
+	Email         string
+	FirstName     string
+	LastName      string
+	Password      string
+	Disabled      bool
+	EmailVerified bool
+	RealmRoles    []string
+	Created       time.Time
+}
+
+// Session is a user session opened by a password login.
+type Session struct {
+	ID         string
+	UserID     string
+	ClientID   string
+	IPAddress  string
+	Start      time.Time
+	LastAccess time.Time
+}
+
+// Email records an email Keycloak would have sent.
+type Email struct {
+	UserID      string
+	Kind        string // "verify-email" or "execute-actions"
+	Actions     []string
+	ClientID    string
+	RedirectURI string
+	Lifespan    string
+}
+
+// authCode is an authorization code waiting to be exchanged.
+type authCode struct {
+	userID        string
+	clientID      string
+	redirectURI   string
+	codeChallenge string
+	nonce         string
+	expiresAt     time.Time
+}
+
+type failure struct {
+	status    int
+	remaining int // < 0 means until cleared
+}
+
+// Server is a fake Keycloak realm served over HTTP.
+type Server struct {
+	URL          string
+	Realm        string
+	ClientID     string
+	ClientSecret string
+	// AdminUsername and AdminPassword log into the master realm through
+	// admin-cli. The realm client's service account is an admin as well.
+	AdminUsername string
+	AdminPassword string
+	// AccessTokenTTL may be negative to hand out already expired tokens.
+	AccessTokenTTL time.Duration
+	// MinPasswordLength makes reset-password answer 400 for shorter
+	// passwords, like a realm password policy would.
+	MinPasswordLength int
+	// DenyImpersonation makes token exchanges for another user fail like
+	// they do for a client without the impersonation permission.
+	DenyImpersonation bool
+
+	srv   *httptest.Server
+	key   *rsa.PrivateKey
+	keyID string
+
+	mu            sync.Mutex
+	users         map[string]*User
+	sessions      map[string]*Session
+	refreshTokens map[string]string // refresh token -> session ID
+	codes         map[string]*authCode
+	adminTokens   map[string]bool
+	emails        []Email
+	failures      map[Operation]*failure
+	calls         map[Operation]int
+}
+
+// New starts a fake Keycloak with realm "test" and a confidential client
+// "auth-service" with secret "secret".
+func New() *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("fakekeycloak: generate key: %v", err))
+	}
+
+	s := &Server{
+		Realm:          "test",
+		ClientID:       "auth-service",
+		ClientSecret:   "secret",
+		AdminUsername:  "admin",
+		AdminPassword:  "admin",
+		AccessTokenTTL: 5 * time.Minute,
+
+		key:   key,
+		keyID: randomID(),
+
+		users:         make(map[string]*User),
+		sessions:      make(map[string]*Session),
+		refreshTokens: make(map[string]string),
+		codes:         make(map[string]*authCode),
+		adminTokens:   make(map[string]bool),
+		failures:      make(map[Operation]*failure),
+		calls:         make(map[Operation]int),
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.route))
+	s.URL = s.srv.URL
+	return s
+}
+
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Issuer is the iss claim of the realm's tokens.
+func (s *Server) Issuer() string {
+	return s.URL + "/realms/" + s.Realm
+}
+
+// AddUser stores the user and returns its ID. A missing ID is generated and
+// a zero Created is set to now.
+func (s *Server) AddUser(user User) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user.ID == "" {
+		user.ID = newUUID()
+	}
+	if user.Created.IsZero() {
+		user.Created = time.Now()
+	}
+	u := user
+	s.users[u.ID] = &u
+	return u.ID
+}
+
+// SetEnabled enables or disables the user.
+func (s *Server) SetEnabled(userID string, enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, ok := s.users[userID]; ok {
+		u.Disabled = !enabled
+	}
+}
+
+// User returns a copy of the stored user.
+func (s *Server) User(userID string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[userID]
+	if !ok {
+		return User{}, false
+	}
+	return *u, true
+}
+
+// UserByUsername returns a copy of the user with the given username.
+func (s *Server) UserByUsername(username string) (User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.findUser(username); u != nil {
+		return *u, true
+	}
+	return User{}, false
+}
+
+// Sessions returns the active sessions of the user.
+func (s *Server) Sessions(userID string) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result []Session
+	for _, session := range s.sessions {
+		if session.UserID == userID {
+			result = append(result, *session)
+		}
+	}
+	return result
+}
+
+// RevokeAdminTokens makes the admin API reject every service account token
+// issued so far, as Keycloak does after a realm key rotation.
+func (s *Server) RevokeAdminTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.adminTokens = make(map[string]bool)
+}
+
+// Emails returns the emails sent so far.
+func (s *Server) Emails() []Email {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Email(nil), s.emails...)
+}
+
+// Calls returns how often op was requested, including injected failures.
+func (s *Server) Calls(op Operation) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[op]
+}
+
+// Fail makes op answer with status until Recover is called.
+func (s *Server) Fail(op Operation, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[op] = &failure{status: status, remaining: -1}
+}
+
+// FailNext makes only the next request of op answer with status.
+func (s *Server) FailNext(op Operation, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[op] = &failure{status: status, remaining: 1}
+}
+
+// Recover clears injected failures of the given operations, or of all
+// operations when none are given.
+func (s *Server) Recover(ops ...Operation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(ops) == 0 {
+		s.failures = make(map[Operation]*failure)
+		return
+	}
+	for _, op := range ops {
+		delete(s.failures, op)
+	}
+}
+
+// injected counts the call and reports the status of an injected failure,
+// or 0. s.mu must be held.
+func (s *Server) injected(op Operation) int {
+	s.calls[op]++
+	f, ok := s.failures[op]
+	if !ok {
+		return 0
+	}
+	if f.remaining > 0 {
+		f.remaining--
+		if f.remaining == 0 {
+			delete(s.failures, op)
+		}
+	}
+	return f.status
+}
+
+func (s *Server) findUser(usernameOrEmail string) *User {
+	for _, u := range s.users {
+		if strings.EqualFold(u.Username, usernameOrEmail) || (u.Email != "" && strings.EqualFold(u.Email, usernameOrEmail)) {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *Server) endSession(sessionID string) {
+	delete(s.sessions, sessionID)
+	for token, sid := range s.refreshTokens {
+		if sid == sessionID {
+			delete(s.refreshTokens, token)
+		}
+	}
+}
+
+// signToken issues an RS256 access token. s.mu must be held.
+func (s *Server) signToken(u *User, session *Session, clientID string) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"jti":   randomID(),
+		"iss":   s.Issuer(),
+		"aud":   "account",
+		"typ":   "Bearer",
+		"azp":   clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(s.AccessTokenTTL).Unix(),
+		"scope": "openid profile email",
+	}
+	if u != nil {
+		claims["sub"] = u.ID
+		claims["sid"] = session.ID
+		claims["preferred_username"] = u.Username
+		claims["email"] = u.Email
+		claims["email_verified"] = u.EmailVerified
+		claims["realm_access"] = map[string]interface{}{"roles": append([]string{}, u.RealmRoles...)}
+	} else {
+		claims["sub"] = "service-account-" + clientID
+		claims["preferred_username"] = "service-account-" + clientID
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = s.keyID
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		panic(fmt.Sprintf("fakekeycloak: sign token: %v", err))
+	}
+	return signed
+}
+
+// signIDToken issues the OpenID Connect ID token of a user login.
+// s.mu must be held.
+func (s *Server) signIDToken(u *User, session *Session, nonce string) string {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"jti":                randomID(),
+		"iss":                s.Issuer(),
+		"aud":                session.ClientID,
+		"azp":                session.ClientID,
+		"typ":                "ID",
+		"sub":                u.ID,
+		"sid":                session.ID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(s.AccessTokenTTL).Unix(),
+		"preferred_username": u.Username,
+		"email":              u.Email,
+		"email_verified":     u.EmailVerified,
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = s.keyID
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		panic(fmt.Sprintf("fakekeycloak: sign token: %v", err))
+	}
+	return signed
+}
+
+// parseToken verifies a token issued by this server.
+func (s *Server) parseToken(raw string) (jwt.MapClaims, bool) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(*jwt.Token) (interface{}, error) {
+		return &s.key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{"RS256"}))
+	return claims, err == nil
+}
+
+func (s *Server) jwks() map[string]interface{} {
+	pub := s.key.PublicKey
+	return map[string]interface{}{
+		"keys": []map[string]string{{
+			"kid": s.keyID,
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("fakekeycloak: random: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
+
+func newUUID() string {
+	h := randomID()
+	return h[0:8] + "-" + h[8:12] + "-4" + h[13:16] + "-a" + h[17:20] + "-" + h[20:]
+}
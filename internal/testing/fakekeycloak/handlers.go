@@ -0,0 +1,654 @@
+package fakekeycloak
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Nerzal/gocloak/v13"
+)
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) >= 4 && parts[0] == "realms" && parts[2] == "protocol" && parts[3] == "openid-connect":
+		s.routeOIDC(w, r, parts[1], parts[4:])
+	case len(parts) >= 4 && parts[0] == "admin" && parts[1] == "realms" && parts[2] == s.Realm:
+		s.routeAdmin(w, r, parts[3:])
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Unable to find matching target resource method"})
+	}
+}
+
+func (s *Server) routeOIDC(w http.ResponseWriter, r *http.Request, realm string, rest []string) {
+	path := strings.Join(rest, "/")
+	if realm != s.Realm && !(realm == "master" && path == "token") {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Realm does not exist"})
+		return
+	}
+
+	switch {
+	case path == "auth" && (r.Method == http.MethodGet || r.Method == http.MethodPost):
+		s.handleAuthorize(w, r)
+	case path == "token" && r.Method == http.MethodPost:
+		s.handleToken(w, r, realm)
+	case path == "token/introspect" && r.Method == http.MethodPost:
+		s.handleIntrospect(w, r)
+	case path == "userinfo" && r.Method == http.MethodGet:
+		s.handleUserInfo(w, r)
+	case path == "logout" && r.Method == http.MethodPost:
+		s.handleLogout(w, r)
+	case path == "certs" && r.Method == http.MethodGet:
+		s.mu.Lock()
+		status := s.injected(OpCerts)
+		s.mu.Unlock()
+		if status != 0 {
+			writeInjected(w, status)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.jwks())
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Unable to find matching target resource method"})
+	}
+}
+
+func (s *Server) routeAdmin(w http.ResponseWriter, r *http.Request, rest []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.adminTokens[bearerToken(r)] {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "HTTP 401 Unauthorized"})
+		return
+	}
+
+	switch {
+	case len(rest) == 2 && rest[0] == "sessions" && r.Method == http.MethodDelete:
+		s.handleDeleteSession(w, rest[1])
+	case len(rest) == 1 && rest[0] == "users" && r.Method == http.MethodGet:
+		s.handleListUsers(w, r)
+	case len(rest) == 1 && rest[0] == "users" && r.Method == http.MethodPost:
+		s.handleCreateUser(w, r)
+	case len(rest) >= 2 && rest[0] == "users":
+		s.routeUser(w, r, rest[1], strings.Join(rest[2:], "/"))
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Unable to find matching target resource method"})
+	}
+}
+
+func (s *Server) routeUser(w http.ResponseWriter, r *http.Request, userID, action string) {
+	op := map[string]Operation{
+		http.MethodGet + " ":                      OpGetUser,
+		http.MethodPut + " ":                      OpUpdateUser,
+		http.MethodDelete + " ":                   OpDeleteUser,
+		http.MethodPut + " reset-password":        OpResetPassword,
+		http.MethodPut + " send-verify-email":     OpSendVerifyEmail,
+		http.MethodPut + " execute-actions-email": OpExecuteActionsEmail,
+		http.MethodPost + " logout":               OpLogoutAllSessions,
+		http.MethodGet + " sessions":              OpUserSessions,
+	}[r.Method+" "+action]
+	if op == "" {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Unable to find matching target resource method"})
+		return
+	}
+	if status := s.injected(op); status != 0 {
+		writeInjected(w, status)
+		return
+	}
+
+	u, ok := s.users[userID]
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "User not found"})
+		return
+	}
+
+	switch op {
+	case OpGetUser:
+		writeJSON(w, http.StatusOK, representation(u))
+	case OpUpdateUser:
+		s.updateUser(w, r, u)
+	case OpDeleteUser:
+		for id, session := range s.sessions {
+			if session.UserID == userID {
+				s.endSession(id)
+			}
+		}
+		delete(s.users, userID)
+		w.WriteHeader(http.StatusNoContent)
+	case OpResetPassword:
+		var cred gocloak.CredentialRepresentation
+		if err := json.NewDecoder(r.Body).Decode(&cred); err != nil || cred.Value == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid credential"})
+			return
+		}
+		if len(*cred.Value) < s.MinPasswordLength {
+			writeJSON(w, http.StatusBadRequest, map[string]string{
+				"error":             "invalidPasswordMinLengthMessage",
+				"error_description": "Invalid password: minimum length not met.",
+			})
+			return
+		}
+		u.Password = *cred.Value
+		w.WriteHeader(http.StatusNoContent)
+	case OpSendVerifyEmail, OpExecuteActionsEmail:
+		if u.Email == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"errorMessage": "User email missing"})
+			return
+		}
+		email := Email{
+			UserID:      userID,
+			Kind:        "verify-email",
+			ClientID:    r.URL.Query().Get("client_id"),
+			RedirectURI: r.URL.Query().Get("redirect_uri"),
+			Lifespan:    r.URL.Query().Get("lifespan"),
+		}
+		if op == OpExecuteActionsEmail {
+			email.Kind = "execute-actions"
+			if err := json.NewDecoder(r.Body).Decode(&email.Actions); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid actions"})
+				return
+			}
+		}
+		s.emails = append(s.emails, email)
+		w.WriteHeader(http.StatusNoContent)
+	case OpLogoutAllSessions:
+		for id, session := range s.sessions {
+			if session.UserID == userID {
+				s.endSession(id)
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case OpUserSessions:
+		result := []gocloak.UserSessionRepresentation{}
+		for _, session := range s.sessions {
+			if session.UserID != userID {
+				continue
+			}
+			result = append(result, gocloak.UserSessionRepresentation{
+				ID:         gocloak.StringP(session.ID),
+				UserID:     gocloak.StringP(session.UserID),
+				Username:   gocloak.StringP(u.Username),
+				IPAddress:  gocloak.StringP(session.IPAddress),
+				Start:      gocloak.Int64P(session.Start.UnixMilli()),
+				LastAccess: gocloak.Int64P(session.LastAccess.UnixMilli()),
+				Clients:    &map[string]string{"client-" + session.ClientID: session.ClientID},
+			})
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request, realm string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status := s.injected(OpToken); status != 0 {
+		writeInjected(w, status)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+
+	grantType := r.PostForm.Get("grant_type")
+	if realm == "master" {
+		if grantType != "password" || r.PostForm.Get("client_id") != "admin-cli" ||
+			r.PostForm.Get("username") != s.AdminUsername || r.PostForm.Get("password") != s.AdminPassword {
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_grant", "Invalid user credentials")
+			return
+		}
+		s.writeServiceToken(w, "admin-cli")
+		return
+	}
+
+	clientID, ok := s.authenticateClient(r)
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Invalid client or Invalid client credentials")
+		return
+	}
+
+	switch grantType {
+	case "client_credentials":
+		s.writeServiceToken(w, clientID)
+	case "password":
+		u := s.findUser(r.PostForm.Get("username"))
+		if u == nil || u.Password == "" || u.Password != r.PostForm.Get("password") {
+			writeOAuthError(w, http.StatusUnauthorized, "invalid_grant", "Invalid user credentials")
+			return
+		}
+		if u.Disabled {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Account disabled")
+			return
+		}
+		s.writeUserToken(w, u, s.newSession(r, u, clientID), "")
+	case "authorization_code":
+		code, ok := s.codes[r.PostForm.Get("code")]
+		delete(s.codes, r.PostForm.Get("code"))
+		if !ok || time.Now().After(code.expiresAt) || code.clientID != clientID ||
+			code.redirectURI != r.PostForm.Get("redirect_uri") || !pkceMatches(code.codeChallenge, r.PostForm.Get("code_verifier")) {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Code not valid")
+			return
+		}
+		u, ok := s.users[code.userID]
+		if !ok || u.Disabled {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "User disabled or deleted")
+			return
+		}
+		s.writeUserToken(w, u, s.newSession(r, u, clientID), code.nonce)
+	case "refresh_token":
+		sessionID, ok := s.refreshTokens[r.PostForm.Get("refresh_token")]
+		session := s.sessions[sessionID]
+		if !ok || session == nil {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Session not active")
+			return
+		}
+		u, ok := s.users[session.UserID]
+		if !ok || u.Disabled {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "User disabled or deleted")
+			return
+		}
+		session.LastAccess = time.Now()
+		s.writeUserToken(w, u, session, "")
+	case "urn:ietf:params:oauth:grant-type:token-exchange":
+		// Direct naked impersonation: the client asks for tokens of a user
+		// with nothing but its own credentials.
+		if s.DenyImpersonation {
+			writeOAuthError(w, http.StatusForbidden, "access_denied", "Client not allowed to exchange")
+			return
+		}
+		u, ok := s.users[r.PostForm.Get("requested_subject")]
+		if !ok {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_token", "Requested subject not found")
+			return
+		}
+		if u.Disabled {
+			writeOAuthError(w, http.StatusBadRequest, "invalid_request", "User disabled")
+			return
+		}
+		s.writeUserToken(w, u, s.newSession(r, u, clientID), "")
+	default:
+		writeOAuthError(w, http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type")
+	}
+}
+
+// handleAuthorize stands in for Keycloak's login page: GET renders a form
+// and POST with username and password redirects back to the client with an
+// authorization code. Only the code flow with S256 PKCE is supported.
+func (s *Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status := s.injected(OpAuthorize); status != 0 {
+		writeInjected(w, status)
+		return
+	}
+
+	query := r.URL.Query()
+	redirect, err := url.Parse(query.Get("redirect_uri"))
+	if query.Get("client_id") != s.ClientID || err != nil || !redirect.IsAbs() {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "Invalid client or redirect uri")
+		return
+	}
+	if query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		redirectWith(w, r, redirect, url.Values{"error": {"invalid_request"}, "state": {query.Get("state")}})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, loginForm)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+	u := s.findUser(r.PostForm.Get("username"))
+	if u == nil || u.Disabled || u.Password == "" || u.Password != r.PostForm.Get("password") {
+		// Keycloak shows the login page again.
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, loginForm)
+		return
+	}
+
+	code := randomID()
+	s.codes[code] = &authCode{
+		userID:        u.ID,
+		clientID:      s.ClientID,
+		redirectURI:   redirect.String(),
+		codeChallenge: query.Get("code_challenge"),
+		nonce:         query.Get("nonce"),
+		expiresAt:     time.Now().Add(time.Minute),
+	}
+	redirectWith(w, r, redirect, url.Values{"code": {code}, "state": {query.Get("state")}})
+}
+
+const loginForm = `<form method="post"><input name="username"><input name="password" type="password"></form>`
+
+func redirectWith(w http.ResponseWriter, r *http.Request, target *url.URL, params url.Values) {
+	redirect := *target
+	query := redirect.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	redirect.RawQuery = query.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func pkceMatches(challenge, verifier string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier != "" && base64.RawURLEncoding.EncodeToString(sum[:]) == challenge
+}
+
+// newSession opens a session for a login of u. s.mu must be held.
+func (s *Server) newSession(r *http.Request, u *User, clientID string) *Session {
+	now := time.Now()
+	session := &Session{
+		ID:         newUUID(),
+		UserID:     u.ID,
+		ClientID:   clientID,
+		IPAddress:  remoteIP(r),
+		Start:      now,
+		LastAccess: now,
+	}
+	s.sessions[session.ID] = session
+	return session
+}
+
+// writeUserToken answers a user grant. nonce is copied into the ID token.
+func (s *Server) writeUserToken(w http.ResponseWriter, u *User, session *Session, nonce string) {
+	refreshToken := randomID()
+	s.refreshTokens[refreshToken] = session.ID
+	writeJSON(w, http.StatusOK, gocloak.JWT{
+		AccessToken:      s.signToken(u, session, session.ClientID),
+		IDToken:          s.signIDToken(u, session, nonce),
+		ExpiresIn:        int(s.AccessTokenTTL.Seconds()),
+		RefreshToken:     refreshToken,
+		RefreshExpiresIn: 1800,
+		TokenType:        "Bearer",
+		SessionState:     session.ID,
+		Scope:            "openid profile email",
+	})
+}
+
+func (s *Server) writeServiceToken(w http.ResponseWriter, clientID string) {
+	token := s.signToken(nil, nil, clientID)
+	s.adminTokens[token] = true
+	writeJSON(w, http.StatusOK, gocloak.JWT{
+		AccessToken: token,
+		ExpiresIn:   int(s.AccessTokenTTL.Seconds()),
+		TokenType:   "Bearer",
+	})
+}
+
+// authenticateClient checks the client credentials sent with HTTP basic
+// auth or in the form, like Keycloak's client_secret_basic/_post.
+func (s *Server) authenticateClient(r *http.Request) (string, bool) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	return clientID, clientID == s.ClientID && secret == s.ClientSecret
+}
+
+func (s *Server) handleIntrospect(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status := s.injected(OpIntrospect); status != 0 {
+		writeInjected(w, status)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+	if _, ok := s.authenticateClient(r); !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Invalid client or Invalid client credentials")
+		return
+	}
+
+	claims, ok := s.activeClaims(r.PostForm.Get("token"))
+	if !ok {
+		writeJSON(w, http.StatusOK, map[string]bool{"active": false})
+		return
+	}
+	claims["active"] = true
+	writeJSON(w, http.StatusOK, claims)
+}
+
+func (s *Server) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status := s.injected(OpUserInfo); status != 0 {
+		writeInjected(w, status)
+		return
+	}
+	claims, ok := s.activeClaims(bearerToken(r))
+	if !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_token", "Token verification failed")
+		return
+	}
+	u := s.users[claims["sub"].(string)]
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"sub":                u.ID,
+		"preferred_username": u.Username,
+		"email":              u.Email,
+		"email_verified":     u.EmailVerified,
+		"given_name":         u.FirstName,
+		"family_name":        u.LastName,
+	})
+}
+
+// activeClaims returns the claims of a valid user token whose session is
+// still active. s.mu must be held.
+func (s *Server) activeClaims(raw string) (map[string]interface{}, bool) {
+	claims, ok := s.parseToken(raw)
+	if !ok {
+		return nil, false
+	}
+	sid, _ := claims["sid"].(string)
+	session, ok := s.sessions[sid]
+	if !ok {
+		return nil, false
+	}
+	if _, ok := s.users[session.UserID]; !ok {
+		return nil, false
+	}
+	return claims, true
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status := s.injected(OpLogout); status != 0 {
+		writeInjected(w, status)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_request", "malformed form")
+		return
+	}
+	if _, ok := s.authenticateClient(r); !ok {
+		writeOAuthError(w, http.StatusUnauthorized, "invalid_client", "Invalid client or Invalid client credentials")
+		return
+	}
+
+	sessionID, ok := s.refreshTokens[r.PostForm.Get("refresh_token")]
+	if !ok {
+		writeOAuthError(w, http.StatusBadRequest, "invalid_grant", "Invalid refresh token")
+		return
+	}
+	s.endSession(sessionID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleListUsers(w http.ResponseWriter, r *http.Request) {
+	if status := s.injected(OpListUsers); status != 0 {
+		writeInjected(w, status)
+		return
+	}
+
+	query := r.URL.Query()
+	exact := query.Get("exact") == "true"
+	match := func(value, filter string) bool {
+		if filter == "" {
+			return true
+		}
+		if exact {
+			return strings.EqualFold(value, filter)
+		}
+		return strings.Contains(strings.ToLower(value), strings.ToLower(filter))
+	}
+
+	result := []*gocloak.User{}
+	for _, u := range s.users {
+		if match(u.Username, query.Get("username")) && match(u.Email, query.Get("email")) {
+			result = append(result, representation(u))
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+	if status := s.injected(OpCreateUser); status != 0 {
+		writeInjected(w, status)
+		return
+	}
+
+	var rep gocloak.User
+	if err := json.NewDecoder(r.Body).Decode(&rep); err != nil || gocloak.PString(rep.Username) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"errorMessage": "User name is missing"})
+		return
+	}
+	if msg := s.conflict("", gocloak.PString(rep.Username), gocloak.PString(rep.Email)); msg != "" {
+		writeJSON(w, http.StatusConflict, map[string]string{"errorMessage": msg})
+		return
+	}
+
+	u := &User{
+		ID:            newUUID(),
+		Username:      strings.ToLower(gocloak.PString(rep.Username)),
+		Email:         strings.ToLower(gocloak.PString(rep.Email)),
+		FirstName:     gocloak.PString(rep.FirstName),
+		LastName:      gocloak.PString(rep.LastName),
+		Disabled:      !gocloak.PBool(rep.Enabled),
+		EmailVerified: gocloak.PBool(rep.EmailVerified),
+		Created:       time.Now(),
+	}
+	s.users[u.ID] = u
+	w.Header().Set("Location", s.URL+"/admin/realms/"+s.Realm+"/users/"+u.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request, u *User) {
+	var rep gocloak.User
+	if err := json.NewDecoder(r.Body).Decode(&rep); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"errorMessage": "invalid user representation"})
+		return
+	}
+	if msg := s.conflict(u.ID, gocloak.PString(rep.Username), gocloak.PString(rep.Email)); msg != "" {
+		writeJSON(w, http.StatusConflict, map[string]string{"errorMessage": msg})
+		return
+	}
+
+	if rep.Username != nil && *rep.Username != "" {
+		u.Username = strings.ToLower(*rep.Username)
+	}
+	if rep.Email != nil {
+		u.Email = strings.ToLower(*rep.Email)
+	}
+	if rep.FirstName != nil {
+		u.FirstName = *rep.FirstName
+	}
+	if rep.LastName != nil {
+		u.LastName = *rep.LastName
+	}
+	if rep.Enabled != nil {
+		u.Disabled = !*rep.Enabled
+	}
+	if rep.EmailVerified != nil {
+		u.EmailVerified = *rep.EmailVerified
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// conflict returns Keycloak's error message when another user than userID
+// already has the username or email.
+func (s *Server) conflict(userID, username, email string) string {
+	for id, u := range s.users {
+		if id == userID {
+			continue
+		}
+		if username != "" && strings.EqualFold(u.Username, username) {
+			return "User exists with same username"
+		}
+		if email != "" && strings.EqualFold(u.Email, email) {
+			return "User exists with same email"
+		}
+	}
+	return ""
+}
+
+func (s *Server) handleDeleteSession(w http.ResponseWriter, sessionID string) {
+	if status := s.injected(OpDeleteSession); status != 0 {
+		writeInjected(w, status)
+		return
+	}
+	if _, ok := s.sessions[sessionID]; !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "Sessions not found"})
+		return
+	}
+	s.endSession(sessionID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func representation(u *User) *gocloak.User {
+	return &gocloak.User{
+		ID:               gocloak.StringP(u.ID),
+		Username:         gocloak.StringP(u.Username),
+		Email:            gocloak.StringP(u.Email),
+		FirstName:        gocloak.StringP(u.FirstName),
+		LastName:         gocloak.StringP(u.LastName),
+		Enabled:          gocloak.BoolP(!u.Disabled),
+		EmailVerified:    gocloak.BoolP(u.EmailVerified),
+		CreatedTimestamp: gocloak.Int64P(u.Created.UnixMilli()),
+	}
+}
+
+func bearerToken(r *http.Request) string {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeOAuthError(w http.ResponseWriter, status int, code, description string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func writeInjected(w http.ResponseWriter, status int) {
+	writeJSON(w, status, map[string]string{"error": "injected failure", "error_description": http.StatusText(status)})
+}
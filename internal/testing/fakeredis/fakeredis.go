@@ -0,0 +1,276 @@
+// Package fakeredis is a tiny in-process server speaking the Redis protocol,
+// for testing stores built on kvstore.RedisStore without a Redis. It knows
+// PING, AUTH, GET, SET (with PX), DEL, PEXPIRE and INCR; everything else
+// gets an error reply.
+package fakeredis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type entry struct {
+	value     string
+	expiresAt time.Time
+}
+
+// Server is a Redis stand-in listening on a random local port.
+type Server struct {
+	Addr string
+	// Password, when set, must be sent with AUTH before other commands.
+	Password string
+
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	data     map[string]*entry
+	commands int
+}
+
+// New starts a server. Close it when done.
+func New() *Server {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("fakeredis: listen: %v", err))
+	}
+	s := &Server{
+		Addr:  ln.Addr().String(),
+		ln:    ln,
+		conns: make(map[net.Conn]struct{}),
+		data:  make(map[string]*entry),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close stops the server and drops the clients' connections.
+func (s *Server) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Keys returns the number of live keys.
+func (s *Server) Keys() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key := range s.data {
+		if s.live(key) != nil {
+			n++
+		}
+	}
+	return n
+}
+
+// Commands returns how many commands were received.
+func (s *Server) Commands() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	rd := bufio.NewReader(conn)
+	authed := s.Password == ""
+
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch {
+		case len(args) == 0:
+			reply = "-ERR empty command\r\n"
+		case strings.EqualFold(args[0], "AUTH"):
+			authed = len(args) == 2 && args[1] == s.Password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = s.exec(args)
+		}
+		if _, err := io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Server) exec(args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands++
+
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		if len(args) != 2 {
+			return wrongArgs(args[0])
+		}
+		if e := s.live(args[1]); e != nil {
+			return bulk(e.value)
+		}
+		return "$-1\r\n"
+	case "SET":
+		if len(args) != 3 && len(args) != 5 {
+			return wrongArgs(args[0])
+		}
+		e := &entry{value: args[2]}
+		if len(args) == 5 {
+			ms, err := strconv.ParseInt(args[4], 10, 64)
+			if !strings.EqualFold(args[3], "PX") || err != nil || ms <= 0 {
+				return "-ERR syntax error\r\n"
+			}
+			e.expiresAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		s.data[args[1]] = e
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if s.live(key) != nil {
+				n++
+			}
+			delete(s.data, key)
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "PEXPIRE":
+		if len(args) != 3 {
+			return wrongArgs(args[0])
+		}
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		e := s.live(args[1])
+		if e == nil {
+			return ":0\r\n"
+		}
+		e.expiresAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	case "INCR":
+		if len(args) != 2 {
+			return wrongArgs(args[0])
+		}
+		e := s.live(args[1])
+		if e == nil {
+			e = &entry{value: "0"}
+			s.data[args[1]] = e
+		}
+		n, err := strconv.ParseInt(e.value, 10, 64)
+		if err != nil {
+			return "-ERR value is not an integer or out of range\r\n"
+		}
+		e.value = strconv.FormatInt(n+1, 10)
+		return ":" + e.value + "\r\n"
+	default:
+		return fmt.Sprintf("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+// live returns the entry at key unless it expired. s.mu must be held.
+func (s *Server) live(key string) *entry {
+	e, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	if !e.expiresAt.IsZero() && time.Now().After(e.expiresAt) {
+		delete(s.data, key)
+		return nil
+	}
+	return e
+}
+
+func bulk(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+}
+
+func wrongArgs(command string) string {
+	return fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", strings.ToLower(command))
+}
+
+// readCommand reads one command sent as a RESP array of bulk strings.
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		header, err := readLine(rd)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(header, "$") {
+			return nil, fmt.Errorf("fakeredis: expected bulk string, got %q", header)
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,241 @@
+// Package softauthn is a software WebAuthn authenticator for tests. It
+// answers the options of a registration or login ceremony the way a browser
+// with a platform authenticator would, with "none" attestation and P-256
+// keys, so the service can be tested without a browser.
+package softauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+)
+
+// Flags of the authenticator data.
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+var b64 = base64.RawURLEncoding
+
+// Authenticator holds discoverable credentials (passkeys) for any number of
+// relying parties and users.
+type Authenticator struct {
+	// Origin is reported in the client data, like a browser reports the
+	// page the ceremony runs on.
+	Origin string
+	// SkipUserVerification clears the UV flag, like a security key without
+	// a PIN would.
+	SkipUserVerification bool
+
+	mu          sync.Mutex
+	credentials []*Credential
+}
+
+// Credential is a key pair created by Register.
+type Credential struct {
+	ID         []byte
+	RPID       string
+	UserHandle []byte
+	// SignCount is the counter of the last signature; tests may lower it
+	// to simulate a cloned authenticator.
+	SignCount uint32
+
+	key *ecdsa.PrivateKey
+}
+
+func New(origin string) *Authenticator {
+	return &Authenticator{Origin: origin}
+}
+
+// Credentials returns the credentials created so far.
+func (a *Authenticator) Credentials() []*Credential {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*Credential(nil), a.credentials...)
+}
+
+type creationOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		RP        struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+		ExcludeCredentials []struct {
+			ID string `json:"id"`
+		} `json:"excludeCredentials"`
+	} `json:"publicKey"`
+}
+
+// Register answers the credential creation options of a registration
+// ceremony (the JSON a server passes to navigator.credentials.create) with
+// the JSON of a new public key credential.
+func (a *Authenticator) Register(options []byte) ([]byte, error) {
+	var opts creationOptions
+	if err := json.Unmarshal(options, &opts); err != nil {
+		return nil, fmt.Errorf("softauthn: decode creation options: %w", err)
+	}
+	pk := opts.PublicKey
+	userHandle, err := b64.DecodeString(pk.User.ID)
+	if err != nil {
+		return nil, fmt.Errorf("softauthn: decode user id: %w", err)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, excluded := range pk.ExcludeCredentials {
+		for _, cred := range a.credentials {
+			if excluded.ID == b64.EncodeToString(cred.ID) {
+				return nil, errors.New("softauthn: credential already registered")
+			}
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	cred := &Credential{ID: make([]byte, 16), RPID: pk.RP.ID, UserHandle: userHandle, key: key}
+	if _, err := rand.Read(cred.ID); err != nil {
+		return nil, err
+	}
+
+	publicKey, err := webauthncbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: key.PublicKey.X.FillBytes(make([]byte, 32)),
+		-3: key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	authData := a.authData(cred, flagAttested)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(cred.ID)))
+	authData = append(authData, cred.ID...)
+	authData = append(authData, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	a.credentials = append(a.credentials, cred)
+	return json.Marshal(map[string]interface{}{
+		"id":    b64.EncodeToString(cred.ID),
+		"rawId": b64.EncodeToString(cred.ID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64.EncodeToString(a.clientData("webauthn.create", pk.Challenge)),
+			"attestationObject": b64.EncodeToString(attestation),
+			"transports":        []string{"internal"},
+		},
+		"clientExtensionResults": map[string]interface{}{},
+	})
+}
+
+type requestOptions struct {
+	PublicKey struct {
+		Challenge        string `json:"challenge"`
+		RPID             string `json:"rpId"`
+		AllowCredentials []struct {
+			ID string `json:"id"`
+		} `json:"allowCredentials"`
+	} `json:"publicKey"`
+}
+
+// Login answers the credential request options of a login ceremony (the
+// JSON a server passes to navigator.credentials.get) with an assertion of
+// the newest matching credential.
+func (a *Authenticator) Login(options []byte) ([]byte, error) {
+	var opts requestOptions
+	if err := json.Unmarshal(options, &opts); err != nil {
+		return nil, fmt.Errorf("softauthn: decode request options: %w", err)
+	}
+	pk := opts.PublicKey
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var cred *Credential
+	for _, c := range a.credentials {
+		if c.RPID != pk.RPID {
+			continue
+		}
+		allowed := len(pk.AllowCredentials) == 0
+		for _, allow := range pk.AllowCredentials {
+			allowed = allowed || allow.ID == b64.EncodeToString(c.ID)
+		}
+		if allowed {
+			cred = c
+		}
+	}
+	if cred == nil {
+		return nil, errors.New("softauthn: no credential for the relying party")
+	}
+	return a.assert(cred, pk.Challenge)
+}
+
+func (a *Authenticator) assert(cred *Credential, challenge string) ([]byte, error) {
+	cred.SignCount++
+	authData := a.authData(cred, 0)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, cred.key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"id":    b64.EncodeToString(cred.ID),
+		"rawId": b64.EncodeToString(cred.ID),
+		"type":  "public-key",
+		"response": map[string]interface{}{
+			"clientDataJSON":    b64.EncodeToString(clientData),
+			"authenticatorData": b64.EncodeToString(authData),
+			"signature":         b64.EncodeToString(signature),
+			"userHandle":        b64.EncodeToString(cred.UserHandle),
+		},
+		"clientExtensionResults": map[string]interface{}{},
+	})
+}
+
+// authData returns the fixed part of the authenticator data: RP ID hash,
+// flags and signature counter.
+func (a *Authenticator) authData(cred *Credential, flags byte) []byte {
+	flags |= flagUserPresent
+	if !a.SkipUserVerification {
+		flags |= flagUserVerified
+	}
+	rpIDHash := sha256.Sum256([]byte(cred.RPID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, cred.SignCount)
+}
+
+func (a *Authenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"type":        ceremony,
+		"challenge":   challenge,
+		"origin":      a.Origin,
+		"crossOrigin": false,
+	})
+	return data
+}
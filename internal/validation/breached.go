@@ -0,0 +1,85 @@
+package validation
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// minBreachedPrefix is the shortest accepted hash prefix. Shorter ones
+// would reject a noticeable share of all passwords.
+const minBreachedPrefix = 5
+
+// BreachedList is a set of breached passwords, known by the SHA-1 hashes
+// or hash prefixes of the passwords. A password is breached if its hash
+// starts with any entry.
+type BreachedList struct {
+	prefixes map[string]struct{}
+	// lengths are the distinct entry lengths, so a lookup only has to try
+	// those prefixes of the hash.
+	lengths []int
+}
+
+// LoadBreachedList reads a breached-password list from path, see
+// ParseBreachedList for the format.
+func LoadBreachedList(path string) (*BreachedList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open breached password list failed: %w", err)
+	}
+	defer f.Close()
+	return ParseBreachedList(f)
+}
+
+// ParseBreachedList reads one hex SHA-1 hash or hash prefix of at least 5
+// digits per line. A ":count" suffix, as in Have I Been Pwned downloads,
+// is ignored, as are blank lines and lines starting with #.
+func ParseBreachedList(r io.Reader) (*BreachedList, error) {
+	list := &BreachedList{prefixes: map[string]struct{}{}}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		prefix, _, _ := strings.Cut(line, ":")
+		prefix = strings.ToUpper(strings.TrimSpace(prefix))
+		if len(prefix) < minBreachedPrefix || len(prefix) > sha1.Size*2 {
+			return nil, fmt.Errorf("breached password list line %d: want %d to %d hex digits", n, minBreachedPrefix, sha1.Size*2)
+		}
+		if _, err := hex.DecodeString(prefix + strings.Repeat("0", len(prefix)%2)); err != nil {
+			return nil, fmt.Errorf("breached password list line %d: %q is not hex", n, prefix)
+		}
+		list.prefixes[prefix] = struct{}{}
+		if !slices.Contains(list.lengths, len(prefix)) {
+			list.lengths = append(list.lengths, len(prefix))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read breached password list failed: %w", err)
+	}
+	slices.Sort(list.lengths)
+	return list, nil
+}
+
+// Contains reports whether password is on the list.
+func (l *BreachedList) Contains(password string) bool {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	for _, n := range l.lengths {
+		if _, ok := l.prefixes[hash[:n]]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of entries.
+func (l *BreachedList) Len() int {
+	return len(l.prefixes)
+}
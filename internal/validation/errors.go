@@ -0,0 +1,19 @@
+// Package validation checks request input before it reaches the identity
+// provider and reports problems per field.
+package validation
+
+import "auth-service/internal/apperr"
+
+// FieldError is a problem with one request field. Code is stable for
+// clients to switch on; Message is for humans.
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// WithFieldErrors returns err with the field errors as its "errors" problem
+// member.
+func WithFieldErrors(err *apperr.Error, errs []FieldError) *apperr.Error {
+	return err.With("errors", errs)
+}
@@ -0,0 +1,182 @@
+package validation
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/config"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ccojocar/zxcvbn-go"
+)
+
+// minUserInputLength keeps short usernames like "al" from rejecting every
+// password that happens to contain them.
+const minUserInputLength = 3
+
+// ErrPasswordPolicy carries the field errors of a rejected password. It
+// shares its code with the rejection by the Keycloak realm policy, so
+// clients handle both alike.
+var ErrPasswordPolicy = apperr.Validation("password_policy_violation", "password does not meet the password policy")
+
+// PasswordPolicy decides which passwords users may choose. It is checked
+// before passwords are sent to the identity provider, whose own policy
+// still applies.
+type PasswordPolicy struct {
+	MinLength        int
+	MaxLength        int
+	RequireLowercase bool
+	RequireUppercase bool
+	RequireDigit     bool
+	RequireSymbol    bool
+	// MinStrength is the lowest accepted zxcvbn score, from 0 (accept
+	// anything) to 4.
+	MinStrength int
+	// Breached rejects known breached passwords when set.
+	Breached *BreachedList
+}
+
+// PasswordRules describes a policy to clients, e.g. to show the rules next
+// to a password field.
+type PasswordRules struct {
+	MinLength        int  `json:"min_length"`
+	MaxLength        int  `json:"max_length"`
+	RequireLowercase bool `json:"require_lowercase"`
+	RequireUppercase bool `json:"require_uppercase"`
+	RequireDigit     bool `json:"require_digit"`
+	RequireSymbol    bool `json:"require_symbol"`
+	MinStrength      int  `json:"min_strength"`
+	DisallowUserInfo bool `json:"disallow_user_info"`
+	CheckBreached    bool `json:"check_breached"`
+}
+
+// NewPasswordPolicy builds the policy from its configuration and loads the
+// breached-password list, if one is configured.
+func NewPasswordPolicy(cfg config.PasswordPolicyConfig) (*PasswordPolicy, error) {
+	policy := &PasswordPolicy{
+		MinLength:        cfg.MinLength,
+		MaxLength:        cfg.MaxLength,
+		RequireLowercase: cfg.RequireLowercase,
+		RequireUppercase: cfg.RequireUppercase,
+		RequireDigit:     cfg.RequireDigit,
+		RequireSymbol:    cfg.RequireSymbol,
+		MinStrength:      cfg.MinStrength,
+	}
+	if cfg.BreachedListFile != "" {
+		breached, err := LoadBreachedList(cfg.BreachedListFile)
+		if err != nil {
+			return nil, err
+		}
+		policy.Breached = breached
+	}
+	return policy, nil
+}
+
+// Rules returns the client view of the policy.
+func (p *PasswordPolicy) Rules() PasswordRules {
+	return PasswordRules{
+		MinLength:        p.MinLength,
+		MaxLength:        p.MaxLength,
+		RequireLowercase: p.RequireLowercase,
+		RequireUppercase: p.RequireUppercase,
+		RequireDigit:     p.RequireDigit,
+		RequireSymbol:    p.RequireSymbol,
+		MinStrength:      p.MinStrength,
+		DisallowUserInfo: true,
+		CheckBreached:    p.Breached != nil,
+	}
+}
+
+// Check returns the violations of password, reported for field. userInputs
+// are the username, email address and similar values the password must
+// not contain; empty ones are skipped.
+func (p *PasswordPolicy) Check(field, password string, userInputs ...string) []FieldError {
+	var errs []FieldError
+	fail := func(code, message string) {
+		errs = append(errs, FieldError{Field: field, Code: code, Message: message})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if p.MaxLength > 0 && length > p.MaxLength {
+		// Nothing else is checked, the strength estimate is slow on long
+		// input.
+		fail("too_long", fmt.Sprintf("must be at most %d characters", p.MaxLength))
+		return errs
+	}
+	if length < p.MinLength {
+		fail("too_short", fmt.Sprintf("must be at least %d characters", p.MinLength))
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+	if p.RequireLowercase && !lower {
+		fail("missing_lowercase", "must contain a lowercase letter")
+	}
+	if p.RequireUppercase && !upper {
+		fail("missing_uppercase", "must contain an uppercase letter")
+	}
+	if p.RequireDigit && !digit {
+		fail("missing_digit", "must contain a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		fail("missing_symbol", "must contain a symbol")
+	}
+
+	inputs := userInputTerms(userInputs)
+	lowered := strings.ToLower(password)
+	for _, input := range inputs {
+		if strings.Contains(lowered, input) {
+			fail("contains_user_info", "must not contain the username or email address")
+			break
+		}
+	}
+
+	if p.MinStrength > 0 {
+		if score := zxcvbn.PasswordStrength(password, inputs).Score; score < p.MinStrength {
+			fail("too_weak", "is too easy to guess")
+		}
+	}
+
+	if p.Breached != nil && p.Breached.Contains(password) {
+		fail("breached", "appeared in a data breach, choose another password")
+	}
+	return errs
+}
+
+// Validate is Check returning ErrPasswordPolicy with the violations, or nil.
+func (p *PasswordPolicy) Validate(field, password string, userInputs ...string) error {
+	if errs := p.Check(field, password, userInputs...); len(errs) > 0 {
+		return WithFieldErrors(ErrPasswordPolicy, errs)
+	}
+	return nil
+}
+
+// userInputTerms lowercases the user inputs and adds the local part of
+// email addresses.
+func userInputTerms(userInputs []string) []string {
+	var terms []string
+	for _, input := range userInputs {
+		input = strings.ToLower(strings.TrimSpace(input))
+		if local, _, ok := strings.Cut(input, "@"); ok {
+			if utf8.RuneCountInString(local) >= minUserInputLength {
+				terms = append(terms, local)
+			}
+		}
+		if utf8.RuneCountInString(input) >= minUserInputLength {
+			terms = append(terms, input)
+		}
+	}
+	return terms
+}
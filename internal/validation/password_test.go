@@ -0,0 +1,121 @@
+package validation
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/config"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const breachedList = `# sha1 of "password", as in a Have I Been Pwned download
+5BAA61E4C9B93F3F0682250B6CF8331B7EE68FD8:3861493
+
+# prefix of sha1("correct-horse-battery-staple")
+dd606cd4
+`
+
+func codes(errs []FieldError) []string {
+	var codes []string
+	for _, err := range errs {
+		codes = append(codes, err.Code)
+	}
+	return codes
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	breached, err := ParseBreachedList(strings.NewReader(breachedList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	strict := &PasswordPolicy{
+		MinLength:        10,
+		MaxLength:        20,
+		RequireLowercase: true,
+		RequireUppercase: true,
+		RequireDigit:     true,
+		RequireSymbol:    true,
+		Breached:         breached,
+	}
+
+	tests := []struct {
+		name     string
+		policy   *PasswordPolicy
+		password string
+		inputs   []string
+		want     []string
+	}{
+		{name: "valid", policy: strict, password: "Lovelace-1815"},
+		{name: "short", policy: strict, password: "Ab1-", want: []string{"too_short"}},
+		{name: "long", policy: strict, password: strings.Repeat("a", 21), want: []string{"too_long"}},
+		{name: "counts characters", policy: strict, password: "Überprüfung-ä1"},
+		{name: "classes", policy: strict, password: "lowercaseonly", want: []string{"missing_uppercase", "missing_digit", "missing_symbol"}},
+		{name: "username", policy: strict, password: "Grace-Hopper-1", inputs: []string{"GraceH", "hopper@example.com"}, want: []string{"contains_user_info"}},
+		{name: "email local part", policy: strict, password: "x-Hopper-1906", inputs: []string{"grace", "hopper@example.com"}, want: []string{"contains_user_info"}},
+		{name: "short usernames ignored", policy: strict, password: "Analytical-1", inputs: []string{"al", ""}},
+		{name: "breached hash", policy: &PasswordPolicy{MinLength: 8, MaxLength: 128, Breached: breached}, password: "password", want: []string{"breached"}},
+		{name: "breached prefix", policy: &PasswordPolicy{MinLength: 8, MaxLength: 128, Breached: breached}, password: "correct-horse-battery-staple", want: []string{"breached"}},
+		{name: "weak", policy: &PasswordPolicy{MinLength: 8, MaxLength: 128, MinStrength: 3}, password: "Password123!", want: []string{"too_weak"}},
+		{name: "strong", policy: &PasswordPolicy{MinLength: 8, MaxLength: 128, MinStrength: 3}, password: "vellum-orbit-quince-47"},
+		{name: "weak with user info", policy: &PasswordPolicy{MinLength: 8, MaxLength: 128, MinStrength: 3}, password: "ada-lovelace-1815", inputs: []string{"ada-lovelace"}, want: []string{"contains_user_info", "too_weak"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := tt.policy.Check("password", tt.password, tt.inputs...)
+			if got := codes(errs); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("violations = %v, want %v", got, tt.want)
+			}
+			for _, err := range errs {
+				if err.Field != "password" || err.Message == "" {
+					t.Fatalf("incomplete field error %+v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestPasswordPolicyValidate(t *testing.T) {
+	policy := &PasswordPolicy{MinLength: 8, MaxLength: 128}
+	if err := policy.Validate("new_password", "long-enough"); err != nil {
+		t.Fatalf("valid password rejected: %v", err)
+	}
+
+	err := policy.Validate("new_password", "short")
+	appErr, ok := apperr.As(err)
+	if !ok || appErr.Code != "password_policy_violation" {
+		t.Fatalf("err = %v, want password_policy_violation", err)
+	}
+	errs, _ := appErr.Extensions["errors"].([]FieldError)
+	if len(errs) != 1 || errs[0] != (FieldError{Field: "new_password", Code: "too_short", Message: "must be at least 8 characters"}) {
+		t.Fatalf("field errors = %+v", appErr.Extensions["errors"])
+	}
+}
+
+func TestNewPasswordPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	if err := os.WriteFile(path, []byte(breachedList), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default().PasswordPolicy
+	cfg.BreachedListFile = path
+	policy, err := NewPasswordPolicy(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Breached.Len() != 2 || !policy.Rules().CheckBreached {
+		t.Fatalf("breached list not loaded: %d entries", policy.Breached.Len())
+	}
+
+	for _, list := range []string{"5BAA\n", "not-a-hash\n", strings.Repeat("A", 41) + "\n"} {
+		if _, err := ParseBreachedList(strings.NewReader(list)); err == nil {
+			t.Fatalf("list %q accepted", list)
+		}
+	}
+	cfg.BreachedListFile = filepath.Join(t.TempDir(), "missing.txt")
+	if _, err := NewPasswordPolicy(cfg); err == nil {
+		t.Fatal("missing list accepted")
+	}
+}
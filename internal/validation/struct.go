@@ -0,0 +1,200 @@
+package validation
+
+import (
+	"auth-service/internal/apperr"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	ErrMissingFields = apperr.Validation("missing_fields", "required fields are missing")
+	ErrInvalidFields = apperr.Validation("invalid_fields", "some fields are invalid")
+)
+
+// Struct normalizes and checks the string fields of the struct v points to
+// against their `validate` tags. Fields are reported by their JSON name;
+// the error is ErrMissingFields if only required fields are missing and
+// ErrInvalidFields otherwise, with the field errors attached.
+//
+// The tag is a comma-separated list of rules:
+//
+//	required   the value must not be empty
+//	min=N      at least N characters
+//	max=N      at most N characters
+//	email      a bare email address, like ada@example.com
+//	username   letters, digits, '.', '_' and '-', starting with a letter or digit
+//	printable  no control or other non-printable characters
+//	verbatim   keep the value as sent, e.g. for passwords
+//
+// Values are trimmed and converted to Unicode NFC before they are checked,
+// unless they are verbatim. Empty values only fail required. A nil *string
+// field counts as absent and is skipped, so on such fields required means
+// "not empty when given". Byte slices such as json.RawMessage only take
+// required, which JSON null does not meet.
+func Struct(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("validation: Struct needs a pointer to a struct, got %T", v))
+	}
+	rv = rv.Elem()
+
+	var errs []FieldError
+	missingOnly := true
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		tag, ok := field.Tag.Lookup("validate")
+		if !ok {
+			continue
+		}
+		value := rv.Field(i)
+		if value.Kind() == reflect.Pointer {
+			if value.IsNil() {
+				continue
+			}
+			value = value.Elem()
+		}
+		rules := strings.Split(tag, ",")
+		if value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.Uint8 {
+			if err := checkRaw(jsonName(field), value.Bytes(), rules); err != nil {
+				errs = append(errs, *err)
+			}
+			continue
+		}
+		if value.Kind() != reflect.String {
+			panic(fmt.Sprintf("validation: field %s is not a string", field.Name))
+		}
+
+		s := value.String()
+		if !hasRule(rules, "verbatim") {
+			s = norm.NFC.String(strings.TrimSpace(s))
+			value.SetString(s)
+		}
+		if err := checkField(jsonName(field), s, rules); err != nil {
+			errs = append(errs, *err)
+			missingOnly = missingOnly && err.Code == "required"
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	if missingOnly {
+		return WithFieldErrors(ErrMissingFields, errs)
+	}
+	return WithFieldErrors(ErrInvalidFields, errs)
+}
+
+// checkField returns the violation of the first rule value fails.
+func checkField(name, value string, rules []string) *FieldError {
+	fail := func(code, message string) *FieldError {
+		return &FieldError{Field: name, Code: code, Message: message}
+	}
+
+	if value == "" {
+		if hasRule(rules, "required") {
+			return fail("required", "is required")
+		}
+		return nil
+	}
+	if !utf8.ValidString(value) {
+		return fail("invalid_encoding", "must be valid UTF-8")
+	}
+
+	length := utf8.RuneCountInString(value)
+	for _, rule := range rules {
+		rule, arg, _ := strings.Cut(rule, "=")
+		switch rule {
+		case "required", "verbatim":
+		case "min":
+			if n := ruleArg(rule, arg); length < n {
+				return fail("too_short", fmt.Sprintf("must be at least %d characters", n))
+			}
+		case "max":
+			if n := ruleArg(rule, arg); length > n {
+				return fail("too_long", fmt.Sprintf("must be at most %d characters", n))
+			}
+		case "email":
+			if !isEmail(value) {
+				return fail("invalid_email", "must be a valid email address")
+			}
+		case "username":
+			if !isUsername(value) {
+				return fail("invalid_username", "may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit")
+			}
+		case "printable":
+			if strings.IndexFunc(value, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+				return fail("invalid_characters", "must not contain control or non-printable characters")
+			}
+		default:
+			panic(fmt.Sprintf("validation: unknown rule %q", rule))
+		}
+	}
+	return nil
+}
+
+// checkRaw checks a byte slice field, which only supports required.
+func checkRaw(name string, value []byte, rules []string) *FieldError {
+	for _, rule := range rules {
+		if rule != "required" {
+			panic(fmt.Sprintf("validation: rule %q does not apply to field %s", rule, name))
+		}
+	}
+	if hasRule(rules, "required") && (len(value) == 0 || string(value) == "null") {
+		return &FieldError{Field: name, Code: "required", Message: "is required"}
+	}
+	return nil
+}
+
+func ruleArg(rule, arg string) int {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		panic(fmt.Sprintf("validation: rule %s needs a number, got %q", rule, arg))
+	}
+	return n
+}
+
+func hasRule(rules []string, name string) bool {
+	for _, rule := range rules {
+		if rule == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isEmail accepts bare addresses only: no display name, no angle brackets
+// and a domain with at least one dot.
+func isEmail(value string) bool {
+	addr, err := mail.ParseAddress(value)
+	if err != nil || addr.Name != "" || addr.Address != value {
+		return false
+	}
+	_, domain, _ := strings.Cut(value, "@")
+	return strings.Contains(domain, ".") && !strings.HasSuffix(domain, ".")
+}
+
+func isUsername(value string) bool {
+	for i, r := range value {
+		switch {
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+		case i > 0 && (r == '.' || r == '_' || r == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func jsonName(field reflect.StructField) string {
+	if name, _, _ := strings.Cut(field.Tag.Get("json"), ","); name != "" && name != "-" {
+		return name
+	}
+	return field.Name
+}
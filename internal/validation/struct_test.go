@@ -0,0 +1,154 @@
+package validation
+
+import (
+	"auth-service/internal/apperr"
+	"auth-service/internal/models"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func fieldErrors(t *testing.T, err error) (string, []FieldError) {
+	t.Helper()
+	if err == nil {
+		return "", nil
+	}
+	appErr, ok := apperr.As(err)
+	if !ok {
+		t.Fatalf("err = %v, want an *apperr.Error", err)
+	}
+	errs, _ := appErr.Extensions["errors"].([]FieldError)
+	return appErr.Code, errs
+}
+
+func TestStructRegisterParams(t *testing.T) {
+	valid := models.RegisterParams{
+		Firstname: "Ada",
+		Lastname:  "Lovelace",
+		Username:  "ada.lovelace",
+		Email:     "ada@example.com",
+		Password:  "analytical-engine",
+	}
+
+	tests := []struct {
+		name   string
+		change func(*models.RegisterParams)
+		code   string
+		want   []FieldError
+	}{
+		{name: "valid", change: func(p *models.RegisterParams) {}},
+		{
+			name:   "missing",
+			change: func(p *models.RegisterParams) { p.Email, p.Password = "", "" },
+			code:   "missing_fields",
+			want: []FieldError{
+				{Field: "email", Code: "required", Message: "is required"},
+				{Field: "password", Code: "required", Message: "is required"},
+			},
+		},
+		{
+			name:   "blank",
+			change: func(p *models.RegisterParams) { p.Firstname = " \t " },
+			code:   "missing_fields",
+			want:   []FieldError{{Field: "firstname", Code: "required", Message: "is required"}},
+		},
+		{
+			name:   "missing and invalid",
+			change: func(p *models.RegisterParams) { p.Lastname, p.Email = "", "Ada <ada@example.com>" },
+			code:   "invalid_fields",
+			want: []FieldError{
+				{Field: "lastname", Code: "required", Message: "is required"},
+				{Field: "email", Code: "invalid_email", Message: "must be a valid email address"},
+			},
+		},
+		{
+			name:   "username charset",
+			change: func(p *models.RegisterParams) { p.Username = "ada lovelace" },
+			code:   "invalid_fields",
+			want:   []FieldError{{Field: "username", Code: "invalid_username", Message: "may only contain letters, digits, '.', '_' and '-', and must start with a letter or digit"}},
+		},
+		{
+			name:   "username length",
+			change: func(p *models.RegisterParams) { p.Username = "al" },
+			code:   "invalid_fields",
+			want:   []FieldError{{Field: "username", Code: "too_short", Message: "must be at least 3 characters"}},
+		},
+		{
+			name:   "max length",
+			change: func(p *models.RegisterParams) { p.Firstname = strings.Repeat("é", 256) },
+			code:   "invalid_fields",
+			want:   []FieldError{{Field: "firstname", Code: "too_long", Message: "must be at most 255 characters"}},
+		},
+		{
+			name:   "control characters",
+			change: func(p *models.RegisterParams) { p.Lastname = "Love\x00lace" },
+			code:   "invalid_fields",
+			want:   []FieldError{{Field: "lastname", Code: "invalid_characters", Message: "must not contain control or non-printable characters"}},
+		},
+		{
+			name:   "invalid utf-8",
+			change: func(p *models.RegisterParams) { p.Lastname = "Love\xfflace" },
+			code:   "invalid_fields",
+			want:   []FieldError{{Field: "lastname", Code: "invalid_encoding", Message: "must be valid UTF-8"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := valid
+			tt.change(&params)
+			code, errs := fieldErrors(t, Struct(&params))
+			if code != tt.code || !reflect.DeepEqual(errs, tt.want) {
+				t.Fatalf("got %s %+v, want %s %+v", code, errs, tt.code, tt.want)
+			}
+		})
+	}
+}
+
+func TestStructNormalizes(t *testing.T) {
+	params := models.RegisterParams{
+		Firstname: "  Ame\u0301lie ",
+		Lastname:  "Poulain",
+		Username:  "amelie",
+		Email:     " amelie@example.com",
+		Password:  " e\u0301 secret ",
+	}
+	if err := Struct(&params); err != nil {
+		t.Fatal(err)
+	}
+	if params.Firstname != "Am\u00e9lie" || params.Email != "amelie@example.com" {
+		t.Fatalf("not normalized: %q %q", params.Firstname, params.Email)
+	}
+	if params.Password != " e\u0301 secret " {
+		t.Fatalf("password changed to %q", params.Password)
+	}
+}
+
+func TestStructUserPayload(t *testing.T) {
+	empty, name := "", "Augusta"
+	if err := Struct(&models.UserPayload{Firstname: &name}); err != nil {
+		t.Fatalf("partial update rejected: %v", err)
+	}
+
+	code, errs := fieldErrors(t, Struct(&models.UserPayload{Firstname: &name, Email: &empty}))
+	want := []FieldError{{Field: "email", Code: "required", Message: "is required"}}
+	if code != "missing_fields" || !reflect.DeepEqual(errs, want) {
+		t.Fatalf("got %s %+v, want blank email rejected", code, errs)
+	}
+}
+
+func TestStructRawField(t *testing.T) {
+	valid := models.WebAuthnFinishParams{CeremonyID: "c1", Credential: json.RawMessage(`{"id":"x"}`)}
+	if err := Struct(&valid); err != nil {
+		t.Fatalf("valid params rejected: %v", err)
+	}
+
+	want := []FieldError{{Field: "credential", Code: "required", Message: "is required"}}
+	for _, credential := range []json.RawMessage{nil, json.RawMessage("null")} {
+		code, errs := fieldErrors(t, Struct(&models.WebAuthnFinishParams{CeremonyID: "c1", Credential: credential}))
+		if code != "missing_fields" || !reflect.DeepEqual(errs, want) {
+			t.Fatalf("credential %q: got %s %+v, want it missing", credential, code, errs)
+		}
+	}
+}